@@ -3,13 +3,16 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awsapi"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/preauth"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/pkg/errors"
 	"log"
-	"strings"
+	"os"
 )
 
 // CognitoEventUserPoolsPreSignupRequest contains the request portion of a PreAuth event
@@ -26,54 +29,69 @@ func main() {
 	if err != nil {
 		log.Fatalf("could not get aws config: %+v\n", err)
 	}
-	ssms := ssm.New(cfg)
-	lambda.Start(processEvent(ssms))
-}
-
-type Settings struct {
-	All     bool     `json:"all"`
-	Domains []string `json:"domains"`
-	Emails  []string `json:"emails"`
+	cache, err := settingsCacheFromEnv(awsapi.NewSSM(ssm.New(cfg)), os.Getenv)
+	if err != nil {
+		log.Fatalf("invalid configuration: %+v\n", err)
+	}
+	cognito := awsapi.NewCognitoIdentityProvider(cognitoidentityprovider.New(cfg))
+	lambda.Start(processEvent(cache, cognito))
 }
 
-func processEvent(ssms *ssm.SSM) func(CognitoEventUserPoolsPreAuth) (CognitoEventUserPoolsPreAuth, error) {
+// The rules of the settings are described in the package `preauth`. The
+// groups of the user are only fetched if the rules use them.
+func processEvent(cache *settingsCache, cognito awsapi.CognitoIdentityProvider) func(CognitoEventUserPoolsPreAuth) (CognitoEventUserPoolsPreAuth, error) {
 	return func(event CognitoEventUserPoolsPreAuth) (CognitoEventUserPoolsPreAuth, error) {
 		fmt.Printf("%+v\n", event)
 		userPoolId := event.UserPoolID
-		clientId := event.CallerContext.ClientID
-		email := event.Request.UserAttributes["email"]
-		splitted := strings.Split(email, "@")
-		if len(splitted) != 2 {
-			return zero, errors.Errorf("invalid email: %s", email)
-		}
-		domain := splitted[1]
-		parameterName := "/hyperdrive/cog_cond_pre_auth/" + userPoolId + "/" + clientId
-		parameter, err := ssms.GetParameterRequest(&ssm.GetParameterInput{
-			Name: &parameterName,
-		}).Send()
+		settings, rules, err := cache.rules(userPoolId, event.CallerContext.ClientID)
 		if err != nil {
-			return zero, errors.Wrap(err, "DDB fetching error")
+			return zero, err
 		}
-		if parameter.Parameter == nil || parameter.Parameter.Value == nil {
-			return zero, errors.Errorf("no configuration for the client %s of user pool %s", clientId, userPoolId)
+		user := preauth.User{
+			Email:            event.Request.UserAttributes["email"],
+			IdentityProvider: identityProvider(event.Request.UserAttributes),
 		}
-		var settings Settings
-		err = json.Unmarshal([]byte(*parameter.Parameter.Value), &settings)
-		if err != nil {
-			return zero, errors.Wrapf(err, "invalid settings for the client %s of user pool %s", clientId, userPoolId)
+		if settings.UsesGroups() {
+			if user.Groups, err = groups(cognito, userPoolId, event.UserName); err != nil {
+				return zero, err
+			}
 		}
-		if !(settings.All || in(settings.Domains, domain) || in(settings.Emails, email)) {
-			return zero, errors.New("not authorized.")
+		if err := rules.Authorize(user); err != nil {
+			return zero, err
 		}
 		return event, nil
 	}
 }
 
-func in(strings []string, val string) bool {
-	for _, s := range strings {
-		if val == s {
-			return true
+// The federated users have the attribute `identities` with the providers
+// they are linked to.
+func identityProvider(attributes map[string]string) string {
+	var identities []struct {
+		ProviderName string `json:"providerName"`
+	}
+	if err := json.Unmarshal([]byte(attributes["identities"]), &identities); err != nil || len(identities) == 0 {
+		return preauth.CognitoProvider
+	}
+	return identities[0].ProviderName
+}
+
+func groups(cognito awsapi.CognitoIdentityProvider, userPoolId, username string) ([]string, error) {
+	var names []string
+	input := &cognitoidentityprovider.AdminListGroupsForUserInput{
+		UserPoolId: &userPoolId,
+		Username:   &username,
+	}
+	for {
+		output, err := cognito.AdminListGroupsForUser(input)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not fetch the groups of the user %s", username)
+		}
+		for _, group := range output.Groups {
+			names = append(names, *group.GroupName)
+		}
+		if output.NextToken == nil {
+			return names, nil
 		}
+		input.NextToken = output.NextToken
 	}
-	return false
 }
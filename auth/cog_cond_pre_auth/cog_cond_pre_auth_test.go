@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awstest"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/pkg/errors"
+)
+
+func preAuthEvent(username, email, identities string) CognitoEventUserPoolsPreAuth {
+	event := CognitoEventUserPoolsPreAuth{}
+	event.UserPoolID = "pool"
+	event.CallerContext = events.CognitoEventUserPoolsCallerContext{ClientID: "client"}
+	event.UserName = username
+	event.Request.UserAttributes = map[string]string{"email": email}
+	if identities != "" {
+		event.Request.UserAttributes["identities"] = identities
+	}
+	return event
+}
+
+func TestProcessEvent(t *testing.T) {
+	const google = `[{"userId":"1","providerName":"Google","providerType":"Google","primary":"true"}]`
+	for i, test := range []struct {
+		settings   string
+		event      CognitoEventUserPoolsPreAuth
+		failures   awstest.Failures
+		authorized bool
+		groups     int
+	}{
+		// test 0: legacy settings
+		{settings: `{"all":false,"domains":["test.com"],"emails":null}`, event: preAuthEvent("ann", "ann@test.com", ""), authorized: true},
+		// test 1: legacy settings refusing the user
+		{settings: `{"All":false,"Domains":["test.com"],"Emails":null}`, event: preAuthEvent("bob", "bob@other.com", "")},
+		// test 2: allowed by group
+		{settings: `{"Groups":["admins"]}`, event: preAuthEvent("ann", "ann@other.com", ""), authorized: true, groups: 1},
+		// test 3: allowed by identity provider
+		{settings: `{"IdentityProviders":["Google"]}`, event: preAuthEvent("Google_1", "ann@gmail.com", google), authorized: true},
+		// test 4: the users of the pool are not federated
+		{settings: `{"IdentityProviders":["Google"]}`, event: preAuthEvent("ann", "ann@gmail.com", "")},
+		// test 5: denied by group
+		{settings: `{"All":true,"DenyGroups":["suspended"]}`, event: preAuthEvent("bob", "bob@test.com", ""), groups: 1},
+		// test 6: failure to fetch the groups
+		{settings: `{"Groups":["admins"]}`, event: preAuthEvent("ann", "ann@test.com", ""),
+			failures: awstest.Failures{"AdminListGroupsForUser": errors.New("boom")}, groups: 1},
+		// test 7: invalid pattern
+		{settings: `{"EmailPatterns":["("]}`, event: preAuthEvent("ann", "ann@test.com", "")},
+		// test 8: no settings
+		{event: preAuthEvent("ann", "ann@test.com", "")},
+	} {
+		ssm := awstest.NewSSM()
+		if test.settings != "" {
+			ssm.PutString("/hyperdrive/cog_cond_pre_auth/pool/client", test.settings)
+		}
+		cognito := awstest.NewCognitoIdentityProvider()
+		cognito.AddUserToGroup("pool", "ann", "users")
+		cognito.AddUserToGroup("pool", "ann", "admins")
+		cognito.AddUserToGroup("pool", "bob", "suspended")
+		cognito.Failures = test.failures
+		_, err := processEvent(newSettingsCache(ssm, 0, false), cognito)(test.event)
+		if (err == nil) != test.authorized {
+			t.Errorf("test %d: expecting the authorization %t got %v", i, test.authorized, err)
+		}
+		if test.groups > 0 && cognito.Called("AdminListGroupsForUser") == 0 {
+			t.Errorf("test %d: the groups must be fetched", i)
+		}
+		if test.groups == 0 && cognito.Called("AdminListGroupsForUser") != 0 {
+			t.Errorf("test %d: the groups must not be fetched", i)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awsapi"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/preauth"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/pkg/errors"
+)
+
+// The settings are configured with the environment of the lambda:
+//
+// * `HYPERDRIVE_PRE_AUTH_CACHE_TTL`: how long the settings are kept in
+//   memory across the invocations, as a Go duration, by default `1m`; `0`
+//   disables the cache.
+// * `HYPERDRIVE_PRE_AUTH_FAILURE_MODE`: `closed`, the default, refuses the
+//   users when SSM is unavailable, i.e. throttled, failing with a 5xx status
+//   or unreachable; `open` authorizes them. In both cases, expired settings
+//   are used while SSM is unavailable. The other errors, e.g. a denied
+//   access or an invalid parameter name, always refuse the users.
+const (
+	cacheTTLEnv    = "HYPERDRIVE_PRE_AUTH_CACHE_TTL"
+	failureModeEnv = "HYPERDRIVE_PRE_AUTH_FAILURE_MODE"
+
+	defaultCacheTTL   = time.Minute
+	failureModeClosed = "closed"
+	failureModeOpen   = "open"
+)
+
+// A settingsCache fetches the settings of the clients and keeps them,
+// compiled, for the TTL. The settings of a client default to the settings
+// of its user pool.
+type settingsCache struct {
+	ssm      awsapi.SSM
+	ttl      time.Duration
+	failOpen bool
+	now      func() time.Time
+	mutex    sync.Mutex
+	entries  map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	settings preauth.Settings
+	rules    *preauth.Rules
+	fetched  time.Time
+}
+
+func newSettingsCache(ssms awsapi.SSM, ttl time.Duration, failOpen bool) *settingsCache {
+	return &settingsCache{ssm: ssms, ttl: ttl, failOpen: failOpen, now: time.Now, entries: make(map[string]cacheEntry)}
+}
+
+// settingsCacheFromEnv configures the cache with the environment.
+func settingsCacheFromEnv(ssms awsapi.SSM, getenv func(string) string) (*settingsCache, error) {
+	ttl := defaultCacheTTL
+	if value := getenv(cacheTTLEnv); value != "" {
+		var err error
+		if ttl, err = time.ParseDuration(value); err != nil || ttl < 0 {
+			return nil, errors.Errorf("invalid %s: %s", cacheTTLEnv, value)
+		}
+	}
+	mode := getenv(failureModeEnv)
+	if mode != "" && mode != failureModeClosed && mode != failureModeOpen {
+		return nil, errors.Errorf("invalid %s: %s", failureModeEnv, mode)
+	}
+	return newSettingsCache(ssms, ttl, mode == failureModeOpen), nil
+}
+
+// rules gives the settings of the client and their rules.
+func (c *settingsCache) rules(userPoolId, clientId string) (preauth.Settings, *preauth.Rules, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := preauth.ParameterName(userPoolId, clientId)
+	entry, cached := c.entries[key]
+	if cached && c.now().Sub(entry.fetched) < c.ttl {
+		return entry.settings, entry.rules, nil
+	}
+	settings, err := c.fetch(userPoolId, clientId)
+	if err != nil {
+		if !unavailable(err) {
+			return preauth.Settings{}, nil, err
+		}
+		if cached {
+			log.Printf("using the expired settings of the client %s of the user pool %s: %v", clientId, userPoolId, err)
+			return entry.settings, entry.rules, nil
+		}
+		if c.failOpen {
+			log.Printf("authorizing all the users of the client %s of the user pool %s: %v", clientId, userPoolId, err)
+			settings := preauth.Settings{All: true}
+			rules, err := preauth.Compile(settings)
+			return settings, rules, err
+		}
+		return preauth.Settings{}, nil, errors.Wrapf(err, "could not fetch the settings of the client %s of the user pool %s", clientId, userPoolId)
+	}
+	rules, err := preauth.Compile(settings)
+	if err != nil {
+		return preauth.Settings{}, nil, errors.Wrapf(err, "invalid settings for the client %s of user pool %s", clientId, userPoolId)
+	}
+	if c.ttl > 0 {
+		c.entries[key] = cacheEntry{settings: settings, rules: rules, fetched: c.now()}
+	}
+	return settings, rules, nil
+}
+
+// fetch reads the settings of the client or else of the user pool. The
+// errors for which SSM is unavailable are returned as is, to tell them
+// apart from the other failures.
+func (c *settingsCache) fetch(userPoolId, clientId string) (preauth.Settings, error) {
+	for _, parameterName := range []string{preauth.ParameterName(userPoolId, clientId), preauth.DefaultParameterName(userPoolId)} {
+		parameter, err := c.ssm.GetParameter(&ssm.GetParameterInput{
+			Name: &parameterName,
+		})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeParameterNotFound {
+			continue
+		}
+		if err != nil && unavailable(err) {
+			return preauth.Settings{}, err
+		}
+		if err != nil {
+			return preauth.Settings{}, errors.Wrapf(err, "could not fetch the parameter %s", parameterName)
+		}
+		if parameter.Parameter == nil || parameter.Parameter.Value == nil {
+			continue
+		}
+		var settings preauth.Settings
+		if err := json.Unmarshal([]byte(*parameter.Parameter.Value), &settings); err != nil {
+			return preauth.Settings{}, errors.Wrapf(err, "invalid settings for the client %s of user pool %s", clientId, userPoolId)
+		}
+		return settings, nil
+	}
+	return preauth.Settings{}, errors.Errorf("no configuration for the client %s of user pool %s", clientId, userPoolId)
+}
+
+// The codes of the errors of a throttled SSM and of the requests that did
+// not reach it.
+var unavailableCodes = map[string]bool{
+	"ThrottlingException": true,
+	"Throttling":          true,
+	"RequestError":        true,
+	"ResponseTimeout":     true,
+}
+
+// unavailable tells whether SSM is unavailable rather than refusing the
+// request: the error is transient.
+func unavailable(err error) bool {
+	if failure, ok := err.(awserr.RequestFailure); ok && failure.StatusCode() >= 500 {
+		return true
+	}
+	aerr, ok := err.(awserr.Error)
+	return ok && unavailableCodes[aerr.Code()]
+}
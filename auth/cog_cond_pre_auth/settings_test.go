@@ -0,0 +1,117 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awstest"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/preauth"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/pkg/errors"
+)
+
+func TestSettingsCache(t *testing.T) {
+	const client = "/hyperdrive/cog_cond_pre_auth/pool/client"
+	const pool = "/hyperdrive/cog_cond_pre_auth/pool/default"
+	throttled := awstest.NotFound("ThrottlingException", "rate exceeded")
+	denied := awstest.NotFound("AccessDeniedException", "not authorized")
+	internal := awserr.NewRequestFailure(awserr.New("InternalServerError", "internal error", nil), 500, "request")
+	for i, test := range []struct {
+		parameters map[string]string
+		ttl        time.Duration
+		failOpen   bool
+		elapsed    time.Duration
+		failures   awstest.Failures
+		fails      bool
+		all        bool
+		fetches    int
+	}{
+		// test 0: the settings are cached
+		{parameters: map[string]string{client: `{"All":true}`}, ttl: time.Minute, elapsed: 30 * time.Second, all: true, fetches: 1},
+		// test 1: the settings expire
+		{parameters: map[string]string{client: `{"All":true}`}, ttl: time.Minute, elapsed: time.Minute, all: true, fetches: 2},
+		// test 2: no cache
+		{parameters: map[string]string{client: `{"All":true}`}, all: true, fetches: 2},
+		// test 3: the expired settings are used while SSM is unavailable
+		{parameters: map[string]string{client: `{"All":true}`}, ttl: time.Minute, elapsed: time.Hour,
+			failures: awstest.Failures{"GetParameter": throttled}, all: true, fetches: 2},
+		// test 4: fail closed
+		{parameters: map[string]string{client: `{"All":true}`},
+			failures: awstest.Failures{"GetParameter": throttled}, fails: true, fetches: 2},
+		// test 5: fail open
+		{parameters: map[string]string{client: `{"All":false}`}, failOpen: true,
+			failures: awstest.Failures{"GetParameter": throttled}, all: true, fetches: 2},
+		// test 6: invalid settings are not authorized in the open mode
+		{parameters: map[string]string{client: `{"All":`}, failOpen: true, fails: true, fetches: 2},
+		// test 7: the settings of the user pool are the default of the client
+		{parameters: map[string]string{pool: `{"All":true}`}, ttl: time.Minute, all: true, fetches: 2},
+		// test 8: the settings of the client win over the default
+		{parameters: map[string]string{client: `{"All":false}`, pool: `{"All":true}`}, ttl: time.Minute, fetches: 1},
+		// test 9: no settings
+		{parameters: map[string]string{}, failOpen: true, fails: true, fetches: 4},
+		// test 10: the failures other than SSM are not ignored in the open mode
+		{parameters: map[string]string{client: `{"All":true}`}, failOpen: true,
+			failures: awstest.Failures{"GetParameter": errors.New("boom")}, fails: true, fetches: 2},
+		// test 11: a denied access is not ignored in the open mode
+		{parameters: map[string]string{client: `{"All":true}`}, failOpen: true,
+			failures: awstest.Failures{"GetParameter": denied}, fails: true, fetches: 2},
+		// test 12: a denied access does not use the expired settings
+		{parameters: map[string]string{client: `{"All":true}`}, ttl: time.Minute, elapsed: time.Hour,
+			failures: awstest.Failures{"GetParameter": denied}, fails: true, fetches: 2},
+		// test 13: fail open on the errors of the service
+		{parameters: map[string]string{client: `{"All":false}`}, failOpen: true,
+			failures: awstest.Failures{"GetParameter": internal}, all: true, fetches: 2},
+	} {
+		ssm := awstest.NewSSM()
+		for name, value := range test.parameters {
+			ssm.PutString(name, value)
+		}
+		now := time.Now()
+		cache := newSettingsCache(ssm, test.ttl, test.failOpen)
+		cache.now = func() time.Time { return now }
+		// a first invocation without failure, except for test 6 and 9.
+		if _, _, err := cache.rules("pool", "client"); err != nil && (test.failures == nil) != test.fails {
+			t.Fatalf("test %d: unexpected error %v", i, err)
+		}
+		now = now.Add(test.elapsed)
+		ssm.Failures = test.failures
+		settings, rules, err := cache.rules("pool", "client")
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if err == nil && (settings.All != test.all || rules == nil || (rules.Authorize(preauth.User{Email: "ann@test.com"}) == nil) != test.all) {
+			t.Errorf("test %d: expecting all %t got %+v", i, test.all, settings)
+		}
+		if calls := ssm.Called("GetParameter"); calls != test.fetches {
+			t.Errorf("test %d: expecting %d fetches got %d", i, test.fetches, calls)
+		}
+	}
+}
+
+func TestSettingsCacheFromEnv(t *testing.T) {
+	for i, test := range []struct {
+		env      map[string]string
+		fails    bool
+		ttl      time.Duration
+		failOpen bool
+	}{
+		// test 0: defaults
+		{env: map[string]string{}, ttl: time.Minute},
+		// test 1: configured
+		{env: map[string]string{cacheTTLEnv: "5m", failureModeEnv: "open"}, ttl: 5 * time.Minute, failOpen: true},
+		// test 2: no cache
+		{env: map[string]string{cacheTTLEnv: "0", failureModeEnv: "closed"}},
+		// test 3: invalid ttl
+		{env: map[string]string{cacheTTLEnv: "5"}, fails: true},
+		// test 4: invalid mode
+		{env: map[string]string{failureModeEnv: "ajar"}, fails: true},
+	} {
+		cache, err := settingsCacheFromEnv(awstest.NewSSM(), func(key string) string { return test.env[key] })
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if err == nil && (cache.ttl != test.ttl || cache.failOpen != test.failOpen) {
+			t.Errorf("test %d: unexpected configuration %v, %t", i, cache.ttl, cache.failOpen)
+		}
+	}
+}
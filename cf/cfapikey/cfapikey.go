@@ -36,20 +36,17 @@ package main
 
 import (
 	"context"
-	"github.com/DEEP-IMPACT-AG/hyperdrive/common"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awsapi"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/resource"
 	"github.com/aws/aws-lambda-go/cfn"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
 	"github.com/aws/aws-sdk-go-v2/service/apigateway"
 	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
-	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
 	"strconv"
 )
 
-var cf *cloudformation.CloudFormation
-var apg *apigateway.APIGateway
-
 // The lambda is started using the AWS lambda go sdk. The handler function
 // does the actual work of creating the apikey. Cloudformation sends an
 // event to signify that a resources must be created, updated or deleted.
@@ -58,70 +55,63 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	apg = apigateway.New(cfg)
-	cf = cloudformation.New(cfg)
-	lambda.Start(cfn.LambdaWrap(processEvent))
+	lambda.Start(cfn.LambdaWrap(resource.Handler(resource.Properties(ApiKeyProperties{}), &apiKey{
+		apg: awsapi.NewAPIGateway(apigateway.New(cfg)),
+		cf:  awsapi.NewCloudFormation(cloudformation.New(cfg)),
+	})))
 }
 
 type ApiKeyProperties struct {
 	Ordinal string
 }
 
-func apiKeyProperties(input map[string]interface{}) (ApiKeyProperties, error) {
-	var properties ApiKeyProperties
-	err := mapstructure.Decode(input, &properties)
-	if err != nil {
-		return properties, err
-	}
-	_, err = strconv.ParseUint(properties.Ordinal, 10, 64)
+func (properties *ApiKeyProperties) Validate() error {
+	_, err := strconv.ParseUint(properties.Ordinal, 10, 64)
 	if err != nil {
-		return properties, errors.Wrapf(err, "Ordinal is obligatory and must be a uint64: %s", properties.Ordinal)
+		return errors.Wrapf(err, "Ordinal is obligatory and must be a uint64: %s", properties.Ordinal)
 	}
-
-	return properties, nil
+	return nil
 }
 
 // It is not possible to update the resource, if the ordinal changes, a new resource is allocated.
-func processEvent(ctx context.Context, event cfn.Event) (string, map[string]interface{}, error) {
-	properties, err := apiKeyProperties(event.ResourceProperties);
+type apiKey struct {
+	apg awsapi.APIGateway
+	cf  awsapi.CloudFormation
+}
+
+func (k *apiKey) Create(ctx context.Context, request resource.Request) (string, map[string]interface{}, error) {
+	return createApiKey(k.cf, k.apg, request.StackID, request.Properties.(ApiKeyProperties))
+}
+
+func (k *apiKey) Update(ctx context.Context, request resource.Request) (string, map[string]interface{}, error) {
+	return createApiKey(k.cf, k.apg, request.StackID, request.Properties.(ApiKeyProperties))
+}
+
+func (k *apiKey) Delete(ctx context.Context, request resource.Request) error {
+	_, err := k.apg.DeleteApiKey(&apigateway.DeleteApiKeyInput{
+		ApiKey: &request.PhysicalResourceID,
+	})
 	if err != nil {
-		return "", nil, err
-	}
-	switch event.RequestType {
-	case cfn.RequestDelete:
-		if !common.IsFailurePhysicalResourceId(event.PhysicalResourceID) {
-			_, err := apg.DeleteApiKeyRequest(&apigateway.DeleteApiKeyInput{
-				ApiKey: &event.PhysicalResourceID,
-			}).Send()
-			if err != nil {
-				return event.PhysicalResourceID, nil, errors.Wrapf(err, "could not delete the api key %s", event.PhysicalResourceID)
-			}
-		}
-		return event.PhysicalResourceID, nil, nil
-	case cfn.RequestUpdate:
-		return createApiKey(event.StackID, properties)
-	case cfn.RequestCreate:
-		return createApiKey(event.StackID, properties)
-	default:
-		return event.PhysicalResourceID, nil, errors.Errorf("unknown request type %s", event.RequestType)
+		return errors.Wrapf(err, "could not delete the api key %s", request.PhysicalResourceID)
 	}
+	return nil
 }
 
 // To create the Api Key, we first retrieve the name of the stack and concatenate with the Ordinal to create
 // The Api Key Name.
-func createApiKey(stackId string, properties ApiKeyProperties) (string, map[string]interface{}, error) {
-	stack, err := cf.DescribeStacksRequest(&cloudformation.DescribeStacksInput{
+func createApiKey(cf awsapi.CloudFormation, apg awsapi.APIGateway, stackId string, properties ApiKeyProperties) (string, map[string]interface{}, error) {
+	stack, err := cf.DescribeStacks(&cloudformation.DescribeStacksInput{
 		StackName: &stackId,
-	}).Send()
+	})
 	if err != nil {
 		return "", nil, errors.Wrapf(err, "Cannot retrieve the stack name for %s", stackId)
 	}
 	name := *stack.Stacks[0].StackName + "-" + properties.Ordinal
 	enabled := true
-	key, err := apg.CreateApiKeyRequest(&apigateway.CreateApiKeyInput{
+	key, err := apg.CreateApiKey(&apigateway.CreateApiKeyInput{
 		Name:    &name,
 		Enabled: &enabled,
-	}).Send()
+	})
 	if err != nil {
 		return "", nil, errors.Wrapf(err, "Cannot create the key with name %s", name)
 	}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awstest"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/resource"
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/pkg/errors"
+)
+
+func TestApiKey(t *testing.T) {
+	const stackId = "arn:aws:cloudformation:eu-west-1:123456789012:stack/test/1"
+	for i, test := range []struct {
+		event    cfn.Event
+		existing bool
+		failures awstest.Failures
+		id       string
+		fails    bool
+		names    []string
+	}{
+		// test 0: create a key named after the stack and the ordinal
+		{event: cfn.Event{RequestType: cfn.RequestCreate, StackID: stackId, ResourceProperties: map[string]interface{}{"Ordinal": "1"}},
+			id: "key1", names: []string{"test-1"}},
+		// test 1: the ordinal must be a number
+		{event: cfn.Event{RequestType: cfn.RequestCreate, StackID: stackId, LogicalResourceID: "Key", ResourceProperties: map[string]interface{}{"Ordinal": "one"}},
+			id: "failure-Key", fails: true},
+		// test 2: failure to fetch the stack
+		{event: cfn.Event{RequestType: cfn.RequestCreate, StackID: stackId, LogicalResourceID: "Key", ResourceProperties: map[string]interface{}{"Ordinal": "1"}},
+			failures: awstest.Failures{"DescribeStacks": errors.New("boom")}, id: "failure-Key", fails: true},
+		// test 3: failure to create the key
+		{event: cfn.Event{RequestType: cfn.RequestCreate, StackID: stackId, LogicalResourceID: "Key", ResourceProperties: map[string]interface{}{"Ordinal": "1"}},
+			failures: awstest.Failures{"CreateApiKey": errors.New("boom")}, id: "failure-Key", fails: true},
+		// test 4: update creates a new key; the old one is deleted by cloudformation
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, StackID: stackId, PhysicalResourceID: "key1",
+			ResourceProperties:    map[string]interface{}{"Ordinal": "2"},
+			OldResourceProperties: map[string]interface{}{"Ordinal": "1"}},
+			existing: true, id: "key2", names: []string{"test-1", "test-2"}},
+		// test 5: delete
+		{event: cfn.Event{RequestType: cfn.RequestDelete, StackID: stackId, PhysicalResourceID: "key1", ResourceProperties: map[string]interface{}{"Ordinal": "1"}},
+			existing: true, id: "key1"},
+		// test 6: failed delete
+		{event: cfn.Event{RequestType: cfn.RequestDelete, StackID: stackId, PhysicalResourceID: "key1", ResourceProperties: map[string]interface{}{"Ordinal": "1"}},
+			existing: true, failures: awstest.Failures{"DeleteApiKey": errors.New("boom")}, id: "key1", fails: true, names: []string{"test-1"}},
+	} {
+		apg := awstest.NewAPIGateway()
+		cf := awstest.NewCloudFormation()
+		cf.PutStack(stackId, "test", cloudformation.StackStatusCreateInProgress)
+		handler := resource.Handler(resource.Properties(ApiKeyProperties{}), &apiKey{apg: apg, cf: cf})
+		if test.existing {
+			if _, _, err := handler(context.Background(), cfn.Event{RequestType: cfn.RequestCreate, StackID: stackId, ResourceProperties: map[string]interface{}{"Ordinal": "1"}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		apg.Failures = test.failures
+		cf.Failures = test.failures
+		id, data, err := handler(context.Background(), test.event)
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if id != test.id {
+			t.Errorf("test %d: expecting id %s got %s", i, test.id, id)
+		}
+		if len(apg.ApiKeys) != len(test.names) {
+			t.Errorf("test %d: expecting keys %v got %v", i, test.names, apg.ApiKeys)
+		}
+		for n, name := range test.names {
+			key, ok := apg.ApiKeys["key"+strconv.Itoa(n+1)]
+			if !ok || *key.Name != name {
+				t.Errorf("test %d: expecting key %s got %+v", i, name, key)
+			}
+		}
+		if !test.fails && test.event.RequestType != cfn.RequestDelete && *data["Secret"].(*string) != *apg.ApiKeys[id].Value {
+			t.Errorf("test %d: unexpected secret %v", i, data)
+		}
+	}
+}
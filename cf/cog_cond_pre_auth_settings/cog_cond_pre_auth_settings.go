@@ -4,7 +4,11 @@
 // `cog_cond_pre_auth` cognito trigger lambda with a SSM parameter.
 //
 // For more information, consult the documentation of the `cog_cond_pre_auth`
-// cognito trigger
+// cognito trigger. The deny rules are evaluated before `All` and the allow
+// rules: a user matching any of them cannot authenticate.
+//
+// With `PoolDefault`, the settings are the default of the user pool: they
+// apply to the clients of the user pool without their own settings.
 //
 // ## Syntax
 //
@@ -19,12 +23,28 @@
 //       Fn::ImportValue:
 //         !Sub ${HyperdriveCore}-CogCondPreAuthSettings
 //     UserPoolId: <userpool-id>
-//	   UserPoolCliendId: <userpoolclient-id>
+//	   UserPoolClientId: <userpoolclient-id>
 //     All: false
 //     Domains:
 //     - test.com
 //     Emails:
 //     - stan@test2.com
+//     EmailPatterns:
+//     - '.*\.ops@test3\.com'
+//     Groups:
+//     - admins
+//     IdentityProviders:
+//     - Google
+//     DenyDomains:
+//     - '*.external.test.com'
+//     DenyEmails:
+//     - former@test.com
+//     DenyEmailPatterns:
+//     - '.*\+.*@test\.com'
+//     DenyGroups:
+//     - suspended
+//     DenyIdentityProviders:
+//     - Facebook
 // ```
 //
 // ## Properties
@@ -40,13 +60,25 @@
 // _Update Requires_: replacement
 //
 //
-// `UserPoolCliendId`
+// `UserPoolClientId`
 //
 // > The id of the user pool client id used to login users.
 //
 // _Type_: String
 //
-// _Required_: Yes
+// _Required_: Yes, unless `PoolDefault` is true
+//
+// _Update Requires_: replacement
+//
+//
+// `PoolDefault`
+//
+// > A flag to configure the default settings of the user pool instead of the settings of a client. The
+// > property `UserPoolClientId` must then be omitted.
+//
+// _Type_: boolean
+//
+// _Required_: no (default: false)
 //
 // _Update Requires_: replacement
 //
@@ -64,7 +96,8 @@
 //
 // `Domains`:
 //
-// > A list of email domains to whitelist
+// > A list of email domains to whitelist. A domain starting with `*.`, e.g. `*.test.com`, whitelists all its
+// > subdomains but not the domain itself.
 //
 // _Type_: List of Strings
 //
@@ -83,6 +116,52 @@
 //
 // _Update Requires_: no interruption
 //
+//
+// `EmailPatterns`:
+//
+// > A list of regular expressions (Go syntax) of the emails to whitelist. The expressions must match the
+// > whole email, without case.
+//
+// _Type_: List of Strings
+//
+// _Required_: no (default: [])
+//
+// _Update Requires_: no interruption
+//
+//
+// `Groups`:
+//
+// > A list of cognito groups of the user pool whose members are whitelisted.
+//
+// _Type_: List of Strings
+//
+// _Required_: no (default: [])
+//
+// _Update Requires_: no interruption
+//
+//
+// `IdentityProviders`:
+//
+// > A list of identity providers whose federated users are whitelisted, e.g. `Google` or the name of a SAML
+// > provider. The provider `Cognito` stands for the users of the user pool itself.
+//
+// _Type_: List of Strings
+//
+// _Required_: no (default: [])
+//
+// _Update Requires_: no interruption
+//
+//
+// `DenyDomains`, `DenyEmails`, `DenyEmailPatterns`, `DenyGroups`, `DenyIdentityProviders`:
+//
+// > The same lists as above to blacklist users, even if they are whitelisted or `All` is true.
+//
+// _Type_: List of Strings
+//
+// _Required_: no (default: [])
+//
+// _Update Requires_: no interruption
+//
 // ## Return Values
 //
 // `Ref`
@@ -93,25 +172,23 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"github.com/DEEP-IMPACT-AG/hyperdrive/common"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awsapi"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/preauth"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/resource"
 	"github.com/aws/aws-lambda-go/cfn"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
 	awsssm "github.com/aws/aws-sdk-go-v2/service/ssm"
-	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
 	"strconv"
 )
 
-var ssm *awsssm.SSM
-
 func main() {
 	cfg, err := external.LoadDefaultAWSConfig()
 	if err != nil {
 		panic(err)
 	}
-	ssm = awsssm.New(cfg)
-	lambda.Start(cfn.LambdaWrap(processEvent))
+	lambda.Start(cfn.LambdaWrap(resource.Handler(resource.Properties(CogCondPreAuthSettingsProperties{}), &settings{ssm: awsapi.NewSSM(awsssm.New(cfg))})))
 }
 
 // The SequenceProperties is the main data structure for the resource and
@@ -119,75 +196,111 @@ func main() {
 // We use the library [mapstructure](https://github.com/mitchellh/mapstructure) to
 // decode the generic map from the cloudformation event to the struct.
 type CogCondPreAuthSettingsProperties struct {
-	UserPoolId       string
-	UserPoolClientId string
-	All              string
-	Domains          []string
-	Emails           []string
+	UserPoolId                                                string
+	UserPoolClientId                                          string
+	PoolDefault                                               string
+	All                                                       string
+	Domains, Emails, EmailPatterns, Groups, IdentityProviders []string
+	DenyDomains, DenyEmails, DenyEmailPatterns                []string
+	DenyGroups, DenyIdentityProviders                         []string
 }
 
-func cogCondPreAuthSettingsProperties(input map[string]interface{}) (CogCondPreAuthSettingsProperties, error) {
-	var properties CogCondPreAuthSettingsProperties
-	if err := mapstructure.Decode(input, &properties); err != nil {
-		return properties, err
-	}
+func (properties *CogCondPreAuthSettingsProperties) Validate() error {
 	if properties.UserPoolId == "" {
-		return properties, errors.New("UserPoolId is required")
+		return errors.New("UserPoolId is required")
 	}
-	if properties.UserPoolClientId == "" {
-		return properties, errors.New("UserPoolClientId is required")
+	poolDefault, err := properties.poolDefault()
+	if err != nil {
+		return err
 	}
-	return properties, nil
+	if poolDefault {
+		if properties.UserPoolClientId != "" {
+			return errors.New("UserPoolClientId must be omitted with PoolDefault")
+		}
+	} else if properties.UserPoolClientId == "" {
+		return errors.New("UserPoolClientId is required")
+	}
+	if _, err := preauth.Compile(properties.settings(false)); err != nil {
+		return err
+	}
+	return nil
 }
 
-func processEvent(ctx context.Context, event cfn.Event) (string, map[string]interface{}, error) {
-	properties, err := cogCondPreAuthSettingsProperties(event.ResourceProperties)
+// PoolDefault is false by default.
+func (properties CogCondPreAuthSettingsProperties) poolDefault() (bool, error) {
+	if properties.PoolDefault == "" {
+		return false, nil
+	}
+	poolDefault, err := strconv.ParseBool(properties.PoolDefault)
 	if err != nil {
-		return "", nil, err
+		return false, errors.Wrapf(err, "PoolDefault must be a boolean: %s", properties.PoolDefault)
 	}
-	switch event.RequestType {
-	case cfn.RequestDelete:
-		if !common.IsFailurePhysicalResourceId(event.PhysicalResourceID) {
-			_, err := ssm.DeleteParameterRequest(&awsssm.DeleteParameterInput{
-				Name: &event.PhysicalResourceID,
-			}).Send();
-			if err != nil {
-				return event.PhysicalResourceID, nil, errors.Wrapf(err, "could not delete the parameter %s", event.PhysicalResourceID)
-			}
-		}
-		return event.PhysicalResourceID, nil, nil
-	case cfn.RequestCreate:
-		return putParameter(ssm, properties)
-	case cfn.RequestUpdate:
-		return putParameter(ssm, properties);
-	default:
-		return "", nil, errors.Errorf("unknown request type %s", event.RequestType)
+	return poolDefault, nil
+}
+
+func (properties CogCondPreAuthSettingsProperties) settings(all bool) preauth.Settings {
+	return preauth.Settings{
+		All:                   all,
+		Domains:               properties.Domains,
+		Emails:                properties.Emails,
+		EmailPatterns:         properties.EmailPatterns,
+		Groups:                properties.Groups,
+		IdentityProviders:     properties.IdentityProviders,
+		DenyDomains:           properties.DenyDomains,
+		DenyEmails:            properties.DenyEmails,
+		DenyEmailPatterns:     properties.DenyEmailPatterns,
+		DenyGroups:            properties.DenyGroups,
+		DenyIdentityProviders: properties.DenyIdentityProviders,
+	}
+}
+
+type settings struct {
+	ssm awsapi.SSM
+}
+
+func (s *settings) Create(ctx context.Context, request resource.Request) (string, map[string]interface{}, error) {
+	return putParameter(s.ssm, request.Properties.(CogCondPreAuthSettingsProperties))
+}
+
+func (s *settings) Update(ctx context.Context, request resource.Request) (string, map[string]interface{}, error) {
+	return putParameter(s.ssm, request.Properties.(CogCondPreAuthSettingsProperties))
+}
+
+func (s *settings) Delete(ctx context.Context, request resource.Request) error {
+	_, err := s.ssm.DeleteParameter(&awsssm.DeleteParameterInput{
+		Name: &request.PhysicalResourceID,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "could not delete the parameter %s", request.PhysicalResourceID)
 	}
+	return nil
 }
 
-func putParameter(ssm *awsssm.SSM, properties CogCondPreAuthSettingsProperties) (string, map[string]interface{}, error) {
+func putParameter(ssm awsapi.SSM, properties CogCondPreAuthSettingsProperties) (string, map[string]interface{}, error) {
 	overwrite := true
-	parameterName := "/hyperdrive/cog_cond_pre_auth/" + properties.UserPoolId + "/" + properties.UserPoolClientId
+	parameterName := preauth.ParameterName(properties.UserPoolId, properties.UserPoolClientId)
+	poolDefault, err := properties.poolDefault()
+	if err != nil {
+		return "", nil, err
+	}
+	if poolDefault {
+		parameterName = preauth.DefaultParameterName(properties.UserPoolId)
+	}
 	all, err := strconv.ParseBool(properties.All)
 	if err != nil {
 		return "", nil, errors.Wrapf(err, "All must be a booleand: %s", properties.All)
 	}
-	data := map[string]interface{}{
-		"All":     all,
-		"Domains": properties.Domains,
-		"Emails":  properties.Emails,
-	}
-	dataBytes, err := json.Marshal(data)
+	dataBytes, err := json.Marshal(properties.settings(all))
 	if err != nil {
 		return "", nil, errors.Wrapf(err, "could not marshal the parameter %s", parameterName)
 	}
 	dataText := string(dataBytes)
-	_, err = ssm.PutParameterRequest(&awsssm.PutParameterInput{
+	_, err = ssm.PutParameter(&awsssm.PutParameterInput{
 		Overwrite: &overwrite,
 		Name:      &parameterName,
 		Type:      awsssm.ParameterTypeString,
 		Value:     &dataText,
-	}).Send();
+	})
 	if err != nil {
 		return "", nil, errors.Wrapf(err, "could not put the parameter %s", parameterName)
 	}
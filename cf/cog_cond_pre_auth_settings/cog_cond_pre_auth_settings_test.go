@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awstest"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/resource"
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/pkg/errors"
+)
+
+func TestSettings(t *testing.T) {
+	const parameter = "/hyperdrive/cog_cond_pre_auth/pool/client"
+	properties := func(all string, domains ...interface{}) map[string]interface{} {
+		return map[string]interface{}{"UserPoolId": "pool", "UserPoolClientId": "client", "All": all, "Domains": domains}
+	}
+	for i, test := range []struct {
+		event    cfn.Event
+		existing bool
+		failures awstest.Failures
+		id       string
+		fails    bool
+		value    string
+	}{
+		// test 0: create puts the settings
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties("false", "test.com")},
+			id: parameter, value: `{"All":false,"Domains":["test.com"],"Emails":null}`},
+		// test 1: the client is required
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Settings", ResourceProperties: map[string]interface{}{"UserPoolId": "pool"}},
+			id: "failure-Settings", fails: true},
+		// test 2: All must be a boolean
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Settings", ResourceProperties: properties("yes")},
+			id: "failure-Settings", fails: true},
+		// test 3: failure to put the parameter
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Settings", ResourceProperties: properties("true")},
+			failures: awstest.Failures{"PutParameter": errors.New("boom")}, id: "failure-Settings", fails: true},
+		// test 4: update overwrites the settings
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: parameter,
+			ResourceProperties:    properties("true"),
+			OldResourceProperties: properties("false", "test.com")},
+			existing: true, id: parameter, value: `{"All":true,"Domains":null,"Emails":null}`},
+		// test 5: delete removes the settings
+		{event: cfn.Event{RequestType: cfn.RequestDelete, PhysicalResourceID: parameter, ResourceProperties: properties("false", "test.com")},
+			existing: true, id: parameter},
+	} {
+		ssm := awstest.NewSSM()
+		handler := resource.Handler(resource.Properties(CogCondPreAuthSettingsProperties{}), &settings{ssm: ssm})
+		if test.existing {
+			if _, _, err := handler(context.Background(), cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties("false", "test.com")}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ssm.Failures = test.failures
+		id, _, err := handler(context.Background(), test.event)
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if id != test.id {
+			t.Errorf("test %d: expecting id %s got %s", i, test.id, id)
+		}
+		value, ok := ssm.Parameters[parameter]
+		if test.value == "" {
+			if ok {
+				t.Errorf("test %d: unexpected parameter %s", i, *value.Value)
+			}
+			continue
+		}
+		if !ok || !sameJSON(*value.Value, test.value) {
+			t.Errorf("test %d: expecting %s got %+v", i, test.value, value)
+		}
+	}
+}
+
+func sameJSON(a, b string) bool {
+	var va, vb interface{}
+	if json.Unmarshal([]byte(a), &va) != nil || json.Unmarshal([]byte(b), &vb) != nil {
+		return false
+	}
+	ja, _ := json.Marshal(va)
+	jb, _ := json.Marshal(vb)
+	return string(ja) == string(jb)
+}
+
+func TestSettingsRules(t *testing.T) {
+	const parameter = "/hyperdrive/cog_cond_pre_auth/pool/client"
+	for i, test := range []struct {
+		properties map[string]interface{}
+		fails      bool
+		value      string
+	}{
+		// test 0: the rules are written with the settings
+		{properties: map[string]interface{}{"All": "false", "Domains": []interface{}{"*.test.com"}, "EmailPatterns": []interface{}{`.*\.ops@test\.com`},
+			"Groups": []interface{}{"admins"}, "IdentityProviders": []interface{}{"Google"},
+			"DenyDomains": []interface{}{"*.ext.test.com"}, "DenyEmails": []interface{}{"bob@test.com"}, "DenyEmailPatterns": []interface{}{`.*\+.*@test\.com`},
+			"DenyGroups": []interface{}{"suspended"}, "DenyIdentityProviders": []interface{}{"Facebook"}},
+			value: `{"All":false,"Domains":["*.test.com"],"Emails":null,"EmailPatterns":[".*\\.ops@test\\.com"],"Groups":["admins"],"IdentityProviders":["Google"],` +
+				`"DenyDomains":["*.ext.test.com"],"DenyEmails":["bob@test.com"],"DenyEmailPatterns":[".*\\+.*@test\\.com"],"DenyGroups":["suspended"],"DenyIdentityProviders":["Facebook"]}`},
+		// test 1: invalid email pattern
+		{properties: map[string]interface{}{"All": "false", "EmailPatterns": []interface{}{"("}}, fails: true},
+		// test 2: invalid wildcard domain
+		{properties: map[string]interface{}{"All": "false", "DenyDomains": []interface{}{"a.*.com"}}, fails: true},
+	} {
+		ssm := awstest.NewSSM()
+		test.properties["UserPoolId"] = "pool"
+		test.properties["UserPoolClientId"] = "client"
+		handler := resource.Handler(resource.Properties(CogCondPreAuthSettingsProperties{}), &settings{ssm: ssm})
+		_, _, err := handler(context.Background(), cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Settings", ResourceProperties: test.properties})
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		value, ok := ssm.Parameters[parameter]
+		if test.fails {
+			if ok {
+				t.Errorf("test %d: unexpected parameter %s", i, *value.Value)
+			}
+			continue
+		}
+		if !ok || !sameJSON(*value.Value, test.value) {
+			t.Errorf("test %d: expecting %s got %+v", i, test.value, value)
+		}
+	}
+}
+
+func TestSettingsPoolDefault(t *testing.T) {
+	for i, test := range []struct {
+		properties map[string]interface{}
+		fails      bool
+		id         string
+	}{
+		// test 0: the default of the user pool
+		{properties: map[string]interface{}{"UserPoolId": "pool", "PoolDefault": "true", "All": "true"},
+			id: "/hyperdrive/cog_cond_pre_auth/pool/default"},
+		// test 1: the client is not allowed with the default
+		{properties: map[string]interface{}{"UserPoolId": "pool", "UserPoolClientId": "client", "PoolDefault": "true", "All": "true"},
+			fails: true, id: "failure-Settings"},
+		// test 2: the settings of a client
+		{properties: map[string]interface{}{"UserPoolId": "pool", "UserPoolClientId": "client", "PoolDefault": "false", "All": "true"},
+			id: "/hyperdrive/cog_cond_pre_auth/pool/client"},
+		// test 3: the flag is parsed as a boolean
+		{properties: map[string]interface{}{"UserPoolId": "pool", "PoolDefault": "True", "All": "true"},
+			id: "/hyperdrive/cog_cond_pre_auth/pool/default"},
+		// test 4: PoolDefault must be a boolean
+		{properties: map[string]interface{}{"UserPoolId": "pool", "PoolDefault": "yes", "All": "true"},
+			fails: true, id: "failure-Settings"},
+	} {
+		ssm := awstest.NewSSM()
+		handler := resource.Handler(resource.Properties(CogCondPreAuthSettingsProperties{}), &settings{ssm: ssm})
+		id, _, err := handler(context.Background(), cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Settings", ResourceProperties: test.properties})
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if id != test.id {
+			t.Errorf("test %d: expecting id %s got %s", i, test.id, id)
+		}
+		if _, ok := ssm.Parameters[id]; ok == test.fails {
+			t.Errorf("test %d: unexpected parameter %s: %t", i, id, ok)
+		}
+	}
+}
@@ -3,12 +3,12 @@ package main
 
 import (
 	"context"
-	common "github.com/DEEP-IMPACT-AG/hyperdrive/common"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awsapi"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/resource"
 	"github.com/aws/aws-lambda-go/cfn"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
 	cip "github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
-	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
 	"strconv"
 )
@@ -31,64 +31,54 @@ type Properties struct {
 
 func properties(input map[string]interface{}) (Properties, error) {
 	var properties Properties
-	if err := mapstructure.Decode(input, &properties); err != nil {
-		return properties, err
-	}
-	return properties, nil
+	err := resource.Decode(input, &properties)
+	return properties, err
 }
 
 // The lambda is started using the AWS lambda go sdk. The handler function
-// does the actual work of creating the certificate. Cloudformation sends
+// does the actual work of configuring the client. Cloudformation sends
 // an event to signify that a resources must be created, updated or
 // deleted.
 func main() {
-	lambda.Start(cfn.LambdaWrap(processEvent))
-}
-
-// When processing an event, we first decode the resource properties and
-// create a acm client client. We have then 3 cases:
-//
-// 1. Delete: The delete case it self has 2 sub cases: if the physical
-//    resource id is a failure id, then this is a NOP, otherwise we delete
-//    the certificate.
-// 2. Create: In that case, we proceed to create the certificate,
-//    add tags if applicable and collect the DNS CNAME records to construct
-//    the attributes of the resource.
-// 3. Update: If only the tags have changed, we update them; otherwise, the update
-//    requires a replacement and the resource is normally created.
-func processEvent(_ context.Context, event cfn.Event) (string, map[string]interface{}, error) {
 	cog, err := cogService()
 	if err != nil {
-		return "", nil, err
+		panic(err)
 	}
-	switch event.RequestType {
-	case cfn.RequestDelete:
-		if !common.IsFailurePhysicalResourceId(event.PhysicalResourceID) {
-			updateClient(cog, Properties{})
-		}
-		return event.PhysicalResourceID, nil, nil
-	case cfn.RequestCreate:
-		fallthrough
-	case cfn.RequestUpdate:
-		properties, err := properties(event.ResourceProperties)
-		if err != nil {
-			return event.PhysicalResourceID, nil, err
-		}
-		if err = updateClient(cog, properties); err != nil {
-			return event.PhysicalResourceID, nil, err
-		}
-		return properties.UserPoolClientId, nil, nil
-	default:
-		return event.PhysicalResourceID, nil, errors.Errorf("unknown request type %s", event.RequestType)
+	lambda.Start(cfn.LambdaWrap(resource.Handler(resource.Properties(Properties{}), &clientSettings{cog: cog})))
+}
+
+// We have 2 cases:
+//
+// 1. Create, Update: we update the user pool client with the given
+//    settings. The physical resource id is the id of the client.
+// 2. Delete: the user pool client itself is not owned by the resource; it
+//    is a NOP.
+type clientSettings struct {
+	cog awsapi.CognitoIdentityProvider
+}
+
+func (c *clientSettings) Create(ctx context.Context, request resource.Request) (string, map[string]interface{}, error) {
+	return c.Update(ctx, request)
+}
+
+func (c *clientSettings) Update(ctx context.Context, request resource.Request) (string, map[string]interface{}, error) {
+	properties := request.Properties.(Properties)
+	if err := updateClient(c.cog, properties); err != nil {
+		return request.PhysicalResourceID, nil, err
 	}
+	return properties.UserPoolClientId, nil, nil
+}
+
+func (c *clientSettings) Delete(ctx context.Context, request resource.Request) error {
+	return nil
 }
 
-func updateClient(cog *cip.CognitoIdentityProvider, properties Properties) error {
+func updateClient(cog awsapi.CognitoIdentityProvider, properties Properties) error {
 	allowedOAuthFlowsUserPoolClient, err := strconv.ParseBool(properties.AllowedOAuthFlowsUserPoolClient)
 	if err != nil {
 		return errors.Wrapf(err, "AllowedOAuthFlowsUserPoolClient not a boolean, %+v", properties)
 	}
-	_, err = cog.UpdateUserPoolClientRequest(&cip.UpdateUserPoolClientInput{
+	_, err = cog.UpdateUserPoolClient(&cip.UpdateUserPoolClientInput{
 		AllowedOAuthFlows:               properties.AllowedOAuthFlows,
 		AllowedOAuthFlowsUserPoolClient: &allowedOAuthFlowsUserPoolClient,
 		AllowedOAuthScopes:              properties.AllowedOAuthScopes,
@@ -98,7 +88,7 @@ func updateClient(cog *cip.CognitoIdentityProvider, properties Properties) error
 		LogoutURLs:                      properties.LogoutURLs,
 		SupportedIdentityProviders:      properties.SupportedIdentityProviders,
 		UserPoolId:                      &properties.UserPoolId,
-	}).Send()
+	})
 	if err != nil {
 		return errors.Wrapf(err, "could not update the user pool client %s", properties.UserPoolClientId)
 	}
@@ -108,13 +98,13 @@ func updateClient(cog *cip.CognitoIdentityProvider, properties Properties) error
 // ### SDK client
 //
 // We use the
-// [ACM sdk v2](https://github.com/aws/aws-sdk-go-v2/tree/master/service/acm)
-// to create the certificate. The client is created with the default
+// [Cognito sdk v2](https://github.com/aws/aws-sdk-go-v2/tree/master/service/cognitoidentityprovider)
+// to configure the client. The client is created with the default
 // credential chain loader.
-func cogService() (*cip.CognitoIdentityProvider, error) {
+func cogService() (awsapi.CognitoIdentityProvider, error) {
 	cfg, err := external.LoadDefaultAWSConfig()
 	if err != nil {
 		return nil, errors.Wrap(err, "could not load default config")
 	}
-	return cip.New(cfg), nil
+	return awsapi.NewCognitoIdentityProvider(cip.New(cfg)), nil
 }
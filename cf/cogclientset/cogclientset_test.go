@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awstest"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/resource"
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"testing"
@@ -41,3 +46,57 @@ func TestDnsPropertiesYaml(t *testing.T) {
 	}
 	fmt.Printf("%+v\n", p)
 }
+
+func TestClientSettings(t *testing.T) {
+	properties := func(callback string) map[string]interface{} {
+		return map[string]interface{}{
+			"AllowedOAuthFlows":               []interface{}{"code"},
+			"AllowedOAuthFlowsUserPoolClient": "true",
+			"AllowedOAuthScopes":              []interface{}{"openid"},
+			"CallbackURLs":                    []interface{}{callback},
+			"SupportedIdentityProviders":      []interface{}{"COGNITO"},
+			"UserPoolId":                      "pool",
+			"UserPoolClientId":                "client",
+		}
+	}
+	for i, test := range []struct {
+		event    cfn.Event
+		failures awstest.Failures
+		id       string
+		fails    bool
+		callback string
+	}{
+		// test 0: create configures the client
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Settings", ResourceProperties: properties("https://auth.test.com/auth")},
+			id: "client", callback: "https://auth.test.com/auth"},
+		// test 1: update configures the client
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: "client",
+			ResourceProperties:    properties("https://auth.test.com/other"),
+			OldResourceProperties: properties("https://auth.test.com/auth")},
+			id: "client", callback: "https://auth.test.com/other"},
+		// test 2: failed update of the client
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Settings", ResourceProperties: properties("https://auth.test.com/auth")},
+			failures: awstest.Failures{"UpdateUserPoolClient": errors.New("boom")}, id: "failure-Settings", fails: true},
+		// test 3: delete does not touch the client
+		{event: cfn.Event{RequestType: cfn.RequestDelete, PhysicalResourceID: "client", ResourceProperties: properties("https://auth.test.com/auth")},
+			id: "client"},
+	} {
+		cog := awstest.NewCognitoIdentityProvider()
+		cog.Failures = test.failures
+		id, _, err := resource.Handler(resource.Properties(Properties{}), &clientSettings{cog: cog})(context.Background(), test.event)
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if id != test.id {
+			t.Errorf("test %d: expecting id %s got %s", i, test.id, id)
+		}
+		client, ok := cog.Clients["pool/client"]
+		if test.callback == "" {
+			if ok {
+				t.Errorf("test %d: unexpected update of the client", i)
+			}
+		} else if !ok || *client.DefaultRedirectURI != test.callback {
+			t.Errorf("test %d: expecting callback %s got %+v", i, test.callback, client)
+		}
+	}
+}
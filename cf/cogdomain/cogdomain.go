@@ -2,17 +2,15 @@ package main
 
 import (
 	"context"
-	"github.com/DEEP-IMPACT-AG/hyperdrive/common"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awsapi"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/resource"
 	"github.com/aws/aws-lambda-go/cfn"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
 	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
-	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
 )
 
-var idp *cognitoidentityprovider.CognitoIdentityProvider
-
 // The lambda is started using the AWS lambda go sdk. The handler function
 // does the actual work of creating the apikey. Cloudformation sends an
 // event to signify that a resources must be created, updated or deleted.
@@ -21,8 +19,10 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	idp = cognitoidentityprovider.New(cfg)
-	lambda.Start(cfn.LambdaWrap(processEvent))
+	lambda.Start(cfn.LambdaWrap(resource.Handler(resource.Properties(DomainProperties{}), &domain{
+		idp:    awsapi.NewCognitoIdentityProvider(cognitoidentityprovider.New(cfg)),
+		region: cfg.Region,
+	})))
 }
 
 type DomainProperties struct {
@@ -31,37 +31,54 @@ type DomainProperties struct {
 	CustomDomainConfig cognitoidentityprovider.CustomDomainConfigType
 }
 
-func domainProperties(input map[string]interface{}) (DomainProperties, error) {
-	var properties DomainProperties
-	if err := mapstructure.Decode(input, &properties); err != nil {
-		return properties, err
+type domain struct {
+	idp    awsapi.CognitoIdentityProvider
+	region string
+}
+
+func (d *domain) Create(ctx context.Context, request resource.Request) (string, map[string]interface{}, error) {
+	return createDomain(d.idp, d.region, request.Properties.(DomainProperties))
+}
+
+func (d *domain) Update(ctx context.Context, request resource.Request) (string, map[string]interface{}, error) {
+	return createDomain(d.idp, d.region, request.Properties.(DomainProperties))
+}
+
+func (d *domain) Delete(ctx context.Context, request resource.Request) error {
+	properties := request.Properties.(DomainProperties)
+	_, err := d.idp.DeleteUserPoolDomain(&cognitoidentityprovider.DeleteUserPoolDomainInput{
+		Domain:     &request.PhysicalResourceID,
+		UserPoolId: &properties.UserPoolId,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "could not delete the UserPoolDomain %s", request.PhysicalResourceID)
 	}
-	return properties, nil
+	return nil
 }
 
-func createDomain(event cfn.Event, properties DomainProperties) (string, map[string]interface{}, error) {
+func createDomain(idp awsapi.CognitoIdentityProvider, region string, properties DomainProperties) (string, map[string]interface{}, error) {
 	var out *cognitoidentityprovider.CreateUserPoolDomainOutput
 	var err error
 	if properties.CustomDomainConfig.CertificateArn == nil {
-		out, err = idp.CreateUserPoolDomainRequest(&cognitoidentityprovider.CreateUserPoolDomainInput{
+		out, err = idp.CreateUserPoolDomain(&cognitoidentityprovider.CreateUserPoolDomainInput{
 			Domain:     &properties.Domain,
 			UserPoolId: &properties.UserPoolId,
-		}).Send()
+		})
 	} else {
-		out, err = idp.CreateUserPoolDomainRequest(&cognitoidentityprovider.CreateUserPoolDomainInput{
+		out, err = idp.CreateUserPoolDomain(&cognitoidentityprovider.CreateUserPoolDomainInput{
 			Domain:             &properties.Domain,
 			UserPoolId:         &properties.UserPoolId,
 			CustomDomainConfig: &properties.CustomDomainConfig,
-		}).Send()
+		})
 	}
 	if err != nil {
-		return common.FailurePhysicalResourceId(event), nil, errors.Wrap(err, "Could not create the UserPoolDomain")
+		return "", nil, errors.Wrap(err, "Could not create the UserPoolDomain")
 	}
 	var cloudFrontDomain string
 	var domain string
 	if out.CloudFrontDomain == nil {
 		cloudFrontDomain = ""
-		domain = properties.Domain + ".auth." + idp.Region + ".amazoncognito.com"
+		domain = properties.Domain + ".auth." + region + ".amazoncognito.com"
 	} else {
 		cloudFrontDomain = *out.CloudFrontDomain
 		domain = properties.Domain
@@ -74,30 +91,3 @@ func createDomain(event cfn.Event, properties DomainProperties) (string, map[str
 		},
 		nil
 }
-
-func processEvent(ctx context.Context, event cfn.Event) (string, map[string]interface{}, error) {
-	properties, err := domainProperties(event.ResourceProperties);
-	if err != nil {
-		return "", nil, err
-	}
-	switch event.RequestType {
-	case cfn.RequestDelete:
-		if !common.IsFailurePhysicalResourceId(event.PhysicalResourceID) {
-			userPoolId := event.ResourceProperties["UserPoolId"].(string)
-			_, err := idp.DeleteUserPoolDomainRequest(&cognitoidentityprovider.DeleteUserPoolDomainInput{
-				Domain:     &event.PhysicalResourceID,
-				UserPoolId: &userPoolId,
-			}).Send()
-			if err != nil {
-				return event.PhysicalResourceID, nil, errors.Wrapf(err, "could not delete the UserPoolDomain %s", event.PhysicalResourceID)
-			}
-		}
-		return event.PhysicalResourceID, nil, nil
-	case cfn.RequestUpdate:
-		return createDomain(event, properties)
-	case cfn.RequestCreate:
-		return createDomain(event, properties)
-	default:
-		return event.PhysicalResourceID, nil, errors.Errorf("unknown request type %s", event.RequestType)
-	}
-}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awstest"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/resource"
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/pkg/errors"
+)
+
+func TestDomain(t *testing.T) {
+	properties := func(domain string) map[string]interface{} {
+		return map[string]interface{}{"Domain": domain, "UserPoolId": "pool"}
+	}
+	for i, test := range []struct {
+		event    cfn.Event
+		existing bool
+		failures awstest.Failures
+		id       string
+		fails    bool
+		domains  int
+		domain   string
+	}{
+		// test 0: create a cognito domain
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties("test")},
+			id: "test", domains: 1, domain: "test.auth.eu-west-1.amazoncognito.com"},
+		// test 1: create a custom domain
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: map[string]interface{}{
+			"Domain": "auth.test.com", "UserPoolId": "pool", "CustomDomainConfig": map[string]interface{}{"CertificateArn": "arn"}}},
+			id: "auth.test.com", domains: 1, domain: "auth.test.com"},
+		// test 2: failed creation
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Domain", ResourceProperties: properties("test")},
+			failures: awstest.Failures{"CreateUserPoolDomain": errors.New("boom")}, id: "failure-Domain", fails: true},
+		// test 3: update creates the new domain
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: "test",
+			ResourceProperties:    properties("other"),
+			OldResourceProperties: properties("test")},
+			existing: true, id: "other", domains: 2, domain: "other.auth.eu-west-1.amazoncognito.com"},
+		// test 4: delete
+		{event: cfn.Event{RequestType: cfn.RequestDelete, PhysicalResourceID: "test", ResourceProperties: properties("test")},
+			existing: true, id: "test"},
+		// test 5: failed delete
+		{event: cfn.Event{RequestType: cfn.RequestDelete, PhysicalResourceID: "test", ResourceProperties: properties("test")},
+			id: "test", fails: true},
+	} {
+		idp := awstest.NewCognitoIdentityProvider()
+		handler := resource.Handler(resource.Properties(DomainProperties{}), &domain{idp: idp, region: "eu-west-1"})
+		if test.existing {
+			if _, _, err := handler(context.Background(), cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties("test")}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		idp.Failures = test.failures
+		id, data, err := handler(context.Background(), test.event)
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if id != test.id {
+			t.Errorf("test %d: expecting id %s got %s", i, test.id, id)
+		}
+		if len(idp.Domains) != test.domains {
+			t.Errorf("test %d: expecting %d domains got %d", i, test.domains, len(idp.Domains))
+		}
+		if test.domain != "" && data["Domain"] != test.domain {
+			t.Errorf("test %d: expecting domain %s got %v", i, test.domain, data["Domain"])
+		}
+	}
+}
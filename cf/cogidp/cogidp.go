@@ -2,20 +2,17 @@ package main
 
 import (
 	"context"
-	"github.com/DEEP-IMPACT-AG/hyperdrive/common"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awsapi"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/resource"
 	"github.com/aws/aws-lambda-go/cfn"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
 	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
 	awsssm "github.com/aws/aws-sdk-go-v2/service/ssm"
-	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
 	"strings"
 )
 
-var idp *cognitoidentityprovider.CognitoIdentityProvider
-var ssm *awsssm.SSM
-
 // The lambda is started using the AWS lambda go sdk. The handler function
 // does the actual work of creating the apikey. Cloudformation sends an
 // event to signify that a resources must be created, updated or deleted.
@@ -24,9 +21,10 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	idp = cognitoidentityprovider.New(cfg)
-	ssm = awsssm.New(cfg)
-	lambda.Start(cfn.LambdaWrap(processEvent))
+	lambda.Start(cfn.LambdaWrap(resource.Handler(resource.Properties(ProviderProperties{}), &identityProvider{
+		idp: awsapi.NewCognitoIdentityProvider(cognitoidentityprovider.New(cfg)),
+		ssm: awsapi.NewSSM(awsssm.New(cfg)),
+	})))
 }
 
 type ProviderProperties struct {
@@ -36,107 +34,109 @@ type ProviderProperties struct {
 	AttributeMapping                                                   map[string]string
 }
 
-func readParameter(parameterName string) (string, error) {
-	decrypt := true
-	param, err := ssm.GetParameterRequest(&awsssm.GetParameterInput{
-		Name:           &parameterName,
-		WithDecryption: &decrypt,
-	}).Send()
-	if err != nil {
-		return "", errors.Wrapf(err, "could not read parameter %s", parameterName)
-	}
-	return *param.Parameter.Value, err
-}
-
-func providerProperties(input map[string]interface{}) (ProviderProperties, map[string]string, error) {
-	var properties ProviderProperties
-	if err := mapstructure.Decode(input, &properties); err != nil {
-		return properties, nil, err
-	}
-	details := make(map[string]string)
-	providerType := properties.ProviderType
-	switch providerType {
+func (properties *ProviderProperties) Validate() error {
+	switch properties.ProviderType {
 	case cognitoidentityprovider.IdentityProviderTypeTypeGoogle:
-		details["authorize_url"] = "https://accounts.google.com/o/oauth2/v2/auth"
-		details["authorize_scopes"] = strings.Join(properties.AuthorizeScopes, " ")
-		details["attributes_url_add_attributes"] = "true"
-		details["token_url"] = "https://www.googleapis.com/oauth2/v4/token"
-		details["attributes_url"] = "https://people.googleapis.com/v1/people/me?personFields="
-		details["oidc_issuer"] = "https://accounts.google.com"
-		details["token_request_method"] = "POST"
+		return nil
 	default:
-		return properties, nil, errors.Errorf("unknown provider type %s", providerType)
-	}
-	clientId, err := readParameter(properties.ClientIdParameter)
-	if err != nil {
-		return properties, nil, err
-	}
-	clientSecret, err := readParameter(properties.ClientSecretParameter)
-	if err != nil {
-		return properties, nil, err
+		return errors.Errorf("unknown provider type %s", properties.ProviderType)
 	}
-	details["client_id"] = clientId
-	details["client_secret"] = clientSecret
-	return properties, details, nil
 }
 
-func createIdentityProvider(event cfn.Event, properties ProviderProperties, providerDetails map[string]string) (string, map[string]interface{}, error) {
-	_, err := idp.CreateIdentityProviderRequest(&cognitoidentityprovider.CreateIdentityProviderInput{
+type identityProvider struct {
+	idp awsapi.CognitoIdentityProvider
+	ssm awsapi.SSM
+}
+
+func (p *identityProvider) Create(ctx context.Context, request resource.Request) (string, map[string]interface{}, error) {
+	properties := request.Properties.(ProviderProperties)
+	providerDetails, err := p.providerDetails(properties)
+	if err != nil {
+		return "", nil, err
+	}
+	_, err = p.idp.CreateIdentityProvider(&cognitoidentityprovider.CreateIdentityProviderInput{
 		UserPoolId:       &properties.UserPoolId,
 		ProviderName:     &properties.ProviderName,
 		ProviderType:     properties.ProviderType,
 		AttributeMapping: properties.AttributeMapping,
 		ProviderDetails:  providerDetails,
-	}).Send();
+	})
 	if err != nil {
-		return common.FailurePhysicalResourceId(event), nil, err
+		return "", nil, err
 	}
 	data := map[string]interface{}{"UserPoolId": properties.UserPoolId, "ProviderName": properties.ProviderName}
 	return properties.UserPoolId + "/" + properties.ProviderName, data, nil
 }
 
-func updateIdentityProvider(event cfn.Event, properties ProviderProperties, providerDetails map[string]string) (string, map[string]interface{}, error) {
-	_, err := idp.UpdateIdentityProviderRequest(&cognitoidentityprovider.UpdateIdentityProviderInput{
+func (p *identityProvider) Update(ctx context.Context, request resource.Request) (string, map[string]interface{}, error) {
+	properties := request.Properties.(ProviderProperties)
+	providerDetails, err := p.providerDetails(properties)
+	if err != nil {
+		return request.PhysicalResourceID, nil, err
+	}
+	_, err = p.idp.UpdateIdentityProvider(&cognitoidentityprovider.UpdateIdentityProviderInput{
 		UserPoolId:       &properties.UserPoolId,
 		ProviderName:     &properties.ProviderName,
 		AttributeMapping: properties.AttributeMapping,
 		ProviderDetails:  providerDetails,
-	}).Send()
+	})
 	if err != nil {
-		return event.PhysicalResourceID, event.ResourceProperties, errors.Wrapf(err, "could not update the identity provider %s for the user pool %s", properties.ProviderName, properties.UserPoolId)
+		return request.PhysicalResourceID, request.ResourceProperties, errors.Wrapf(err, "could not update the identity provider %s for the user pool %s", properties.ProviderName, properties.UserPoolId)
 	}
-	return event.PhysicalResourceID, event.ResourceProperties, nil
+	return request.PhysicalResourceID, request.ResourceProperties, nil
 }
 
-func processEvent(_ context.Context, event cfn.Event) (string, map[string]interface{}, error) {
-	properties, providerDetails, err := providerProperties(event.ResourceProperties);
+func (p *identityProvider) Delete(ctx context.Context, request resource.Request) error {
+	properties := request.Properties.(ProviderProperties)
+	_, err := p.idp.DeleteIdentityProvider(&cognitoidentityprovider.DeleteIdentityProviderInput{
+		UserPoolId:   &properties.UserPoolId,
+		ProviderName: &properties.ProviderName,
+	})
 	if err != nil {
-		return "", nil, err
+		return errors.Wrapf(err, "could not delete the identity provider %s", request.PhysicalResourceID)
 	}
-	switch event.RequestType {
-	case cfn.RequestDelete:
-		if !common.IsFailurePhysicalResourceId(event.PhysicalResourceID) {
-			userPoolId := event.ResourceProperties["UserPoolId"].(string)
-			providerName := event.ResourceProperties["ProviderName"].(string)
-			_, err := idp.DeleteIdentityProviderRequest(&cognitoidentityprovider.DeleteIdentityProviderInput{
-				UserPoolId:   &userPoolId,
-				ProviderName: &providerName,
-			}).Send()
-			if err != nil {
-				return event.PhysicalResourceID, nil, errors.Wrapf(err, "could not delete the identity provider %s", event.PhysicalResourceID)
-			}
-		}
-		return event.PhysicalResourceID, nil, nil
-	case cfn.RequestUpdate:
-		oldUserPoolId := event.OldResourceProperties["UserPoolId"].(string)
-		oldProviderName := event.OldResourceProperties["ProviderName"].(string)
-		if properties.UserPoolId != oldUserPoolId || properties.ProviderName != oldProviderName {
-			return createIdentityProvider(event, properties, providerDetails)
-		}
-		return updateIdentityProvider(event, properties, providerDetails)
-	case cfn.RequestCreate:
-		return createIdentityProvider(event, properties, providerDetails)
-	default:
-		return event.PhysicalResourceID, nil, errors.Errorf("unknown request type %s", event.RequestType)
+	return nil
+}
+
+func (p *identityProvider) RequiresReplacement(request resource.Request) bool {
+	return request.Changed("UserPoolId", "ProviderName")
+}
+
+func (p *identityProvider) readParameter(parameterName string) (string, error) {
+	decrypt := true
+	param, err := p.ssm.GetParameter(&awsssm.GetParameterInput{
+		Name:           &parameterName,
+		WithDecryption: &decrypt,
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "could not read parameter %s", parameterName)
 	}
+	return *param.Parameter.Value, err
+}
+
+// The provider details contain the client id and the client secret that
+// are read from SSM parameters.
+func (p *identityProvider) providerDetails(properties ProviderProperties) (map[string]string, error) {
+	details := make(map[string]string)
+	switch properties.ProviderType {
+	case cognitoidentityprovider.IdentityProviderTypeTypeGoogle:
+		details["authorize_url"] = "https://accounts.google.com/o/oauth2/v2/auth"
+		details["authorize_scopes"] = strings.Join(properties.AuthorizeScopes, " ")
+		details["attributes_url_add_attributes"] = "true"
+		details["token_url"] = "https://www.googleapis.com/oauth2/v4/token"
+		details["attributes_url"] = "https://people.googleapis.com/v1/people/me?personFields="
+		details["oidc_issuer"] = "https://accounts.google.com"
+		details["token_request_method"] = "POST"
+	}
+	clientId, err := p.readParameter(properties.ClientIdParameter)
+	if err != nil {
+		return nil, err
+	}
+	clientSecret, err := p.readParameter(properties.ClientSecretParameter)
+	if err != nil {
+		return nil, err
+	}
+	details["client_id"] = clientId
+	details["client_secret"] = clientSecret
+	return details, nil
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awstest"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/resource"
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/pkg/errors"
+)
+
+func TestIdentityProvider(t *testing.T) {
+	properties := func(pool, scope string) map[string]interface{} {
+		return map[string]interface{}{
+			"UserPoolId":            pool,
+			"ProviderName":          "Google",
+			"ProviderType":          "Google",
+			"ClientIdParameter":     "/google/id",
+			"ClientSecretParameter": "/google/secret",
+			"AuthorizeScopes":       []interface{}{"openid", scope},
+		}
+	}
+	for i, test := range []struct {
+		event     cfn.Event
+		existing  bool
+		failures  awstest.Failures
+		id        string
+		fails     bool
+		providers []string
+		scopes    string
+	}{
+		// test 0: create with the client id and secret from ssm
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties("pool", "email")},
+			id: "pool/Google", providers: []string{"pool/Google"}, scopes: "openid email"},
+		// test 1: only google is supported
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Idp", ResourceProperties: map[string]interface{}{"ProviderType": "SAML"}},
+			id: "failure-Idp", fails: true},
+		// test 2: the parameters must exist
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Idp", ResourceProperties: properties("pool", "email")},
+			failures: awstest.Failures{"GetParameter": errors.New("boom")}, id: "failure-Idp", fails: true},
+		// test 3: update in place
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: "pool/Google",
+			ResourceProperties:    properties("pool", "profile"),
+			OldResourceProperties: properties("pool", "email")},
+			existing: true, id: "pool/Google", providers: []string{"pool/Google"}, scopes: "openid profile"},
+		// test 4: update of the user pool creates a new provider
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: "pool/Google",
+			ResourceProperties:    properties("other", "email"),
+			OldResourceProperties: properties("pool", "email")},
+			existing: true, id: "other/Google", providers: []string{"pool/Google", "other/Google"}, scopes: "openid email"},
+		// test 5: failed update
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: "pool/Google",
+			ResourceProperties:    properties("pool", "profile"),
+			OldResourceProperties: properties("pool", "email")},
+			existing: true, failures: awstest.Failures{"UpdateIdentityProvider": errors.New("boom")}, id: "pool/Google", fails: true, providers: []string{"pool/Google"}},
+		// test 6: delete
+		{event: cfn.Event{RequestType: cfn.RequestDelete, PhysicalResourceID: "pool/Google", ResourceProperties: properties("pool", "email")},
+			existing: true, id: "pool/Google"},
+	} {
+		idp := awstest.NewCognitoIdentityProvider()
+		ssm := awstest.NewSSM()
+		ssm.PutString("/google/id", "client")
+		ssm.PutString("/google/secret", "secret")
+		handler := resource.Handler(resource.Properties(ProviderProperties{}), &identityProvider{idp: idp, ssm: ssm})
+		if test.existing {
+			if _, _, err := handler(context.Background(), cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties("pool", "email")}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		idp.Failures = test.failures
+		ssm.Failures = test.failures
+		id, _, err := handler(context.Background(), test.event)
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if id != test.id {
+			t.Errorf("test %d: expecting id %s got %s", i, test.id, id)
+		}
+		if len(idp.IdentityProviders) != len(test.providers) {
+			t.Errorf("test %d: expecting providers %v got %v", i, test.providers, idp.IdentityProviders)
+		}
+		if test.scopes == "" {
+			continue
+		}
+		provider := idp.IdentityProviders[id]
+		details := provider.ProviderDetails
+		if details["client_id"] != "client" || details["client_secret"] != "secret" || details["authorize_scopes"] != test.scopes {
+			t.Errorf("test %d: unexpected provider details %v", i, details)
+		}
+	}
+}
@@ -23,7 +23,14 @@
 //     ServiceToken:
 //       Fn::ImportValue:
 //         !Sub ${HyperdriveCore}-DnsCertificate
+//     CertificateTransparencyLoggingPreference: <ENABLED|DISABLED>
+//     DeleteValidationRecords: <true|false>
 //     DomainName: <main-domain-name>
+//     HostedZoneId: <id of the hosted zone for the validation records>
+//     HostedZoneIds:
+//       <domain-name>: <id of the hosted zone for the domain>
+//       ...
+//     KeyAlgorithm: <key algorithm>
 //     Region: <region of the certificate>
 //     SubjectAlternativeNames:
 //     - <alternative names>
@@ -32,6 +39,29 @@
 //     - Key: key
 //       Value: value
 //     - ...
+//     WaitForIssued: <true|false>
+// ```
+//
+// To import a certificate into ACM instead, the PEM encoded certificate,
+// private key and, optionally, certificate chain are given as SSM
+// parameters; the parameters for the private key should be of type
+// `SecureString`.
+//
+// ```yaml
+// MyImportedCertificate:
+//   Type: Custom::DnsCertificate
+//   Properties:
+//     ServiceToken:
+//       Fn::ImportValue:
+//         !Sub ${HyperdriveCore}-DnsCertificate
+//     CertificateParameter: /hyperdrive/dnscert/<name>/certificate
+//     CertificateChainParameter: /hyperdrive/dnscert/<name>/chain
+//     PrivateKeyParameter: /hyperdrive/dnscert/<name>/key
+//     KeyAlgorithm: <key algorithm>
+//     Region: <region of the certificate>
+//     Tags:
+//     - Key: key
+//       Value: value
 // ```
 //
 // ### Properties
@@ -45,16 +75,125 @@
 // >
 // > _Required_: Yes
 //
+// `CertificateParameter`
+//
+// > The name of the SSM parameter with the PEM encoded certificate to
+// > import. The lambda can only read the parameters under
+// > `/hyperdrive/dnscert/`. A version of the parameter may be selected with
+// > the suffix `:<version>`, e.g. to import a renewed certificate. If
+// > given, the certificate is imported instead of requested and
+// > `DomainName`, `SubjectAlternativeNames`, the hosted zones and
+// > `CertificateTransparencyLoggingPreference` are not applicable.
+// >
+// > _Type_: String
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: No interruption, if the certificate was already
+// > imported; replacement otherwise.
+//
+// `CertificateChainParameter`
+//
+// > The name of the SSM parameter with the PEM encoded certificate chain of
+// > the imported certificate.
+// >
+// > _Type_: String
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: No interruption.
+//
+// `PrivateKeyParameter`
+//
+// > The name of the SSM parameter, preferably a `SecureString`, with the
+// > PEM encoded private key of the imported certificate.
+// >
+// > _Type_: String
+// >
+// > _Required_: Yes, if `CertificateParameter` is given.
+// >
+// > _Update Requires_: No interruption.
+//
+// `CertificateTransparencyLoggingPreference`
+//
+// > Whether the certificate is logged in the public certificate transparency
+// > logs, either `ENABLED` or `DISABLED`.
+// >
+// > _Type_: String
+// >
+// > _Required_: No (default: ENABLED)
+// >
+// > _Update Requires_: No interruption.
+//
+// `DeleteValidationRecords`
+//
+// > If `true`, the validation records managed by the resource are deleted
+// > with the certificate, or from the hosted zones they move out of, unless
+// > they are still used by another certificate of the account in the region
+// > of the certificate. The certificates of the other regions are not
+// > checked: as ACM uses the same validation record for a domain in all
+// > the regions, only enable the deletion if the domains have no
+// > certificates in other regions. By default, the records are kept.
+// >
+// > _Type_: Boolean
+// >
+// > _Required_: No (default: false)
+// >
+// > _Update Requires_: No interruption.
+//
 // `DomainName`
 //
 // > The main domain name for this certificate.
 // >
 // > _Type_: String
 // >
-// > _Required_: Yes
+// > _Required_: Yes, unless the certificate is imported.
 // >
 // > _Update Requires_: Replacement
 //
+// `HostedZoneId`
+//
+// > The Route53 hosted zone in which the resource creates the CNAME records
+// > for the validation of the domains. The records shared by several
+// > domains (e.g. `test.com` and `*.test.com`) are created only once. The
+// > records are kept when the resource is deleted, unless
+// > `DeleteValidationRecords` is `true`. If neither `HostedZoneId` nor
+// > `HostedZoneIds` is given, the records are not managed by the resource.
+// >
+// > _Type_: String
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: No interruption.
+//
+// `HostedZoneIds`
+//
+// > The Route53 hosted zones per domain, for certificates whose domains are
+// > in several hosted zones. A domain is matched with the longest key that
+// > is the domain itself or one of its parent domains; domains without a
+// > match use the `HostedZoneId`.
+// >
+// > _Type_: Map of domain name to String
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: No interruption.
+//
+// `KeyAlgorithm`
+//
+// > The algorithm of the key of the certificate, e.g. `RSA_2048` or
+// > `EC_prime256v1`. A requested certificate has a key of the algorithm,
+// > one of `RSA_2048` (the default), `EC_prime256v1` and `EC_secp384r1`.
+// > For imported certificates, the key of the certificate is checked to be
+// > of the given algorithm.
+// >
+// > _Type_: String
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: Replacement for requested certificates, no
+// > interruption for imported certificates.
+//
 // `Region`
 //
 // > The region for the certificate. This is mostly useful to create
@@ -80,7 +219,8 @@
 //
 // `Tags`
 //
-// > Tags to apply on the certificate.
+// > Tags to apply on the certificate. Only the tags that have changed are
+// > updated.
 // >
 // > _Type_: List of Tags (a Tag a a map with keys `Key` and `Value`)
 // >
@@ -88,6 +228,21 @@
 // >
 // > _Update Requires_: No interruption.
 //
+// `WaitForIssued`
+//
+// > If `true`, the resource is created only when the certificate has been
+// > issued, i.e. when its domains have been validated. The validation
+// > records must therefore be managed by the resource with `HostedZoneId`
+// > or exist independently of the resource. As
+// > cloudformation waits at most one hour for a custom resource, the
+// > creation fails if the certificate is not issued in time.
+// >
+// > _Type_: Boolean
+// >
+// > _Required_: No (default: false)
+// >
+// > _Update Requires_: No interruption.
+//
 // ### Return Values
 //
 // `Ref`
@@ -103,10 +258,14 @@
 // 1. `<domain-name>-RecordName` : the name for the CNAME record.
 // 2. `<domain-name>-RecordValue`: the value for the CNAME record.
 //
-// If you use Route53 for DNS, you can use these attributes to generate
+// If you use Route53 for DNS, you can let the resource create the records
+// with the property `HostedZoneId` or use these attributes to generate
 // corresponding records in your HostedZone. The hyperdrive can generate
 // cloudformation templates for that purpose.
 //
+// Imported certificates have no validation records and only the attribute
+// `Arn`.
+//
 // ### Example
 //
 // The following yaml fragment create a SSL certificate for the domains
@@ -142,20 +301,36 @@
 //
 // The implemention of the dnscert lambda uses the
 // [AWS Lambda Go](https://github.com/aws/aws-lambda-go) library to
-// simplify the integration. It is run in the `go1.x` runtime.
+// simplify the integration. It is run in the `go1.x` runtime. Waiting for
+// the certificate is implemented by re-invoking the lambda (see
+// `resource.LambdaWrap`); the lambda must be allowed to invoke itself and
+// to send the polls of the certificate to the queue of the delayed
+// continuations, that triggers the lambda.
 package main
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"github.com/DEEP-IMPACT-AG/hyperdrive/common"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awsapi"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/resource"
 	"github.com/aws/aws-lambda-go/cfn"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
 	"github.com/aws/aws-sdk-go-v2/service/acm"
-	"github.com/mitchellh/mapstructure"
+	awslambda "github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/pkg/errors"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -164,7 +339,19 @@ import (
 // an event to signify that a resources must be created, updated or
 // deleted.
 func main() {
-	lambda.Start(cfn.LambdaWrap(processEvent))
+	cfg, err := external.LoadDefaultAWSConfig()
+	if err != nil {
+		panic(err)
+	}
+	lambda.Start(resource.LambdaWrap(
+		resource.Handler(resource.Properties(DnsCertificateProperties{}), &dnsCertificate{
+			acm:     acmService,
+			route53: awsapi.NewRoute53(route53.New(cfg)),
+			ssm:     awsapi.NewSSM(ssm.New(cfg)),
+		}),
+		awsapi.NewLambda(awslambda.New(cfg)),
+		awsapi.NewSQS(sqs.New(cfg)),
+	))
 }
 
 // The main data structure for the certificate resource is defined as a go
@@ -172,148 +359,372 @@ func main() {
 // library [mapstructure](https://github.com/mitchellh/mapstructure) to
 // decode the generic map from the cloudformation event to the struct.
 type DnsCertificateProperties struct {
-	DomainName              string
-	Region                  string
-	SubjectAlternativeNames []string
-	Tags                    []acm.Tag
+	CertificateParameter                     string
+	CertificateChainParameter                string
+	CertificateTransparencyLoggingPreference string
+	DeleteValidationRecords                  string
+	DomainName                               string
+	HostedZoneId                             string
+	HostedZoneIds                            map[string]string
+	KeyAlgorithm                             string
+	PrivateKeyParameter                      string
+	Region                                   string
+	SubjectAlternativeNames                  []string
+	Tags                                     []acm.Tag
+	WaitForIssued                            string
+}
+
+func (properties *DnsCertificateProperties) Validate() error {
+	switch acm.CertificateTransparencyLoggingPreference(properties.CertificateTransparencyLoggingPreference) {
+	case "", acm.CertificateTransparencyLoggingPreferenceEnabled, acm.CertificateTransparencyLoggingPreferenceDisabled:
+	default:
+		return errors.Errorf("invalid certificate transparency logging preference %s", properties.CertificateTransparencyLoggingPreference)
+	}
+	if properties.imported() {
+		if properties.PrivateKeyParameter == "" {
+			return errors.New("the private key parameter of the imported certificate must be defined")
+		}
+		if properties.managesRecords() {
+			return errors.New("an imported certificate has no validation records")
+		}
+		return nil
+	}
+	if properties.DomainName == "" {
+		return errors.New("domain name must be defined")
+	}
+	switch acm.KeyAlgorithm(properties.KeyAlgorithm) {
+	case "", acm.KeyAlgorithmRsa2048, acm.KeyAlgorithmEcPrime256v1, acm.KeyAlgorithmEcSecp384r1:
+	default:
+		return errors.Errorf("the key algorithm %s cannot be requested, only %s, %s or %s", properties.KeyAlgorithm,
+			acm.KeyAlgorithmRsa2048, acm.KeyAlgorithmEcPrime256v1, acm.KeyAlgorithmEcSecp384r1)
+	}
+	return nil
+}
+
+func (properties DnsCertificateProperties) imported() bool {
+	return properties.CertificateParameter != ""
+}
+
+// ACM requests a key `RSA_2048` by default.
+func (properties DnsCertificateProperties) requestedKeyAlgorithm() string {
+	if properties.KeyAlgorithm == "" {
+		return string(acm.KeyAlgorithmRsa2048)
+	}
+	return properties.KeyAlgorithm
 }
 
 func dnsCertificateProperties(input map[string]interface{}) (DnsCertificateProperties, error) {
 	var properties DnsCertificateProperties
-	if err := mapstructure.Decode(input, &properties); err != nil {
-		return properties, err
-	}
-	return properties, nil
+	err := resource.Decode(input, &properties)
+	return properties, err
 }
 
-// When processing an event, we first decode the resource properties and
-// create a acm client client. We have then 3 cases:
+// When processing an event, we first create an acm client for the region
+// of the certificate with the `acm` function that can be replaced in
+// tests. We have then 3 cases:
 //
-// 1. Delete: The delete case it self has 2 sub cases: if the physical
-//    resource id is a failure id, then this is a NOP, otherwise we delete
-//    the certificate.
+// 1. Delete: we delete the certificate and, if managed and enabled, its
+//    validation records. Deleting a certificate whose creation has failed is a NOP
+//    handled by the framework.
 // 2. Create: In that case, we proceed to create the certificate,
 //    add tags if applicable and collect the DNS CNAME records to construct
-//    the attributes of the resource.
-// 3. Update: If only the tags have changed, we update them; otherwise, the update
-//    requires a replacement and the resource is normally created.
-func processEvent(ctx context.Context, event cfn.Event) (string, map[string]interface{}, error) {
-	properties, err := dnsCertificateProperties(event.ResourceProperties)
+//    the attributes of the resource. If managed, the records are upserted
+//    in the hosted zones.
+// 3. Update: If only the tags, the hosted zones or `WaitForIssued` have
+//    changed, we update them; otherwise, the update requires a replacement
+//    and the resource is normally created.
+//
+// Collecting the records, and optionally waiting for the certificate to
+// be issued, continues in new invocations of the lambda until done; the
+// state of the continuation is the ARN of the certificate and whether the
+// records have already been upserted.
+type dnsCertificate struct {
+	acm     func(region string) (awsapi.ACM, error)
+	route53 awsapi.Route53
+	ssm     awsapi.SSM
+}
+
+type certificateState struct {
+	CertificateArn  string
+	RecordsUpserted bool
+}
+
+func (d *dnsCertificate) Create(ctx context.Context, request resource.Request) (string, map[string]interface{}, error) {
+	properties := request.Properties.(DnsCertificateProperties)
+	acms, err := d.acm(properties.Region)
 	if err != nil {
 		return "", nil, err
 	}
-	acms, err := acmService(properties)
+	if request.Continued() {
+		var state certificateState
+		if err := request.DecodeState(&state); err != nil {
+			return "", nil, err
+		}
+		return d.certificateData(acms, state, properties)
+	}
+	var arn string
+	if properties.imported() {
+		arn, err = d.importCertificate(acms, "", properties)
+		if err == nil {
+			err = addTags(acms, arn, properties.Tags)
+		}
+	} else {
+		arn, err = createCertificate(acms, request.Event, properties)
+	}
+	if err != nil {
+		return arn, nil, err
+	}
+	return d.certificateData(acms, certificateState{CertificateArn: arn}, properties)
+}
+
+func (d *dnsCertificate) Update(ctx context.Context, request resource.Request) (string, map[string]interface{}, error) {
+	properties := request.Properties.(DnsCertificateProperties)
+	acms, err := d.acm(properties.Region)
 	if err != nil {
 		return "", nil, err
 	}
-	switch event.RequestType {
-	case cfn.RequestDelete:
-		if !common.IsFailurePhysicalResourceId(event.PhysicalResourceID) {
-			_, err := acms.DeleteCertificateRequest(&acm.DeleteCertificateInput{
-				CertificateArn: &event.PhysicalResourceID,
-			}).Send()
-			if err != nil {
-				return event.PhysicalResourceID, nil, errors.Wrapf(err, "could not delete the certificate %s", event.PhysicalResourceID)
-			}
+	state := certificateState{CertificateArn: request.PhysicalResourceID}
+	if request.Continued() {
+		if err := request.DecodeState(&state); err != nil {
+			return request.PhysicalResourceID, nil, err
 		}
-		return event.PhysicalResourceID, nil, nil
-	case cfn.RequestCreate:
-		return createCertificate(acms, event, properties)
-	case cfn.RequestUpdate:
-		oldProperties, err := dnsCertificateProperties(event.OldResourceProperties)
-		if err != nil {
-			return event.PhysicalResourceID, nil, err
+		return d.certificateData(acms, state, properties)
+	}
+	if properties.imported() && request.Changed("CertificateParameter", "CertificateChainParameter", "PrivateKeyParameter", "KeyAlgorithm") {
+		if _, err := d.importCertificate(acms, request.PhysicalResourceID, properties); err != nil {
+			return request.PhysicalResourceID, nil, err
 		}
-		if onlyTagsChanged(event, oldProperties, properties) {
-			data, err := updateTags(acms, event, properties)
-			return event.PhysicalResourceID, data, err
-		} else {
-			return createCertificate(acms, event, properties)
+	}
+	if err := updateTags(acms, request.PhysicalResourceID, properties); err != nil {
+		return request.PhysicalResourceID, nil, err
+	}
+	if !properties.imported() && request.Changed("CertificateTransparencyLoggingPreference") {
+		if err := updateOptions(acms, request.PhysicalResourceID, properties); err != nil {
+			return request.PhysicalResourceID, nil, err
+		}
+	}
+	if request.Changed("HostedZoneId", "HostedZoneIds") {
+		if err := d.moveRecords(acms, request.PhysicalResourceID, request.OldProperties.(DnsCertificateProperties), properties); err != nil {
+			return request.PhysicalResourceID, nil, err
+		}
+	}
+	return d.certificateData(acms, state, properties)
+}
+
+func (d *dnsCertificate) Delete(ctx context.Context, request resource.Request) error {
+	properties := request.Properties.(DnsCertificateProperties)
+	acms, err := d.acm(properties.Region)
+	if err != nil {
+		return err
+	}
+	var records []validationRecord
+	if properties.managesRecords() && properties.DeleteValidationRecords == "true" {
+		if records, err = certificateRecords(acms, request.PhysicalResourceID); err != nil {
+			return err
 		}
-	default:
-		return event.PhysicalResourceID, nil, errors.Errorf("unknown request type %s", event.RequestType)
 	}
+	_, err = acms.DeleteCertificate(&acm.DeleteCertificateInput{
+		CertificateArn: &request.PhysicalResourceID,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "could not delete the certificate %s", request.PhysicalResourceID)
+	}
+	return d.deleteRecords(acms, request.PhysicalResourceID, records, properties)
+}
+
+func (d *dnsCertificate) RequiresReplacement(request resource.Request) bool {
+	oldProperties := request.OldProperties.(DnsCertificateProperties)
+	properties := request.Properties.(DnsCertificateProperties)
+	if oldProperties.imported() || properties.imported() {
+		return oldProperties.imported() != properties.imported() ||
+			!common.IsSameRegion(request.Event, oldProperties.Region, properties.Region)
+	}
+	return !onlyTagsChanged(request.Event, oldProperties, properties)
 }
 
 // ### Creation
 //
 // We create the certificate with the certificate transparency logging
-// enabled. If applicable, we add the tags to the certificate. Finally, we
-// gather the CNAME record to be exported at attributes of the resource.
-func createCertificate(acms *acm.ACM, event cfn.Event, properties DnsCertificateProperties) (string, map[string]interface{}, error) {
-	// 1. Create the certificate with certificate transparency logging enabled
-	res, err := acms.RequestCertificateRequest(&acm.RequestCertificateInput{
-		DomainName:       &properties.DomainName,
-		ValidationMethod: acm.ValidationMethodDns,
-		Options: &acm.CertificateOptions{
-			CertificateTransparencyLoggingPreference: acm.CertificateTransparencyLoggingPreferenceEnabled,
-		},
+// enabled, unless disabled by the properties, and the key algorithm of the
+// properties, if any. If applicable, we add the tags to the certificate. Finally, we gather the CNAME record to be
+// exported at attributes of the resource.
+func createCertificate(acms awsapi.ACM, event cfn.Event, properties DnsCertificateProperties) (string, error) {
+	// 1. Create the certificate
+	input := &awsapi.RequestCertificateInput{
+		DomainName:              &properties.DomainName,
+		ValidationMethod:        aws.String(string(acm.ValidationMethodDns)),
+		Options:                 certificateOptions(properties),
 		SubjectAlternativeNames: properties.SubjectAlternativeNames,
-	}).Send()
+	}
+	if properties.KeyAlgorithm != "" {
+		input.KeyAlgorithm = &properties.KeyAlgorithm
+	}
+	res, err := acms.RequestCertificate(input)
 	if err != nil {
-		return "", nil, errors.Wrap(err, "could not create the certificate")
+		return "", errors.Wrap(err, "could not create the certificate")
 	}
 
 	// 2. If applicable, create the tags
-	if len(properties.Tags) > 0 {
-		_, err = acms.AddTagsToCertificateRequest(&acm.AddTagsToCertificateInput{
-			CertificateArn: res.CertificateArn,
-			Tags:           properties.Tags,
-		}).Send()
+	return *res.CertificateArn, addTags(acms, *res.CertificateArn, properties.Tags)
+}
+
+func certificateOptions(properties DnsCertificateProperties) *acm.CertificateOptions {
+	preference := acm.CertificateTransparencyLoggingPreference(properties.CertificateTransparencyLoggingPreference)
+	if preference == "" {
+		preference = acm.CertificateTransparencyLoggingPreferenceEnabled
+	}
+	return &acm.CertificateOptions{CertificateTransparencyLoggingPreference: preference}
+}
+
+func addTags(acms awsapi.ACM, certificateArn string, tags []acm.Tag) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	_, err := acms.AddTagsToCertificate(&acm.AddTagsToCertificateInput{
+		CertificateArn: &certificateArn,
+		Tags:           tags,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "could not add tags to certificate %s", certificateArn)
+	}
+	return nil
+}
+
+// ### Import
+//
+// The certificate, its chain and its private key are read from the SSM
+// parameters. Importing into the ARN of an existing certificate replaces
+// it while keeping its ARN and tags.
+func (d *dnsCertificate) importCertificate(acms awsapi.ACM, certificateArn string, properties DnsCertificateProperties) (string, error) {
+	certificate, err := d.readParameter(properties.CertificateParameter)
+	if err != nil {
+		return certificateArn, err
+	}
+	if err := checkKeyAlgorithm(certificate, properties.KeyAlgorithm); err != nil {
+		return certificateArn, err
+	}
+	privateKey, err := d.readParameter(properties.PrivateKeyParameter)
+	if err != nil {
+		return certificateArn, err
+	}
+	input := &acm.ImportCertificateInput{
+		Certificate: []byte(certificate),
+		PrivateKey:  []byte(privateKey),
+	}
+	if properties.CertificateChainParameter != "" {
+		chain, err := d.readParameter(properties.CertificateChainParameter)
 		if err != nil {
-			return *res.CertificateArn, nil, errors.Wrapf(err, "could not add tags to certificate %s", *res.CertificateArn)
+			return certificateArn, err
 		}
+		input.CertificateChain = []byte(chain)
 	}
+	if certificateArn != "" {
+		input.CertificateArn = &certificateArn
+	}
+	res, err := acms.ImportCertificate(input)
+	if err != nil {
+		return certificateArn, errors.Wrapf(err, "could not import the certificate %s", properties.CertificateParameter)
+	}
+	return *res.CertificateArn, nil
+}
 
-	// 3. Fetch the certificate to get the domain validation information.
-	data, err := dataForResource(acms, res.CertificateArn, properties)
+func (d *dnsCertificate) readParameter(parameterName string) (string, error) {
+	decrypt := true
+	param, err := d.ssm.GetParameter(&ssm.GetParameterInput{
+		Name:           &parameterName,
+		WithDecryption: &decrypt,
+	})
 	if err != nil {
-		return *res.CertificateArn, nil, err
+		return "", errors.Wrapf(err, "could not read parameter %s", parameterName)
 	}
+	return *param.Parameter.Value, nil
+}
 
-	// 4. Construct the response to cloudformation.
-	return *res.CertificateArn, data, nil
+// The key algorithm of a certificate is named as in ACM.
+func checkKeyAlgorithm(certificatePEM, keyAlgorithm string) error {
+	if keyAlgorithm == "" {
+		return nil
+	}
+	block, _ := pem.Decode([]byte(certificatePEM))
+	if block == nil {
+		return errors.New("the certificate is not PEM encoded")
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return errors.Wrap(err, "could not parse the certificate")
+	}
+	var algorithm acm.KeyAlgorithm
+	switch key := certificate.PublicKey.(type) {
+	case *rsa.PublicKey:
+		algorithm = acm.KeyAlgorithm(fmt.Sprintf("RSA_%d", key.N.BitLen()))
+	case *ecdsa.PublicKey:
+		algorithm = map[string]acm.KeyAlgorithm{
+			"P-256": acm.KeyAlgorithmEcPrime256v1,
+			"P-384": acm.KeyAlgorithmEcSecp384r1,
+			"P-521": acm.KeyAlgorithmEcSecp521r1,
+		}[key.Curve.Params().Name]
+	}
+	if algorithm != acm.KeyAlgorithm(keyAlgorithm) {
+		return errors.Errorf("the key algorithm of the certificate is %s, not %s", algorithm, keyAlgorithm)
+	}
+	return nil
 }
 
-// Fetching for the data for the CNAME records requires a loop and waiting
-// since those are created by AWS asynchronously and added to the
-// certificate information only when they have been properly created. We
-// wait at most 3 minutes with 3 seconds interval.
-func dataForResource(acms *acm.ACM, certificateArn *string, properties DnsCertificateProperties) (map[string]interface{}, error) {
-OUTER:
-	for i := 0; i < 60; i++ {
-		cert, err := acms.DescribeCertificateRequest(&acm.DescribeCertificateInput{
-			CertificateArn: certificateArn,
-		}).Send()
-		if err != nil {
-			return nil, errors.Wrapf(err, "could not fetch certificate %s", *certificateArn)
-		}
-		fmt.Printf("Attempt %d: %+v\n", i, cert)
-		options := cert.Certificate.DomainValidationOptions
-		if options != nil && len(options) == len(properties.SubjectAlternativeNames)+1 {
-			data := make(map[string]interface{}, 2*len(options))
-			data["Arn"] = *certificateArn
-			for _, option := range options {
-				if option.ResourceRecord == nil {
-					time.Sleep(3 * time.Second)
-					continue OUTER
-				}
-				domainName := *option.DomainName
-				data[domainName+"-RecordName"] = *option.ResourceRecord.Name
-				data[domainName+"-RecordValue"] = *option.ResourceRecord.Value
-			}
-			return data, nil
+// The CNAME records are created by AWS asynchronously and added to the
+// certificate information only when they have been properly created. As
+// long as they are missing, or the certificate is not issued if we must
+// wait for it, the operation continues in a new invocation. The records
+// are upserted in the hosted zones once they are available.
+func (d *dnsCertificate) certificateData(acms awsapi.ACM, state certificateState, properties DnsCertificateProperties) (string, map[string]interface{}, error) {
+	certificateArn := state.CertificateArn
+	cert, err := acms.DescribeCertificate(&acm.DescribeCertificateInput{
+		CertificateArn: &certificateArn,
+	})
+	if err != nil {
+		return certificateArn, nil, errors.Wrapf(err, "could not fetch certificate %s", certificateArn)
+	}
+	if properties.imported() {
+		return certificateArn, map[string]interface{}{"Arn": certificateArn}, nil
+	}
+	options := cert.Certificate.DomainValidationOptions
+	if len(options) != len(properties.SubjectAlternativeNames)+1 {
+		return certificateArn, nil, resource.InProgress(state, 3*time.Second)
+	}
+	data := make(map[string]interface{}, 2*len(options)+1)
+	data["Arn"] = certificateArn
+	for _, option := range options {
+		if option.ResourceRecord == nil {
+			return certificateArn, nil, resource.InProgress(state, 3*time.Second)
+		}
+		domainName := *option.DomainName
+		data[domainName+"-RecordName"] = *option.ResourceRecord.Name
+		data[domainName+"-RecordValue"] = *option.ResourceRecord.Value
+	}
+	if properties.managesRecords() && !state.RecordsUpserted {
+		if err := d.upsertRecords(validationRecords(options), properties); err != nil {
+			return certificateArn, nil, err
+		}
+		state.RecordsUpserted = true
+	}
+	if properties.WaitForIssued == "true" {
+		switch cert.Certificate.Status {
+		case acm.CertificateStatusIssued:
+		case acm.CertificateStatusPendingValidation:
+			return certificateArn, nil, resource.InProgress(state, 30*time.Second)
+		default:
+			return certificateArn, nil, errors.Errorf("certificate %s will not be issued, its status is %s", certificateArn, cert.Certificate.Status)
 		}
-		time.Sleep(time.Second)
 	}
-	return nil, errors.Errorf("no DNS entries for certificate %s", *certificateArn)
+	return certificateArn, data, nil
 }
 
 // ### Update
 //
-// As explained above, we update if and only if the tags are the only
-// properties to have changed. For this purpose, we check the equality of
-// all the other properties. `SubjectAlternativeNames` is considered a set.
+// As explained above, we update if and only if the tags, the hosted zones,
+// the certificate transparency logging preference or `WaitForIssued` are
+// the only properties to have changed. For this
+// purpose, we check the equality of all the other properties.
+// `SubjectAlternativeNames` is considered a set.
 //
 // Note that we do not test the tags themselves: it is not necessary as
 // cloudformation sends an update request only if at least one property has
@@ -321,6 +732,7 @@ OUTER:
 func onlyTagsChanged(event cfn.Event, oldProperties, properties DnsCertificateProperties) bool {
 	return properties.DomainName == oldProperties.DomainName &&
 		common.IsSameRegion(event, oldProperties.Region, properties.Region) &&
+		properties.requestedKeyAlgorithm() == oldProperties.requestedKeyAlgorithm() &&
 		sameSubjectAlternativeNames(properties.SubjectAlternativeNames, oldProperties.SubjectAlternativeNames)
 }
 
@@ -347,40 +759,308 @@ func sameSubjectAlternativeNames(san1, san2 []string) bool {
 	return true
 }
 
-// Updating is quite straightforward: we delete all the tags before
-// recreating them. We must gather the CNAME records to send as attribute
-// to the response.
-func updateTags(acms *acm.ACM, event cfn.Event, properties DnsCertificateProperties) (map[string]interface{}, error) {
+// Only the tags that have changed are updated: the tags whose key is no
+// longer present are removed before the new and modified tags are added.
+// The certificate is thus never untagged.
+func updateTags(acms awsapi.ACM, certificateArn string, properties DnsCertificateProperties) error {
 	// 1. we first fetch the tags.
-	tags, err := acms.ListTagsForCertificateRequest(&acm.ListTagsForCertificateInput{
-		CertificateArn: &event.PhysicalResourceID,
-	}).Send()
+	tags, err := acms.ListTagsForCertificate(&acm.ListTagsForCertificateInput{
+		CertificateArn: &certificateArn,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "could not list tags for certificate %s", certificateArn)
+	}
+	// 2. we compute the differences.
+	existing := make(map[string]string, len(tags.Tags))
+	for _, tag := range tags.Tags {
+		existing[*tag.Key] = aws.StringValue(tag.Value)
+	}
+	var added []acm.Tag
+	for _, tag := range properties.Tags {
+		if value, ok := existing[*tag.Key]; !ok || value != aws.StringValue(tag.Value) {
+			added = append(added, tag)
+		}
+		delete(existing, *tag.Key)
+	}
+	var removed []acm.Tag
+	for _, tag := range tags.Tags {
+		if _, ok := existing[*tag.Key]; ok {
+			removed = append(removed, tag)
+		}
+	}
+	// 3. we remove the old tags.
+	if len(removed) > 0 {
+		_, err = acms.RemoveTagsFromCertificate(&acm.RemoveTagsFromCertificateInput{
+			CertificateArn: &certificateArn,
+			Tags:           removed,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "could not remove tags for certificate %s", certificateArn)
+		}
+	}
+	// 4. we add the new and modified tags.
+	return addTags(acms, certificateArn, added)
+}
+
+func updateOptions(acms awsapi.ACM, certificateArn string, properties DnsCertificateProperties) error {
+	_, err := acms.UpdateCertificateOptions(&acm.UpdateCertificateOptionsInput{
+		CertificateArn: &certificateArn,
+		Options:        certificateOptions(properties),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "could not update the options of the certificate %s", certificateArn)
+	}
+	return nil
+}
+
+// ### Validation records
+//
+// ACM uses the same validation record for a domain and its wildcard
+// domain; the records of a certificate are therefore deduplicated by name.
+type validationRecord struct {
+	DomainName, Name, Value string
+}
+
+// recordTTL is the TTL of the validation records created by the resource.
+const recordTTL = 300
+
+func validationRecords(options []acm.DomainValidation) []validationRecord {
+	seen := make(map[string]bool, len(options))
+	var records []validationRecord
+	for _, option := range options {
+		if option.ResourceRecord == nil {
+			continue
+		}
+		name := recordName(*option.ResourceRecord.Name)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		records = append(records, validationRecord{
+			DomainName: *option.DomainName,
+			Name:       *option.ResourceRecord.Name,
+			Value:      *option.ResourceRecord.Value,
+		})
+	}
+	return records
+}
+
+func certificateRecords(acms awsapi.ACM, certificateArn string) ([]validationRecord, error) {
+	var cert *acm.DescribeCertificateOutput
+	err := retryThrottled(func() (err error) {
+		cert, err = acms.DescribeCertificate(&acm.DescribeCertificateInput{
+			CertificateArn: &certificateArn,
+		})
+		return err
+	})
 	if err != nil {
-		return nil, errors.Wrapf(err, "could not list tags for certificate %s", event.PhysicalResourceID)
+		return nil, errors.Wrapf(err, "could not fetch certificate %s", certificateArn)
+	}
+	return validationRecords(cert.Certificate.DomainValidationOptions), nil
+}
+
+func (r validationRecord) recordSet() *route53.ResourceRecordSet {
+	ttl := int64(recordTTL)
+	return &route53.ResourceRecordSet{
+		Name:            &r.Name,
+		Type:            route53.RRTypeCname,
+		TTL:             &ttl,
+		ResourceRecords: []route53.ResourceRecord{{Value: &r.Value}},
+	}
+}
+
+// DNS names are compared in lower case and without the trailing dot.
+func recordName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func (properties DnsCertificateProperties) managesRecords() bool {
+	return properties.HostedZoneId != "" || len(properties.HostedZoneIds) > 0
+}
+
+// The hosted zone of a domain is the one of the longest matching domain in
+// `HostedZoneIds` or, if none matches, `HostedZoneId`.
+func (properties DnsCertificateProperties) hostedZone(domainName string) (string, error) {
+	domain := recordName(domainName)
+	zone, length := properties.HostedZoneId, -1
+	for name, id := range properties.HostedZoneIds {
+		name = recordName(name)
+		if (domain == name || strings.HasSuffix(domain, "."+name)) && len(name) > length {
+			zone, length = id, len(name)
+		}
+	}
+	if zone == "" {
+		return "", errors.Errorf("no hosted zone for the domain %s", domainName)
+	}
+	return zone, nil
+}
+
+func (d *dnsCertificate) upsertRecords(records []validationRecord, properties DnsCertificateProperties) error {
+	changes := make(map[string][]route53.Change)
+	for _, record := range records {
+		zone, err := properties.hostedZone(record.DomainName)
+		if err != nil {
+			return err
+		}
+		changes[zone] = append(changes[zone], route53.Change{
+			Action:            route53.ChangeActionUpsert,
+			ResourceRecordSet: record.recordSet(),
+		})
+	}
+	return d.changeRecords(changes)
+}
+
+// When the hosted zones change and the deletion of the records is
+// enabled, the records are deleted from the zones they move out of. They
+// are then upserted in their new zones like on creation.
+func (d *dnsCertificate) moveRecords(acms awsapi.ACM, certificateArn string, oldProperties, properties DnsCertificateProperties) error {
+	if !oldProperties.managesRecords() || properties.DeleteValidationRecords != "true" {
+		return nil
 	}
-	// 2. we remove them all.
-	_, err = acms.RemoveTagsFromCertificateRequest(&acm.RemoveTagsFromCertificateInput{
-		CertificateArn: &event.PhysicalResourceID,
-		Tags:           tags.Tags,
-	}).Send()
+	records, err := certificateRecords(acms, certificateArn)
 	if err != nil {
-		return nil, errors.Wrapf(err, "could not remove tags for certificate %s", event.PhysicalResourceID)
+		return err
+	}
+	var moved []validationRecord
+	for _, record := range records {
+		oldZone, err := oldProperties.hostedZone(record.DomainName)
+		if err != nil {
+			continue
+		}
+		if zone, _ := properties.hostedZone(record.DomainName); zone != oldZone {
+			moved = append(moved, record)
+		}
+	}
+	return d.deleteRecords(acms, certificateArn, moved, oldProperties)
+}
+
+// The validation record of a domain is the same for all the certificates
+// of the account: we only delete the records that no other certificate
+// of the region uses. As the record may have been changed outside of the resource, the
+// record set to delete is fetched from its zone.
+func (d *dnsCertificate) deleteRecords(acms awsapi.ACM, certificateArn string, records []validationRecord, properties DnsCertificateProperties) error {
+	if len(records) == 0 {
+		return nil
 	}
-	// 3. we create the new tags.
-	_, err = acms.AddTagsToCertificateRequest(&acm.AddTagsToCertificateInput{
-		CertificateArn: &event.PhysicalResourceID,
-		Tags:           properties.Tags,
-	}).Send()
+	used, err := usedRecords(acms, certificateArn)
 	if err != nil {
-		return nil, errors.Wrapf(err, "could not add tags for certificate %s", event.PhysicalResourceID)
+		return err
+	}
+	changes := make(map[string][]route53.Change)
+	for _, record := range records {
+		if used[recordName(record.Name)] {
+			continue
+		}
+		zone, err := properties.hostedZone(record.DomainName)
+		if err != nil {
+			return err
+		}
+		set, err := d.recordSet(zone, record.Name)
+		if err != nil {
+			return err
+		}
+		if set != nil {
+			changes[zone] = append(changes[zone], route53.Change{
+				Action:            route53.ChangeActionDelete,
+				ResourceRecordSet: set,
+			})
+		}
+	}
+	return d.changeRecords(changes)
+}
+
+// usedRecords collects the names of the validation records of the
+// certificates, except the given one, that may still need them.
+func usedRecords(acms awsapi.ACM, certificateArn string) (map[string]bool, error) {
+	used := make(map[string]bool)
+	input := &acm.ListCertificatesInput{
+		CertificateStatuses: []acm.CertificateStatus{acm.CertificateStatusPendingValidation, acm.CertificateStatusIssued},
+	}
+	for {
+		var certificates *acm.ListCertificatesOutput
+		err := retryThrottled(func() (err error) {
+			certificates, err = acms.ListCertificates(input)
+			return err
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "could not list the certificates")
+		}
+		for _, summary := range certificates.CertificateSummaryList {
+			if *summary.CertificateArn == certificateArn {
+				continue
+			}
+			records, err := certificateRecords(acms, *summary.CertificateArn)
+			if err != nil {
+				return nil, err
+			}
+			for _, record := range records {
+				used[recordName(record.Name)] = true
+			}
+		}
+		if certificates.NextToken == nil {
+			return used, nil
+		}
+		input.NextToken = certificates.NextToken
 	}
-	// 4. we gather the data.
-	data, err := dataForResource(acms, &event.PhysicalResourceID, properties)
+}
+
+// ACM has low rate limits; checking the records used by the other
+// certificates makes a call per certificate. The throttled calls are
+// retried with an exponential backoff.
+const throttledAttempts = 5
+
+var throttledBackoff = 500 * time.Millisecond
+
+func retryThrottled(call func() error) error {
+	backoff := throttledBackoff
+	for attempt := 1; ; attempt++ {
+		err := call()
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != "ThrottlingException" || attempt == throttledAttempts {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (d *dnsCertificate) recordSet(zone, name string) (*route53.ResourceRecordSet, error) {
+	max := "1"
+	sets, err := d.route53.ListResourceRecordSets(&route53.ListResourceRecordSetsInput{
+		HostedZoneId:    &zone,
+		StartRecordName: &name,
+		StartRecordType: route53.RRTypeCname,
+		MaxItems:        &max,
+	})
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrapf(err, "could not fetch the record %s from the hosted zone %s", name, zone)
+	}
+	for _, set := range sets.ResourceRecordSets {
+		if set.Type == route53.RRTypeCname && recordName(*set.Name) == recordName(name) {
+			return &set, nil
+		}
+	}
+	return nil, nil
+}
+
+// The changes are applied zone by zone, in a stable order.
+func (d *dnsCertificate) changeRecords(changes map[string][]route53.Change) error {
+	zones := make([]string, 0, len(changes))
+	for zone := range changes {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	for _, zone := range zones {
+		zone := zone
+		_, err := d.route53.ChangeResourceRecordSets(&route53.ChangeResourceRecordSetsInput{
+			HostedZoneId: &zone,
+			ChangeBatch:  &route53.ChangeBatch{Changes: changes[zone]},
+		})
+		if err != nil {
+			return errors.Wrapf(err, "could not change the validation records in the hosted zone %s", zone)
+		}
 	}
-	// 5. finally, we send back the response.
-	return data, nil
+	return nil
 }
 
 // ### SDK client
@@ -389,13 +1069,13 @@ func updateTags(acms *acm.ACM, event cfn.Event, properties DnsCertificatePropert
 // [ACM sdk v2](https://github.com/aws/aws-sdk-go-v2/tree/master/service/acm)
 // to create the certificate. The client is created with the default
 // credential chain loader, if need be with the supplied region.
-func acmService(properties DnsCertificateProperties) (*acm.ACM, error) {
+func acmService(region string) (awsapi.ACM, error) {
 	var cfg aws.Config
 	var err error
-	if len(properties.Region) > 0 {
-		cfg, err = external.LoadDefaultAWSConfig(external.WithRegion(properties.Region))
+	if len(region) > 0 {
+		cfg, err = external.LoadDefaultAWSConfig(external.WithRegion(region))
 		if err != nil {
-			return nil, errors.Wrapf(err, "could not load config with region %s", properties.Region)
+			return nil, errors.Wrapf(err, "could not load config with region %s", region)
 		}
 	} else {
 		cfg, err = external.LoadDefaultAWSConfig()
@@ -403,5 +1083,5 @@ func acmService(properties DnsCertificateProperties) (*acm.ACM, error) {
 			return nil, errors.Wrap(err, "could not load default config")
 		}
 	}
-	return acm.New(cfg), nil
+	return awsapi.NewACM(acm.New(cfg)), nil
 }
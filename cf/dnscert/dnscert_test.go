@@ -1,12 +1,26 @@
 package main
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awsapi"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awstest"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/resource"
 	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/pkg/errors"
 	"io/ioutil"
+	"math/big"
 	"testing"
+	"time"
 )
 
 func TestDnsCertificatePropertiesWithRegion(t *testing.T) {
@@ -113,6 +127,15 @@ func TestOnlyTagsChangedCompleteness(t *testing.T) {
 			SubjectAlternativeNames: []string{"hello2.test.com", "hello1.test.com"},
 			Tags: []acm.Tag{tag("key", "value2")},
 		}},
+		// test 4
+		{DnsCertificateProperties{
+			DomainName: "test.com",
+			Region:     "us-east-1",
+		}, DnsCertificateProperties{
+			DomainName:   "test.com",
+			Region:       "us-east-1",
+			KeyAlgorithm: "EC_prime256v1",
+		}},
 	} {
 		if onlyTagsChanged(cfn.Event{}, test.prop1, test.prop2) {
 			t.Errorf("TestOnlyTagsChangedCompleteness %d, %+v, %+v", i, test.prop1, test.prop2)
@@ -123,3 +146,399 @@ func TestOnlyTagsChangedCompleteness(t *testing.T) {
 func tag(key string, val string) acm.Tag {
 	return acm.Tag{Key: &key, Value: &val}
 }
+
+func TestDnsCertificate(t *testing.T) {
+	const arn = "arn:aws:acm:eu-west-1:123456789012:certificate/1"
+	properties := func(domainName string, tags ...interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"DomainName":              domainName,
+			"Region":                  "eu-west-1",
+			"SubjectAlternativeNames": []interface{}{"www." + domainName},
+			"Tags":                    tags,
+		}
+	}
+	tag1 := map[string]interface{}{"Key": "key", "Value": "value1"}
+	tag2 := map[string]interface{}{"Key": "key", "Value": "value2"}
+	for i, test := range []struct {
+		event        cfn.Event
+		existing     bool
+		issued       bool
+		continued    bool
+		failures     awstest.Failures
+		id           string
+		fails        bool
+		certificates int
+		tags         []acm.Tag
+	}{
+		// test 0: create with tags and validation records
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties("test.com", tag1)},
+			id: arn, certificates: 1, tags: []acm.Tag{tag("key", "value1")}},
+		// test 1: failed creation
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Cert", ResourceProperties: properties("test.com")},
+			failures: awstest.Failures{"RequestCertificate": errors.New("boom")}, id: "failure-Cert", fails: true},
+		// test 2: failed tagging keeps the id of the certificate
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties("test.com", tag1)},
+			failures: awstest.Failures{"AddTagsToCertificate": errors.New("boom")}, id: arn, fails: true, certificates: 1},
+		// test 3: update of the tags only
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: arn,
+			ResourceProperties:    properties("test.com", tag2),
+			OldResourceProperties: properties("test.com", tag1)},
+			existing: true, id: arn, certificates: 1, tags: []acm.Tag{tag("key", "value2")}},
+		// test 4: update of the domain creates a new certificate
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: arn,
+			ResourceProperties:    properties("other.com", tag1),
+			OldResourceProperties: properties("test.com", tag1)},
+			existing: true, id: "arn:aws:acm:eu-west-1:123456789012:certificate/2", certificates: 2, tags: []acm.Tag{tag("key", "value1")}},
+		// test 5: delete
+		{event: cfn.Event{RequestType: cfn.RequestDelete, PhysicalResourceID: arn, ResourceProperties: properties("test.com", tag1)},
+			existing: true, id: arn},
+		// test 6: failed delete
+		{event: cfn.Event{RequestType: cfn.RequestDelete, PhysicalResourceID: arn, ResourceProperties: properties("test.com", tag1)},
+			existing: true, failures: awstest.Failures{"DeleteCertificate": errors.New("boom")}, id: arn, fails: true, certificates: 1},
+		// test 7: waiting for the certificate to be issued continues the operation
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: waitForIssued(properties("test.com", tag1))},
+			id: arn, fails: true, certificates: 1},
+		// test 8: the continuation completes once the certificate is issued
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: waitForIssued(properties("test.com", tag1))},
+			existing: true, issued: true, continued: true, id: arn, certificates: 1, tags: []acm.Tag{tag("key", "value1")}},
+	} {
+		acms := awstest.NewACM("eu-west-1")
+		certificate := &dnsCertificate{acm: func(region string) (awsapi.ACM, error) {
+			if region != acms.Region {
+				return nil, errors.Errorf("unexpected region %s", region)
+			}
+			return acms, nil
+		}}
+		handler := resource.Handler(resource.Properties(DnsCertificateProperties{}), certificate)
+		if test.existing {
+			if _, _, err := handler(context.Background(), cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties("test.com", tag1)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if test.issued {
+			acms.Certificates[arn].Status = acm.CertificateStatusIssued
+		}
+		acms.Failures = test.failures
+		ctx := context.Background()
+		if test.continued {
+			ctx = resource.WithContinuation(ctx, &resource.Continuation{State: json.RawMessage(`{"CertificateArn":"` + arn + `"}`), Attempt: 1})
+		}
+		id, data, err := handler(ctx, test.event)
+		if test.fails && !test.continued && test.event.ResourceProperties["WaitForIssued"] != nil {
+			if _, ok := errors.Cause(err).(*resource.InProgressError); !ok {
+				t.Errorf("test %d: expecting the operation in progress got %v", i, err)
+			}
+		}
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if id != test.id {
+			t.Errorf("test %d: expecting id %s got %s", i, test.id, id)
+		}
+		if len(acms.Certificates) != test.certificates {
+			t.Errorf("test %d: expecting %d certificates got %d", i, test.certificates, len(acms.Certificates))
+		}
+		if test.tags != nil {
+			tags := acms.Tags[id]
+			if len(tags) != len(test.tags) || *tags[0].Value != *test.tags[0].Value {
+				t.Errorf("test %d: expecting tags %v got %v", i, test.tags, tags)
+			}
+			domainName := test.event.ResourceProperties["DomainName"].(string)
+			if data["Arn"] != id || data["www."+domainName+"-RecordName"] == nil {
+				t.Errorf("test %d: missing attributes in %v", i, data)
+			}
+		}
+	}
+}
+
+func waitForIssued(properties map[string]interface{}) map[string]interface{} {
+	properties["WaitForIssued"] = "true"
+	return properties
+}
+
+func keepRecords(properties map[string]interface{}) map[string]interface{} {
+	delete(properties, "DeleteValidationRecords")
+	return properties
+}
+
+func TestDnsCertificateRecords(t *testing.T) {
+	const arn = "arn:aws:acm:eu-west-1:123456789012:certificate/1"
+	properties := func(domainName string, zones interface{}, sans ...interface{}) map[string]interface{} {
+		p := map[string]interface{}{
+			"DeleteValidationRecords": "true",
+			"DomainName":              domainName,
+			"Region":                  "eu-west-1",
+			"SubjectAlternativeNames": sans,
+		}
+		switch zones := zones.(type) {
+		case string:
+			p["HostedZoneId"] = zones
+		case map[string]interface{}:
+			p["HostedZoneIds"] = zones
+		}
+		return p
+	}
+	for i, test := range []struct {
+		existing []map[string]interface{}
+		event    cfn.Event
+		id       string
+		fails    bool
+		records  map[string]int
+	}{
+		// test 0: the records shared by the wildcard are created once
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties("test.com", "Z1", "*.test.com", "www.test.com")},
+			id: arn, records: map[string]int{"Z1": 2}},
+		// test 1: the records are created in the zone of their domain
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties("test.com", map[string]interface{}{"test.com": "Z1", "www.test.com": "Z2"}, "www.test.com")},
+			id: arn, records: map[string]int{"Z1": 1, "Z2": 1}},
+		// test 2: a domain without zone fails the creation
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties("test.com", map[string]interface{}{"other.com": "Z2"})},
+			id: arn, fails: true, records: map[string]int{}},
+		// test 3: the records are deleted with the certificate
+		{existing: []map[string]interface{}{properties("test.com", "Z1", "www.test.com")},
+			event: cfn.Event{RequestType: cfn.RequestDelete, PhysicalResourceID: arn, ResourceProperties: properties("test.com", "Z1", "www.test.com")},
+			id: arn, records: map[string]int{}},
+		// test 4: the records used by another certificate are kept
+		{existing: []map[string]interface{}{properties("test.com", "Z1", "www.test.com"), properties("test.com", "Z1")},
+			event: cfn.Event{RequestType: cfn.RequestDelete, PhysicalResourceID: arn, ResourceProperties: properties("test.com", "Z1", "www.test.com")},
+			id: arn, records: map[string]int{"Z1": 1}},
+		// test 5: changing the zone moves the records
+		{existing: []map[string]interface{}{properties("test.com", "Z1", "www.test.com")},
+			event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: arn,
+				ResourceProperties:    properties("test.com", "Z2", "www.test.com"),
+				OldResourceProperties: properties("test.com", "Z1", "www.test.com")},
+			id: arn, records: map[string]int{"Z2": 2}},
+		// test 6: the records are created before waiting for the certificate
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: waitForIssued(properties("test.com", "Z1"))},
+			id: arn, fails: true, records: map[string]int{"Z1": 1}},
+		// test 7: the records are kept by default
+		{existing: []map[string]interface{}{properties("test.com", "Z1", "www.test.com")},
+			event: cfn.Event{RequestType: cfn.RequestDelete, PhysicalResourceID: arn, ResourceProperties: keepRecords(properties("test.com", "Z1", "www.test.com"))},
+			id: arn, records: map[string]int{"Z1": 2}},
+		// test 8: changing the zone keeps the records in the former zone by default
+		{existing: []map[string]interface{}{properties("test.com", "Z1", "www.test.com")},
+			event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: arn,
+				ResourceProperties:    keepRecords(properties("test.com", "Z2", "www.test.com")),
+				OldResourceProperties: properties("test.com", "Z1", "www.test.com")},
+			id: arn, records: map[string]int{"Z1": 2, "Z2": 2}},
+	} {
+		acms := awstest.NewACM("eu-west-1")
+		route53 := awstest.NewRoute53()
+		route53.PutZone("Z1")
+		route53.PutZone("Z2")
+		certificate := &dnsCertificate{
+			acm:     func(region string) (awsapi.ACM, error) { return acms, nil },
+			route53: route53,
+		}
+		handler := resource.Handler(resource.Properties(DnsCertificateProperties{}), certificate)
+		for _, properties := range test.existing {
+			if _, _, err := handler(context.Background(), cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		id, _, err := handler(context.Background(), test.event)
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if id != test.id {
+			t.Errorf("test %d: expecting id %s got %s", i, test.id, id)
+		}
+		for zone, records := range route53.Zones {
+			if len(records) != test.records[zone] {
+				t.Errorf("test %d: expecting %d records in %s got %v", i, test.records[zone], zone, records)
+			}
+		}
+	}
+}
+
+func TestDnsCertificateKeyAlgorithm(t *testing.T) {
+	const arn = "arn:aws:acm:eu-west-1:123456789012:certificate/1"
+	for i, test := range []struct {
+		keyAlgorithm string
+		fails        bool
+		expected     acm.KeyAlgorithm
+	}{
+		// test 0: the default algorithm
+		{expected: acm.KeyAlgorithmRsa2048},
+		// test 1: an elliptic curve key
+		{keyAlgorithm: "EC_prime256v1", expected: acm.KeyAlgorithmEcPrime256v1},
+		// test 2: an algorithm that ACM does not issue
+		{keyAlgorithm: "EC_secp521r1", fails: true},
+	} {
+		acms := awstest.NewACM("eu-west-1")
+		certificate := &dnsCertificate{acm: func(region string) (awsapi.ACM, error) { return acms, nil }}
+		handler := resource.Handler(resource.Properties(DnsCertificateProperties{}), certificate)
+		_, _, err := handler(context.Background(), cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Cert", ResourceProperties: map[string]interface{}{
+			"DomainName":   "test.com",
+			"Region":       "eu-west-1",
+			"KeyAlgorithm": test.keyAlgorithm,
+		}})
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if test.fails {
+			continue
+		}
+		if cert, ok := acms.Certificates[arn]; !ok || cert.KeyAlgorithm != test.expected {
+			t.Errorf("test %d: expecting a certificate with the key algorithm %s got %+v", i, test.expected, cert)
+		}
+	}
+}
+
+func TestDnsCertificateImport(t *testing.T) {
+	const arn = "arn:aws:acm:eu-west-1:123456789012:certificate/1"
+	properties := func(certificate, keyAlgorithm string) map[string]interface{} {
+		return map[string]interface{}{
+			"CertificateParameter": certificate,
+			"PrivateKeyParameter":  "/hyperdrive/dnscert/test/key",
+			"KeyAlgorithm":         keyAlgorithm,
+			"Region":               "eu-west-1",
+			"Tags":                 []interface{}{map[string]interface{}{"Key": "key", "Value": "value"}},
+		}
+	}
+	for i, test := range []struct {
+		existing    bool
+		event       cfn.Event
+		id          string
+		fails       bool
+		certificate string
+	}{
+		// test 0: import with tags
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties("/hyperdrive/dnscert/test/certificate", "")},
+			id: arn, certificate: "test.com"},
+		// test 1: import with the key algorithm of the certificate
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties("/hyperdrive/dnscert/test/certificate", "EC_prime256v1")},
+			id: arn, certificate: "test.com"},
+		// test 2: import with another key algorithm
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Cert", ResourceProperties: properties("/hyperdrive/dnscert/test/certificate", "RSA_2048")},
+			id: "failure-Cert", fails: true},
+		// test 3: the private key is required
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Cert", ResourceProperties: map[string]interface{}{"CertificateParameter": "/hyperdrive/dnscert/test/certificate"}},
+			id: "failure-Cert", fails: true},
+		// test 4: a new certificate is imported in place
+		{existing: true, event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: arn,
+			ResourceProperties:    properties("/hyperdrive/dnscert/test/renewed", ""),
+			OldResourceProperties: properties("/hyperdrive/dnscert/test/certificate", "")},
+			id: arn, certificate: "renewed.test.com"},
+		// test 5: requesting a certificate instead replaces the resource
+		{existing: true, event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: arn,
+			ResourceProperties:    map[string]interface{}{"DomainName": "test.com", "Region": "eu-west-1"},
+			OldResourceProperties: properties("/hyperdrive/dnscert/test/certificate", "")},
+			id: "arn:aws:acm:eu-west-1:123456789012:certificate/2"},
+	} {
+		acms := awstest.NewACM("eu-west-1")
+		ssm := awstest.NewSSM()
+		ssm.PutString("/hyperdrive/dnscert/test/certificate", selfSigned(t, "test.com"))
+		ssm.PutString("/hyperdrive/dnscert/test/renewed", selfSigned(t, "renewed.test.com"))
+		ssm.PutString("/hyperdrive/dnscert/test/key", "key")
+		certificate := &dnsCertificate{
+			acm: func(region string) (awsapi.ACM, error) { return acms, nil },
+			ssm: ssm,
+		}
+		handler := resource.Handler(resource.Properties(DnsCertificateProperties{}), certificate)
+		if test.existing {
+			if _, _, err := handler(context.Background(), cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties("/hyperdrive/dnscert/test/certificate", "")}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		id, data, err := handler(context.Background(), test.event)
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if id != test.id {
+			t.Errorf("test %d: expecting id %s got %s", i, test.id, id)
+		}
+		if test.certificate != "" {
+			if acms.Imported[id] != selfSigned(t, test.certificate) {
+				t.Errorf("test %d: expecting the certificate for %s", i, test.certificate)
+			}
+			if len(data) != 1 || data["Arn"] != id {
+				t.Errorf("test %d: unexpected attributes %v", i, data)
+			}
+			if tags := acms.Tags[id]; len(tags) != 1 {
+				t.Errorf("test %d: unexpected tags %v", i, tags)
+			}
+		}
+	}
+}
+
+func TestUpdateTags(t *testing.T) {
+	const arn = "arn:aws:acm:eu-west-1:123456789012:certificate/1"
+	acms := awstest.NewACM("eu-west-1")
+	if _, err := acms.RequestCertificate(&awsapi.RequestCertificateInput{DomainName: aws.String("test.com")}); err != nil {
+		t.Fatal(err)
+	}
+	acms.Tags[arn] = []acm.Tag{tag("a", "1"), tag("b", "2")}
+	if err := updateTags(acms, arn, DnsCertificateProperties{Tags: []acm.Tag{tag("a", "1"), tag("b", "3"), tag("c", "4")}}); err != nil {
+		t.Fatal(err)
+	}
+	if acms.Called("RemoveTagsFromCertificate") != 0 || acms.Called("AddTagsToCertificate") != 1 {
+		t.Error("only the modified and new tags must be added")
+	}
+	if err := updateTags(acms, arn, DnsCertificateProperties{Tags: []acm.Tag{tag("b", "3")}}); err != nil {
+		t.Fatal(err)
+	}
+	if acms.Called("RemoveTagsFromCertificate") != 1 || acms.Called("AddTagsToCertificate") != 1 {
+		t.Error("only the old tags must be removed")
+	}
+	if tags := acms.Tags[arn]; len(tags) != 1 || *tags[0].Key != "b" || *tags[0].Value != "3" {
+		t.Errorf("unexpected tags %v", tags)
+	}
+}
+
+var certificates = make(map[string]string)
+
+// selfSigned creates a PEM encoded self-signed certificate with an EC key
+// for the domain, once per domain.
+func selfSigned(t *testing.T, domainName string) string {
+	if certificate, ok := certificates[domainName]; ok {
+		return certificate
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domainName},
+		DNSNames:     []string{domainName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificates[domainName] = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	return certificates[domainName]
+}
+
+func TestRetryThrottled(t *testing.T) {
+	throttledBackoff = time.Millisecond
+	for i, test := range []struct {
+		failure error
+		calls   int
+	}{
+		// test 0: no failure
+		{calls: 1},
+		// test 1: the throttled calls are retried
+		{failure: awstest.NotFound("ThrottlingException", "rate exceeded"), calls: throttledAttempts},
+		// test 2: the other failures are not retried
+		{failure: awstest.NotFound("ResourceNotFoundException", "not found"), calls: 1},
+	} {
+		acms := awstest.NewACM("eu-west-1")
+		domainName := "test.com"
+		certificate, err := acms.RequestCertificate(&awsapi.RequestCertificateInput{DomainName: &domainName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		acms.Failures = awstest.Failures{"DescribeCertificate": test.failure}
+		_, err = certificateRecords(acms, *certificate.CertificateArn)
+		if (err != nil) != (test.failure != nil) {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if calls := acms.Called("DescribeCertificate"); calls != test.calls {
+			t.Errorf("test %d: expecting %d calls got %d", i, test.calls, calls)
+		}
+	}
+}
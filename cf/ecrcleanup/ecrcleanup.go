@@ -9,7 +9,27 @@
 // lived ECR repository when one wants to quickly create and delete ECR repositories.
 //
 // It is not dangerouse to delete the resource itself when updating the stack as the `ecrcleanup` custom resource only
-// cleanup the content when the stack is getting deleted.
+// cleanup the content when the stack is getting deleted. As for the `s3cleanup` resource, the flag
+// "ActiveOnlyOnStackDeletion" set to false makes the resource delete the images whenever it is deleted.
+// The lifecycles of the stack in which the images are deleted, by default the deletion of the stack and the
+// rollback of its creation, can be chosen with "CleanupLifecycles".
+//
+// Instead of deleting all the images, the resource can apply retention rules, e.g. for a long lived
+// repository of a build pipeline. The rules are applied when the resource is created or updated as well as
+// when it is deleted:
+//
+// 1. the images with a tag matching one of the `KeepTagPatterns` are kept;
+// 2. of the other images, the `KeepLast` most recently pushed are kept;
+// 3. the untagged images pushed more than `UntaggedOlderThanDays` days ago are deleted;
+// 4. if `KeepLast` or `KeepTagPatterns` is defined, all the other images are deleted as well.
+//
+// To apply the rules again, e.g. after each build, change a property of the resource, like a build number
+// in `Trigger`.
+//
+// The repository may be in another region or, given a repository policy allowing it, in another account,
+// e.g. the target of a replication. With the flag "DeleteRepository", the resource force-deletes the
+// repository itself with all its images instead of only cleaning it, e.g. for the replicated repositories
+// that cloudformation does not manage.
 //
 // ## Syntax
 //
@@ -23,11 +43,103 @@
 //     ServiceToken:
 //       Fn::ImportValue:
 //         !Sub ${HyperdriveCore}-EcrCleanup
+//     ActiveOnlyOnStackDeletion: <true|false>
+//     CleanupLifecycles:
+//     - <Delete|CreateRollback|Replacement|UpdateCleanup|UpdateRollback|Other>
+//     - ...
+//     DeleteRepository: <true|false>
+//     KeepLast: <number of images>
+//     KeepTagPatterns:
+//     - <glob pattern>
+//     - ...
+//     Region: <region of the repository>
+//     RegistryId: <account id of the registry>
 //     Repository: <repository name>
+//     Trigger: <any value>
+//     UntaggedOlderThanDays: <days>
 // ```
 //
 // ## Properties
 //
+// `ActiveOnlyOnStackDeletion`
+//
+// > If the flag is true, the default, the resource deletes images on deletion if and only if the stack is
+// > being deleted. If the flag is false, the resource deletes images whenever it is deleted. The retention
+// > rules are applied on creation and update regardless of the flag.
+// >
+// > _Type_: Boolean
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: no interruption
+//
+// `CleanupLifecycles`
+//
+// > The lifecycles of the stack in which the resource deletes images when the flag `ActiveOnlyOnStackDeletion`
+// > is true: `Delete` (the stack or one of its parent stacks is being deleted), `CreateRollback` (the creation
+// > of the stack or of one of its parent stacks is rolled back), `Replacement` (the resource is replaced during
+// > an update), `UpdateCleanup` (the resource is removed from the template), `UpdateRollback` (the update of the
+// > stack is rolled back) and `Other`. By default `Delete` and `CreateRollback`.
+// >
+// > _Type_: List of String
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: no interruption
+//
+// `DeleteRepository`
+//
+// > If the flag is true, the repository itself is deleted, with all its images, instead of the images only.
+// > The flag cannot be combined with retention rules.
+// >
+// > _Type_: Boolean
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: no interruption
+//
+// `KeepLast`
+//
+// > The number of most recently pushed images to keep, not counting the images kept by their tags.
+// >
+// > _Type_: Integer as String
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: no interruption
+//
+// `KeepTagPatterns`
+//
+// > Glob patterns, as defined by the go function `path.Match`, of the tags of the images to keep, e.g.
+// > `release-*`.
+// >
+// > _Type_: List of String
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: no interruption
+//
+// `Region`
+//
+// > The region of the repository, by default the region of the stack.
+// >
+// > _Type_: Region (string)
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: no interruption
+//
+// `RegistryId`
+//
+// > The account id of the registry of the repository, by default the account of the stack. The policy of a
+// > repository in another account must allow the role of the lambda to list and delete its images.
+// >
+// > _Type_: String
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: no interruption
+//
 // `Repository`
 //
 // > The name of the repository to clean when the resource is deleted while its stack
@@ -38,24 +150,49 @@
 // > _Required_: Yes
 // >
 // > _Update Requires_: no interruption
+//
+// `Trigger`
+//
+// > Any value; changing it applies the retention rules again.
+// >
+// > _Type_: String
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: no interruption
+//
+// `UntaggedOlderThanDays`
+//
+// > The age in days above which untagged images are deleted.
+// >
+// > _Type_: Integer as String
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: no interruption
 package main
 
 import (
 	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
-	common "github.com/DEEP-IMPACT-AG/hyperdrive/common"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awsapi"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/resource"
 	"github.com/aws/aws-lambda-go/cfn"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
 	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
 	awsecr "github.com/aws/aws-sdk-go-v2/service/ecr"
-	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
 )
 
-var ecr *awsecr.ECR
-var cf *cloudformation.CloudFormation
-
 // The lambda is started using the AWS lambda go sdk. The handler function
 // does the actual work of creating the log group. Cloudformation sends an
 // event to signify that a resources must be created, updated or deleted.
@@ -64,9 +201,21 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	ecr = awsecr.New(cfg)
-	cf = cloudformation.New(cfg)
-	lambda.Start(cfn.LambdaWrap(processEvent))
+	lambda.Start(cfn.LambdaWrap(resource.Handler(resource.Properties(EcrCleanupProperties{}), &ecrCleanup{
+		ecr: ecrService,
+		cf:  awsapi.NewCloudFormation(cloudformation.New(cfg)),
+	})))
+}
+
+// The ECR client is created for the region of the repository, if given.
+func ecrService(region string) (awsapi.ECR, error) {
+	cfg, err := external.LoadDefaultAWSConfig(
+		external.WithRegion(region),
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not create aws config with region %s", region)
+	}
+	return awsapi.NewECR(awsecr.New(cfg)), nil
 }
 
 // The EcrCleanupProperties is the main data structure for the ecrcleanup resource and
@@ -74,85 +223,273 @@ func main() {
 // We use the library [mapstructure](https://github.com/mitchellh/mapstructure) to
 // decode the generic map from the cloudformation event to the struct.
 type EcrCleanupProperties struct {
-	Repository string
+	Repository                string
+	RegistryId, Region        string
+	DeleteRepository          string
+	ActiveOnlyOnStackDeletion string
+	CleanupLifecycles         []string
+	KeepLast                  string
+	KeepTagPatterns           []string
+	UntaggedOlderThanDays     string
+	Trigger                   string
 }
 
-func ecrCleanupProperties(input map[string]interface{}) (EcrCleanupProperties, error) {
-	var properties EcrCleanupProperties
-	if err := mapstructure.Decode(input, &properties); err != nil {
-		return properties, err
+func (properties *EcrCleanupProperties) Validate() error {
+	if err := resource.ValidateLifecycles(properties.CleanupLifecycles); err != nil {
+		return err
 	}
-	return properties, nil
+	if properties.Repository == "" {
+		return errors.New("repository name must be defined")
+	}
+	for _, value := range []string{properties.KeepLast, properties.UntaggedOlderThanDays} {
+		if value == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(value); err != nil || n < 0 {
+			return errors.Errorf("invalid number %s", value)
+		}
+	}
+	for _, pattern := range properties.KeepTagPatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "invalid tag pattern %s", pattern)
+		}
+	}
+	if properties.DeleteRepository == "true" && properties.hasRules() {
+		return errors.New("the repository cannot be deleted with retention rules")
+	}
+	return nil
 }
 
-// To process an event, we first decode the resource properties and analyse
-// the event. We have 2 cases.
+func (properties EcrCleanupProperties) registryId() *string {
+	if properties.RegistryId == "" {
+		return nil
+	}
+	return &properties.RegistryId
+}
+
+func (properties EcrCleanupProperties) hasRules() bool {
+	return properties.KeepLast != "" || len(properties.KeepTagPatterns) > 0 || properties.UntaggedOlderThanDays != ""
+}
+
+// We have 2 cases.
 //
 // 1. Delete: The delete case it self has 3 sub cases:
-//    1. the physical resource id is a failure id, then this is a NOP;
-//    2. the stack is being deleted: in that case, we delete all the images in the
-//       repository.
+//    1. the physical resource id is a failure id, then this is a NOP
+//       handled by the framework;
+//    2. the stack is being deleted, or the resource is active regardless of
+//       the stack: in that case, we delete all the images in the repository
+//       or, if retention rules are defined, the images not retained. If the
+//       repository must be deleted, it is force-deleted with its images.
 //    3. the stack is not being delete: it is a NOP as well.
-// 2. Create, Update: In that case, it is a NOP, the physical ID is simply
-//    the logical ID of the resource.
-func processEvent(ctx context.Context, event cfn.Event) (string, map[string]interface{}, error) {
-	properties, err := ecrCleanupProperties(event.ResourceProperties)
+// 2. Create, Update: In that case, the retention rules, if any, are
+//    applied; the physical ID is simply the logical ID of the resource.
+type ecrCleanup struct {
+	ecr func(region string) (awsapi.ECR, error)
+	cf  awsapi.CloudFormation
+}
+
+func (c *ecrCleanup) Create(ctx context.Context, request resource.Request) (string, map[string]interface{}, error) {
+	return request.LogicalResourceID, nil, c.applyRules(request.Properties.(EcrCleanupProperties))
+}
+
+func (c *ecrCleanup) Update(ctx context.Context, request resource.Request) (string, map[string]interface{}, error) {
+	return request.PhysicalResourceID, nil, c.applyRules(request.Properties.(EcrCleanupProperties))
+}
+
+func (c *ecrCleanup) Delete(ctx context.Context, request resource.Request) error {
+	properties := request.Properties.(EcrCleanupProperties)
+	delete, err := shouldDelete(c.cf, request.Event, properties)
 	if err != nil {
-		return "", nil, err
-	}
-	switch event.RequestType {
-	case cfn.RequestDelete:
-		if !common.IsFailurePhysicalResourceId(event.PhysicalResourceID) {
-			stacks, err := cf.DescribeStacksRequest(&cloudformation.DescribeStacksInput{
-				StackName: &event.StackID,
-			}).Send()
-			if err != nil {
-				return event.PhysicalResourceID, nil, errors.Wrapf(err, "could not fetch the stack for the resource %s", event.PhysicalResourceID)
-			}
-			stackStatus := stacks.Stacks[0].StackStatus
-			if stackStatus == cloudformation.StackStatusDeleteInProgress {
-				if err = deleteImages(properties.Repository); err != nil {
-					return event.PhysicalResourceID, nil, errors.Wrapf(err, "could not delete the images of the repository %s", event.PhysicalResourceID)
-				}
-			}
-		}
-		return event.PhysicalResourceID, nil, nil
-	case cfn.RequestCreate:
-		return event.LogicalResourceID, nil, nil
-	case cfn.RequestUpdate:
-		return event.PhysicalResourceID, nil, nil
-	default:
-		return event.LogicalResourceID, nil, errors.Errorf("unknown request type %s", event.RequestType)
+		return err
+	}
+	if !delete {
+		return nil
+	}
+	if properties.hasRules() {
+		return c.applyRules(properties)
+	}
+	ecr, err := c.ecr(properties.Region)
+	if err != nil {
+		return err
 	}
+	if properties.DeleteRepository == "true" {
+		return deleteRepository(ecr, properties)
+	}
+	if err = deleteImages(ecr, properties); err != nil {
+		return errors.Wrapf(err, "could not delete the images of the repository %s", properties.Repository)
+	}
+	return nil
+}
+
+func shouldDelete(cf awsapi.CloudFormation, event cfn.Event, properties EcrCleanupProperties) (bool, error) {
+	if properties.ActiveOnlyOnStackDeletion == "false" {
+		return true, nil
+	}
+	return resource.ShouldCleanup(cf, event, properties.CleanupLifecycles)
 }
 
 // We delete all the images in batches.
-	func deleteImages(repositoryName string) error {
-	images, err := ecr.ListImagesRequest(&awsecr.ListImagesInput{
-		RepositoryName: &repositoryName,
-	}).Send()
+func deleteImages(ecr awsapi.ECR, properties EcrCleanupProperties) error {
+	images, err := ecr.ListImages(&awsecr.ListImagesInput{
+		RegistryId:     properties.registryId(),
+		RepositoryName: &properties.Repository,
+	})
 	if err != nil {
-		return errors.Wrapf(err, "could not fetch images for the repository %s", repositoryName)
+		return errors.Wrapf(err, "could not fetch images for the repository %s", properties.Repository)
 	}
 	for {
-		if len(images.ImageIds) > 0 {
-			_, err := ecr.BatchDeleteImageRequest(&awsecr.BatchDeleteImageInput{
-				ImageIds:       images.ImageIds,
-				RepositoryName: &repositoryName,
-			}).Send()
-			if err != nil {
-				return errors.Wrapf(err, "could not delete images from the repository %s", repositoryName)
-			}
+		if err := batchDeleteImages(ecr, properties, images.ImageIds); err != nil {
+			return err
 		}
 		if images.NextToken == nil {
 			return nil
 		}
-		images, err = ecr.ListImagesRequest(&awsecr.ListImagesInput{
-			RepositoryName: &repositoryName,
+		images, err = ecr.ListImages(&awsecr.ListImagesInput{
+			RegistryId:     properties.registryId(),
+			RepositoryName: &properties.Repository,
 			NextToken:      images.NextToken,
-		}).Send()
+		})
+		if err != nil {
+			return errors.Wrapf(err, "could not fetch images for the repository %s", properties.Repository)
+		}
+	}
+}
+
+// A repository that does not exist anymore is considered deleted.
+func deleteRepository(ecr awsapi.ECR, properties EcrCleanupProperties) error {
+	force := true
+	_, err := ecr.DeleteRepository(&awsecr.DeleteRepositoryInput{
+		Force:          &force,
+		RegistryId:     properties.registryId(),
+		RepositoryName: &properties.Repository,
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == awsecr.ErrCodeRepositoryNotFoundException {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "could not delete the repository %s", properties.Repository)
+	}
+	return nil
+}
+
+// ### Retention rules
+//
+// The details of all the images are fetched to know when they were pushed
+// and how they are tagged; the images not retained are then deleted by
+// digest, with all their tags.
+func (c *ecrCleanup) applyRules(properties EcrCleanupProperties) error {
+	if !properties.hasRules() {
+		return nil
+	}
+	ecr, err := c.ecr(properties.Region)
+	if err != nil {
+		return err
+	}
+	var images []awsecr.ImageDetail
+	input := &awsecr.DescribeImagesInput{RegistryId: properties.registryId(), RepositoryName: &properties.Repository}
+	for {
+		output, err := ecr.DescribeImages(input)
 		if err != nil {
-			return errors.Wrapf(err, "could not fetch images for the repository %s", repositoryName)
+			return errors.Wrapf(err, "could not fetch images for the repository %s", properties.Repository)
+		}
+		images = append(images, output.ImageDetails...)
+		if output.NextToken == nil {
+			break
+		}
+		input.NextToken = output.NextToken
+	}
+	expired := expiredImages(properties, images, time.Now())
+	ids := make([]awsecr.ImageIdentifier, len(expired))
+	for i, image := range expired {
+		ids[i] = awsecr.ImageIdentifier{ImageDigest: image.ImageDigest}
+	}
+	return batchDeleteImages(ecr, properties, ids)
+}
+
+func expiredImages(properties EcrCleanupProperties, images []awsecr.ImageDetail, now time.Time) []awsecr.ImageDetail {
+	sort.SliceStable(images, func(i, j int) bool {
+		return pushedAt(images[i]).After(pushedAt(images[j]))
+	})
+	keepLast, _ := strconv.Atoi(properties.KeepLast)
+	var before *time.Time
+	if properties.UntaggedOlderThanDays != "" {
+		days, _ := strconv.Atoi(properties.UntaggedOlderThanDays)
+		limit := now.AddDate(0, 0, -days)
+		before = &limit
+	}
+	deleteOthers := properties.KeepLast != "" || len(properties.KeepTagPatterns) > 0
+	var expired []awsecr.ImageDetail
+	for _, image := range images {
+		if keptByTag(properties.KeepTagPatterns, image.ImageTags) {
+			continue
+		}
+		if keepLast > 0 {
+			keepLast--
+			continue
+		}
+		untaggedExpired := before != nil && len(image.ImageTags) == 0 && pushedAt(image).Before(*before)
+		if deleteOthers || untaggedExpired {
+			expired = append(expired, image)
 		}
 	}
+	return expired
+}
+
+func keptByTag(patterns, tags []string) bool {
+	for _, tag := range tags {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, tag); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func pushedAt(image awsecr.ImageDetail) time.Time {
+	if image.ImagePushedAt == nil {
+		return time.Time{}
+	}
+	return *image.ImagePushedAt
+}
+
+// maxBatchSize is the maximal number of images deleted at once.
+const maxBatchSize = 100
+
+// The images that could not be deleted are reported in the error, except
+// the ones that do not exist anymore.
+func batchDeleteImages(ecr awsapi.ECR, properties EcrCleanupProperties, ids []awsecr.ImageIdentifier) error {
+	repositoryName := properties.Repository
+	var failures []string
+	for start := 0; start < len(ids); start += maxBatchSize {
+		end := start + maxBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		output, err := ecr.BatchDeleteImage(&awsecr.BatchDeleteImageInput{
+			ImageIds:       ids[start:end],
+			RegistryId:     properties.registryId(),
+			RepositoryName: &repositoryName,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "could not delete images from the repository %s", repositoryName)
+		}
+		for _, failure := range output.Failures {
+			if failure.FailureCode == awsecr.ImageFailureCodeImageNotFound {
+				continue
+			}
+			image := "unknown image"
+			if failure.ImageId != nil {
+				image = aws.StringValue(failure.ImageId.ImageDigest)
+				if failure.ImageId.ImageTag != nil {
+					image += " (" + *failure.ImageId.ImageTag + ")"
+				}
+			}
+			failures = append(failures, fmt.Sprintf("%s: %s %s", image, failure.FailureCode, aws.StringValue(failure.FailureReason)))
+		}
+	}
+	if len(failures) > 0 {
+		return errors.Errorf("could not delete %d images from the repository %s: %s", len(failures), repositoryName, strings.Join(failures, "; "))
+	}
+	return nil
 }
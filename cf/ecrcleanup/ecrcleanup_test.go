@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awsapi"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awstest"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/resource"
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/pkg/errors"
+)
+
+func TestEcrCleanup(t *testing.T) {
+	const stackId = "arn:aws:cloudformation:eu-west-1:123456789012:stack/test/1"
+	properties := map[string]interface{}{"Repository": "repo"}
+	for i, test := range []struct {
+		event     cfn.Event
+		status    cloudformation.StackStatus
+		failures  awstest.Failures
+		id        string
+		fails     bool
+		remaining int
+	}{
+		// test 0: create is a NOP
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Cleanup", ResourceProperties: properties},
+			id: "Cleanup", remaining: 250},
+		// test 1: update is a NOP
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, LogicalResourceID: "Cleanup", PhysicalResourceID: "Cleanup",
+			ResourceProperties: properties, OldResourceProperties: properties},
+			id: "Cleanup", remaining: 250},
+		// test 2: delete while the stack is not being deleted is a NOP
+		{event: cfn.Event{RequestType: cfn.RequestDelete, StackID: stackId, PhysicalResourceID: "Cleanup", ResourceProperties: properties},
+			status: cloudformation.StackStatusUpdateCompleteCleanupInProgress, id: "Cleanup", remaining: 250},
+		// test 3: delete of all the images over several pages
+		{event: cfn.Event{RequestType: cfn.RequestDelete, StackID: stackId, PhysicalResourceID: "Cleanup", ResourceProperties: properties},
+			status: cloudformation.StackStatusDeleteInProgress, id: "Cleanup"},
+		// test 4: failure to fetch the stack
+		{event: cfn.Event{RequestType: cfn.RequestDelete, StackID: stackId, PhysicalResourceID: "Cleanup", ResourceProperties: properties},
+			failures: awstest.Failures{"DescribeStacks": errors.New("boom")}, id: "Cleanup", fails: true, remaining: 250},
+		// test 5: failure to delete the images
+		{event: cfn.Event{RequestType: cfn.RequestDelete, StackID: stackId, PhysicalResourceID: "Cleanup", ResourceProperties: properties},
+			status: cloudformation.StackStatusDeleteInProgress, failures: awstest.Failures{"BatchDeleteImage": errors.New("boom")}, id: "Cleanup", fails: true, remaining: 250},
+	} {
+		ecr := awstest.NewECR()
+		ecr.Failures = test.failures
+		for n := 0; n < 250; n++ {
+			tag := ""
+			if n%2 == 0 {
+				tag = fmt.Sprintf("v%d", n)
+			}
+			ecr.PutImage("repo", fmt.Sprintf("sha256:%04d", n), tag)
+		}
+		cf := awstest.NewCloudFormation()
+		cf.Failures = test.failures
+		cf.PutStack(stackId, "test", test.status)
+		id, _, err := resource.Handler(resource.Properties(EcrCleanupProperties{}), &ecrCleanup{ecr: func(region string) (awsapi.ECR, error) { return ecr, nil }, cf: cf})(context.Background(), test.event)
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if id != test.id {
+			t.Errorf("test %d: expecting id %s got %s", i, test.id, id)
+		}
+		if len(ecr.Repositories["repo"]) != test.remaining {
+			t.Errorf("test %d: expecting %d remaining images got %d", i, test.remaining, len(ecr.Repositories["repo"]))
+		}
+	}
+}
+
+func TestEcrCleanupRules(t *testing.T) {
+	const stackId = "arn:aws:cloudformation:eu-west-1:123456789012:stack/test/1"
+	properties := func(rules map[string]interface{}) map[string]interface{} {
+		properties := map[string]interface{}{"Repository": "repo"}
+		for k, v := range rules {
+			properties[k] = v
+		}
+		return properties
+	}
+	for i, test := range []struct {
+		event     cfn.Event
+		status    cloudformation.StackStatus
+		denied    string
+		fails     string
+		remaining []string
+	}{
+		// test 0: keep the last 2 images
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Cleanup", ResourceProperties: properties(map[string]interface{}{"KeepLast": "2"})},
+			remaining: []string{"sha256:5", "sha256:6"}},
+		// test 1: keep the releases and the last image
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Cleanup", ResourceProperties: properties(map[string]interface{}{
+			"KeepLast": "1", "KeepTagPatterns": []interface{}{"release-*"}})},
+			remaining: []string{"sha256:1", "sha256:3", "sha256:6"}},
+		// test 2: delete the untagged images older than 10 days only
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, LogicalResourceID: "Cleanup", PhysicalResourceID: "Cleanup",
+			ResourceProperties: properties(map[string]interface{}{"UntaggedOlderThanDays": "10"}), OldResourceProperties: properties(nil)},
+			remaining: []string{"sha256:1", "sha256:3", "sha256:4", "sha256:5", "sha256:6"}},
+		// test 3: the rules apply on stack deletion instead of deleting everything
+		{event: cfn.Event{RequestType: cfn.RequestDelete, StackID: stackId, PhysicalResourceID: "Cleanup", ResourceProperties: properties(map[string]interface{}{"KeepLast": "1"})},
+			status: cloudformation.StackStatusDeleteInProgress, remaining: []string{"sha256:6"}},
+		// test 4: delete regardless of the stack
+		{event: cfn.Event{RequestType: cfn.RequestDelete, StackID: stackId, PhysicalResourceID: "Cleanup", ResourceProperties: properties(map[string]interface{}{"ActiveOnlyOnStackDeletion": "false"})},
+			status: cloudformation.StackStatusUpdateCompleteCleanupInProgress},
+		// test 5: the images that could not be deleted are reported
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Cleanup", ResourceProperties: properties(map[string]interface{}{"KeepLast": "4"})},
+			denied: "sha256:2", fails: "could not delete 1 images from the repository repo: sha256:2: ImageReferencedByManifestList",
+			remaining: []string{"sha256:2", "sha256:3", "sha256:4", "sha256:5", "sha256:6"}},
+		// test 6: invalid rules
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Cleanup", ResourceProperties: properties(map[string]interface{}{"KeepLast": "-1"})},
+			fails: "invalid number", remaining: []string{"sha256:1", "sha256:2", "sha256:3", "sha256:4", "sha256:5", "sha256:6"}},
+	} {
+		ecr := awstest.NewECR()
+		now := time.Now()
+		ecr.PutImageAt("repo", "sha256:1", "release-1", now.AddDate(0, 0, -30))
+		ecr.PutImageAt("repo", "sha256:1", "stable", now.AddDate(0, 0, -30))
+		ecr.PutImageAt("repo", "sha256:2", "", now.AddDate(0, 0, -20))
+		ecr.PutImageAt("repo", "sha256:3", "release-2", now.AddDate(0, 0, -15))
+		ecr.PutImageAt("repo", "sha256:4", "", now.AddDate(0, 0, -5))
+		ecr.PutImageAt("repo", "sha256:5", "build-5", now.AddDate(0, 0, -2))
+		ecr.PutImageAt("repo", "sha256:6", "build-6", now.AddDate(0, 0, -1))
+		if test.denied != "" {
+			ecr.Denied[test.denied] = true
+		}
+		cf := awstest.NewCloudFormation()
+		cf.PutStack(stackId, "test", test.status)
+		_, _, err := resource.Handler(resource.Properties(EcrCleanupProperties{}), &ecrCleanup{ecr: func(region string) (awsapi.ECR, error) { return ecr, nil }, cf: cf})(context.Background(), test.event)
+		if (err != nil) != (test.fails != "") || (err != nil && !strings.Contains(err.Error(), test.fails)) {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		var remaining []string
+		for _, image := range ecr.Repositories["repo"] {
+			if n := len(remaining); n == 0 || remaining[n-1] != *image.ImageDigest {
+				remaining = append(remaining, *image.ImageDigest)
+			}
+		}
+		if !reflect.DeepEqual(remaining, test.remaining) {
+			t.Errorf("test %d: expecting remaining images %v got %v", i, test.remaining, remaining)
+		}
+	}
+}
+
+func TestEcrCleanupRepository(t *testing.T) {
+	const stackId = "arn:aws:cloudformation:eu-west-1:123456789012:stack/test/1"
+	properties := func(extra map[string]interface{}) map[string]interface{} {
+		properties := map[string]interface{}{"Repository": "repo"}
+		for k, v := range extra {
+			properties[k] = v
+		}
+		return properties
+	}
+	for i, test := range []struct {
+		event      cfn.Event
+		missing    bool
+		fails      string
+		remaining  map[string]int
+		repository bool
+	}{
+		// test 0: delete the images of a repository in another region
+		{event: cfn.Event{RequestType: cfn.RequestDelete, StackID: stackId, PhysicalResourceID: "Cleanup", ResourceProperties: properties(map[string]interface{}{"Region": "us-east-1"})},
+			remaining: map[string]int{"eu-west-1": 3, "us-east-1": 0}, repository: true},
+		// test 1: delete the images of a repository in another registry
+		{event: cfn.Event{RequestType: cfn.RequestDelete, StackID: stackId, PhysicalResourceID: "Cleanup", ResourceProperties: properties(map[string]interface{}{"RegistryId": "123456789012"})},
+			remaining: map[string]int{"eu-west-1": 0, "us-east-1": 3}, repository: true},
+		// test 2: the registry must match
+		{event: cfn.Event{RequestType: cfn.RequestDelete, StackID: stackId, PhysicalResourceID: "Cleanup", ResourceProperties: properties(map[string]interface{}{"RegistryId": "210987654321"})},
+			fails: "RepositoryNotFoundException", remaining: map[string]int{"eu-west-1": 3, "us-east-1": 3}, repository: true},
+		// test 3: force-delete the repository with its images
+		{event: cfn.Event{RequestType: cfn.RequestDelete, StackID: stackId, PhysicalResourceID: "Cleanup", ResourceProperties: properties(map[string]interface{}{"Region": "us-east-1", "DeleteRepository": "true"})},
+			remaining: map[string]int{"eu-west-1": 3, "us-east-1": 0}},
+		// test 4: a missing repository is already deleted
+		{event: cfn.Event{RequestType: cfn.RequestDelete, StackID: stackId, PhysicalResourceID: "Cleanup", ResourceProperties: properties(map[string]interface{}{"DeleteRepository": "true"})},
+			missing: true, remaining: map[string]int{"eu-west-1": 0, "us-east-1": 3}},
+		// test 5: the repository cannot be deleted with retention rules
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Cleanup", ResourceProperties: properties(map[string]interface{}{"KeepLast": "1", "DeleteRepository": "true"})},
+			fails: "retention rules", remaining: map[string]int{"eu-west-1": 3, "us-east-1": 3}, repository: true},
+	} {
+		ecrs := map[string]*awstest.ECR{"eu-west-1": awstest.NewECR(), "us-east-1": awstest.NewECR()}
+		for region, ecr := range ecrs {
+			if region == "eu-west-1" && test.missing {
+				continue
+			}
+			for n := 0; n < 3; n++ {
+				ecr.PutImage("repo", fmt.Sprintf("sha256:%d", n), fmt.Sprintf("v%d", n))
+			}
+		}
+		cf := awstest.NewCloudFormation()
+		cf.PutStack(stackId, "test", cloudformation.StackStatusDeleteInProgress)
+		service := func(region string) (awsapi.ECR, error) {
+			if region == "" {
+				region = "eu-west-1"
+			}
+			return ecrs[region], nil
+		}
+		_, _, err := resource.Handler(resource.Properties(EcrCleanupProperties{}), &ecrCleanup{ecr: service, cf: cf})(context.Background(), test.event)
+		if (err != nil) != (test.fails != "") || (err != nil && !strings.Contains(err.Error(), test.fails)) {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		for region, remaining := range test.remaining {
+			if n := len(ecrs[region].Repositories["repo"]); n != remaining {
+				t.Errorf("test %d: expecting %d remaining images in %s got %d", i, remaining, region, n)
+			}
+		}
+		region, _ := test.event.ResourceProperties["Region"].(string)
+		if region == "" {
+			region = "eu-west-1"
+		}
+		if _, ok := ecrs[region].Repositories["repo"]; ok != test.repository && !test.missing {
+			t.Errorf("test %d: expecting the repository to exist %t", i, test.repository)
+		}
+	}
+}
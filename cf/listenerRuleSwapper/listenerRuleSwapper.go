@@ -1,7 +1,26 @@
 // # ListenerRuleSwapper
 //
 // The `listenerRuleSwapper` custom resource is meant for a very specific use case of an application served by an ALB
-// and that requires interruption on release.
+// and that requires interruption on release: blue/green deployments where the traffic is switched from one target
+// group to the other by swapping the priorities of the listener rules forwarding to them.
+//
+// The rules are given in a list, with their initial priorities. The rule with the lowest priority number, i.e. the
+// one evaluated first, is the _active_ rule. Every time the `Trigger` changes, the priorities of the rules are
+// rotated: the active rule gets the highest priority number and every other rule moves up by one. With 2 rules, the
+// priorities are simply swapped. All the priorities are set in a single call and thus atomically.
+//
+// Creating the resource does not change the priorities, it only reports the active rule. Deleting the resource,
+// e.g. while its stack is deleted, is a NOP.
+//
+// The rules given with the former properties `Rule1Arn` and `Rule2Arn` keep their former behavior: they are
+// swapped when the resource is created and on every update, whether the `Trigger` changes or not. Moving to
+// `RuleArns` replaces the resource and thus swaps the rules once more; the rules are then only rotated when the
+// `Trigger` changes.
+//
+// To shift the traffic gradually between target groups instead, the resource sets the weights of a weighted forward
+// action: the rule `ForwardRuleArn` forwards to the `TargetGroups` in proportion to their weights, e.g. 90 and 10,
+// then 50 and 50, then 0 and 100. The weights are set on creation and on every update. The rule must have a single
+// forward action, that the resource replaces; the rotation of rules and the weighted forward action are exclusive.
 //
 // ## Syntax
 //
@@ -13,118 +32,427 @@
 //   Type: Custom::ListenerRuleSwapper
 //   Properties:
 //     ServiceToken: !ImportValue HyperdriveCore-ListenerRuleSwapper
-//	   ListenerArn: <listener arn>
-//     Rule1Arn: <rule arn>
-//	   Rule2Arn: <rule arn>
+//     ListenerArn: <listener arn>
+//     RuleArns:
+//     - <rule arn>
+//     - ...
 //     Trigger: <changing value>
 // ```
+//
+// or, with a weighted forward action:
+//
+// ```yaml
+// ListenerRuleSwapper:
+//   Type: Custom::ListenerRuleSwapper
+//   Properties:
+//     ServiceToken: !ImportValue HyperdriveCore-ListenerRuleSwapper
+//     ListenerArn: <listener arn>
+//     ForwardRuleArn: <rule arn>
+//     TargetGroups:
+//     - TargetGroupArn: <target group arn>
+//       Weight: 90
+//     - TargetGroupArn: <target group arn>
+//       Weight: 10
+// ```
+//
+// ## Properties
+//
+// `ListenerArn`
+//
+// > The ARN of the listener of the rules. If given, the rules are checked to belong to the listener.
+// >
+// > _Type_: String
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: Replacement
+//
+// `RuleArns`
+//
+// > The ARNs of the rules to rotate, at least 2. None of them may be the default rule of the listener.
+// >
+// > _Type_: List of String
+// >
+// > _Required_: Yes, unless `Rule1Arn` and `Rule2Arn` or `ForwardRuleArn` are given.
+// >
+// > _Update Requires_: Replacement
+//
+// `Rule1Arn`, `Rule2Arn`
+//
+// > The ARNs of 2 rules to swap; the former notation of `RuleArns` with 2 rules, swapped on creation and on every
+// > update.
+// >
+// > _Type_: String
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: Replacement
+//
+// `Trigger`
+//
+// > Any value; the rules are rotated every time the value changes, e.g. with the version of the release.
+// >
+// > _Type_: String
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: No interruption
+//
+// `ForwardRuleArn`
+//
+// > The ARN of the rule whose forward action is weighted. It may not be the default rule of the listener.
+// >
+// > _Type_: String
+// >
+// > _Required_: Yes, with `TargetGroups`
+// >
+// > _Update Requires_: Replacement
+//
+// `TargetGroups`
+//
+// > The target groups of the weighted forward action, 1 to 5, each with its `TargetGroupArn` and its `Weight`,
+// > between 0 and 999.
+// >
+// > _Type_: List of TargetGroup
+// >
+// > _Required_: Yes, with `ForwardRuleArn`
+// >
+// > _Update Requires_: No interruption
+//
+// ## Return Values
+//
+// `Ref`
+//
+// The logical id of the resource.
+//
+// `Fn::GetAtt`
+//
+// 1. `ActiveRule`: the position, starting with 1, of the active rule in the list of rules.
+// 2. `ActiveRuleArn`: the ARN of the active rule.
+// 3. `ActiveTargetGroupArn`: with a weighted forward action, the ARN of the target group with the greatest weight,
+//    the first one if several.
 package main
 
 import (
 	"context"
-	"github.com/DEEP-IMPACT-AG/hyperdrive/common"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awsapi"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/resource"
 	"github.com/aws/aws-lambda-go/cfn"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
 	"github.com/aws/aws-sdk-go-v2/service/elbv2"
-	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 )
 
-var elb *elbv2.ELBV2
-
 // The lambda is started using the AWS lambda go sdk. The handler function
-// does the actual work of creating the log group. Cloudformation sends an
+// does the actual work of swapping the rules. Cloudformation sends an
 // event to signify that a resources must be created, updated or deleted.
 func main() {
 	cfg, err := external.LoadDefaultAWSConfig()
 	if err != nil {
 		panic(err)
 	}
-	elb = elbv2.New(cfg)
-	lambda.Start(cfn.LambdaWrap(processEvent))
+	lambda.Start(cfn.LambdaWrap(resource.Handler(resource.Properties(Properties{}), &ruleSwapper{elb: awsapi.NewELBV2(elbv2.New(cfg))})))
 }
 
-// The Properties is the main data structure for the ecrcleanup resource and
+// The Properties is the main data structure for the listenerRuleSwapper resource and
 // is defined as a go struct. The struct mirrors the properties as defined above.
 // We use the library [mapstructure](https://github.com/mitchellh/mapstructure) to
 // decode the generic map from the cloudformation event to the struct.
 type Properties struct {
-	ListenerArn string
-	Rule1Arn string
-	Rule2Arn string
+	ListenerArn    string
+	Rule1Arn       string
+	Rule2Arn       string
+	RuleArns       []string
+	Trigger        string
+	ForwardRuleArn string
+	TargetGroups   []TargetGroup
+}
+
+// A TargetGroup is a target group of the weighted forward action.
+type TargetGroup struct {
+	TargetGroupArn string
+	Weight         string
+}
+
+// The limits of the weighted forward actions of the ELBv2 api.
+const (
+	maxTargetGroups = 5
+	maxWeight       = 999
+)
+
+func (properties *Properties) Validate() error {
+	if properties.weighted() {
+		return properties.validateForward()
+	}
+	if len(properties.RuleArns) > 0 && (properties.Rule1Arn != "" || properties.Rule2Arn != "") {
+		return errors.New("either the rule arns or the rule 1 and 2 arns must be defined")
+	}
+	rules := properties.rules()
+	if len(rules) < 2 {
+		return errors.New("at least 2 rules must be defined")
+	}
+	seen := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		if seen[rule] {
+			return errors.Errorf("the rule %s is defined more than once", rule)
+		}
+		seen[rule] = true
+		if !properties.listenerRule(rule) {
+			return errors.Errorf("the rule %s is not a rule of the listener %s", rule, properties.ListenerArn)
+		}
+	}
+	return nil
+}
+
+func (properties *Properties) validateForward() error {
+	if properties.ForwardRuleArn == "" {
+		return errors.New("ForwardRuleArn is required with TargetGroups")
+	}
+	if len(properties.rules()) > 0 {
+		return errors.New("the rules to rotate and the weighted forward rule are exclusive")
+	}
+	if !properties.listenerRule(properties.ForwardRuleArn) {
+		return errors.Errorf("the rule %s is not a rule of the listener %s", properties.ForwardRuleArn, properties.ListenerArn)
+	}
+	if len(properties.TargetGroups) < 1 || len(properties.TargetGroups) > maxTargetGroups {
+		return errors.Errorf("between 1 and %d target groups must be defined", maxTargetGroups)
+	}
+	seen := make(map[string]bool, len(properties.TargetGroups))
+	for _, targetGroup := range properties.TargetGroups {
+		if targetGroup.TargetGroupArn == "" {
+			return errors.New("the TargetGroupArn of the target groups is required")
+		}
+		if seen[targetGroup.TargetGroupArn] {
+			return errors.Errorf("the target group %s is defined more than once", targetGroup.TargetGroupArn)
+		}
+		seen[targetGroup.TargetGroupArn] = true
+		if _, err := targetGroup.weight(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The arn of a rule extends the arn of its listener.
+func (properties Properties) listenerRule(rule string) bool {
+	return properties.ListenerArn == "" || strings.HasPrefix(rule, strings.Replace(properties.ListenerArn, ":listener/", ":listener-rule/", 1)+"/")
 }
 
-func properties(input map[string]interface{}) (Properties, error) {
-	var properties Properties
-	if err := mapstructure.Decode(input, &properties); err != nil {
-		return properties, err
+func (properties Properties) weighted() bool {
+	return properties.ForwardRuleArn != "" || len(properties.TargetGroups) > 0
+}
+
+func (targetGroup TargetGroup) weight() (int64, error) {
+	weight, err := strconv.ParseInt(targetGroup.Weight, 10, 64)
+	if err != nil || weight < 0 || weight > maxWeight {
+		return 0, errors.Errorf("the weight %s of the target group %s must be between 0 and %d", targetGroup.Weight, targetGroup.TargetGroupArn, maxWeight)
 	}
-	return properties, nil
+	return weight, nil
+}
+
+// The rules of `Rule1Arn` and `Rule2Arn` are swapped on every creation and
+// update, as they were before `RuleArns` and `Trigger`.
+func (properties Properties) legacy() bool {
+	return len(properties.RuleArns) == 0
 }
 
-// To process an event, we first decode the resource properties and analyse
-// the event. We have 2 cases.
+func (properties Properties) rules() []string {
+	if len(properties.RuleArns) > 0 {
+		return properties.RuleArns
+	}
+	var rules []string
+	for _, rule := range []string{properties.Rule1Arn, properties.Rule2Arn} {
+		if rule != "" {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// We have 3 cases:
+//
+// 1. Create: we read the priorities of the rules to report the active rule;
+//    the rules of `Rule1Arn` and `Rule2Arn` are swapped.
+// 2. Update: if the `Trigger` has changed, or for the rules of `Rule1Arn`
+//    and `Rule2Arn`, we rotate the priorities of the rules; changing the
+//    listener or the rules requires a replacement.
+// 3. Delete: it is a NOP.
 //
-// 1. Delete: The delete case it self has 3 sub cases:
-//    1. the physical resource id is a failure id, then this is a NOP;
-//    2. the stack is being deleted: in that case, we delete all the images in the
-//       repository.
-//    3. the stack is not being delete: it is a NOP as well.
-// 2. Create, Update: In that case, it is a NOP, the physical ID is simply
-//    the logical ID of the resource.
-func processEvent(ctx context.Context, event cfn.Event) (string, map[string]interface{}, error) {
-	properties, err := properties(event.ResourceProperties)
+// With a weighted forward action, Create and Update set the weights.
+//
+// The physical ID is simply the logical ID of the resource.
+type ruleSwapper struct {
+	elb awsapi.ELBV2
+}
+
+func (r *ruleSwapper) Create(ctx context.Context, request resource.Request) (string, map[string]interface{}, error) {
+	properties := request.Properties.(Properties)
+	if properties.weighted() {
+		data, err := forward(r.elb, properties)
+		return request.LogicalResourceID, data, err
+	}
+	rules, err := describeRules(r.elb, properties)
 	if err != nil {
-		return "", nil, err
+		return request.LogicalResourceID, nil, err
 	}
-	switch event.RequestType {
-	case cfn.RequestDelete:
-		if !common.IsFailurePhysicalResourceId(event.PhysicalResourceID) {
-			return swapRules(event.LogicalResourceID, properties)
+	if properties.legacy() {
+		if rules, err = rotateRules(r.elb, properties, rules); err != nil {
+			return request.LogicalResourceID, nil, err
 		}
-		return event.LogicalResourceID, nil, nil
-	case cfn.RequestCreate:
-		return swapRules(event.LogicalResourceID, properties)
-	case cfn.RequestUpdate:
-		return swapRules(event.LogicalResourceID, properties)
-	default:
-		return event.LogicalResourceID, nil, errors.Errorf("unknown request type %s", event.RequestType)
 	}
+	return request.LogicalResourceID, attributes(rules), nil
 }
 
-func rulePriority(rule elbv2.Rule) *int64 {
-	prio, err := strconv.ParseInt(*rule.Priority, 10, 64)
+func (r *ruleSwapper) Update(ctx context.Context, request resource.Request) (string, map[string]interface{}, error) {
+	properties := request.Properties.(Properties)
+	if properties.weighted() {
+		data, err := forward(r.elb, properties)
+		return request.LogicalResourceID, data, err
+	}
+	rules, err := describeRules(r.elb, properties)
 	if err != nil {
-		panic(err)
+		return request.LogicalResourceID, nil, err
 	}
-	return &prio
+	if properties.legacy() || request.Changed("Trigger") {
+		if rules, err = rotateRules(r.elb, properties, rules); err != nil {
+			return request.LogicalResourceID, nil, err
+		}
+	}
+	return request.LogicalResourceID, attributes(rules), nil
+}
+
+func (r *ruleSwapper) Delete(ctx context.Context, request resource.Request) error {
+	return nil
+}
+
+func (r *ruleSwapper) RequiresReplacement(request resource.Request) bool {
+	oldProperties := request.OldProperties.(Properties)
+	properties := request.Properties.(Properties)
+	return oldProperties.ListenerArn != properties.ListenerArn || !reflect.DeepEqual(oldProperties.rules(), properties.rules()) ||
+		oldProperties.ForwardRuleArn != properties.ForwardRuleArn
+}
+
+// A rule with its priority, in the order of the properties.
+type rule struct {
+	arn      string
+	priority int64
 }
 
-func swapRules(resId string, prop Properties) (string, map[string]interface{}, error) {
-	rules, err := elb.DescribeRulesRequest(&elbv2.DescribeRulesInput{
-		ListenerArn: &prop.ListenerArn,
-		RuleArns: []string{prop.Rule1Arn, prop.Rule2Arn},
-	}).Send()
-	var rule1Priority *int64
-	var rule2Priority *int64
-	for _, rule := range rules.Rules {
-		if *rule.RuleArn == prop.Rule1Arn {
-			rule1Priority = rulePriority(rule)
+func describeRules(elb awsapi.ELBV2, properties Properties) ([]rule, error) {
+	arns := properties.rules()
+	res, err := elb.DescribeRules(&elbv2.DescribeRulesInput{
+		RuleArns: arns,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not fetch the rules %s", strings.Join(arns, ", "))
+	}
+	priorities := make(map[string]string, len(res.Rules))
+	for _, r := range res.Rules {
+		if r.IsDefault != nil && *r.IsDefault {
+			return nil, errors.Errorf("the rule %s is the default rule of its listener", *r.RuleArn)
+		}
+		if r.Priority != nil {
+			priorities[*r.RuleArn] = *r.Priority
 		}
 	}
+	rules := make([]rule, len(arns))
+	for i, arn := range arns {
+		priority, err := strconv.ParseInt(priorities[arn], 10, 64)
+		if err != nil {
+			return nil, errors.Errorf("the rule %s has no numeric priority", arn)
+		}
+		rules[i] = rule{arn: arn, priority: priority}
+	}
+	return rules, nil
+}
+
+// The rule at the i-th position in the order of the priorities gets the
+// priority of the rule at the previous position; the first rule gets the
+// priority of the last one.
+func rotateRules(elb awsapi.ELBV2, properties Properties, rules []rule) ([]rule, error) {
+	sorted := append([]rule(nil), rules...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].priority < sorted[j].priority })
+	priorities := make(map[string]int64, len(sorted))
+	pairs := make([]elbv2.RulePriorityPair, len(sorted))
+	for i, r := range sorted {
+		arn, priority := r.arn, sorted[(i+len(sorted)-1)%len(sorted)].priority
+		priorities[arn] = priority
+		pairs[i] = elbv2.RulePriorityPair{RuleArn: &arn, Priority: &priority}
+	}
+	_, err := elb.SetRulePriorities(&elbv2.SetRulePrioritiesInput{
+		RulePriorities: pairs,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not rotate the rules %s on the listener %s", strings.Join(properties.rules(), ", "), properties.ListenerArn)
+	}
+	rotated := make([]rule, len(rules))
+	for i, r := range rules {
+		rotated[i] = rule{arn: r.arn, priority: priorities[r.arn]}
+	}
+	return rotated, nil
+}
+
+// The weights are set with a single forward action that replaces the
+// actions of the rule: a rule with other actions, e.g. an authentication,
+// is refused as they would be lost.
+func forward(elb awsapi.ELBV2, properties Properties) (map[string]interface{}, error) {
+	res, err := elb.DescribeRules(&elbv2.DescribeRulesInput{
+		RuleArns: []string{properties.ForwardRuleArn},
+	})
 	if err != nil {
-		return resId, nil, errors.Wrapf(err, "could not fetch the rules %s and %s on the listener %s", prop.Rule1Arn, prop.Rule2Arn, prop.ListenerArn)
-	}
-	_, err = elb.SetRulePrioritiesRequest(&elbv2.SetRulePrioritiesInput{
-		RulePriorities: []elbv2.RulePriorityPair{
-			{RuleArn: &prop.Rule1Arn, Priority: rule2Priority},
-			{RuleArn: &prop.Rule2Arn, Priority: rule1Priority},
-		},
-	}).Send()
+		return nil, errors.Wrapf(err, "could not fetch the rule %s", properties.ForwardRuleArn)
+	}
+	for _, r := range res.Rules {
+		if r.IsDefault != nil && *r.IsDefault {
+			return nil, errors.Errorf("the rule %s is the default rule of its listener", properties.ForwardRuleArn)
+		}
+		if len(r.Actions) != 1 || r.Actions[0].Type != elbv2.ActionTypeEnumForward {
+			return nil, errors.Errorf("the rule %s must have a single forward action", properties.ForwardRuleArn)
+		}
+	}
+	targetGroups := make([]awsapi.TargetGroupTuple, len(properties.TargetGroups))
+	weights := make([]int64, len(properties.TargetGroups))
+	active := 0
+	for i, targetGroup := range properties.TargetGroups {
+		if weights[i], err = targetGroup.weight(); err != nil {
+			return nil, err
+		}
+		targetGroups[i] = awsapi.TargetGroupTuple{TargetGroupArn: aws.String(targetGroup.TargetGroupArn), Weight: &weights[i]}
+		if weights[i] > weights[active] {
+			active = i
+		}
+	}
+	_, err = elb.ModifyRuleForward(&awsapi.ModifyRuleForwardInput{
+		RuleArn: &properties.ForwardRuleArn,
+		Actions: []awsapi.ForwardAction{{
+			Type:          aws.String(string(elbv2.ActionTypeEnumForward)),
+			ForwardConfig: &awsapi.ForwardActionConfig{TargetGroups: targetGroups},
+		}},
+	})
 	if err != nil {
-		return resId, nil, errors.Wrapf(err, "could not swap the rules %s and %s on the listener %s", prop.Rule1Arn, prop.Rule2Arn, prop.ListenerArn)
+		return nil, errors.Wrapf(err, "could not set the weights of the target groups of the rule %s", properties.ForwardRuleArn)
+	}
+	return map[string]interface{}{
+		"ActiveTargetGroupArn": properties.TargetGroups[active].TargetGroupArn,
+	}, nil
+}
+
+// The active rule is the one with the lowest priority number.
+func attributes(rules []rule) map[string]interface{} {
+	active := 0
+	for i, r := range rules {
+		if r.priority < rules[active].priority {
+			active = i
+		}
+	}
+	return map[string]interface{}{
+		"ActiveRule":    active + 1,
+		"ActiveRuleArn": rules[active].arn,
 	}
-	return resId, nil, nil
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awstest"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/resource"
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/pkg/errors"
+)
+
+func TestRuleSwapper(t *testing.T) {
+	const listener = "arn:aws:elasticloadbalancing:eu-west-1:123456789012:listener/app/lb/1/2"
+	const rule = "arn:aws:elasticloadbalancing:eu-west-1:123456789012:listener-rule/app/lb/1/2/"
+	properties := func(trigger string, rules ...interface{}) map[string]interface{} {
+		return map[string]interface{}{"ListenerArn": listener, "RuleArns": rules, "Trigger": trigger}
+	}
+	for i, test := range []struct {
+		event      cfn.Event
+		failures   awstest.Failures
+		fails      bool
+		active     int
+		priorities []string
+	}{
+		// test 0: create reports the active rule
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Swapper", ResourceProperties: properties("1", rule+"r1", rule+"r2")},
+			active: 1, priorities: []string{"10", "20", "30"}},
+		// test 1: a new trigger swaps the rules
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, LogicalResourceID: "Swapper", PhysicalResourceID: "Swapper",
+			ResourceProperties:    properties("2", rule+"r1", rule+"r2"),
+			OldResourceProperties: properties("1", rule+"r1", rule+"r2")},
+			active: 2, priorities: []string{"20", "10", "30"}},
+		// test 2: the rules with 2 properties are swapped the same way
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, LogicalResourceID: "Swapper", PhysicalResourceID: "Swapper",
+			ResourceProperties:    map[string]interface{}{"Rule1Arn": rule + "r1", "Rule2Arn": rule + "r2", "Trigger": "2"},
+			OldResourceProperties: map[string]interface{}{"Rule1Arn": rule + "r1", "Rule2Arn": rule + "r2", "Trigger": "1"}},
+			active: 2, priorities: []string{"20", "10", "30"}},
+		// test 3: the rules are not swapped without a new trigger
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, LogicalResourceID: "Swapper", PhysicalResourceID: "Swapper",
+			ResourceProperties:    properties("1", rule+"r1", rule+"r2"),
+			OldResourceProperties: properties("1", rule+"r1", rule+"r2")},
+			active: 1, priorities: []string{"10", "20", "30"}},
+		// test 4: 3 rules are rotated
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, LogicalResourceID: "Swapper", PhysicalResourceID: "Swapper",
+			ResourceProperties:    properties("2", rule+"r1", rule+"r2", rule+"r3"),
+			OldResourceProperties: properties("1", rule+"r1", rule+"r2", rule+"r3")},
+			active: 2, priorities: []string{"30", "10", "20"}},
+		// test 5: changing the rules replaces the resource without swapping
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, LogicalResourceID: "Swapper", PhysicalResourceID: "Swapper",
+			ResourceProperties:    properties("2", rule+"r2", rule+"r3"),
+			OldResourceProperties: properties("1", rule+"r1", rule+"r2")},
+			active: 1, priorities: []string{"10", "20", "30"}},
+		// test 6: delete is a NOP
+		{event: cfn.Event{RequestType: cfn.RequestDelete, LogicalResourceID: "Swapper", PhysicalResourceID: "Swapper", ResourceProperties: properties("1", rule+"r1", rule+"r2")},
+			priorities: []string{"10", "20", "30"}},
+		// test 7: the rules must belong to the listener
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Swapper", ResourceProperties: properties("1", rule+"r1", "arn:aws:elasticloadbalancing:eu-west-1:123456789012:listener-rule/app/lb/1/3/r2")},
+			fails: true, priorities: []string{"10", "20", "30"}},
+		// test 8: at least 2 rules are required
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Swapper", ResourceProperties: properties("1", rule+"r1")},
+			fails: true, priorities: []string{"10", "20", "30"}},
+		// test 9: failure to fetch the rules
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Swapper", ResourceProperties: properties("1", rule+"r1", rule+"r4")},
+			fails: true, priorities: []string{"10", "20", "30"}},
+		// test 10: the rules with 2 properties are swapped on creation
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Swapper",
+			ResourceProperties: map[string]interface{}{"Rule1Arn": rule + "r1", "Rule2Arn": rule + "r2"}},
+			active: 2, priorities: []string{"20", "10", "30"}},
+		// test 11: the rules with 2 properties are swapped on every update
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, LogicalResourceID: "Swapper", PhysicalResourceID: "Swapper",
+			ResourceProperties:    map[string]interface{}{"Rule1Arn": rule + "r1", "Rule2Arn": rule + "r2", "Trigger": "1"},
+			OldResourceProperties: map[string]interface{}{"Rule1Arn": rule + "r1", "Rule2Arn": rule + "r2", "Trigger": "1"}},
+			active: 2, priorities: []string{"20", "10", "30"}},
+		// test 12: failure to swap the rules
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, LogicalResourceID: "Swapper", PhysicalResourceID: "Swapper",
+			ResourceProperties:    properties("2", rule+"r1", rule+"r2"),
+			OldResourceProperties: properties("1", rule+"r1", rule+"r2")},
+			failures: awstest.Failures{"SetRulePriorities": errors.New("boom")}, fails: true, priorities: []string{"10", "20", "30"}},
+	} {
+		elb := awstest.NewELBV2()
+		elb.Failures = test.failures
+		elb.PutRule(rule+"r1", 10)
+		elb.PutRule(rule+"r2", 20)
+		elb.PutRule(rule+"r3", 30)
+		_, data, err := resource.Handler(resource.Properties(Properties{}), &ruleSwapper{elb: elb})(context.Background(), test.event)
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if test.active > 0 && data["ActiveRule"] != test.active {
+			t.Errorf("test %d: expecting the active rule %d got %v", i, test.active, data)
+		}
+		for n, priority := range test.priorities {
+			arn := rule + "r" + strconv.Itoa(n+1)
+			if elb.Priority(arn) != priority {
+				t.Errorf("test %d: expecting priority %s for %s got %s", i, priority, arn, elb.Priority(arn))
+			}
+		}
+	}
+}
+
+func TestRuleSwapperForward(t *testing.T) {
+	const listener = "arn:aws:elasticloadbalancing:eu-west-1:123456789012:listener/app/lb/1/2"
+	const rule = "arn:aws:elasticloadbalancing:eu-west-1:123456789012:listener-rule/app/lb/1/2/r1"
+	const blue = "arn:aws:elasticloadbalancing:eu-west-1:123456789012:targetgroup/blue/1"
+	const green = "arn:aws:elasticloadbalancing:eu-west-1:123456789012:targetgroup/green/2"
+	properties := func(blueWeight, greenWeight string) map[string]interface{} {
+		return map[string]interface{}{"ListenerArn": listener, "ForwardRuleArn": rule, "TargetGroups": []interface{}{
+			map[string]interface{}{"TargetGroupArn": blue, "Weight": blueWeight},
+			map[string]interface{}{"TargetGroupArn": green, "Weight": greenWeight},
+		}}
+	}
+	for i, test := range []struct {
+		event    cfn.Event
+		failures awstest.Failures
+		fails    bool
+		active   string
+		weights  []int64
+	}{
+		// test 0: create sets the weights
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Swapper", ResourceProperties: properties("90", "10")},
+			active: blue, weights: []int64{90, 10}},
+		// test 1: update shifts the traffic
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, LogicalResourceID: "Swapper", PhysicalResourceID: "Swapper",
+			ResourceProperties: properties("20", "80"), OldResourceProperties: properties("90", "10")},
+			active: green, weights: []int64{20, 80}},
+		// test 2: the first target group is active on equal weights
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Swapper", ResourceProperties: properties("50", "50")},
+			active: blue, weights: []int64{50, 50}},
+		// test 3: delete is a NOP
+		{event: cfn.Event{RequestType: cfn.RequestDelete, LogicalResourceID: "Swapper", PhysicalResourceID: "Swapper", ResourceProperties: properties("90", "10")}},
+		// test 4: invalid weight
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Swapper", ResourceProperties: properties("1000", "10")},
+			fails: true},
+		// test 5: the rules to rotate cannot be combined with the weights
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Swapper",
+			ResourceProperties: map[string]interface{}{"ForwardRuleArn": rule, "RuleArns": []interface{}{rule}, "TargetGroups": []interface{}{map[string]interface{}{"TargetGroupArn": blue, "Weight": "1"}}}},
+			fails: true},
+		// test 6: the target groups are required
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Swapper", ResourceProperties: map[string]interface{}{"ForwardRuleArn": rule}},
+			fails: true},
+		// test 7: failure to modify the rule
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Swapper", ResourceProperties: properties("90", "10")},
+			failures: awstest.Failures{"ModifyRule": errors.New("boom")}, fails: true},
+	} {
+		elb := awstest.NewELBV2()
+		elb.Failures = test.failures
+		elb.PutForwardRule(rule, blue)
+		_, data, err := resource.Handler(resource.Properties(Properties{}), &ruleSwapper{elb: elb})(context.Background(), test.event)
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if test.active != "" && data["ActiveTargetGroupArn"] != test.active {
+			t.Errorf("test %d: expecting the active target group %s got %v", i, test.active, data)
+		}
+		var weights []int64
+		for _, targetGroup := range elb.Forwards[rule] {
+			weights = append(weights, *targetGroup.Weight)
+		}
+		if !reflect.DeepEqual(weights, test.weights) {
+			t.Errorf("test %d: expecting the weights %v got %v", i, test.weights, weights)
+		}
+	}
+}
+
+func TestRuleSwapperForwardActions(t *testing.T) {
+	const rule = "arn:aws:elasticloadbalancing:eu-west-1:123456789012:listener-rule/app/lb/1/2/r1"
+	elb := awstest.NewELBV2()
+	elb.PutRule(rule, 10)
+	properties := map[string]interface{}{"ForwardRuleArn": rule, "TargetGroups": []interface{}{map[string]interface{}{"TargetGroupArn": "tg", "Weight": "1"}}}
+	_, _, err := resource.Handler(resource.Properties(Properties{}), &ruleSwapper{elb: elb})(context.Background(), cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Swapper", ResourceProperties: properties})
+	if err == nil || elb.Called("ModifyRule") != 0 {
+		t.Errorf("a rule without a single forward action must be refused, got %v", err)
+	}
+}
@@ -5,7 +5,10 @@
 // lambda@edge functions that are always created in the us-east-1 region
 // but that always log in the nearest region where they are used. To
 // configure those log groups via cloudformation (retention, tags), we have
-// the `loggrp` custom resource lambda.
+// the `loggrp` custom resource lambda. The subscription filters, metric
+// filters and KMS key of the log group are managed in its region as well.
+// As lambda@edge functions log in every region, the same log group can be
+// managed in a list of regions or in all the regions of the account.
 //
 // ## Syntax
 // To create a new log group, add the following resource to your cloudformation
@@ -18,9 +21,32 @@
 //     ServiceToken:
 //       Fn::ImportValue:
 //         !Sub ${HyperdriveCore}-LogGroup
+//     AdoptExisting: <true|false>
+//     AllRegions: <true|false>
+//     KmsKeyId: <arn of the kms key>
 //     LogGroupName: <log group name>
+//     MetricFilters:
+//     - FilterName: <name>
+//       FilterPattern: <pattern>
+//       MetricTransformations:
+//       - MetricName: <metric name>
+//         MetricNamespace: <metric namespace>
+//         MetricValue: <metric value>
+//         DefaultValue: <default value>
+//     - ...
 //     Region: <region of the loggrp>
+//     RetainOnDelete: <true|false>
+//     Regions:
+//     - <region>
+//     - ...
 //     RetentionInDays: <retention in days>
+//     SubscriptionFilters:
+//     - FilterName: <name>
+//       FilterPattern: <pattern>
+//       DestinationArn: <arn of the destination>
+//       RoleArn: <arn of the role>
+//       Distribution: <ByLogStream|Random>
+//     - ...
 //     Tags:
 //       <key>: <value>
 //       ...
@@ -37,6 +63,44 @@
 // >
 // > _Required_: Yes
 //
+// `AdoptExisting`
+//
+// > If `true`, an existing log group with the same name, e.g. created by
+// > lambda when the function first logged, is adopted instead of failing:
+// > its retention, KMS key and tags are replaced by the ones of the
+// > resource and the filters of the resource are put. Other filters of the
+// > log group are kept. An adopted log group is deleted with the resource,
+// > also on rollback, unless `RetainOnDelete` is `true`.
+// >
+// > _Type_: Boolean
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: No interruption
+//
+// `AllRegions`
+//
+// > If `true`, the log group is managed in all the regions enabled in the
+// > account. Exclusive with `Region` and `Regions`.
+// >
+// > _Type_: Boolean
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: No interruption
+//
+// `KmsKeyId`
+//
+// > The ARN of the KMS key to encrypt the logs with. The key must be in the
+// > region of the log group and allow cloudwatch logs to use it. As keys
+// > are regional, it can only be used with a single region.
+// >
+// > _Type_: String
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: No interruption
+//
 // `LogGroupName`
 //
 // > The name of the log group. It is also its ID.
@@ -47,6 +111,20 @@
 // >
 // > _Update Requires_: Replacement
 //
+// `MetricFilters`
+//
+// > The metric filters of the log group, identified by their `FilterName`.
+// > The `FilterPattern` and the `MetricTransformations`, with the
+// > `MetricName`, `MetricNamespace`, `MetricValue` and optional
+// > `DefaultValue` of the metrics, are defined as in
+// > `AWS::Logs::MetricFilter`.
+// >
+// > _Type_: List of metric filters
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: No interruption
+//
 // `Region`
 //
 // > The region for the log group. This is mostly useful to create log
@@ -58,6 +136,30 @@
 // >
 // > _Update Requires_: Replacement if different from the current region
 //
+// `RetainOnDelete`
+//
+// > If `true`, the log group and its logs are kept when the resource is
+// > deleted or replaced, or when a region is dropped from `Regions`.
+// >
+// > _Type_: Boolean
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: No interruption
+//
+// `Regions`
+//
+// > The list of regions for the log group. The log group is created with
+// > the same retention, tags and filters in every region. Exclusive with
+// > `Region` and `AllRegions`.
+// >
+// > _Type_: List of regions (string)
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: No interruption. The log group is created in the
+// > added regions and deleted from the dropped ones.
+//
 // `RetentionInDays`
 //
 // > Period of retention of the logs.
@@ -68,6 +170,20 @@
 // >
 // > _Update Requires_: No interruption
 //
+// `SubscriptionFilters`
+//
+// > The subscription filters of the log group, at most 2, identified by
+// > their `FilterName`. The `DestinationArn` of the kinesis stream, firehose
+// > delivery stream or lambda function must be in the region of the log
+// > group; the `RoleArn` is needed for kinesis and firehose destinations.
+// > The optional `Distribution` is either `ByLogStream` or `Random`.
+// >
+// > _Type_: List of subscription filters
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: No interruption
+//
 // `Tags`
 //
 // > Tags to apply on the log group.
@@ -89,6 +205,9 @@
 // `Fn::GetAtt`
 //
 // The resource gives the ARN of the log group under the attribute `Arn`.
+// With `Regions` or `AllRegions`, `Arn` is the ARN in the first region and
+// the ARN in each region is given under the attribute `<region>-Arn`, e.g.
+// `eu-west-1-Arn`.
 //
 // ## Example
 //
@@ -107,31 +226,68 @@
 //     RetentionInDays: "90"
 // ```
 //
+// The following example creates the same log group in all the regions.
+//
+// ```yaml
+// LambdaEdgeLogGroups:
+//   Type: Custom::LogGroup
+//   Properties:
+//     ServiceToken:
+//       Fn::ImportValue:
+//         !Sub ${HyperdriveCore}-LogGroup
+//     LogGroupName: /aws/lambda/us-east-1.lambda_at_edge
+//     AllRegions: true
+//     RetentionInDays: "90"
+// ```
+//
 // ## Implementation
 //
 // The implemention of the `loggrp` lambda uses the
 // [AWS Lambda Go](https://github.com/aws/aws-lambda-go) library to
 // simplify the integration. It is run in the `go1.x` runtime.
+//
+// The operations in the different regions run concurrently. If some
+// regions fail, the error lists the failure of each region; the regions
+// that succeeded are kept as they are and cleaned up by cloudformation on
+// rollback. In several regions, the log groups created or adopted by the
+// resource are tagged with `hyperdrive:loggrp-owner` and only the log
+// groups with the tag of the resource are deleted: a log group that
+// already existed in a region is never deleted on rollback.
 package main
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
 	common "github.com/DEEP-IMPACT-AG/hyperdrive/common"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awsapi"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/resource"
 	"github.com/aws/aws-lambda-go/cfn"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
-	"github.com/mitchellh/mapstructure"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/pkg/errors"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 )
 
 // The lambda is started using the AWS lambda go sdk. The handler function
 // does the actual work of creating the log group. Cloudformation sends an
 // event to signify that a resources must be created, updated or deleted.
 func main() {
-	lambda.Start(cfn.LambdaWrap(processEvent))
+	cfg, err := external.LoadDefaultAWSConfig()
+	if err != nil {
+		panic(err)
+	}
+	group := &logGroup{logs: logService, ec2: awsapi.NewEC2(ec2.New(cfg))}
+	lambda.Start(cfn.LambdaWrap(resource.Handler(resource.Properties(LogGroupProperties{}), group)))
 }
 
 // The main data structure for the log group resource is defined as a go
@@ -140,80 +296,344 @@ func main() {
 // decode the generic map from the cloudformation event to the struct.
 type LogGroupProperties struct {
 	Region, LogGroupName string
+	Regions              []string
+	AllRegions           string
+	AdoptExisting        string
+	RetainOnDelete       string
+	KmsKeyId             string
 	RetentionInDays      string
 	Tags                 map[string]string
+	SubscriptionFilters  []SubscriptionFilter
+	MetricFilters        []MetricFilter
+}
+
+type SubscriptionFilter struct {
+	FilterName, FilterPattern string
+	DestinationArn, RoleArn   string
+	Distribution              string
+}
+
+type MetricFilter struct {
+	FilterName, FilterPattern string
+	MetricTransformations     []MetricTransformation
+}
+
+type MetricTransformation struct {
+	MetricName, MetricNamespace string
+	MetricValue, DefaultValue   string
 }
 
-func logGroupProperties(input map[string]interface{}) (LogGroupProperties, error) {
-	var properties LogGroupProperties
-	if err := mapstructure.Decode(input, &properties); err != nil {
-		return properties, err
+func (properties *LogGroupProperties) Validate() error {
+	scopes := 0
+	for _, defined := range []bool{properties.Region != "", len(properties.Regions) > 0, properties.AllRegions == "true"} {
+		if defined {
+			scopes++
+		}
+	}
+	if scopes > 1 {
+		return errors.New("only one of Region, Regions and AllRegions can be defined")
+	}
+	if properties.KmsKeyId != "" && properties.multiRegion() {
+		return errors.New("the kms key can only be used in a single region")
+	}
+	seen := make(map[string]bool)
+	for _, region := range properties.Regions {
+		if region == "" || seen[region] {
+			return errors.Errorf("the regions must be defined and unique: %q", region)
+		}
+		seen[region] = true
+	}
+	if len(properties.SubscriptionFilters) > maxSubscriptionFilters {
+		return errors.Errorf("at most %d subscription filters can be defined", maxSubscriptionFilters)
+	}
+	names := make(map[string]bool)
+	for _, filter := range properties.SubscriptionFilters {
+		if filter.FilterName == "" || names[filter.FilterName] {
+			return errors.Errorf("the subscription filter names must be defined and unique: %q", filter.FilterName)
+		}
+		names[filter.FilterName] = true
+		if filter.DestinationArn == "" {
+			return errors.Errorf("the destination of the subscription filter %s must be defined", filter.FilterName)
+		}
+	}
+	names = make(map[string]bool)
+	for _, filter := range properties.MetricFilters {
+		if filter.FilterName == "" || names[filter.FilterName] {
+			return errors.Errorf("the metric filter names must be defined and unique: %q", filter.FilterName)
+		}
+		names[filter.FilterName] = true
+		if len(filter.MetricTransformations) == 0 {
+			return errors.Errorf("the metric filter %s must define a metric transformation", filter.FilterName)
+		}
+		for _, transformation := range filter.MetricTransformations {
+			if _, err := transformation.defaultValue(); err != nil {
+				return errors.Wrapf(err, "invalid default value for the metric filter %s", filter.FilterName)
+			}
+		}
 	}
-	return properties, nil
+	return nil
 }
 
-// To process an event, we first decode the resource properties, create a
-// AWS cloudwatch logs client and analyse the event itself. We have 2 cases.
+// maxSubscriptionFilters is the limit of subscription filters per log group.
+const maxSubscriptionFilters = 2
+
+func (properties LogGroupProperties) multiRegion() bool {
+	return len(properties.Regions) > 0 || properties.AllRegions == "true"
+}
+
+// To process an event, we first determine the regions of the log group
+// and create a AWS cloudwatch logs client for each region with the `logs`
+// function that can be replaced in tests. We have 3 cases.
 //
-// 1. Delete: The delete case it self has 2 sub cases: if the physical
-//    resource id is a failure id, then this is a NOP, otherwise we delete
-//    the log group.
-// 2. Create, Update: In that case, we proceed to create the log group with
-//    the given retention period and the given tags.
-//    > As of 2018-07-11, any change to the properties of the log group
-//    > will trigger a replacement. It is buggy to change the tags or the
-//    > retention period.
-func processEvent(ctx context.Context, event cfn.Event) (string, map[string]interface{}, error) {
-	properties, err := logGroupProperties(event.ResourceProperties)
+// 1. Delete: we delete the log group in every region, unless it is
+//    retained. Deleting a log group whose creation has failed is a NOP
+//    handled by the framework and a log group that does not exist anymore
+//    is ignored.
+// 2. Create: we proceed to create the log group with the given retention
+//    period and the given tags in every region.
+// 3. Update: if the name of the log group or its single region changes,
+//    the log group is replaced, otherwise the retention period, the KMS
+//    key, the tags and the filters are updated. The log group is created
+//    in the added regions and deleted from the dropped ones.
+type logGroup struct {
+	logs func(region string) (awsapi.CloudWatchLogs, error)
+	ec2  awsapi.EC2
+}
+
+func (l *logGroup) Create(ctx context.Context, request resource.Request) (string, map[string]interface{}, error) {
+	properties := request.Properties.(LogGroupProperties)
+	regions, err := l.regions(request.Event, properties)
 	if err != nil {
 		return "", nil, err
 	}
-	logs, err := logService(properties)
+	results := l.forEachRegion(regions, func(logs awsapi.CloudWatchLogs, region string) (string, map[string]interface{}, error) {
+		return createLogGroup(logs, request.Event, properties)
+	})
+	return summarize(properties, len(regions), results)
+}
+
+func (l *logGroup) Update(ctx context.Context, request resource.Request) (string, map[string]interface{}, error) {
+	oldProperties := request.OldProperties.(LogGroupProperties)
+	properties := request.Properties.(LogGroupProperties)
+	oldRegions, err := l.regions(request.Event, oldProperties)
+	if err != nil {
+		return request.PhysicalResourceID, nil, err
+	}
+	regions, err := l.regions(request.Event, properties)
 	if err != nil {
-		return "", nil, err
+		return request.PhysicalResourceID, nil, err
 	}
-	switch event.RequestType {
-	case cfn.RequestDelete:
-		if !common.IsFailurePhysicalResourceId(event.PhysicalResourceID) {
-			_, err := logs.DeleteLogGroupRequest(&cloudwatchlogs.DeleteLogGroupInput{
-				LogGroupName: &event.PhysicalResourceID,
-			}).Send()
-			if err != nil {
-				return event.PhysicalResourceID, nil, errors.Wrapf(err, "could not delete log group %s", event.PhysicalResourceID)
+	existing := make(map[string]bool, len(oldRegions))
+	for _, region := range oldRegions {
+		existing[region] = true
+	}
+	kept := make(map[string]bool, len(regions))
+	for _, region := range regions {
+		kept[region] = true
+	}
+	var dropped []string
+	for _, region := range oldRegions {
+		if !kept[region] {
+			dropped = append(dropped, region)
+		}
+	}
+	results := l.forEachRegion(append(regions, dropped...), func(logs awsapi.CloudWatchLogs, region string) (string, map[string]interface{}, error) {
+		switch {
+		case !kept[region]:
+			if properties.RetainOnDelete == "true" {
+				return "", nil, nil
+			}
+			if !oldProperties.multiRegion() {
+				return "", nil, deleteLogGroup(logs, request.PhysicalResourceID)
 			}
+			return "", nil, deleteOwnedLogGroup(logs, request.Event, request.PhysicalResourceID)
+		case !existing[region]:
+			return createLogGroup(logs, request.Event, properties)
+		default:
+			data, err := updateLogGroup(logs, request.Event, oldProperties, properties)
+			return request.PhysicalResourceID, data, err
+		}
+	})
+	_, data, err := summarize(properties, len(regions), results)
+	return request.PhysicalResourceID, data, err
+}
+
+func (l *logGroup) Delete(ctx context.Context, request resource.Request) error {
+	properties := request.Properties.(LogGroupProperties)
+	if properties.RetainOnDelete == "true" {
+		return nil
+	}
+	regions, err := l.regions(request.Event, properties)
+	if err != nil {
+		return err
+	}
+	results := l.forEachRegion(regions, func(logs awsapi.CloudWatchLogs, region string) (string, map[string]interface{}, error) {
+		if !properties.multiRegion() {
+			return "", nil, deleteLogGroup(logs, request.PhysicalResourceID)
 		}
-		return event.PhysicalResourceID, nil, nil
-	case cfn.RequestCreate:
-		return createLogGroup(logs, properties)
-	case cfn.RequestUpdate:
-		oldProperties, err := logGroupProperties(event.OldResourceProperties)
+		return "", nil, deleteOwnedLogGroup(logs, request.Event, request.PhysicalResourceID)
+	})
+	_, _, err = summarize(properties, len(regions), results)
+	return err
+}
+
+// Changing the regions of a log group in several regions is done in
+// place: replacing it would create the new log group in the regions that
+// are kept before deleting the old one there.
+func (l *logGroup) RequiresReplacement(request resource.Request) bool {
+	oldProperties := request.OldProperties.(LogGroupProperties)
+	properties := request.Properties.(LogGroupProperties)
+	if request.Changed("LogGroupName") {
+		return true
+	}
+	if oldProperties.multiRegion() || properties.multiRegion() {
+		return false
+	}
+	return !common.IsSameRegion(request.Event, oldProperties.Region, properties.Region)
+}
+
+// ### Regions
+//
+// With `AllRegions`, the regions enabled in the account are listed with
+// ec2. With a single region, the region may be empty for the region of the
+// lambda; when known, the region of the stack, which is the same, is used
+// instead so that the regions can be compared on update.
+func (l *logGroup) regions(event cfn.Event, properties LogGroupProperties) ([]string, error) {
+	if properties.AllRegions == "true" {
+		output, err := l.ec2.DescribeRegions(&ec2.DescribeRegionsInput{})
 		if err != nil {
-			return "", nil, err
+			return nil, errors.Wrap(err, "could not list the regions")
+		}
+		regions := make([]string, len(output.Regions))
+		for i, region := range output.Regions {
+			regions[i] = *region.RegionName
+		}
+		sort.Strings(regions)
+		return regions, nil
+	}
+	if len(properties.Regions) > 0 {
+		return properties.Regions, nil
+	}
+	if properties.Region == "" && event.StackID != "" {
+		return []string{common.ArnRegion(event.StackID)}, nil
+	}
+	return []string{properties.Region}, nil
+}
+
+// ### Ownership
+//
+// In several regions, the log group may already exist in some of them: its
+// creation fails there but the resource still gets the name of the log
+// group as id from the other regions. The log groups of the resource are
+// therefore tagged with its owner, a hash of the stack and the logical id
+// of the resource; a single log group is owned by the resource if it has
+// its id.
+const ownerTag = "hyperdrive:loggrp-owner"
+
+func owner(event cfn.Event) string {
+	hash := sha1.Sum([]byte(event.StackID + "/" + event.LogicalResourceID))
+	return hex.EncodeToString(hash[:])
+}
+
+// tags gives the tags of the log group, with the owner in several regions.
+func (properties LogGroupProperties) tags(event cfn.Event) map[string]string {
+	if !properties.multiRegion() {
+		return properties.Tags
+	}
+	tags := make(map[string]string, len(properties.Tags)+1)
+	for k, v := range properties.Tags {
+		tags[k] = v
+	}
+	tags[ownerTag] = owner(event)
+	return tags
+}
+
+type regionResult struct {
+	region string
+	id     string
+	data   map[string]interface{}
+	err    error
+}
+
+// The operation runs concurrently in every region. The results are given
+// in the order of the regions.
+func (l *logGroup) forEachRegion(regions []string, operation func(logs awsapi.CloudWatchLogs, region string) (string, map[string]interface{}, error)) []regionResult {
+	results := make([]regionResult, len(regions))
+	var wg sync.WaitGroup
+	for i, region := range regions {
+		wg.Add(1)
+		go func(result *regionResult, region string) {
+			defer wg.Done()
+			result.region = region
+			logs, err := l.logs(region)
+			if err != nil {
+				result.err = err
+				return
+			}
+			result.id, result.data, result.err = operation(logs, region)
+		}(&results[i], region)
+	}
+	wg.Wait()
+	return results
+}
+
+// The results of the first `count` regions give the ARNs; the remaining
+// ones are the regions dropped on update. With a single region, its error
+// is given as is; otherwise the error lists the failure of every region.
+func summarize(properties LogGroupProperties, count int, results []regionResult) (string, map[string]interface{}, error) {
+	var id string
+	var failures []string
+	data := make(map[string]interface{})
+	for i, result := range results {
+		if result.id != "" {
+			id = result.id
+		}
+		if result.err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", result.region, result.err))
+			continue
 		}
-		if oldProperties.LogGroupName != properties.LogGroupName || !common.IsSameRegion(event, oldProperties.Region, properties.Region) {
-			return createLogGroup(logs, properties)
+		if i >= count || result.data == nil {
+			continue
 		}
-		data, err := updateLogGroup(logs, event, oldProperties, properties)
-		return event.PhysicalResourceID, data, err
-	default:
-		return event.PhysicalResourceID, nil, errors.Errorf("unknown request type %s", event.RequestType)
+		if i == 0 {
+			data["Arn"] = result.data["Arn"]
+		}
+		if properties.multiRegion() {
+			data[result.region+"-Arn"] = result.data["Arn"]
+		}
+	}
+	if len(failures) == 0 {
+		return id, data, nil
+	}
+	if len(results) == 1 {
+		return id, nil, results[0].err
 	}
+	return id, nil, errors.Errorf("the log group %s failed in %d of %d regions: %s", properties.LogGroupName, len(failures), len(results), strings.Join(failures, "; "))
 }
 
 // ### Create
 //
 // Creating is a straightforward multi-step process since not all
 // properties can be written at the same time. We first create the log
-// group with its tags. We then put the retention policy in place, if
-// applicable. Finally, we need to fetch the log group arn separately to
-// give is as attribute to the resources.
-func createLogGroup(logs *cloudwatchlogs.CloudWatchLogs, properties LogGroupProperties) (string, map[string]interface{}, error) {
+// group with its tags and KMS key; an existing log group is adopted
+// instead, if allowed. We then put the retention policy and the filters in
+// place, if applicable. Finally, we need to fetch the log group arn
+// separately to give is as attribute to the resources.
+func createLogGroup(logs awsapi.CloudWatchLogs, event cfn.Event, properties LogGroupProperties) (string, map[string]interface{}, error) {
 	// 1. Create the log group
-	_, err := logs.CreateLogGroupRequest(&cloudwatchlogs.CreateLogGroupInput{
+	input := &cloudwatchlogs.CreateLogGroupInput{
 		LogGroupName: &properties.LogGroupName,
-		Tags:         properties.Tags,
-	}).Send()
-	if err != nil {
+		Tags:         properties.tags(event),
+	}
+	if properties.KmsKeyId != "" {
+		input.KmsKeyId = &properties.KmsKeyId
+	}
+	_, err := logs.CreateLogGroup(input)
+	if hasCode(err, cloudwatchlogs.ErrCodeResourceAlreadyExistsException) && properties.AdoptExisting == "true" {
+		if err := adoptLogGroup(logs, event, properties); err != nil {
+			return properties.LogGroupName, nil, err
+		}
+	} else if err != nil {
 		return "", nil, err
 	}
 
@@ -224,66 +644,152 @@ func createLogGroup(logs *cloudwatchlogs.CloudWatchLogs, properties LogGroupProp
 		}
 	}
 
-	// 3. Fetch the log group to get the arn
+	// 3. Put the filters
+	if err := updateSubscriptionFilters(logs, properties.LogGroupName, nil, properties.SubscriptionFilters); err != nil {
+		return properties.LogGroupName, nil, err
+	}
+	if err := updateMetricFilters(logs, properties.LogGroupName, nil, properties.MetricFilters); err != nil {
+		return properties.LogGroupName, nil, err
+	}
+
+	// 4. Fetch the log group to get the arn
 	arn, err := fetchLogGroupArn(logs, properties.LogGroupName)
 	if err != nil {
 		return properties.LogGroupName, nil, err
 	}
 
-	// 4. Construct the response to cloudformation.
+	// 5. Construct the response to cloudformation.
 	return properties.LogGroupName, map[string]interface{}{"Arn": *arn}, nil
 }
 
-func putRetentionPolicy(logs *cloudwatchlogs.CloudWatchLogs, logGroupName string, retention string) error {
+// ### Delete
+//
+// A log group that does not exist anymore, e.g. deleted by hand or never
+// created in a region that failed, is considered deleted.
+func deleteLogGroup(logs awsapi.CloudWatchLogs, logGroupName string) error {
+	_, err := logs.DeleteLogGroup(&cloudwatchlogs.DeleteLogGroupInput{
+		LogGroupName: &logGroupName,
+	})
+	if hasCode(err, cloudwatchlogs.ErrCodeResourceNotFoundException) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "could not delete log group %s", logGroupName)
+	}
+	return nil
+}
+
+// In several regions, only the log groups with the tag of the resource are
+// deleted.
+func deleteOwnedLogGroup(logs awsapi.CloudWatchLogs, event cfn.Event, logGroupName string) error {
+	tags, err := logs.ListTagsLogGroup(&cloudwatchlogs.ListTagsLogGroupInput{
+		LogGroupName: &logGroupName,
+	})
+	if hasCode(err, cloudwatchlogs.ErrCodeResourceNotFoundException) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "could not list the tags of the log group %s", logGroupName)
+	}
+	if tags.Tags[ownerTag] != owner(event) {
+		return nil
+	}
+	return deleteLogGroup(logs, logGroupName)
+}
+
+// To adopt a log group, we replace its KMS key, its retention, if it must
+// be dropped, and its tags with the ones of the resource.
+func adoptLogGroup(logs awsapi.CloudWatchLogs, event cfn.Event, properties LogGroupProperties) error {
+	group, err := describeLogGroup(logs, properties.LogGroupName)
+	if err != nil {
+		return err
+	}
+	if aws.StringValue(group.KmsKeyId) != properties.KmsKeyId {
+		if err := updateKmsKey(logs, properties.LogGroupName, properties.KmsKeyId); err != nil {
+			return err
+		}
+	}
+	if group.RetentionInDays != nil && properties.RetentionInDays == "" {
+		_, err := logs.DeleteRetentionPolicy(&cloudwatchlogs.DeleteRetentionPolicyInput{
+			LogGroupName: &properties.LogGroupName,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "could not delete retention policy for log group %s", properties.LogGroupName)
+		}
+	}
+	tags, err := logs.ListTagsLogGroup(&cloudwatchlogs.ListTagsLogGroupInput{
+		LogGroupName: &properties.LogGroupName,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "could not list the tags of the log group %s", properties.LogGroupName)
+	}
+	return updateTags(logs, properties.LogGroupName, tags.Tags, properties.tags(event))
+}
+
+func hasCode(err error, code string) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == code
+}
+
+func putRetentionPolicy(logs awsapi.CloudWatchLogs, logGroupName string, retention string) error {
 	r, err := strconv.ParseInt(retention, 10, 64)
 	if err != nil {
 		return errors.Wrapf(err, "could not parse retention in days %s for group %s", retention, logGroupName)
 	}
-	_, err = logs.PutRetentionPolicyRequest(&cloudwatchlogs.PutRetentionPolicyInput{
+	_, err = logs.PutRetentionPolicy(&cloudwatchlogs.PutRetentionPolicyInput{
 		LogGroupName:    &logGroupName,
 		RetentionInDays: &r,
-	}).Send()
+	})
 	if err != nil {
 		return errors.Wrapf(err, "could not put retention policy for log group %s", logGroupName)
 	}
 	return nil
 }
 
-func fetchLogGroupArn(logs *cloudwatchlogs.CloudWatchLogs, logGroupName string) (*string, error) {
-	data, err := logs.DescribeLogGroupsRequest(&cloudwatchlogs.DescribeLogGroupsInput{
+func fetchLogGroupArn(logs awsapi.CloudWatchLogs, logGroupName string) (*string, error) {
+	group, err := describeLogGroup(logs, logGroupName)
+	if err != nil {
+		return nil, err
+	}
+	return group.Arn, nil
+}
+
+func describeLogGroup(logs awsapi.CloudWatchLogs, logGroupName string) (*cloudwatchlogs.LogGroup, error) {
+	data, err := logs.DescribeLogGroups(&cloudwatchlogs.DescribeLogGroupsInput{
 		LogGroupNamePrefix: &logGroupName,
-	}).Send()
+	})
 	if err != nil {
 		return nil, errors.Wrapf(err, "could not fetch log groups with prefix %s", logGroupName)
 	}
-	var arn *string
 	for _, group := range data.LogGroups {
 		if *group.LogGroupName == logGroupName {
-			arn = group.Arn
-			break
+			return &group, nil
 		}
 	}
-	if arn == nil {
-		return nil, errors.Errorf("log group not found for name %s", logGroupName)
-	}
-	return arn, nil
+	return nil, errors.Errorf("log group not found for name %s", logGroupName)
 }
 
 // ### Update
-// Only the RetentionInDays and the Tags can be updated without replacing
-// the resource.
+// Only the name and the region of the log group require a replacement.
+// The other properties are updated when they have changed:
 //
 // 1. Retention: if the retention has been dropped, we delete the
 //    corresponding RetentionPolicy, otherwise, we update/create the
 //    Retention policy.
-// 2. If the tags have changed, we first delete the old tags and add the
-//    new tags in a second step.
-func updateLogGroup(logs *cloudwatchlogs.CloudWatchLogs, event cfn.Event, oldProperties LogGroupProperties, properties LogGroupProperties) (map[string]interface{}, error) {
+// 2. KMS key: the new key is associated to the log group or, if it has
+//    been dropped, the old key is disassociated.
+// 3. Tags: we remove the tags that have been dropped and add the new and
+//    modified tags. The owner is tagged when the log group goes to several
+//    regions.
+// 4. Filters: we delete the filters that have been dropped before putting
+//    the new and modified filters, as there may be at most 2 subscription
+//    filters.
+func updateLogGroup(logs awsapi.CloudWatchLogs, event cfn.Event, oldProperties LogGroupProperties, properties LogGroupProperties) (map[string]interface{}, error) {
 	if oldProperties.RetentionInDays != properties.RetentionInDays {
 		if len(oldProperties.RetentionInDays) > 0 && len(properties.RetentionInDays) == 0 {
-			_, err := logs.DeleteRetentionPolicyRequest(&cloudwatchlogs.DeleteRetentionPolicyInput{
+			_, err := logs.DeleteRetentionPolicy(&cloudwatchlogs.DeleteRetentionPolicyInput{
 				LogGroupName: &event.PhysicalResourceID,
-			}).Send()
+			})
 			if err != nil {
 				return nil, errors.Wrapf(err, "could not delete retention policy for log group %s", event.PhysicalResourceID)
 			}
@@ -294,37 +800,180 @@ func updateLogGroup(logs *cloudwatchlogs.CloudWatchLogs, event cfn.Event, oldPro
 			}
 		}
 	}
-	if !reflect.DeepEqual(oldProperties.Tags, properties.Tags) {
-		tags, err := logs.ListTagsLogGroupRequest(&cloudwatchlogs.ListTagsLogGroupInput{
-			LogGroupName: &event.PhysicalResourceID,
-		}).Send()
+	if oldProperties.KmsKeyId != properties.KmsKeyId {
+		if err := updateKmsKey(logs, event.PhysicalResourceID, properties.KmsKeyId); err != nil {
+			return nil, err
+		}
+	}
+	if oldTags, tags := oldProperties.tags(event), properties.tags(event); !reflect.DeepEqual(oldTags, tags) {
+		if err := updateTags(logs, event.PhysicalResourceID, oldTags, tags); err != nil {
+			return nil, err
+		}
+	}
+	if err := updateSubscriptionFilters(logs, event.PhysicalResourceID, oldProperties.SubscriptionFilters, properties.SubscriptionFilters); err != nil {
+		return nil, err
+	}
+	if err := updateMetricFilters(logs, event.PhysicalResourceID, oldProperties.MetricFilters, properties.MetricFilters); err != nil {
+		return nil, err
+	}
+	arn, err := fetchLogGroupArn(logs, event.PhysicalResourceID)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"Arn": *arn}, nil
+}
+
+func updateKmsKey(logs awsapi.CloudWatchLogs, logGroupName, kmsKeyId string) error {
+	if kmsKeyId == "" {
+		_, err := logs.DisassociateKmsKey(&cloudwatchlogs.DisassociateKmsKeyInput{
+			LogGroupName: &logGroupName,
+		})
 		if err != nil {
-			return nil, errors.Wrapf(err, "could not list the tags for log group %s", event.PhysicalResourceID)
+			return errors.Wrapf(err, "could not disassociate the kms key from the log group %s", logGroupName)
 		}
-		t := make([]string, 0, len(tags.Tags))
-		for k := range tags.Tags {
-			t = append(t, k)
+		return nil
+	}
+	_, err := logs.AssociateKmsKey(&cloudwatchlogs.AssociateKmsKeyInput{
+		LogGroupName: &logGroupName,
+		KmsKeyId:     &kmsKeyId,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "could not associate the kms key %s to the log group %s", kmsKeyId, logGroupName)
+	}
+	return nil
+}
+
+func updateTags(logs awsapi.CloudWatchLogs, logGroupName string, oldTags, tags map[string]string) error {
+	var removed []string
+	for k := range oldTags {
+		if _, ok := tags[k]; !ok {
+			removed = append(removed, k)
 		}
-		_, err = logs.UntagLogGroupRequest(&cloudwatchlogs.UntagLogGroupInput{
-			LogGroupName: &event.PhysicalResourceID,
-			Tags:         t,
-		}).Send()
+	}
+	if len(removed) > 0 {
+		sort.Strings(removed)
+		_, err := logs.UntagLogGroup(&cloudwatchlogs.UntagLogGroupInput{
+			LogGroupName: &logGroupName,
+			Tags:         removed,
+		})
 		if err != nil {
-			return nil, errors.Wrapf(err, "could untag the log group %s", event.PhysicalResourceID)
+			return errors.Wrapf(err, "could untag the log group %s", logGroupName)
+		}
+	}
+	added := make(map[string]string)
+	for k, v := range tags {
+		if old, ok := oldTags[k]; !ok || old != v {
+			added[k] = v
 		}
-		_, err = logs.TagLogGroupRequest(&cloudwatchlogs.TagLogGroupInput{
-			LogGroupName: &event.PhysicalResourceID,
-			Tags:         properties.Tags,
-		}).Send()
+	}
+	if len(added) > 0 {
+		_, err := logs.TagLogGroup(&cloudwatchlogs.TagLogGroupInput{
+			LogGroupName: &logGroupName,
+			Tags:         added,
+		})
 		if err != nil {
-			return nil, errors.Wrapf(err, "could tag the log group %s", event.PhysicalResourceID)
+			return errors.Wrapf(err, "could tag the log group %s", logGroupName)
 		}
 	}
-	arn, err := fetchLogGroupArn(logs, event.PhysicalResourceID)
+	return nil
+}
+
+func updateSubscriptionFilters(logs awsapi.CloudWatchLogs, logGroupName string, oldFilters, filters []SubscriptionFilter) error {
+	current := make(map[string]SubscriptionFilter, len(filters))
+	for _, filter := range filters {
+		current[filter.FilterName] = filter
+	}
+	previous := make(map[string]SubscriptionFilter, len(oldFilters))
+	for _, filter := range oldFilters {
+		previous[filter.FilterName] = filter
+		if _, ok := current[filter.FilterName]; ok {
+			continue
+		}
+		_, err := logs.DeleteSubscriptionFilter(&cloudwatchlogs.DeleteSubscriptionFilterInput{
+			LogGroupName: &logGroupName,
+			FilterName:   &filter.FilterName,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "could not delete the subscription filter %s of the log group %s", filter.FilterName, logGroupName)
+		}
+	}
+	for _, filter := range filters {
+		if old, ok := previous[filter.FilterName]; ok && old == filter {
+			continue
+		}
+		input := &cloudwatchlogs.PutSubscriptionFilterInput{
+			LogGroupName:   &logGroupName,
+			FilterName:     &filter.FilterName,
+			FilterPattern:  &filter.FilterPattern,
+			DestinationArn: &filter.DestinationArn,
+			Distribution:   cloudwatchlogs.Distribution(filter.Distribution),
+		}
+		if filter.RoleArn != "" {
+			input.RoleArn = &filter.RoleArn
+		}
+		if _, err := logs.PutSubscriptionFilter(input); err != nil {
+			return errors.Wrapf(err, "could not put the subscription filter %s of the log group %s", filter.FilterName, logGroupName)
+		}
+	}
+	return nil
+}
+
+func updateMetricFilters(logs awsapi.CloudWatchLogs, logGroupName string, oldFilters, filters []MetricFilter) error {
+	current := make(map[string]MetricFilter, len(filters))
+	for _, filter := range filters {
+		current[filter.FilterName] = filter
+	}
+	previous := make(map[string]MetricFilter, len(oldFilters))
+	for _, filter := range oldFilters {
+		previous[filter.FilterName] = filter
+		if _, ok := current[filter.FilterName]; ok {
+			continue
+		}
+		_, err := logs.DeleteMetricFilter(&cloudwatchlogs.DeleteMetricFilterInput{
+			LogGroupName: &logGroupName,
+			FilterName:   &filter.FilterName,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "could not delete the metric filter %s of the log group %s", filter.FilterName, logGroupName)
+		}
+	}
+	for _, filter := range filters {
+		if old, ok := previous[filter.FilterName]; ok && reflect.DeepEqual(old, filter) {
+			continue
+		}
+		transformations := make([]cloudwatchlogs.MetricTransformation, len(filter.MetricTransformations))
+		for i, t := range filter.MetricTransformations {
+			name, namespace, value := t.MetricName, t.MetricNamespace, t.MetricValue
+			defaultValue, _ := t.defaultValue()
+			transformations[i] = cloudwatchlogs.MetricTransformation{
+				MetricName:      &name,
+				MetricNamespace: &namespace,
+				MetricValue:     &value,
+				DefaultValue:    defaultValue,
+			}
+		}
+		_, err := logs.PutMetricFilter(&cloudwatchlogs.PutMetricFilterInput{
+			LogGroupName:          &logGroupName,
+			FilterName:            &filter.FilterName,
+			FilterPattern:         &filter.FilterPattern,
+			MetricTransformations: transformations,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "could not put the metric filter %s of the log group %s", filter.FilterName, logGroupName)
+		}
+	}
+	return nil
+}
+
+func (t MetricTransformation) defaultValue() (*float64, error) {
+	if t.DefaultValue == "" {
+		return nil, nil
+	}
+	value, err := strconv.ParseFloat(t.DefaultValue, 64)
 	if err != nil {
 		return nil, err
 	}
-	return map[string]interface{}{"Arn": *arn}, nil
+	return &value, nil
 }
 
 // ### SDK client
@@ -333,12 +982,12 @@ func updateLogGroup(logs *cloudwatchlogs.CloudWatchLogs, event cfn.Event, oldPro
 // [cloudwatchlogs sdk v2](https://github.com/aws/aws-sdk-go-v2/tree/master/service/cloudwatchlogs)
 // to create the certificate. The client is created with the default
 // credential chain loader, if need be with the supplied region.
-func logService(properties LogGroupProperties) (*cloudwatchlogs.CloudWatchLogs, error) {
+func logService(region string) (awsapi.CloudWatchLogs, error) {
 	cfg, err := external.LoadDefaultAWSConfig(
-		external.WithRegion(properties.Region),
+		external.WithRegion(region),
 	)
 	if err != nil {
-		return nil, errors.Wrapf(err, "could not create aws config with region %s", properties.Region)
+		return nil, errors.Wrapf(err, "could not create aws config with region %s", region)
 	}
-	return cloudwatchlogs.New(cfg), nil
+	return awsapi.NewCloudWatchLogs(cloudwatchlogs.New(cfg)), nil
 }
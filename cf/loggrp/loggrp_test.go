@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awsapi"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awstest"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/resource"
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/pkg/errors"
+)
+
+func TestLogGroup(t *testing.T) {
+	const name = "/aws/lambda/test"
+	properties := func(region, retention string, tags map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"LogGroupName":    name,
+			"Region":          region,
+			"RetentionInDays": retention,
+			"Tags":            tags,
+		}
+	}
+	for i, test := range []struct {
+		event     cfn.Event
+		existing  string
+		failures  awstest.Failures
+		id        string
+		fails     bool
+		region    string
+		retention int64
+		tags      map[string]string
+	}{
+		// test 0: create with retention and tags
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties("eu-west-1", "90", map[string]interface{}{"a": "1"})},
+			id: name, region: "eu-west-1", retention: 90, tags: map[string]string{"a": "1"}},
+		// test 1: failed creation
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Group", ResourceProperties: properties("eu-west-1", "", nil)},
+			failures: awstest.Failures{"CreateLogGroup": errors.New("boom")}, id: "failure-Group", fails: true},
+		// test 2: invalid retention keeps the created log group
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties("eu-west-1", "ninety", nil)},
+			id: name, fails: true, region: "eu-west-1"},
+		// test 3: update of the retention and tags
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: name,
+			ResourceProperties:    properties("eu-west-1", "30", map[string]interface{}{"b": "2"}),
+			OldResourceProperties: properties("eu-west-1", "90", map[string]interface{}{"a": "1"})},
+			existing: "eu-west-1", id: name, region: "eu-west-1", retention: 30, tags: map[string]string{"b": "2"}},
+		// test 4: update of the region replaces the log group
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: name,
+			ResourceProperties:    properties("us-east-1", "90", nil),
+			OldResourceProperties: properties("eu-west-1", "90", nil)},
+			existing: "eu-west-1", id: name, region: "us-east-1", retention: 90, tags: map[string]string{}},
+		// test 5: failed update
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: name,
+			ResourceProperties:    properties("eu-west-1", "", map[string]interface{}{"b": "2"}),
+			OldResourceProperties: properties("eu-west-1", "90", map[string]interface{}{"a": "1"})},
+			existing: "eu-west-1", failures: awstest.Failures{"TagLogGroup": errors.New("boom")}, id: name, fails: true, region: "eu-west-1"},
+		// test 6: delete
+		{event: cfn.Event{RequestType: cfn.RequestDelete, PhysicalResourceID: name, ResourceProperties: properties("eu-west-1", "90", nil)},
+			existing: "eu-west-1", id: name},
+	} {
+		regions := map[string]*awstest.CloudWatchLogs{
+			"eu-west-1": awstest.NewCloudWatchLogs("eu-west-1"),
+			"us-east-1": awstest.NewCloudWatchLogs("us-east-1"),
+		}
+		group := &logGroup{logs: func(region string) (awsapi.CloudWatchLogs, error) {
+			logs, ok := regions[region]
+			if !ok {
+				return nil, errors.Errorf("unexpected region %s", region)
+			}
+			return logs, nil
+		}}
+		handler := resource.Handler(resource.Properties(LogGroupProperties{}), group)
+		if test.existing != "" {
+			existing := properties(test.existing, "90", map[string]interface{}{"a": "1"})
+			if _, _, err := handler(context.Background(), cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: existing}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, logs := range regions {
+			logs.Failures = test.failures
+		}
+		id, data, err := handler(context.Background(), test.event)
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if id != test.id {
+			t.Errorf("test %d: expecting id %s got %s", i, test.id, id)
+		}
+		if test.region == "" {
+			if test.event.RequestType == cfn.RequestDelete && len(regions[test.existing].LogGroups) > 0 {
+				t.Errorf("test %d: log group not deleted", i)
+			}
+			continue
+		}
+		created, ok := regions[test.region].LogGroups[name]
+		if !ok {
+			t.Errorf("test %d: no log group in region %s", i, test.region)
+			continue
+		}
+		if test.fails {
+			continue
+		}
+		if created.RetentionInDays == nil || *created.RetentionInDays != test.retention {
+			t.Errorf("test %d: expecting retention %d got %v", i, test.retention, created.RetentionInDays)
+		}
+		if len(created.Tags) != len(test.tags) {
+			t.Errorf("test %d: expecting tags %v got %v", i, test.tags, created.Tags)
+		}
+		for k, v := range test.tags {
+			if created.Tags[k] != v {
+				t.Errorf("test %d: expecting tags %v got %v", i, test.tags, created.Tags)
+			}
+		}
+		if data["Arn"] != created.Arn {
+			t.Errorf("test %d: expecting arn %s got %v", i, created.Arn, data["Arn"])
+		}
+	}
+}
+
+func TestLogGroupFilters(t *testing.T) {
+	const name = "/aws/lambda/test"
+	subscription := func(name, destination string) map[string]interface{} {
+		return map[string]interface{}{"FilterName": name, "FilterPattern": "ERROR", "DestinationArn": destination}
+	}
+	metric := func(name, pattern, defaultValue string) map[string]interface{} {
+		return map[string]interface{}{"FilterName": name, "FilterPattern": pattern, "MetricTransformations": []interface{}{
+			map[string]interface{}{"MetricName": "Errors", "MetricNamespace": "Test", "MetricValue": "1", "DefaultValue": defaultValue},
+		}}
+	}
+	properties := func(kmsKeyId string, subscriptions, metrics []interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"LogGroupName":        name,
+			"Region":              "eu-west-1",
+			"KmsKeyId":            kmsKeyId,
+			"SubscriptionFilters": subscriptions,
+			"MetricFilters":       metrics,
+		}
+	}
+	existing := properties("key1",
+		[]interface{}{subscription("s1", "arn:aws:lambda:eu-west-1:123456789012:function:f1"), subscription("s2", "arn:aws:lambda:eu-west-1:123456789012:function:f2")},
+		[]interface{}{metric("m1", "ERROR", "0"), metric("m2", "WARN", "")})
+	for i, test := range []struct {
+		event         cfn.Event
+		fails         bool
+		kmsKeyId      string
+		subscriptions []string
+		metrics       map[string]string
+		puts          int
+	}{
+		// test 0: create with the kms key and the filters
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: existing},
+			kmsKeyId: "key1", subscriptions: []string{"s1", "s2"}, metrics: map[string]string{"m1": "ERROR", "m2": "WARN"}, puts: 2},
+		// test 1: only the changed filters are updated, the dropped ones first
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: name,
+			ResourceProperties: properties("key2",
+				[]interface{}{subscription("s1", "arn:aws:lambda:eu-west-1:123456789012:function:f1"), subscription("s3", "arn:aws:lambda:eu-west-1:123456789012:function:f3")},
+				[]interface{}{metric("m1", "FATAL", "0")}),
+			OldResourceProperties: existing},
+			kmsKeyId: "key2", subscriptions: []string{"s1", "s3"}, metrics: map[string]string{"m1": "FATAL"}, puts: 1},
+		// test 2: dropping the kms key
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: name,
+			ResourceProperties: properties("",
+				[]interface{}{subscription("s1", "arn:aws:lambda:eu-west-1:123456789012:function:f1"), subscription("s2", "arn:aws:lambda:eu-west-1:123456789012:function:f2")},
+				[]interface{}{metric("m1", "ERROR", "0"), metric("m2", "WARN", "")}),
+			OldResourceProperties: existing},
+			subscriptions: []string{"s1", "s2"}, metrics: map[string]string{"m1": "ERROR", "m2": "WARN"}},
+		// test 3: at most 2 subscription filters
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: name,
+			ResourceProperties: properties("key1",
+				[]interface{}{subscription("s1", "a1"), subscription("s2", "a2"), subscription("s3", "a3")}, nil),
+			OldResourceProperties: existing},
+			fails: true, kmsKeyId: "key1", subscriptions: []string{"s1", "s2"}, metrics: map[string]string{"m1": "ERROR", "m2": "WARN"}},
+		// test 4: invalid default value of a metric
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: name,
+			ResourceProperties:    properties("key1", nil, []interface{}{metric("m1", "ERROR", "zero")}),
+			OldResourceProperties: existing},
+			fails: true, kmsKeyId: "key1", subscriptions: []string{"s1", "s2"}, metrics: map[string]string{"m1": "ERROR", "m2": "WARN"}},
+	} {
+		logs := awstest.NewCloudWatchLogs("eu-west-1")
+		handler := resource.Handler(resource.Properties(LogGroupProperties{}), &logGroup{logs: func(region string) (awsapi.CloudWatchLogs, error) {
+			return logs, nil
+		}})
+		if test.event.RequestType != cfn.RequestCreate {
+			if _, _, err := handler(context.Background(), cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: existing}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		puts := logs.Called("PutMetricFilter")
+		if _, _, err := handler(context.Background(), test.event); (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		group := logs.LogGroups[name]
+		if group.KmsKeyId != test.kmsKeyId {
+			t.Errorf("test %d: expecting kms key %s got %s", i, test.kmsKeyId, group.KmsKeyId)
+		}
+		if len(group.SubscriptionFilters) != len(test.subscriptions) {
+			t.Errorf("test %d: expecting subscription filters %v got %v", i, test.subscriptions, group.SubscriptionFilters)
+		}
+		for _, subscription := range test.subscriptions {
+			if _, ok := group.SubscriptionFilters[subscription]; !ok {
+				t.Errorf("test %d: missing subscription filter %s", i, subscription)
+			}
+		}
+		if len(group.MetricFilters) != len(test.metrics) {
+			t.Errorf("test %d: expecting metric filters %v got %v", i, test.metrics, group.MetricFilters)
+		}
+		for metric, pattern := range test.metrics {
+			if filter, ok := group.MetricFilters[metric]; !ok || *filter.FilterPattern != pattern {
+				t.Errorf("test %d: expecting metric filter %s with pattern %s", i, metric, pattern)
+			}
+		}
+		if logs.Called("PutMetricFilter")-puts != test.puts {
+			t.Errorf("test %d: expecting %d metric filters put got %d", i, test.puts, logs.Called("PutMetricFilter")-puts)
+		}
+	}
+}
+
+func TestLogGroupRegions(t *testing.T) {
+	const name = "/aws/lambda/us-east-1.edge"
+	properties := func(regions ...interface{}) map[string]interface{} {
+		return map[string]interface{}{"LogGroupName": name, "Regions": regions, "RetentionInDays": "30"}
+	}
+	all := map[string]interface{}{"LogGroupName": name, "AllRegions": "true", "RetentionInDays": "30"}
+	for i, test := range []struct {
+		event    cfn.Event
+		existing []string
+		foreign  []string
+		failures map[string]awstest.Failures
+		id       string
+		fails    string
+		regions  []string
+	}{
+		// test 0: create in several regions
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties("eu-west-1", "us-east-1")},
+			id: name, regions: []string{"eu-west-1", "us-east-1"}},
+		// test 1: create in all the regions
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: all},
+			id: name, regions: []string{"ap-south-1", "eu-west-1", "us-east-1"}},
+		// test 2: partial failure with the detail of the failed region
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties("eu-west-1", "us-east-1")},
+			failures: map[string]awstest.Failures{"us-east-1": {"CreateLogGroup": errors.New("boom")}},
+			id: name, fails: "failed in 1 of 2 regions: us-east-1: boom", regions: []string{"eu-west-1"}},
+		// test 3: update adds and removes regions in place
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: name,
+			ResourceProperties:    properties("eu-west-1", "ap-south-1"),
+			OldResourceProperties: properties("eu-west-1", "us-east-1")},
+			existing: []string{"eu-west-1", "us-east-1"}, id: name, regions: []string{"ap-south-1", "eu-west-1"}},
+		// test 4: delete tolerates a log group missing in a region
+		{event: cfn.Event{RequestType: cfn.RequestDelete, PhysicalResourceID: name, ResourceProperties: all},
+			existing: []string{"eu-west-1", "us-east-1"}, id: name},
+		// test 5: the region properties are exclusive
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Group", ResourceProperties: map[string]interface{}{
+			"LogGroupName": name, "Region": "eu-west-1", "Regions": []interface{}{"us-east-1"}}},
+			id: "failure-Group", fails: "only one of"},
+		// test 6: the creation fails in a region where the log group already exists
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties("eu-west-1", "us-east-1")},
+			foreign: []string{"us-east-1"}, id: name, fails: "failed in 1 of 2 regions: us-east-1", regions: []string{"eu-west-1", "us-east-1"}},
+		// test 7: the rollback of the creation keeps the log group that already existed
+		{event: cfn.Event{RequestType: cfn.RequestDelete, PhysicalResourceID: name, ResourceProperties: properties("eu-west-1", "us-east-1")},
+			existing: []string{"eu-west-1"}, foreign: []string{"us-east-1"}, id: name, regions: []string{"us-east-1"}},
+		// test 8: the update fails in an added region where the log group already exists
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: name,
+			ResourceProperties:    properties("eu-west-1", "us-east-1"),
+			OldResourceProperties: properties("eu-west-1")},
+			existing: []string{"eu-west-1"}, foreign: []string{"us-east-1"}, id: name, fails: "failed in 1 of 2 regions: us-east-1", regions: []string{"eu-west-1", "us-east-1"}},
+		// test 9: the rollback of the update keeps the log group that already existed
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: name,
+			ResourceProperties:    properties("eu-west-1"),
+			OldResourceProperties: properties("eu-west-1", "us-east-1")},
+			existing: []string{"eu-west-1"}, foreign: []string{"us-east-1"}, id: name, regions: []string{"eu-west-1", "us-east-1"}},
+		// test 10: a single log group going to several regions is tagged with its owner
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: name,
+			ResourceProperties:    properties("eu-west-1", "us-east-1"),
+			OldResourceProperties: map[string]interface{}{"LogGroupName": name, "Region": "eu-west-1", "RetentionInDays": "30"}},
+			foreign: []string{"eu-west-1"}, id: name, regions: []string{"eu-west-1", "us-east-1"}},
+	} {
+		regions := map[string]*awstest.CloudWatchLogs{}
+		for _, region := range []string{"ap-south-1", "eu-west-1", "us-east-1"} {
+			regions[region] = awstest.NewCloudWatchLogs(region)
+		}
+		for _, region := range test.existing {
+			regions[region].LogGroups[name] = &awstest.LogGroup{Arn: "arn:aws:logs:" + region + ":123456789012:log-group:" + name,
+				Tags: map[string]string{ownerTag: owner(test.event)}}
+		}
+		for _, region := range test.foreign {
+			regions[region].LogGroups[name] = &awstest.LogGroup{Arn: "arn:aws:logs:" + region + ":123456789012:log-group:" + name}
+		}
+		for region, failures := range test.failures {
+			regions[region].Failures = failures
+		}
+		group := &logGroup{ec2: awstest.NewEC2("us-east-1", "eu-west-1", "ap-south-1"), logs: func(region string) (awsapi.CloudWatchLogs, error) {
+			return regions[region], nil
+		}}
+		id, data, err := resource.Handler(resource.Properties(LogGroupProperties{}), group)(context.Background(), test.event)
+		if (err != nil) != (test.fails != "") || (err != nil && !strings.Contains(err.Error(), test.fails)) {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if id != test.id {
+			t.Errorf("test %d: expecting id %s got %s", i, test.id, id)
+		}
+		var actual []string
+		for _, region := range []string{"ap-south-1", "eu-west-1", "us-east-1"} {
+			if created, ok := regions[region].LogGroups[name]; ok {
+				actual = append(actual, region)
+				if test.fails == "" && test.event.RequestType != cfn.RequestDelete && data[region+"-Arn"] != created.Arn && created.Tags[ownerTag] != "" {
+					t.Errorf("test %d: expecting arn %s for %s got %v", i, created.Arn, region, data[region+"-Arn"])
+				}
+			}
+		}
+		if !reflect.DeepEqual(actual, test.regions) {
+			t.Errorf("test %d: expecting log groups in %v got %v", i, test.regions, actual)
+		}
+		for _, region := range test.foreign {
+			if tag := regions[region].LogGroups[name].Tags[ownerTag]; (tag != "") != (test.event.RequestType == cfn.RequestUpdate && test.fails == "" && region == "eu-west-1") {
+				t.Errorf("test %d: unexpected owner %q in %s", i, tag, region)
+			}
+		}
+	}
+}
+
+func TestLogGroupAdoptAndRetain(t *testing.T) {
+	const name = "/aws/lambda/us-east-1.edge"
+	properties := func(adopt, retain, retention string, regions ...interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"LogGroupName":    name,
+			"Regions":         regions,
+			"RetentionInDays": retention,
+			"Tags":            map[string]interface{}{"b": "2"},
+			"AdoptExisting":   adopt,
+			"RetainOnDelete":  retain,
+		}
+	}
+	for i, test := range []struct {
+		event     cfn.Event
+		existing  []string
+		owned     bool
+		id        string
+		fails     bool
+		regions   []string
+		retention int64
+		tags      map[string]string
+	}{
+		// test 0: an existing log group is not adopted by default
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Group", ResourceProperties: properties("", "", "30", "eu-west-1")},
+			existing: []string{"eu-west-1"}, id: "failure-Group", fails: true, regions: []string{"eu-west-1"}, retention: 7, tags: map[string]string{"a": "1"}},
+		// test 1: adoption of the existing log group
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties("true", "", "30", "eu-west-1", "us-east-1")},
+			existing: []string{"eu-west-1"}, id: name, regions: []string{"eu-west-1", "us-east-1"}, retention: 30, tags: map[string]string{"b": "2", ownerTag: owner(cfn.Event{})}},
+		// test 2: the adoption drops the retention of the existing log group
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties("true", "", "", "eu-west-1")},
+			existing: []string{"eu-west-1"}, id: name, regions: []string{"eu-west-1"}, tags: map[string]string{"b": "2", ownerTag: owner(cfn.Event{})}},
+		// test 3: the log group is retained on delete
+		{event: cfn.Event{RequestType: cfn.RequestDelete, PhysicalResourceID: name, ResourceProperties: properties("", "true", "30", "eu-west-1")},
+			existing: []string{"eu-west-1"}, id: name, regions: []string{"eu-west-1"}, retention: 7, tags: map[string]string{"a": "1"}},
+		// test 4: the log group is retained in the dropped region
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: name,
+			ResourceProperties:    properties("", "true", "7", "us-east-1"),
+			OldResourceProperties: properties("", "true", "7", "eu-west-1", "us-east-1")},
+			existing: []string{"eu-west-1", "us-east-1"}, id: name, regions: []string{"eu-west-1", "us-east-1"}, retention: 7, tags: map[string]string{"a": "1"}},
+		// test 5: the log group is deleted otherwise
+		{event: cfn.Event{RequestType: cfn.RequestDelete, PhysicalResourceID: name, ResourceProperties: properties("", "", "30", "eu-west-1")},
+			existing: []string{"eu-west-1"}, owned: true, id: name},
+	} {
+		regions := map[string]*awstest.CloudWatchLogs{
+			"eu-west-1": awstest.NewCloudWatchLogs("eu-west-1"),
+			"us-east-1": awstest.NewCloudWatchLogs("us-east-1"),
+		}
+		for _, region := range test.existing {
+			retention := int64(7)
+			regions[region].LogGroups[name] = &awstest.LogGroup{
+				Arn:             "arn:aws:logs:" + region + ":123456789012:log-group:" + name,
+				RetentionInDays: &retention,
+				Tags:            map[string]string{"a": "1"},
+			}
+			if test.owned {
+				regions[region].LogGroups[name].Tags[ownerTag] = owner(test.event)
+			}
+		}
+		group := &logGroup{logs: func(region string) (awsapi.CloudWatchLogs, error) {
+			return regions[region], nil
+		}}
+		id, _, err := resource.Handler(resource.Properties(LogGroupProperties{}), group)(context.Background(), test.event)
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if id != test.id {
+			t.Errorf("test %d: expecting id %s got %s", i, test.id, id)
+		}
+		var actual []string
+		for _, region := range []string{"eu-west-1", "us-east-1"} {
+			if _, ok := regions[region].LogGroups[name]; ok {
+				actual = append(actual, region)
+			}
+		}
+		if !reflect.DeepEqual(actual, test.regions) {
+			t.Errorf("test %d: expecting log groups in %v got %v", i, test.regions, actual)
+		}
+		if len(actual) == 0 {
+			continue
+		}
+		adopted := regions["eu-west-1"].LogGroups[name]
+		if (adopted.RetentionInDays == nil && test.retention != 0) || (adopted.RetentionInDays != nil && *adopted.RetentionInDays != test.retention) {
+			t.Errorf("test %d: expecting retention %d got %v", i, test.retention, adopted.RetentionInDays)
+		}
+		if !reflect.DeepEqual(adopted.Tags, test.tags) {
+			t.Errorf("test %d: expecting tags %v got %v", i, test.tags, adopted.Tags)
+		}
+	}
+}
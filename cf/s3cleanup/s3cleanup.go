@@ -7,6 +7,9 @@
 //
 // With the flag "ActiveOnlyOnStackDeletion" (default true) is true, The `s3cleanup` custom resource only deletes objects
 // when the stack itself is being deleted. In that case, it also safe to remove the resource from an existing stack.
+// The stack is also considered deleted when one of its parent stacks is deleted or when the creation of the stack or
+// of one of its parents is rolled back; the lifecycles in which objects are deleted can be chosen with
+// "CleanupLifecycles".
 //
 // When the flag "ActiveOnlyOnStackDeletion" is false, the `s3cleanup` custom resource deletes objects when it is deleted.
 // This is mostly useful when regularly replacing the `s3cleanup` custom resource when changing the prefix. An example
@@ -15,6 +18,23 @@
 // is the flag "ActiveOnlyOnStackDeletion" to true.
 // Changing the bucket or the prefix will trigger a replacement and therefore a deletion of the resource.
 //
+// Deleting the objects of a large bucket may take longer than the lambda may run. The deletion then
+// continues in new invocations of the lambda until all the objects are deleted; the lambda must be
+// allowed to invoke itself.
+//
+// All the versions and the delete markers of the objects are deleted and the incomplete multipart uploads
+// are aborted so that a versioned bucket can be deleted afterwards. With the flag "DeleteBucket", the
+// resource deletes the emptied bucket itself, e.g. a bucket with the deletion policy `Retain` that
+// cloudformation does not delete.
+//
+// As deleting objects cannot be undone, the resource can write a manifest of everything it deletes to an
+// audit bucket before deleting it. With the flag "DryRun", nothing is deleted: the manifest lists what would
+// be deleted and the resource gives the number and the total size of the objects as attributes when it is
+// created or updated. The objects to delete can be restricted with filters, e.g. to delete the build
+// artifacts older than 30 days under some prefixes only. An object version is deleted if its key starts
+// with one of the prefixes, its key ends with one of the suffixes or matches one of the patterns, if any,
+// it has all the tags, if any, and it is older than the given age, if any.
+//
 // ## Syntax
 //
 // To create an `s3cleanup` resource, add the following resource to your cloudformation
@@ -28,8 +48,28 @@
 //       Fn::ImportValue:
 //         !Sub ${HyperdriveCore}-S3Cleanup
 //     ActiveOnlyOnStackDeletion: true
+//     CleanupLifecycles:
+//     - <Delete|CreateRollback|Replacement|UpdateCleanup|UpdateRollback|Other>
+//     - ...
+//     AuditBucket: <bucket name>
+//     AuditPrefix: <prefix>
 //     Bucket: <bucket name>
+//     DeleteBucket: <true|false>
+//     DryRun: <true|false>
+//     OlderThanDays: <days>
+//     Patterns:
+//     - <glob pattern>
+//     - ...
 //     Prefix: <prefix>
+//     Prefixes:
+//     - <prefix>
+//     - ...
+//     Suffixes:
+//     - <suffix>
+//     - ...
+//     Tags:
+//       <key>: <value>
+//       ...
 // ```
 //
 // ## Properties
@@ -46,6 +86,44 @@
 //
 // _Update Requires_: no interruption
 //
+// `CleanupLifecycles`
+//
+// > The lifecycles of the stack in which the resource deletes objects when the flag `ActiveOnlyOnStackDeletion`
+// > is true: `Delete` (the stack or one of its parent stacks is being deleted), `CreateRollback` (the creation
+// > of the stack or of one of its parent stacks is rolled back), `Replacement` (the resource is replaced during
+// > an update), `UpdateCleanup` (the resource is removed from the template), `UpdateRollback` (the update of the
+// > stack is rolled back) and `Other`. By default `Delete` and `CreateRollback`.
+//
+// _Type_: List of String
+//
+// _Required_: No
+//
+// _Update Requires_: no interruption
+//
+// `AuditBucket`
+//
+// > The name of the S3 bucket to write the manifest to. The manifest is made of CSV files with the key, the
+// > version id, the size and the last modification of the deleted objects, one file per batch, written under
+// > `<AuditPrefix><logical id>/<start of the operation>/`. Each file is written before the batch is deleted.
+// > Delete markers are listed with a size of 0; aborted multipart uploads are not listed.
+// >
+// > _Type_: Bucket Name
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: no interruption
+//
+// `AuditPrefix`
+//
+// > The prefix of the manifest in the audit bucket. If the audit bucket is the cleaned up bucket, the
+// > manifest must not be under one of the prefixes deleted.
+// >
+// > _Type_: String
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: no interruption
+//
 // `Bucket`
 //
 // > The name of the S3 Bucket to cleanup when the `s3cleanup` resource is deleted while its stack
@@ -57,6 +135,51 @@
 // >
 // > _Update Requires_: replacement
 //
+// `DeleteBucket`
+//
+// > If the flag is true, the bucket itself is deleted once it is empty. The flag cannot be combined with
+// > prefixes or filters.
+// >
+// > _Type_: Boolean
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: no interruption
+//
+// `DryRun`
+//
+// > If the flag is true, no object is deleted and no bucket is deleted. On creation and on update, the
+// > objects that would be deleted are listed in the manifest and counted; on deletion, they are listed in
+// > the manifest only.
+// >
+// > _Type_: Boolean
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: no interruption
+//
+// `OlderThanDays`
+//
+// > Only the object versions last modified more than the given number of days ago are deleted. The age is
+// > computed when the deletion starts.
+// >
+// > _Type_: Integer as String
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: no interruption
+//
+// `Patterns`
+//
+// > Glob patterns, as defined by the go function `path.Match`, that the keys of the objects to delete must
+// > match. A `*` does not match a `/`: `builds/*/*.zip` matches the archives one level below `builds/`.
+// >
+// > _Type_: List of String
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: no interruption
+//
 // `Prefix`
 //
 // > A prefix to delete objects. If the prefix is omitted or is empty, then all objects are deleted.
@@ -66,32 +189,103 @@
 // > _Required_: No
 // >
 // > _Update Requires_: replacement
+//
+// `Prefixes`
+//
+// > Further prefixes to delete objects, in addition to `Prefix`.
+// >
+// > _Type_: List of String
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: no interruption
+//
+// `Suffixes`
+//
+// > Suffixes, e.g. `.zip`, that the keys of the objects to delete must end with, unless they match one of
+// > the `Patterns`.
+// >
+// > _Type_: List of String
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: no interruption
+//
+// `Tags`
+//
+// > Tags that the object versions to delete must have. The tags of every version are fetched, which slows
+// > the deletion down. Delete markers and multipart uploads have no tags and are kept.
+// >
+// > _Type_: map of String to String
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: no interruption
+//
+// ## Return Values
+//
+// `Fn::GetAtt`
+//
+// In a dry run, the resource gives the number of objects that would be deleted under the attribute
+// `ObjectCount` and their total size in bytes under the attribute `ByteCount`.
+//
+// ## Example
+//
+// The following example deletes a retained bucket with all its content when the stack is deleted.
+//
+// ```yaml
+// ArtifactsBucket:
+//   Type: AWS::S3::Bucket
+//   DeletionPolicy: Retain
+// ArtifactsBucketCleanup:
+//   Type: Custom::S3Cleanup
+//   Properties:
+//     ServiceToken:
+//       Fn::ImportValue:
+//         !Sub ${HyperdriveCore}-S3Cleanup
+//     Bucket: !Ref ArtifactsBucket
+//     DeleteBucket: true
+// ```
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/csv"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/DEEP-IMPACT-AG/hyperdrive/common"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awsapi"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/resource"
 	"github.com/aws/aws-lambda-go/cfn"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
 	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	awslambda "github.com/aws/aws-sdk-go-v2/service/lambda"
 	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/mitchellh/mapstructure"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/pkg/errors"
 )
 
-var s3 *awss3.S3
-var cf *cloudformation.CloudFormation
-
 func main() {
 	cfg, err := external.LoadDefaultAWSConfig()
 	if err != nil {
 		panic(err)
 	}
-	s3 = awss3.New(cfg)
-	cf = cloudformation.New(cfg)
-	lambda.Start(cfn.LambdaWrap(processEvent))
+	lambda.Start(resource.LambdaWrap(
+		resource.Handler(resource.Properties(S3CleanupProperties{}), &s3Cleanup{
+			s3: awsapi.NewS3(awss3.New(cfg)),
+			cf: awsapi.NewCloudFormation(cloudformation.New(cfg)),
+		}),
+		awsapi.NewLambda(awslambda.New(cfg)),
+		awsapi.NewSQS(sqs.New(cfg)),
+	))
 }
 
 // The S3CleanupProperties is the main data structure for the s3bucket resource and
@@ -100,120 +294,534 @@ func main() {
 // decode the generic map from the cloudformation event to the struct.
 type S3CleanupProperties struct {
 	ActiveOnlyOnStackDeletion string
+	CleanupLifecycles         []string
 	Bucket, Prefix            string
+	Prefixes                  []string
+	Suffixes, Patterns        []string
+	Tags                      map[string]string
+	OlderThanDays             string
+	DeleteBucket              string
+	DryRun                    string
+	AuditBucket, AuditPrefix  string
 }
 
-func s3CleanupProperties(input map[string]interface{}) (S3CleanupProperties, error) {
-	var properties S3CleanupProperties
-	if err := mapstructure.Decode(input, &properties); err != nil {
-		return properties, err
+func (properties *S3CleanupProperties) Validate() error {
+	if err := resource.ValidateLifecycles(properties.CleanupLifecycles); err != nil {
+		return err
 	}
 	if properties.Bucket == "" {
-		return properties, errors.New("bucket name must be defined")
+		return errors.New("bucket name must be defined")
+	}
+	for _, pattern := range properties.Patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "invalid pattern %s", pattern)
+		}
+	}
+	if properties.OlderThanDays != "" {
+		if days, err := strconv.Atoi(properties.OlderThanDays); err != nil || days < 0 {
+			return errors.Errorf("invalid number of days %s", properties.OlderThanDays)
+		}
+	}
+	if properties.DeleteBucket == "true" && properties.filtered() {
+		return errors.New("the bucket can only be deleted without prefixes and filters")
+	}
+	if properties.AuditPrefix != "" && properties.AuditBucket == "" {
+		return errors.New("the audit prefix requires an audit bucket")
+	}
+	if properties.AuditBucket == properties.Bucket && properties.DryRun != "true" {
+		for _, prefix := range properties.prefixes() {
+			if strings.HasPrefix(properties.AuditPrefix, prefix) {
+				return errors.Errorf("the manifest under %s would be deleted with the prefix %s", properties.AuditPrefix, prefix)
+			}
+		}
+	}
+	return nil
+}
+
+func (properties S3CleanupProperties) filtered() bool {
+	return properties.Prefix != "" || len(properties.Prefixes) > 0 || len(properties.Suffixes) > 0 ||
+		len(properties.Patterns) > 0 || len(properties.Tags) > 0 || properties.OlderThanDays != ""
+}
+
+// The prefixes are deleted one after the other; without prefix, the whole
+// bucket is deleted.
+func (properties S3CleanupProperties) prefixes() []string {
+	if len(properties.Prefixes) == 0 {
+		return []string{properties.Prefix}
+	}
+	if properties.Prefix == "" {
+		return properties.Prefixes
 	}
-	return properties, nil
+	return append([]string{properties.Prefix}, properties.Prefixes...)
 }
 
-// To process an event, we first decode the resource properties and analyse
-// the event. We have 2 cases.
+// matches checks the age, the suffixes and the patterns.
+func (properties S3CleanupProperties) matches(before *time.Time, key string, modified *time.Time) bool {
+	if before != nil && (modified == nil || !modified.Before(*before)) {
+		return false
+	}
+	if len(properties.Suffixes) == 0 && len(properties.Patterns) == 0 {
+		return true
+	}
+	for _, suffix := range properties.Suffixes {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	for _, pattern := range properties.Patterns {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// We have 2 cases.
 //
 // 1. Delete: The delete case it self has 3 sub cases:
-//    1. the physical resource id is a failure id, then this is a NOP;
+//    1. the physical resource id is a failure id, then this is a NOP
+//       handled by the framework;
 //    2. the stack is being deleted: in that case, we delete all the objects with the given
-//       path prefix from the S3 bucket or, if the path prefix is not defined, we delete
-//       all the resources.
+//       path prefixes from the S3 bucket or, if no path prefix is defined, we delete
+//       all the resources, as far as they match the filters. In a dry run, the objects
+//       are only listed in the manifest.
 //    3. the stack is not being delete: it is a NOP as well.
+//
+//    Deleting many objects may continue in further invocations of the
+//    lambda; the stack is then not checked again.
 // 2. Create, Update: In that case, it is a NOP, the physical ID is simply
-//    the logical ID.
-func processEvent(ctx context.Context, event cfn.Event) (string, map[string]interface{}, error) {
-	properties, err := s3CleanupProperties(event.ResourceProperties)
+//    the logical ID. In a dry run, the objects that would be deleted are
+//    listed in the manifest and counted.
+type s3Cleanup struct {
+	s3 awsapi.S3
+	cf awsapi.CloudFormation
+}
+
+func (c *s3Cleanup) Create(ctx context.Context, request resource.Request) (string, map[string]interface{}, error) {
+	return c.dryRun(ctx, request)
+}
+
+func (c *s3Cleanup) Update(ctx context.Context, request resource.Request) (string, map[string]interface{}, error) {
+	return c.dryRun(ctx, request)
+}
+
+func (c *s3Cleanup) dryRun(ctx context.Context, request resource.Request) (string, map[string]interface{}, error) {
+	properties := request.Properties.(S3CleanupProperties)
+	id := physicalResourceId(request.Event, properties)
+	if properties.DryRun != "true" {
+		return id, nil, nil
+	}
+	state := newCleanupState(request.Event, properties)
+	if request.Continued() {
+		if err := request.DecodeState(&state); err != nil {
+			return id, nil, err
+		}
+	}
+	state, err := deleteVersions(ctx, c.s3, properties, state)
 	if err != nil {
-		return "", nil, err
-	}
-	switch event.RequestType {
-	case cfn.RequestDelete:
-		if !common.IsFailurePhysicalResourceId(event.PhysicalResourceID) {
-			delete, err := shouldDelete(event, properties);
-			if err != nil {
-				return event.PhysicalResourceID, nil, errors.Wrapf(err, "could not fetch the stack for the resource %s", event.PhysicalResourceID)
-			}
-			if delete {
-				if err = deleteObjects(properties); err != nil {
-					return event.PhysicalResourceID, nil, errors.Wrapf(err, "could not delete the images of the repository %s", event.PhysicalResourceID)
-				}
-			}
+		return id, nil, err
+	}
+	return id, map[string]interface{}{"ObjectCount": state.Objects, "ByteCount": state.Bytes}, nil
+}
+
+func (c *s3Cleanup) Delete(ctx context.Context, request resource.Request) error {
+	properties := request.Properties.(S3CleanupProperties)
+	state := newCleanupState(request.Event, properties)
+	if request.Continued() {
+		if err := request.DecodeState(&state); err != nil {
+			return err
+		}
+	} else {
+		delete, err := shouldDelete(c.cf, request.Event, properties)
+		if err != nil {
+			return errors.Wrapf(err, "could not fetch the stack for the resource %s", request.PhysicalResourceID)
+		}
+		if !delete {
+			return nil
 		}
-		return event.PhysicalResourceID, nil, nil
-	case cfn.RequestCreate:
-		return physicalResourceId(event, properties), nil, nil
-	case cfn.RequestUpdate:
-		return physicalResourceId(event, properties), nil, nil
-	default:
-		return event.LogicalResourceID, nil, errors.Errorf("unknown request type %s", event.RequestType)
 	}
+	if err := deleteObjects(ctx, c.s3, properties, state); err != nil {
+		return err
+	}
+	if properties.DeleteBucket == "true" && properties.DryRun != "true" {
+		return deleteBucket(c.s3, properties.Bucket)
+	}
+	return nil
 }
 
-func shouldDelete(event cfn.Event, properties S3CleanupProperties) (bool, error) {
+func shouldDelete(cf awsapi.CloudFormation, event cfn.Event, properties S3CleanupProperties) (bool, error) {
 	if properties.ActiveOnlyOnStackDeletion == "false" {
 		return true, nil
 	}
-	stacks, err := cf.DescribeStacksRequest(&cloudformation.DescribeStacksInput{
-		StackName: &event.StackID,
-	}).Send()
+	return resource.ShouldCleanup(cf, event, properties.CleanupLifecycles)
+}
+
+// A bucket may contain more versions than a single invocation of the
+// lambda can delete. When the time left gets short, the deletion stops
+// after the current page and continues in a new invocation from the
+// markers of the next page. Once the versions are deleted, the multipart
+// uploads are aborted the same way. The age limit, the manifest and the
+// counts are kept over the invocations.
+type cleanupState struct {
+	PrefixIndex                int `json:",omitempty"`
+	KeyMarker, VersionIdMarker *string
+	UploadIdMarker             *string    `json:",omitempty"`
+	Uploads                    bool       `json:",omitempty"`
+	Before                     *time.Time `json:",omitempty"`
+	Manifest                   string     `json:",omitempty"`
+	Part                       int        `json:",omitempty"`
+	Objects, Bytes             int64
+}
+
+// The manifest of an operation is written under the audit prefix in a
+// folder named after the resource and the start of the operation.
+func newCleanupState(event cfn.Event, properties S3CleanupProperties) cleanupState {
+	var state cleanupState
+	now := time.Now().UTC()
+	if properties.OlderThanDays != "" {
+		days, _ := strconv.Atoi(properties.OlderThanDays)
+		before := now.AddDate(0, 0, -days)
+		state.Before = &before
+	}
+	if properties.AuditBucket != "" {
+		state.Manifest = properties.AuditPrefix + event.LogicalResourceID + "/" + now.Format("20060102T150405Z") + "/"
+	}
+	return state
+}
+
+// minTimeLeft is the time left below which no new page is deleted.
+const minTimeLeft = time.Minute
+
+// maxWorkers is the number of batches of objects deleted concurrently.
+const maxWorkers = 4
+
+// maxReportedFailures is the number of objects that could not be deleted
+// listed in the error.
+const maxReportedFailures = 10
+
+// The pages of versions and delete markers are listed one after the other
+// and the selected objects of each page are deleted in a batch by one of
+// the workers. Before continuing in a new invocation, the running batches
+// are awaited.
+func deleteObjects(ctx context.Context, s3 awsapi.S3, properties S3CleanupProperties, state cleanupState) error {
+	if !state.Uploads {
+		var err error
+		if state, err = deleteVersions(ctx, s3, properties, state); err != nil || properties.DryRun == "true" {
+			return err
+		}
+		state = cleanupState{Uploads: true, Before: state.Before}
+		if resource.TimeLeft(ctx) < minTimeLeft {
+			return resource.InProgress(state, 0)
+		}
+	}
+	return abortUploads(ctx, s3, properties, state)
+}
+
+func deleteVersions(ctx context.Context, s3 awsapi.S3, properties S3CleanupProperties, state cleanupState) (cleanupState, error) {
+	deleter := newBatchDeleter(s3, properties, state)
+	prefixes := properties.prefixes()
+	for state.PrefixIndex < len(prefixes) && !deleter.failed() {
+		versions, err := s3.ListObjectVersions(&awss3.ListObjectVersionsInput{
+			Bucket:          &properties.Bucket,
+			Prefix:          &prefixes[state.PrefixIndex],
+			KeyMarker:       state.KeyMarker,
+			VersionIdMarker: state.VersionIdMarker,
+		})
+		if err != nil {
+			deleter.wait(&state)
+			return state, errors.Wrapf(err, "could not fetch versions for the bucket %s", properties.Bucket)
+		}
+		deleter.delete(selectObjects(properties, state.Before, versions))
+		if *versions.IsTruncated {
+			state.KeyMarker, state.VersionIdMarker = versions.NextKeyMarker, versions.NextVersionIdMarker
+		} else {
+			state.PrefixIndex++
+			state.KeyMarker, state.VersionIdMarker = nil, nil
+		}
+		if state.PrefixIndex < len(prefixes) && resource.TimeLeft(ctx) < minTimeLeft {
+			if err := deleter.wait(&state); err != nil {
+				return state, err
+			}
+			return state, resource.InProgress(state, 0)
+		}
+	}
+	return state, deleter.wait(&state)
+}
+
+// An object is a version or a delete marker with the data of the manifest.
+type object struct {
+	awss3.ObjectIdentifier
+	size     int64
+	modified *time.Time
+}
+
+// The delete markers are selected like the versions but without tags:
+// deleting the latest delete marker of an object whose versions are kept
+// would restore the object.
+func selectObjects(properties S3CleanupProperties, before *time.Time, versions *awss3.ListObjectVersionsOutput) []object {
+	var objects []object
+	for _, version := range versions.Versions {
+		if properties.matches(before, *version.Key, version.LastModified) {
+			var size int64
+			if version.Size != nil {
+				size = *version.Size
+			}
+			objects = append(objects, object{awss3.ObjectIdentifier{Key: version.Key, VersionId: version.VersionId}, size, version.LastModified})
+		}
+	}
+	if len(properties.Tags) > 0 {
+		return objects
+	}
+	for _, marker := range versions.DeleteMarkers {
+		if properties.matches(before, *marker.Key, marker.LastModified) {
+			objects = append(objects, object{awss3.ObjectIdentifier{Key: marker.Key, VersionId: marker.VersionId}, 0, marker.LastModified})
+		}
+	}
+	return objects
+}
+
+// The batchDeleter deletes batches of objects with at most `maxWorkers`
+// concurrent calls. Each batch is written to its own part of the manifest
+// before being deleted. The objects that S3 could not delete are collected
+// and reported together once all the batches are done.
+type batchDeleter struct {
+	s3          awsapi.S3
+	bucket      string
+	tags        map[string]string
+	dryRun      bool
+	auditBucket string
+	manifest    string
+	workers     chan struct{}
+	wg          sync.WaitGroup
+	mutex       sync.Mutex
+	err         error
+	failures    []string
+	part        int
+	objects     int64
+	bytes       int64
+}
+
+func newBatchDeleter(s3 awsapi.S3, properties S3CleanupProperties, state cleanupState) *batchDeleter {
+	return &batchDeleter{
+		s3:          s3,
+		bucket:      properties.Bucket,
+		tags:        properties.Tags,
+		dryRun:      properties.DryRun == "true",
+		auditBucket: properties.AuditBucket,
+		manifest:    state.Manifest,
+		workers:     make(chan struct{}, maxWorkers),
+		part:        state.Part,
+		objects:     state.Objects,
+		bytes:       state.Bytes,
+	}
+}
+
+func (d *batchDeleter) delete(objects []object) {
+	if len(objects) == 0 {
+		return
+	}
+	d.workers <- struct{}{}
+	d.wg.Add(1)
+	d.part++
+	go func(part int) {
+		defer func() {
+			<-d.workers
+			d.wg.Done()
+		}()
+		failures, err := d.deleteBatch(part, objects)
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		d.failures = append(d.failures, failures...)
+		if err != nil && d.err == nil {
+			d.err = err
+		}
+	}(d.part)
+}
+
+func (d *batchDeleter) deleteBatch(part int, objects []object) ([]string, error) {
+	if len(d.tags) > 0 {
+		var err error
+		if objects, err = d.tagged(objects); err != nil || len(objects) == 0 {
+			return nil, err
+		}
+	}
+	if d.manifest != "" {
+		if err := d.writeManifest(part, objects); err != nil {
+			return nil, err
+		}
+	}
+	d.count(objects)
+	if d.dryRun {
+		return nil, nil
+	}
+	identifiers := make([]awss3.ObjectIdentifier, len(objects))
+	for i, object := range objects {
+		identifiers[i] = object.ObjectIdentifier
+	}
+	quiet := true
+	output, err := d.s3.DeleteObjects(&awss3.DeleteObjectsInput{
+		Bucket: &d.bucket,
+		Delete: &awss3.Delete{
+			Objects: identifiers,
+			Quiet:   &quiet,
+		},
+	})
 	if err != nil {
-		return false, errors.Wrapf(err, "could not fetch the stack for the resource %s", event.PhysicalResourceID)
+		return nil, errors.Wrapf(err, "could not delete objects from the s3 bucket %s", d.bucket)
+	}
+	failures := make([]string, len(output.Errors))
+	for i, e := range output.Errors {
+		failures[i] = fmt.Sprintf("%s (version %s): %s", aws.StringValue(e.Key), aws.StringValue(e.VersionId), aws.StringValue(e.Message))
+	}
+	return failures, nil
+}
+
+func (d *batchDeleter) tagged(objects []object) ([]object, error) {
+	var selected []object
+	for _, object := range objects {
+		tagging, err := d.s3.GetObjectTagging(&awss3.GetObjectTaggingInput{
+			Bucket:    &d.bucket,
+			Key:       object.Key,
+			VersionId: object.VersionId,
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not fetch the tags of the object %s in the s3 bucket %s", *object.Key, d.bucket)
+		}
+		tags := make(map[string]string, len(tagging.TagSet))
+		for _, tag := range tagging.TagSet {
+			tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+		matches := true
+		for k, v := range d.tags {
+			if value, ok := tags[k]; !ok || value != v {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			selected = append(selected, object)
+		}
 	}
-	stackStatus := stacks.Stacks[0].StackStatus
-	return stackStatus == cloudformation.StackStatusDeleteInProgress, nil
+	return selected, nil
 }
 
-func deleteObjects(properties S3CleanupProperties) error {
-	versions, err := s3.ListObjectVersionsRequest(&awss3.ListObjectVersionsInput{
-		Bucket: &properties.Bucket,
-		Prefix: &properties.Prefix,
-	}).Send()
+// The manifest is a CSV file with the key, the version id, the size and
+// the last modification of every object.
+func (d *batchDeleter) writeManifest(part int, objects []object) error {
+	var buffer bytes.Buffer
+	w := csv.NewWriter(&buffer)
+	w.Write([]string{"Key", "VersionId", "Size", "LastModified"})
+	for _, object := range objects {
+		var modified string
+		if object.modified != nil {
+			modified = object.modified.UTC().Format(time.RFC3339)
+		}
+		w.Write([]string{*object.Key, aws.StringValue(object.VersionId), strconv.FormatInt(object.size, 10), modified})
+	}
+	w.Flush()
+	key := fmt.Sprintf("%smanifest-%05d.csv", d.manifest, part)
+	contentType := "text/csv"
+	_, err := d.s3.PutObject(&awss3.PutObjectInput{
+		Bucket:      &d.auditBucket,
+		Key:         &key,
+		Body:        bytes.NewReader(buffer.Bytes()),
+		ContentType: &contentType,
+	})
 	if err != nil {
-		return errors.Wrapf(err, "could not fetch versions for the bucket %s", properties.Bucket)
+		return errors.Wrapf(err, "could not write the manifest %s to the s3 bucket %s", key, d.auditBucket)
 	}
-	quiet := true
+	return nil
+}
+
+func (d *batchDeleter) count(objects []object) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, object := range objects {
+		d.objects++
+		d.bytes += object.size
+	}
+}
+
+func (d *batchDeleter) failed() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.err != nil
+}
+
+// wait awaits the running batches and gives the part and the counts back
+// to the state.
+func (d *batchDeleter) wait(state *cleanupState) error {
+	d.wg.Wait()
+	state.Part, state.Objects, state.Bytes = d.part, d.objects, d.bytes
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.failures) == 0 {
+		return nil
+	}
+	reported := d.failures
+	if len(reported) > maxReportedFailures {
+		reported = reported[:maxReportedFailures]
+	}
+	return errors.Errorf("could not delete %d objects from the s3 bucket %s: %s", len(d.failures), d.bucket, strings.Join(reported, "; "))
+}
 
-	for {
-		versionsLength := len(versions.Versions)
-		if versionsLength > 0 {
-			objects := make([]awss3.ObjectIdentifier, versionsLength)
-			for i, version := range versions.Versions {
-				objects[i] = awss3.ObjectIdentifier{
-					Key:       version.Key,
-					VersionId: version.VersionId,
-				}
+// The incomplete multipart uploads are selected like the delete markers,
+// by their initiation date.
+func abortUploads(ctx context.Context, s3 awsapi.S3, properties S3CleanupProperties, state cleanupState) error {
+	if len(properties.Tags) > 0 {
+		return nil
+	}
+	prefixes := properties.prefixes()
+	for state.PrefixIndex < len(prefixes) {
+		uploads, err := s3.ListMultipartUploads(&awss3.ListMultipartUploadsInput{
+			Bucket:         &properties.Bucket,
+			Prefix:         &prefixes[state.PrefixIndex],
+			KeyMarker:      state.KeyMarker,
+			UploadIdMarker: state.UploadIdMarker,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "could not fetch the multipart uploads for the bucket %s", properties.Bucket)
+		}
+		for _, upload := range uploads.Uploads {
+			if !properties.matches(state.Before, *upload.Key, upload.Initiated) {
+				continue
 			}
-			_, err = s3.DeleteObjectsRequest(&awss3.DeleteObjectsInput{
-				Bucket: &properties.Bucket,
-				Delete: &awss3.Delete{
-					Objects: objects,
-					Quiet:   &quiet,
-				},
-			}).Send()
-			if err != nil {
-				return errors.Wrapf(err, "could not delete objects from the s3 bucket %s", properties.Bucket)
+			_, err := s3.AbortMultipartUpload(&awss3.AbortMultipartUploadInput{
+				Bucket:   &properties.Bucket,
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			if err != nil && !hasCode(err, "NoSuchUpload") {
+				return errors.Wrapf(err, "could not abort the multipart upload of %s in the bucket %s", *upload.Key, properties.Bucket)
 			}
 		}
-		if *versions.IsTruncated {
-			versions, err = s3.ListObjectVersionsRequest(&awss3.ListObjectVersionsInput{
-				Bucket:          &properties.Bucket,
-				Prefix:          &properties.Prefix,
-				KeyMarker:       versions.NextKeyMarker,
-				VersionIdMarker: versions.NextVersionIdMarker,
-			}).Send()
-			if err != nil {
-				return errors.Wrapf(err, "could not fetch versions for the bucket %s", properties.Bucket)
-			}
+		if *uploads.IsTruncated {
+			state.KeyMarker, state.UploadIdMarker = uploads.NextKeyMarker, uploads.NextUploadIdMarker
 		} else {
-			return nil
+			state = cleanupState{PrefixIndex: state.PrefixIndex + 1, Uploads: true, Before: state.Before}
 		}
+		if state.PrefixIndex < len(prefixes) && resource.TimeLeft(ctx) < minTimeLeft {
+			return resource.InProgress(state, 0)
+		}
+	}
+	return nil
+}
+
+// A bucket that does not exist anymore is considered deleted.
+func deleteBucket(s3 awsapi.S3, bucket string) error {
+	_, err := s3.DeleteBucket(&awss3.DeleteBucketInput{Bucket: &bucket})
+	if err != nil && !hasCode(err, awss3.ErrCodeNoSuchBucket) {
+		return errors.Wrapf(err, "could not delete the s3 bucket %s", bucket)
 	}
+	return nil
+}
+
+func hasCode(err error, code string) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == code
 }
 
 func physicalResourceId(event cfn.Event, properties S3CleanupProperties) string {
-	return event.LogicalResourceID + ":" + properties.Bucket + ":" + properties.Prefix;
+	return event.LogicalResourceID + ":" + properties.Bucket + ":" + properties.Prefix
 }
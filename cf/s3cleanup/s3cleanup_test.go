@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awstest"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/resource"
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/pkg/errors"
+)
+
+func TestS3Cleanup(t *testing.T) {
+	const stackId = "arn:aws:cloudformation:eu-west-1:123456789012:stack/test/1"
+	properties := func(prefix, active string) map[string]interface{} {
+		return map[string]interface{}{"Bucket": "bucket", "Prefix": prefix, "ActiveOnlyOnStackDeletion": active}
+	}
+	for i, test := range []struct {
+		event     cfn.Event
+		status    cloudformation.StackStatus
+		failures  awstest.Failures
+		timeLeft  time.Duration
+		state     string
+		id        string
+		fails     bool
+		remaining int
+	}{
+		// test 0: create is a NOP
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Cleanup", ResourceProperties: properties("logs/", "")},
+			id: "Cleanup:bucket:logs/", remaining: 300},
+		// test 1: the bucket is required
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Cleanup", ResourceProperties: map[string]interface{}{}},
+			id: "failure-Cleanup", fails: true, remaining: 300},
+		// test 2: update is a NOP
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, LogicalResourceID: "Cleanup", PhysicalResourceID: "Cleanup:bucket:logs/",
+			ResourceProperties:    properties("data/", ""),
+			OldResourceProperties: properties("logs/", "")},
+			id: "Cleanup:bucket:data/", remaining: 300},
+		// test 3: delete while the stack is not being deleted is a NOP
+		{event: cfn.Event{RequestType: cfn.RequestDelete, StackID: stackId, PhysicalResourceID: "Cleanup:bucket:", ResourceProperties: properties("", "")},
+			status: cloudformation.StackStatusUpdateCompleteCleanupInProgress, id: "Cleanup:bucket:", remaining: 300},
+		// test 4: delete of all the versions over several pages
+		{event: cfn.Event{RequestType: cfn.RequestDelete, StackID: stackId, PhysicalResourceID: "Cleanup:bucket:", ResourceProperties: properties("", "")},
+			status: cloudformation.StackStatusDeleteInProgress, id: "Cleanup:bucket:"},
+		// test 5: delete of the versions with the prefix only
+		{event: cfn.Event{RequestType: cfn.RequestDelete, StackID: stackId, PhysicalResourceID: "Cleanup:bucket:logs/", ResourceProperties: properties("logs/", "")},
+			status: cloudformation.StackStatusDeleteInProgress, id: "Cleanup:bucket:logs/", remaining: 100},
+		// test 6: delete regardless of the stack
+		{event: cfn.Event{RequestType: cfn.RequestDelete, StackID: stackId, PhysicalResourceID: "Cleanup:bucket:", ResourceProperties: properties("", "false")},
+			status: cloudformation.StackStatusUpdateCompleteCleanupInProgress, id: "Cleanup:bucket:"},
+		// test 7: failure to fetch the stack
+		{event: cfn.Event{RequestType: cfn.RequestDelete, StackID: stackId, PhysicalResourceID: "Cleanup:bucket:", ResourceProperties: properties("", "")},
+			failures: awstest.Failures{"DescribeStacks": errors.New("boom")}, id: "Cleanup:bucket:", fails: true, remaining: 300},
+		// test 8: failure to delete the objects
+		{event: cfn.Event{RequestType: cfn.RequestDelete, StackID: stackId, PhysicalResourceID: "Cleanup:bucket:", ResourceProperties: properties("", "")},
+			status: cloudformation.StackStatusDeleteInProgress, failures: awstest.Failures{"DeleteObjects": errors.New("boom")}, id: "Cleanup:bucket:", fails: true, remaining: 300},
+		// test 9: the deletion stops after a page when the time is short
+		{event: cfn.Event{RequestType: cfn.RequestDelete, StackID: stackId, PhysicalResourceID: "Cleanup:bucket:", ResourceProperties: properties("", "")},
+			status: cloudformation.StackStatusDeleteInProgress, timeLeft: 30 * time.Second, id: "Cleanup:bucket:", fails: true, remaining: 250},
+		// test 10: the continued deletion resumes after the markers without checking the stack
+		{event: cfn.Event{RequestType: cfn.RequestDelete, StackID: stackId, PhysicalResourceID: "Cleanup:bucket:", ResourceProperties: properties("", "")},
+			status: cloudformation.StackStatusUpdateCompleteCleanupInProgress, state: `{"KeyMarker":"data/0049","VersionIdMarker":"1"}`, id: "Cleanup:bucket:", remaining: 100},
+	} {
+		s3 := awstest.NewS3()
+		s3.PageSize = 50
+		s3.Failures = test.failures
+		for n := 0; n < 100; n++ {
+			key := fmt.Sprintf("logs/%04d", n)
+			s3.PutVersion("bucket", key, "1")
+			s3.PutVersion("bucket", key, "2")
+			s3.PutVersion("bucket", fmt.Sprintf("data/%04d", n/2), fmt.Sprint(n%2))
+		}
+		cf := awstest.NewCloudFormation()
+		cf.Failures = test.failures
+		cf.PutStack(stackId, "test", test.status)
+		ctx := context.Background()
+		if test.timeLeft > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, test.timeLeft)
+			defer cancel()
+		}
+		if test.state != "" {
+			ctx = resource.WithContinuation(ctx, &resource.Continuation{State: json.RawMessage(test.state), Attempt: 1})
+		}
+		id, _, err := resource.Handler(resource.Properties(S3CleanupProperties{}), &s3Cleanup{s3: s3, cf: cf})(ctx, test.event)
+		if test.timeLeft > 0 {
+			if _, ok := errors.Cause(err).(*resource.InProgressError); !ok {
+				t.Errorf("test %d: expecting the deletion in progress got %v", i, err)
+			}
+		}
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if id != test.id {
+			t.Errorf("test %d: expecting id %s got %s", i, test.id, id)
+		}
+		if len(s3.Buckets["bucket"]) != test.remaining {
+			t.Errorf("test %d: expecting %d remaining versions got %d", i, test.remaining, len(s3.Buckets["bucket"]))
+		}
+	}
+}
+
+func TestS3CleanupFilters(t *testing.T) {
+	properties := func(extra map[string]interface{}) map[string]interface{} {
+		properties := map[string]interface{}{"Bucket": "bucket", "ActiveOnlyOnStackDeletion": "false"}
+		for k, v := range extra {
+			properties[k] = v
+		}
+		return properties
+	}
+	for i, test := range []struct {
+		properties map[string]interface{}
+		timeLeft   time.Duration
+		fails      string
+		remaining  []string
+		markers    int
+	}{
+		// test 0: all the versions and delete markers are deleted
+		{properties: properties(nil)},
+		// test 1: several prefixes
+		{properties: properties(map[string]interface{}{"Prefix": "logs/", "Prefixes": []interface{}{"tmp/"}}),
+			remaining: []string{"builds/a.txt", "builds/a.zip", "builds/old/b.zip"}, markers: 1},
+		// test 2: suffixes and patterns
+		{properties: properties(map[string]interface{}{"Suffixes": []interface{}{".log"}, "Patterns": []interface{}{"builds/*/*.zip"}}),
+			remaining: []string{"builds/a.txt", "builds/a.zip", "tmp/c"}, markers: 1},
+		// test 3: tags, the delete markers are kept
+		{properties: properties(map[string]interface{}{"Tags": map[string]interface{}{"type": "build"}}),
+			remaining: []string{"builds/a.txt", "builds/old/b.zip", "logs/1.log", "tmp/c"}, markers: 2},
+		// test 4: older than 30 days, the recent delete marker is kept
+		{properties: properties(map[string]interface{}{"Prefix": "builds/", "OlderThanDays": "30"}),
+			remaining: []string{"builds/a.txt", "builds/a.zip", "logs/1.log", "tmp/c"}, markers: 2},
+		// test 5: the objects that cannot be deleted are reported
+		{properties: properties(map[string]interface{}{"Prefixes": []interface{}{"builds/", "tmp/"}, "Suffixes": []interface{}{".zip", "c"}}),
+			fails: "could not delete 1 objects from the s3 bucket bucket: tmp/c (version 1): Access Denied",
+			remaining: []string{"builds/a.txt", "logs/1.log", "tmp/c"}, markers: 1},
+		// test 6: the deletion continues with the next prefix
+		{properties: properties(map[string]interface{}{"Prefixes": []interface{}{"builds/", "tmp/"}}), timeLeft: 30 * time.Second,
+			fails: "operation in progress", remaining: []string{"logs/1.log", "tmp/c"}, markers: 1},
+		// test 7: invalid patterns are rejected
+		{properties: properties(map[string]interface{}{"Patterns": []interface{}{"["}}),
+			fails: "invalid pattern", remaining: []string{"builds/a.txt", "builds/a.zip", "builds/old/b.zip", "logs/1.log", "tmp/c"}, markers: 2},
+	} {
+		s3 := awstest.NewS3()
+		s3.PutVersion("bucket", "builds/a.txt", "1")
+		s3.PutVersion("bucket", "builds/a.zip", "1")
+		s3.TagVersion("builds/a.zip", "1", map[string]string{"type": "build"})
+		s3.PutVersionAt("bucket", "builds/old/b.zip", "1", 0, time.Now().AddDate(0, 0, -40))
+		s3.PutDeleteMarker("bucket", "builds/old/b.zip", "2")
+		s3.PutVersion("bucket", "logs/1.log", "1")
+		s3.PutVersion("bucket", "tmp/c", "1")
+		s3.PutDeleteMarker("bucket", "tmp/d", "1")
+		s3.Denied["tmp/c"] = strings.Contains(test.fails, "tmp/c")
+		ctx := context.Background()
+		if test.timeLeft > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, test.timeLeft)
+			defer cancel()
+		}
+		event := cfn.Event{RequestType: cfn.RequestDelete, LogicalResourceID: "Cleanup", PhysicalResourceID: "Cleanup:bucket:", ResourceProperties: test.properties}
+		_, _, err := resource.Handler(resource.Properties(S3CleanupProperties{}), &s3Cleanup{s3: s3, cf: awstest.NewCloudFormation()})(ctx, event)
+		if (err != nil) != (test.fails != "") || (err != nil && !strings.Contains(err.Error(), test.fails)) {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		var remaining []string
+		for _, version := range s3.Buckets["bucket"] {
+			remaining = append(remaining, *version.Key)
+		}
+		if !reflect.DeepEqual(remaining, test.remaining) {
+			t.Errorf("test %d: expecting remaining objects %v got %v", i, test.remaining, remaining)
+		}
+		if len(s3.DeleteMarkers["bucket"]) != test.markers {
+			t.Errorf("test %d: expecting %d remaining delete markers got %d", i, test.markers, len(s3.DeleteMarkers["bucket"]))
+		}
+	}
+}
+
+func TestS3CleanupBucket(t *testing.T) {
+	properties := func(extra map[string]interface{}) map[string]interface{} {
+		properties := map[string]interface{}{"Bucket": "bucket", "ActiveOnlyOnStackDeletion": "false"}
+		for k, v := range extra {
+			properties[k] = v
+		}
+		return properties
+	}
+	for i, test := range []struct {
+		properties map[string]interface{}
+		missing    bool
+		failures   awstest.Failures
+		state      string
+		fails      bool
+		versions   int
+		uploads    int
+		deleted    bool
+	}{
+		// test 0: the multipart uploads with the prefix are aborted
+		{properties: properties(map[string]interface{}{"Prefix": "logs/"}), versions: 1, uploads: 1},
+		// test 1: the bucket is emptied and deleted
+		{properties: properties(map[string]interface{}{"DeleteBucket": "true"}), deleted: true},
+		// test 2: a missing bucket is considered deleted
+		{properties: properties(map[string]interface{}{"DeleteBucket": "true"}), missing: true, deleted: true},
+		// test 3: the bucket cannot be deleted with a prefix
+		{properties: properties(map[string]interface{}{"DeleteBucket": "true", "Prefix": "logs/"}), fails: true, versions: 3, uploads: 2},
+		// test 4: failure to abort an upload
+		{properties: properties(map[string]interface{}{"DeleteBucket": "true"}), failures: awstest.Failures{"AbortMultipartUpload": errors.New("boom")},
+			fails: true, uploads: 2},
+		// test 5: the continued operation resumes with the uploads after the marker; the versions left prevent the deletion
+		{properties: properties(map[string]interface{}{"DeleteBucket": "true"}), state: `{"Uploads":true,"KeyMarker":"logs/1","UploadIdMarker":"u1"}`,
+			fails: true, versions: 3, uploads: 1},
+	} {
+		s3 := awstest.NewS3()
+		if !test.missing {
+			s3.PutVersion("bucket", "logs/1", "1")
+			s3.PutVersion("bucket", "logs/1", "2")
+			s3.PutVersion("bucket", "tmp/2", "1")
+			s3.PutDeleteMarker("bucket", "logs/1", "3")
+			s3.PutUpload("bucket", "logs/1", "u1")
+			s3.PutUpload("bucket", "tmp/2", "u2")
+		}
+		s3.Failures = test.failures
+		ctx := context.Background()
+		if test.state != "" {
+			ctx = resource.WithContinuation(ctx, &resource.Continuation{State: json.RawMessage(test.state), Attempt: 1})
+		}
+		event := cfn.Event{RequestType: cfn.RequestDelete, LogicalResourceID: "Cleanup", PhysicalResourceID: "Cleanup:bucket:", ResourceProperties: test.properties}
+		_, _, err := resource.Handler(resource.Properties(S3CleanupProperties{}), &s3Cleanup{s3: s3, cf: awstest.NewCloudFormation()})(ctx, event)
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if _, ok := s3.Buckets["bucket"]; ok == test.deleted {
+			t.Errorf("test %d: expecting the bucket deleted %t", i, test.deleted)
+		}
+		if len(s3.Buckets["bucket"]) != test.versions {
+			t.Errorf("test %d: expecting %d remaining versions got %d", i, test.versions, len(s3.Buckets["bucket"]))
+		}
+		if len(s3.Uploads["bucket"]) != test.uploads {
+			t.Errorf("test %d: expecting %d remaining uploads got %d", i, test.uploads, len(s3.Uploads["bucket"]))
+		}
+	}
+}
+
+func TestS3CleanupAudit(t *testing.T) {
+	properties := func(extra map[string]interface{}) map[string]interface{} {
+		properties := map[string]interface{}{"Bucket": "bucket", "ActiveOnlyOnStackDeletion": "false", "AuditBucket": "audit", "AuditPrefix": "cleanup/"}
+		for k, v := range extra {
+			properties[k] = v
+		}
+		return properties
+	}
+	for i, test := range []struct {
+		event     cfn.Event
+		timeLeft  time.Duration
+		fails     bool
+		data      map[string]interface{}
+		manifest  []string
+		remaining int
+	}{
+		// test 0: the dry run on creation counts the objects and writes the manifest
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Cleanup", ResourceProperties: properties(map[string]interface{}{"DryRun": "true", "Prefix": "logs/"})},
+			data:     map[string]interface{}{"ObjectCount": int64(3), "ByteCount": int64(300)},
+			manifest: []string{"Key,VersionId,Size,LastModified", "logs/1,1,100,", "logs/1,2,200,", "logs/1,3,0,"}, remaining: 4},
+		// test 1: the objects are not counted without dry run
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, LogicalResourceID: "Cleanup", ResourceProperties: properties(nil), OldResourceProperties: properties(nil)},
+			remaining: 4},
+		// test 2: the dry run on deletion writes the manifest only
+		{event: cfn.Event{RequestType: cfn.RequestDelete, LogicalResourceID: "Cleanup", PhysicalResourceID: "Cleanup:bucket:", ResourceProperties: properties(map[string]interface{}{"DryRun": "true", "DeleteBucket": "true"})},
+			manifest: []string{"Key,VersionId,Size,LastModified", "logs/1,1,100,", "logs/1,2,200,", "tmp/2,1,1000,", "logs/1,3,0,"}, remaining: 4},
+		// test 3: the deleted objects are written to the manifest
+		{event: cfn.Event{RequestType: cfn.RequestDelete, LogicalResourceID: "Cleanup", PhysicalResourceID: "Cleanup:bucket:tmp/", ResourceProperties: properties(map[string]interface{}{"Prefix": "tmp/"})},
+			manifest: []string{"Key,VersionId,Size,LastModified", "tmp/2,1,1000,"}, remaining: 3},
+		// test 4: the counts are kept over the invocations
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Cleanup", ResourceProperties: properties(map[string]interface{}{"DryRun": "true", "Prefixes": []interface{}{"logs/", "tmp/"}})},
+			timeLeft: 30 * time.Second, fails: true,
+			manifest: []string{"Key,VersionId,Size,LastModified", "logs/1,1,100,", "logs/1,2,200,", "logs/1,3,0,"}, remaining: 4},
+		// test 5: the manifest must not be deleted
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Cleanup", ResourceProperties: properties(map[string]interface{}{"AuditBucket": "bucket"})},
+			fails: true, remaining: 4},
+	} {
+		s3 := awstest.NewS3()
+		modified := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		s3.PutVersionAt("bucket", "logs/1", "1", 100, modified)
+		s3.PutVersionAt("bucket", "logs/1", "2", 200, modified)
+		s3.PutDeleteMarker("bucket", "logs/1", "3")
+		s3.PutVersionAt("bucket", "tmp/2", "1", 1000, modified)
+		ctx := context.Background()
+		if test.timeLeft > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, test.timeLeft)
+			defer cancel()
+		}
+		handler := resource.Handler(resource.Properties(S3CleanupProperties{}), &s3Cleanup{s3: s3, cf: awstest.NewCloudFormation()})
+		_, data, err := handler(ctx, test.event)
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if progress, ok := errors.Cause(err).(*resource.InProgressError); ok {
+			state := progress.State.(cleanupState)
+			if state.PrefixIndex != 1 || state.Objects != 3 || state.Bytes != 300 || state.Part != 1 {
+				t.Errorf("test %d: unexpected state %+v", i, state)
+			}
+		}
+		if !reflect.DeepEqual(data, test.data) {
+			t.Errorf("test %d: expecting data %v got %v", i, test.data, data)
+		}
+		var manifest []string
+		for key, content := range s3.Objects["audit"] {
+			if !strings.HasPrefix(key, "cleanup/Cleanup/") || !strings.HasSuffix(key, "/manifest-00001.csv") {
+				t.Errorf("test %d: unexpected manifest %s", i, key)
+			}
+			for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+				if n := strings.LastIndex(line, ","); n > 0 && strings.HasPrefix(line[n+1:], "20") {
+					line = line[:n+1]
+				}
+				manifest = append(manifest, line)
+			}
+		}
+		if !reflect.DeepEqual(manifest, test.manifest) {
+			t.Errorf("test %d: expecting manifest %v got %v", i, test.manifest, manifest)
+		}
+		if len(s3.Buckets["bucket"])+len(s3.DeleteMarkers["bucket"]) != test.remaining {
+			t.Errorf("test %d: expecting %d remaining objects got %d", i, test.remaining, len(s3.Buckets["bucket"])+len(s3.DeleteMarkers["bucket"]))
+		}
+	}
+}
@@ -3,8 +3,17 @@
 // The `seq` custom resource is used to create a sequence that is stored as an SSM parameter.
 // Once created and used, the sequence initial value can not more be changed.
 //
+// With the backend `dynamodb`, the values are drawn from an atomic counter in the DynamoDB table of the
+// sequences instead of the version of the SSM parameter: concurrent draws never collide and no value is
+// skipped. An existing sequence is migrated by changing its backend from `ssm` to `dynamodb`; the counter
+// continues from the last value drawn. Do not draw values from the sequence while it is migrated.
+//
 // To fetch values from the sequence, use the `seqval` custom resource.
 //
+// A sequence is not deleted while `seqval` resources still use it: the deletion fails or, with the flag
+// `RetainWithConsumers`, the sequence is kept. A deleted sequence leaves a tombstone with its counter; a
+// sequence created again with the same name resumes from it and never gives the same values again.
+//
 // ## Syntax
 //
 // To create an `seq` resource, add the following resource to your cloudformation
@@ -18,7 +27,10 @@
 //       Fn::ImportValue:
 //         !Sub ${HyperdriveCore}-SequenceGenerator
 //     SequenceName: /parameter/name
-//     InitialValue: 1
+//     Backend: <ssm|dynamodb>
+//     Expression: <expression>
+//     Format: <format>
+//     RetainWithConsumers: <true|false>
 // ```
 //
 // ## Properties
@@ -34,6 +46,20 @@
 //
 // _Update Requires_: replacement
 //
+// `Backend`
+//
+// > The storage of the counter of the sequence: `ssm` (default) or `dynamodb`. The change from `ssm` to
+// > `dynamodb` migrates the sequence; the change back is only possible while no value has been drawn from
+// > the counter.
+// >
+// > _Type_: String
+// >
+// > _Default_: ssm
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: no interruption
+//
 // `Expression`
 //
 // > The arithmetic expression to compute the sequence: standard operations + variable x for the current value of the
@@ -48,6 +74,32 @@
 // >
 // > _Update Requires_: no interruption
 //
+// `Format`
+//
+// > The format of the values drawn from the sequence, given by `seqval` as `FormattedValue`. Either a Go
+// > `fmt` format for the value, like `app-%04d`, or a template where each `{expression}` is replaced by the
+// > expression evaluated for the value as `x`, like `10.0.{x}.0/24` or `{x < 10 ? "high" : "low"}`. The
+// > format is stored in the SSM parameter with the same name under the prefix "/hyperdrive/sequence-format".
+// >
+// > _Type_: String
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: no interruption
+//
+// `RetainWithConsumers`
+//
+// > If the flag is true, the deletion of the sequence while `seqval` resources still use it succeeds but
+// > keeps the sequence. Otherwise, the deletion fails.
+// >
+// > _Type_: Boolean
+// >
+// > _Default_: false
+// >
+// > _Required_: No
+// >
+// > _Update Requires_: no interruption
+//
 // ## Return Values
 //
 // `Ref`
@@ -58,24 +110,29 @@ package main
 import (
 	"context"
 	"github.com/DEEP-IMPACT-AG/hyperdrive/common"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awsapi"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/resource"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/sequences"
 	"github.com/aws/aws-lambda-go/cfn"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	awsssm "github.com/aws/aws-sdk-go-v2/service/ssm"
-	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
+	"os"
 	"strings"
 )
 
-var ssm *awsssm.SSM
-
 func main() {
 	cfg, err := external.LoadDefaultAWSConfig()
 	if err != nil {
 		panic(err)
 	}
-	ssm = awsssm.New(cfg)
-	lambda.Start(cfn.LambdaWrap(processEvent))
+	lambda.Start(cfn.LambdaWrap(resource.Handler(resource.Properties(SequenceProperties{}), &sequence{
+		ssm:      awsapi.NewSSM(awsssm.New(cfg)),
+		dynamodb: awsapi.NewDynamoDB(dynamodb.New(cfg)),
+		table:    os.Getenv(sequences.TableEnv),
+	})))
 }
 
 // The SequenceProperties is the main data structure for the resource and
@@ -84,61 +141,90 @@ func main() {
 // decode the generic map from the cloudformation event to the struct.
 type SequenceProperties struct {
 	SequenceName, Expression string
+	Backend, Format          string
+	RetainWithConsumers      string
 }
 
-func sequenceProperties(input map[string]interface{}) (SequenceProperties, error) {
-	var properties SequenceProperties
-	if err := mapstructure.Decode(input, &properties); err != nil {
-		return properties, err
-	}
+func (properties *SequenceProperties) Validate() error {
 	if !strings.HasPrefix(properties.SequenceName, "/") {
-		return properties, errors.Errorf("name %s must start with an /", properties.SequenceName)
+		return errors.Errorf("name %s must start with an /", properties.SequenceName)
 	}
 	if properties.Expression == "" {
 		properties.Expression = "x"
 	}
+	if properties.Backend == "" {
+		properties.Backend = sequences.BackendSSM
+	}
+	if properties.Backend != sequences.BackendSSM && properties.Backend != sequences.BackendDynamoDB {
+		return errors.Errorf("invalid backend %s", properties.Backend)
+	}
 	if _, err := common.Eval(properties.Expression, 1); err != nil {
-		return properties, err
+		return err
+	}
+	if _, err := common.Format(properties.Format, 1); err != nil {
+		return err
 	}
-	return properties, nil
+	return nil
 }
 
-func processEvent(ctx context.Context, event cfn.Event) (string, map[string]interface{}, error) {
-	properties, err := sequenceProperties(event.ResourceProperties)
-	if err != nil {
+type sequence struct {
+	ssm      awsapi.SSM
+	dynamodb awsapi.DynamoDB
+	table    string
+}
+
+func (s *sequence) store() sequences.Store {
+	return sequences.Store{SSM: s.ssm, DynamoDB: s.dynamodb, Table: s.table}
+}
+
+// Creating the sequence puts the SSM parameter and, for the `dynamodb`
+// backend, the counter, and the format if any; updating the sequence
+// changes its expression or format or migrates it to another backend;
+// deleting the sequence deletes all of them unless it still has consumers.
+func (s *sequence) Create(ctx context.Context, request resource.Request) (string, map[string]interface{}, error) {
+	properties := request.Properties.(SequenceProperties)
+	parameterName := sequences.ParameterName(properties.SequenceName)
+	store := s.store()
+	if err := store.Create(parameterName, properties.Expression, properties.Backend); err != nil {
 		return "", nil, err
 	}
-	switch event.RequestType {
-	case cfn.RequestDelete:
-		if !common.IsFailurePhysicalResourceId(event.PhysicalResourceID) {
-			_, err := ssm.DeleteParameterRequest(&awsssm.DeleteParameterInput{
-				Name: &event.PhysicalResourceID,
-			}).Send();
-			if err != nil {
-				return event.PhysicalResourceID, nil, errors.Wrapf(err, "could not delete the sequence %s", properties.SequenceName)
-			}
+	if properties.Format != "" {
+		if err := store.PutFormat(parameterName, properties.Format); err != nil {
+			return parameterName, nil, err
 		}
-		return event.PhysicalResourceID, nil, nil
-	case cfn.RequestCreate:
-		return putSequence(ssm, properties)
-	case cfn.RequestUpdate:
-		return putSequence(ssm, properties);
-	default:
-		return "", nil, errors.Errorf("unknown request type %s", event.RequestType)
 	}
+	return parameterName, nil, nil
 }
 
-func putSequence(ssm *awsssm.SSM, properties SequenceProperties) (string, map[string]interface{}, error) {
-	overwrite := true
-	parameterName := "/hyperdrive/sequence" + properties.SequenceName
-	_, err := ssm.PutParameterRequest(&awsssm.PutParameterInput{
-		Name:      &parameterName,
-		Type:      awsssm.ParameterTypeString,
-		Value:     &properties.Expression,
-		Overwrite: &overwrite,
-	}).Send();
+func (s *sequence) Update(ctx context.Context, request resource.Request) (string, map[string]interface{}, error) {
+	properties := request.Properties.(SequenceProperties)
+	oldProperties := request.OldProperties.(SequenceProperties)
+	if request.Changed("SequenceName") {
+		return s.Create(ctx, request)
+	}
+	store := s.store()
+	err := store.Update(request.PhysicalResourceID, oldProperties.Expression, properties.Expression, oldProperties.Backend, properties.Backend)
+	if err == nil && request.Changed("Format") {
+		err = store.PutFormat(request.PhysicalResourceID, properties.Format)
+	}
+	return request.PhysicalResourceID, nil, err
+}
+
+func (s *sequence) Delete(ctx context.Context, request resource.Request) error {
+	properties := request.Properties.(SequenceProperties)
+	store := s.store()
+	consumers, err := store.Consumers(request.PhysicalResourceID)
 	if err != nil {
-		return "", nil, errors.Wrapf(err, "could not put the parameter %s", parameterName)
+		return err
 	}
-	return parameterName, nil, nil
+	if len(consumers) > 0 {
+		if properties.RetainWithConsumers == "true" {
+			return nil
+		}
+		return errors.Errorf("the sequence %s is used by %s", properties.SequenceName, strings.Join(consumers, ", "))
+	}
+	if err := store.Delete(request.PhysicalResourceID); err != nil {
+		return errors.Wrapf(err, "could not delete the sequence %s", properties.SequenceName)
+	}
+	return nil
 }
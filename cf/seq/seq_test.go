@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awstest"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/resource"
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsssm "github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/pkg/errors"
+)
+
+func TestSequence(t *testing.T) {
+	for i, test := range []struct {
+		event      cfn.Event
+		existing   map[string]string
+		failures   awstest.Failures
+		id         string
+		fails      bool
+		expression string
+	}{
+		// test 0: create with the default expression
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: map[string]interface{}{"SequenceName": "/a"}},
+			id: "/hyperdrive/sequence/a", expression: "x"},
+		// test 1: create with an invalid name
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Seq", ResourceProperties: map[string]interface{}{"SequenceName": "a"}},
+			id: "failure-Seq", fails: true},
+		// test 2: create with an invalid expression
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Seq", ResourceProperties: map[string]interface{}{"SequenceName": "/a", "Expression": "x +"}},
+			id: "failure-Seq", fails: true},
+		// test 3: failure to put the parameter
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Seq", ResourceProperties: map[string]interface{}{"SequenceName": "/a"}},
+			failures: awstest.Failures{"PutParameter": errors.New("boom")}, id: "failure-Seq", fails: true},
+		// test 4: update changes the expression
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: "/hyperdrive/sequence/a",
+			ResourceProperties:    map[string]interface{}{"SequenceName": "/a", "Expression": "2*x"},
+			OldResourceProperties: map[string]interface{}{"SequenceName": "/a"}},
+			existing: map[string]string{"/hyperdrive/sequence/a": "x"},
+			id:       "/hyperdrive/sequence/a", expression: "2*x"},
+		// test 5: delete removes the parameter
+		{event: cfn.Event{RequestType: cfn.RequestDelete, PhysicalResourceID: "/hyperdrive/sequence/a", ResourceProperties: map[string]interface{}{"SequenceName": "/a"}},
+			existing: map[string]string{"/hyperdrive/sequence/a": "x"},
+			id:       "/hyperdrive/sequence/a"},
+		// test 6: delete of a missing parameter is a NOP
+		{event: cfn.Event{RequestType: cfn.RequestDelete, PhysicalResourceID: "/hyperdrive/sequence/a", ResourceProperties: map[string]interface{}{"SequenceName": "/a"}},
+			id: "/hyperdrive/sequence/a"},
+	} {
+		ssm := awstest.NewSSM()
+		ssm.Failures = test.failures
+		for name, value := range test.existing {
+			ssm.PutString(name, value)
+		}
+		id, _, err := resource.Handler(resource.Properties(SequenceProperties{}), &sequence{ssm: ssm})(context.Background(), test.event)
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if id != test.id {
+			t.Errorf("test %d: expecting id %s got %s", i, test.id, id)
+		}
+		parameter, ok := ssm.Parameters[test.id]
+		if test.expression == "" {
+			if test.event.RequestType == cfn.RequestDelete && ok {
+				t.Errorf("test %d: parameter %s not deleted", i, test.id)
+			}
+		} else if !ok || *parameter.Value != test.expression {
+			t.Errorf("test %d: expecting expression %s got %+v", i, test.expression, parameter)
+		}
+	}
+}
+
+func TestSequenceBackend(t *testing.T) {
+	const id = "/hyperdrive/sequence/a"
+	for i, test := range []struct {
+		event   cfn.Event
+		table   string
+		fails   bool
+		counter string
+	}{
+		// test 0: create with the dynamodb backend
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: map[string]interface{}{"SequenceName": "/a", "Backend": "dynamodb"}},
+			table: "sequences", counter: "0"},
+		// test 1: the dynamodb backend requires the table
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: map[string]interface{}{"SequenceName": "/a", "Backend": "dynamodb"}},
+			fails: true},
+		// test 2: invalid backend
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: map[string]interface{}{"SequenceName": "/a", "Backend": "redis"}},
+			table: "sequences", fails: true},
+		// test 3: the migration keeps the last value drawn from the parameter
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: id,
+			ResourceProperties:    map[string]interface{}{"SequenceName": "/a", "Backend": "dynamodb"},
+			OldResourceProperties: map[string]interface{}{"SequenceName": "/a"}},
+			table: "sequences", counter: "2"},
+	} {
+		ssm := awstest.NewSSM()
+		dynamodb := awstest.NewDynamoDB()
+		dynamodb.CreateTable("sequences", "Name")
+		ssm.PutString(id, "x")
+		for d := 0; d < 2; d++ {
+			ssm.PutParameter(&awsssm.PutParameterInput{Name: aws.String(id), Value: aws.String("x"), Overwrite: aws.Bool(true)})
+		}
+		_, _, err := resource.Handler(resource.Properties(SequenceProperties{}), &sequence{ssm: ssm, dynamodb: dynamodb, table: test.table})(context.Background(), test.event)
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		item := dynamodb.Item("sequences", id)
+		if test.counter == "" && item != nil {
+			t.Errorf("test %d: unexpected counter %v", i, item)
+		}
+		if test.counter != "" && (item == nil || *item["Counter"].N != test.counter) {
+			t.Errorf("test %d: expecting the counter %s got %v", i, test.counter, item)
+		}
+	}
+}
+
+func TestSequenceFormat(t *testing.T) {
+	const id = "/hyperdrive/sequence/a"
+	const formatId = "/hyperdrive/sequence-format/a"
+	for i, test := range []struct {
+		event  cfn.Event
+		fails  bool
+		format string
+	}{
+		// test 0: create with a format
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: map[string]interface{}{"SequenceName": "/a", "Format": "app-%04d"}},
+			format: "app-%04d"},
+		// test 1: invalid format
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: map[string]interface{}{"SequenceName": "/a", "Format": "10.0.{x.0/24"}},
+			fails: true},
+		// test 2: change of the format
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: id,
+			ResourceProperties:    map[string]interface{}{"SequenceName": "/a", "Format": "10.0.{x}.0/24"},
+			OldResourceProperties: map[string]interface{}{"SequenceName": "/a", "Format": "app-%04d"}},
+			format: "10.0.{x}.0/24"},
+		// test 3: removal of the format
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: id,
+			ResourceProperties:    map[string]interface{}{"SequenceName": "/a"},
+			OldResourceProperties: map[string]interface{}{"SequenceName": "/a", "Format": "app-%04d"}}},
+		// test 4: the deletion removes the format
+		{event: cfn.Event{RequestType: cfn.RequestDelete, PhysicalResourceID: id,
+			ResourceProperties: map[string]interface{}{"SequenceName": "/a", "Format": "app-%04d"}}},
+	} {
+		ssm := awstest.NewSSM()
+		if test.event.RequestType != cfn.RequestCreate {
+			ssm.PutString(id, "x")
+			ssm.PutString(formatId, "app-%04d")
+		}
+		_, _, err := resource.Handler(resource.Properties(SequenceProperties{}), &sequence{ssm: ssm})(context.Background(), test.event)
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		param, ok := ssm.Parameters[formatId]
+		if test.format == "" && ok {
+			t.Errorf("test %d: unexpected format %s", i, *param.Value)
+		}
+		if test.format != "" && (!ok || *param.Value != test.format) {
+			t.Errorf("test %d: expecting the format %s got %v", i, test.format, param.Value)
+		}
+	}
+}
+
+func TestSequenceConsumers(t *testing.T) {
+	const id = "/hyperdrive/sequence/a"
+	for i, test := range []struct {
+		properties map[string]interface{}
+		consumers  []string
+		fails      bool
+		deleted    bool
+	}{
+		// test 0: a sequence without consumers is deleted
+		{properties: map[string]interface{}{"SequenceName": "/a"}, deleted: true},
+		// test 1: a sequence with consumers is not deleted
+		{properties: map[string]interface{}{"SequenceName": "/a"}, consumers: []string{"/hyperdrive/sequence/a:1=1"}, fails: true},
+		// test 2: a sequence with consumers is retained
+		{properties: map[string]interface{}{"SequenceName": "/a", "RetainWithConsumers": "true"}, consumers: []string{"/hyperdrive/sequence/a:1=1"}},
+	} {
+		ssm := awstest.NewSSM()
+		seq := &sequence{ssm: ssm}
+		ssm.PutString(id, "x")
+		for _, consumer := range test.consumers {
+			if err := seq.store().Register(id, consumer, "Value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, _, err := resource.Handler(resource.Properties(SequenceProperties{}), seq)(context.Background(), cfn.Event{
+			RequestType: cfn.RequestDelete, PhysicalResourceID: id, ResourceProperties: test.properties,
+		})
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if _, ok := ssm.Parameters[id]; ok == test.deleted {
+			t.Errorf("test %d: expecting the deletion %t", i, test.deleted)
+		}
+	}
+}
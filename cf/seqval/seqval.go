@@ -1,7 +1,15 @@
 // # Sequence Value
 //
 // The `seqval` custom resource is used to fetch values from a sequence created by the `seq` custom resource.
-// A `seqval` custom resource draw a value from a sequence on creation only.
+// A `seqval` custom resource draw a value from a sequence on creation. On update, the values drawn are kept: the
+// values are only drawn again when the `Redraw` property, the sequence or the number of reserved values change, or
+// when the values are out of new bounds. The values drawn are recorded in the physical id of the resource; the
+// values drawn before they were recorded are drawn again on the next update.
+//
+// A `seqval` resource registers itself as a consumer of the sequence: the sequence is not deleted while it is used.
+//
+// The value is drawn from the counter of the sequence in the DynamoDB table of the sequences if the sequence
+// uses the `dynamodb` backend, else from the version of its SSM parameter.
 //
 // ## Syntax
 //
@@ -15,11 +23,72 @@
 //     ServiceToken:
 //       Fn::ImportValue:
 //         !Sub ${HyperdriveCore}-SequenceValue
+//     Max: <number>
+//     Min: <number>
+//     Recycle: <true|false>
+//     Redraw: <any value>
+//     Reserve: <number of values>
 //     Sequence: !Ref Sequence
 // ```
 //
 // ## Properties
 //
+// `Max`
+//
+// > The maximal value to draw. When the sequence gives a greater value, the sequence is exhausted and the
+// > creation fails, unless a smaller released value can be recycled.
+//
+// _Type_: Number
+//
+// _Required_: No
+//
+// _Update Requires_: no interruption
+//
+// `Min`
+//
+// > The minimal value to draw. The values of the sequence smaller than the minimum are skipped.
+//
+// _Type_: Number
+//
+// _Required_: No
+//
+// _Update Requires_: no interruption
+//
+// `Recycle`
+//
+// > If the flag is true, the values are released when the resource is deleted, e.g. when it is replaced
+// > by an update, and drawn again, the smallest first, before new values are drawn from the sequence. The
+// > sequence must use the `dynamodb` backend.
+//
+// _Type_: Boolean
+//
+// _Required_: No
+//
+// _Update Requires_: no interruption
+//
+// `Redraw`
+//
+// > Any value: changing it draws new values, e.g. a counter incremented to force a new value.
+//
+// _Type_: String
+//
+// _Required_: No
+//
+// _Update Requires_: no interruption
+//
+// `Reserve`
+//
+// > The number of consecutive values to draw, by default 1. The sequence must use the `dynamodb` backend to
+// > reserve several values, at most 100; the reserved blocks are not recycled into smaller blocks. Changing the
+// > number draws new values. As the values are recorded in the physical id, limited to 1024 characters, the
+// > draw fails if the values are too long to be recorded, e.g. large values that do not follow each other.
+//
+// _Type_: Number
+//
+// _Required_: No
+//
+// _Update Requires_: no interruption
+//
 // `Sequence`
 //
 // > The name of the sequence to draw a value from
@@ -32,32 +101,49 @@
 //
 // ## Return Values
 //
+// `Ref`
+//
+// The `Ref` intrinsic function gives the name of the sequence followed by the drawn values of `x` and the values,
+// e.g. `/hyperdrive/sequence/ports:5-7=8005..8007`. The values following each other with the same step are
+// given as a range, with the step if not 1, e.g. `10..50/10`.
+//
 // `Fn::GetAtt`
 //
-// The attribute `Value` contains the value that has been drawn from the sequence.
+// The attribute `Value` contains the (first) value that has been drawn from the sequence. The attribute `Values`
+// contains all the values drawn and `ValuesText` the same values separated by commas. The attributes
+// `FormattedValue` and `FormattedValues` contain the values formatted with the `Format` of the sequence, e.g.
+// `app-0042` or `10.0.42.0/24`, or the values in decimal if the sequence has no format.
 package main
 
 import (
 	"context"
+	"fmt"
 	"github.com/DEEP-IMPACT-AG/hyperdrive/common"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awsapi"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/resource"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/sequences"
 	"github.com/aws/aws-lambda-go/cfn"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	awsssm "github.com/aws/aws-sdk-go-v2/service/ssm"
-	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
+	"math"
+	"os"
 	"strconv"
+	"strings"
 )
 
-var ssm *awsssm.SSM
-
 func main() {
 	cfg, err := external.LoadDefaultAWSConfig()
 	if err != nil {
 		panic(err)
 	}
-	ssm = awsssm.New(cfg)
-	lambda.Start(cfn.LambdaWrap(processEvent))
+	lambda.Start(cfn.LambdaWrap(resource.Handler(resource.Properties(SequenceValueProperties{}), &sequenceValue{
+		ssm:      awsapi.NewSSM(awsssm.New(cfg)),
+		dynamodb: awsapi.NewDynamoDB(dynamodb.New(cfg)),
+		table:    os.Getenv(sequences.TableEnv),
+	})))
 }
 
 // The SequenceValueProperties is the main data structure for the resource and
@@ -65,65 +151,322 @@ func main() {
 // We use the library [mapstructure](https://github.com/mitchellh/mapstructure) to
 // decode the generic map from the cloudformation event to the struct.
 type SequenceValueProperties struct {
-	Sequence string
+	Sequence          string
+	Recycle, Redraw   string
+	Reserve, Min, Max string
 }
 
-func sequenceValueProperties(input map[string]interface{}) (SequenceValueProperties, error) {
-	var properties SequenceValueProperties
-	if err := mapstructure.Decode(input, &properties); err != nil {
-		return properties, err
-	}
+func (properties *SequenceValueProperties) Validate() error {
 	if properties.Sequence == "" {
-		return properties, errors.New("sequence is required")
+		return errors.New("sequence is required")
+	}
+	if properties.Reserve == "" {
+		properties.Reserve = "1"
 	}
-	return properties, nil
+	if n, err := strconv.ParseInt(properties.Reserve, 10, 64); err != nil || n < 1 || n > maxReserve {
+		return errors.Errorf("invalid number of values to reserve %s", properties.Reserve)
+	}
+	for _, value := range []string{properties.Min, properties.Max} {
+		if value == "" {
+			continue
+		}
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return errors.Errorf("invalid bound %s", value)
+		}
+	}
+	if min, max, ok := properties.bounds(); ok && min > max {
+		return errors.Errorf("the minimum %d is greater than the maximum %d", min, max)
+	}
+	return nil
 }
 
-func processEvent(ctx context.Context, event cfn.Event) (string, map[string]interface{}, error) {
-	properties, err := sequenceValueProperties(event.ResourceProperties)
-	if err != nil {
-		return "", nil, err
+// maxReserve limits the number of values recorded in the physical id.
+const maxReserve = 100
+
+func (properties SequenceValueProperties) reserve() int64 {
+	n, _ := strconv.ParseInt(properties.Reserve, 10, 64)
+	return n
+}
+
+// The bounds default to the range of int64; ok tells if both are defined.
+func (properties SequenceValueProperties) bounds() (int64, int64, bool) {
+	min, max := int64(math.MinInt64), int64(math.MaxInt64)
+	if properties.Min != "" {
+		min, _ = strconv.ParseInt(properties.Min, 10, 64)
+	}
+	if properties.Max != "" {
+		max, _ = strconv.ParseInt(properties.Max, 10, 64)
 	}
-	switch event.RequestType {
-	case cfn.RequestDelete:
-		return event.PhysicalResourceID, nil, nil
-	case cfn.RequestCreate:
-		return nextValue(ssm, event, properties)
-	case cfn.RequestUpdate:
-		return nextValue(ssm, event, properties);
-	default:
-		return "", nil, errors.Errorf("unknown request type %s", event.RequestType)
+	return min, max, properties.Min != "" && properties.Max != ""
+}
+
+type sequenceValue struct {
+	ssm      awsapi.SSM
+	dynamodb awsapi.DynamoDB
+	table    string
+}
+
+// Values are drawn on creation. The physical id records the values drawn
+// and the values of `x`: when the values are drawn again on update, the new
+// id makes cloudformation delete the previous values, that are released if
+// they are recycled. Every physical id is registered as a consumer of the
+// sequence until it is deleted.
+func (s *sequenceValue) Create(ctx context.Context, request resource.Request) (string, map[string]interface{}, error) {
+	properties := request.Properties.(SequenceValueProperties)
+	id, data, err := nextValues(s.store(), properties)
+	if err != nil {
+		return id, data, err
 	}
+	return id, data, s.register(request, properties.Sequence, id)
 }
 
-func nextValue(ssm *awsssm.SSM, event cfn.Event, properties SequenceValueProperties) (string, map[string]interface{}, error) {
-	overwrite := true
-	pname := properties.Sequence
-	param, err := ssm.GetParameterRequest(&awsssm.GetParameterInput{
-		Name: &pname,
-	}).Send()
+func (s *sequenceValue) Update(ctx context.Context, request resource.Request) (string, map[string]interface{}, error) {
+	properties := request.Properties.(SequenceValueProperties)
+	if _, _, _, values, ok := parseValuesId(request.PhysicalResourceID); ok && !redraw(request, values) {
+		format, err := s.store().Format(properties.Sequence)
+		if err != nil {
+			return request.PhysicalResourceID, nil, err
+		}
+		data, err := valuesData(values, format)
+		if err != nil {
+			return request.PhysicalResourceID, nil, err
+		}
+		// the resources created before the consumers were tracked register on update.
+		return request.PhysicalResourceID, data, s.register(request, properties.Sequence, request.PhysicalResourceID)
+	}
+	id, data, err := nextValues(s.store(), properties)
+	if id == "" {
+		return request.PhysicalResourceID, data, err
+	}
 	if err != nil {
-		return event.PhysicalResourceID, nil, errors.Wrapf(err, "unable to get the parameter %s", pname)
-	}
-	expression := *param.Parameter.Value;
-	next, err := ssm.PutParameterRequest(&awsssm.PutParameterInput{
-		Name:      &pname,
-		Value:     &expression,
-		Type:      awsssm.ParameterTypeString,
-		Overwrite: &overwrite,
-	}).Send()
+		return id, data, err
+	}
+	return id, data, s.register(request, properties.Sequence, id)
+}
+
+func (s *sequenceValue) register(request resource.Request, sequence, id string) error {
+	return s.store().Register(sequence, id, fmt.Sprintf("%s of the stack %s", request.LogicalResourceID, request.StackID))
+}
+
+// The values are drawn again if requested, if the sequence or the number
+// of values change or if the values are out of the bounds.
+func redraw(request resource.Request, values []int64) bool {
+	if request.Changed("Redraw", "Sequence", "Reserve") {
+		return true
+	}
+	min, max, _ := request.Properties.(SequenceValueProperties).bounds()
+	for _, value := range values {
+		if value < min || value > max {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *sequenceValue) Delete(ctx context.Context, request resource.Request) error {
+	properties := request.Properties.(SequenceValueProperties)
+	sequence, first, last, _, ok := parseValuesId(request.PhysicalResourceID)
+	if !ok {
+		return nil
+	}
+	if err := s.store().Unregister(sequence, request.PhysicalResourceID); err != nil {
+		return err
+	}
+	if properties.Recycle != "true" || sequence != properties.Sequence {
+		return nil
+	}
+	xs := make([]int64, 0, last-first+1)
+	for x := first; x <= last; x++ {
+		xs = append(xs, x)
+	}
+	return s.store().Release(sequence, xs)
+}
+
+func (s *sequenceValue) store() sequences.Store {
+	return sequences.Store{SSM: s.ssm, DynamoDB: s.dynamodb, Table: s.table}
+}
+
+// maxDraws bounds the draws skipping the values below the minimum.
+const maxDraws = 100
+
+// Recycled values are drawn first, except for blocks of values. The
+// values below the minimum are skipped; the recycled values above the
+// maximum are dropped, the values of the sequence above the maximum
+// mean that the sequence is exhausted.
+func nextValues(store sequences.Store, properties SequenceValueProperties) (string, map[string]interface{}, error) {
+	min, max, _ := properties.bounds()
+	count := properties.reserve()
+	format, err := store.Format(properties.Sequence)
 	if err != nil {
-		return event.PhysicalResourceID, nil, errors.Wrapf(err, "unable to put the parameter %s", pname)
+		return "", nil, err
+	}
+	for draw := 0; draw < maxDraws; draw++ {
+		var first int64
+		var expression string
+		recycled := false
+		var err error
+		if properties.Recycle == "true" && count == 1 {
+			if first, expression, recycled, err = store.Recycled(properties.Sequence); err != nil {
+				return "", nil, err
+			}
+		}
+		if !recycled {
+			if first, expression, err = store.Reserve(properties.Sequence, count); err != nil {
+				return "", nil, err
+			}
+		}
+		values := make([]int64, count)
+		for i := range values {
+			if values[i], err = common.Eval(expression, first+int64(i)); err != nil {
+				return "", nil, err
+			}
+		}
+		switch {
+		case values[0] < min:
+			continue
+		case values[count-1] > max && recycled:
+			continue
+		case values[count-1] > max:
+			return "", nil, errors.Errorf("the sequence %s is exhausted: the value %d is greater than the maximum %d", properties.Sequence, values[count-1], max)
+		}
+		data, err := valuesData(values, format)
+		if err != nil {
+			return "", nil, err
+		}
+		id := valuesId(properties.Sequence, first, values)
+		if len(id) > maxIdLength {
+			xs := make([]int64, count)
+			for i := range xs {
+				xs[i] = first + int64(i)
+			}
+			if err := store.Release(properties.Sequence, xs); err != nil {
+				return "", nil, err
+			}
+			return "", nil, errors.Errorf("the %d values of the sequence %s are too long for the physical id, reserve fewer values", count, properties.Sequence)
+		}
+		return id, data, nil
+	}
+	return "", nil, errors.Errorf("could not draw a value of the sequence %s greater than the minimum %d", properties.Sequence, min)
+}
+
+func valuesData(values []int64, format string) (map[string]interface{}, error) {
+	texts := make([]string, len(values))
+	formatted := make([]string, len(values))
+	for i, value := range values {
+		texts[i] = strconv.FormatInt(value, 10)
+		text, err := common.Format(format, value)
+		if err != nil {
+			return nil, err
+		}
+		formatted[i] = text
+	}
+	data := make(map[string]interface{}, 6)
+	data["ValueText"] = texts[0]
+	data["Value"] = values[0]
+	data["Values"] = values
+	data["ValuesText"] = strings.Join(texts, ",")
+	data["FormattedValue"] = formatted[0]
+	data["FormattedValues"] = formatted
+	return data, nil
+}
+
+// maxIdLength is the limit of cloudformation for the physical ids.
+const maxIdLength = 1024
+
+func valuesId(sequence string, first int64, values []int64) string {
+	xs := strconv.FormatInt(first, 10)
+	if len(values) > 1 {
+		xs = fmt.Sprintf("%d-%d", first, first+int64(len(values))-1)
+	}
+	return fmt.Sprintf("%s:%s=%s", sequence, xs, formatValues(values))
+}
+
+// The runs of at least 3 values with the same step are given as ranges,
+// e.g. `8005..8007` or `10..50/10`.
+func formatValues(values []int64) string {
+	var texts []string
+	for i := 0; i < len(values); {
+		j := i + 1
+		if j < len(values) && values[j] != values[i] {
+			step := values[j] - values[i]
+			for j+1 < len(values) && values[j+1]-values[j] == step {
+				j++
+			}
+			if j-i >= 2 {
+				text := fmt.Sprintf("%d..%d", values[i], values[j])
+				if step != 1 {
+					text += "/" + strconv.FormatInt(step, 10)
+				}
+				texts = append(texts, text)
+				i = j + 1
+				continue
+			}
+		}
+		texts = append(texts, strconv.FormatInt(values[i], 10))
+		i++
+	}
+	return strings.Join(texts, ",")
+}
+
+// parseValues reads at most count values.
+func parseValues(text string, count int64) ([]int64, bool) {
+	var values []int64
+	for _, part := range strings.Split(text, ",") {
+		bounds := strings.SplitN(part, "..", 2)
+		from, err := strconv.ParseInt(bounds[0], 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		if len(bounds) == 1 {
+			values = append(values, from)
+			continue
+		}
+		step := int64(1)
+		to := strings.SplitN(bounds[1], "/", 2)
+		if len(to) == 2 {
+			if step, err = strconv.ParseInt(to[1], 10, 64); err != nil || step == 0 {
+				return nil, false
+			}
+		}
+		last, err := strconv.ParseInt(to[0], 10, 64)
+		if err != nil || (last-from)%step != 0 || (last-from)/step < 0 || (last-from)/step >= count-int64(len(values)) {
+			return nil, false
+		}
+		for value := from; ; value += step {
+			values = append(values, value)
+			if value == last {
+				break
+			}
+		}
 	}
-	// The initial version is 1 (when the sequence is created, it means that the first real value will be 2. As we
-	// want to start with 1, we decrement the value obtain from incrementing the parameter.
-	value, err := common.Eval(expression, *next.Version-1)
+	return values, int64(len(values)) == count
+}
+
+// The physical ids of the resources created before the values were
+// recorded cannot be parsed.
+func parseValuesId(id string) (string, int64, int64, []int64, bool) {
+	i := strings.LastIndex(id, ":")
+	if i < 0 {
+		return "", 0, 0, nil, false
+	}
+	parts := strings.SplitN(id[i+1:], "=", 2)
+	if len(parts) != 2 {
+		return "", 0, 0, nil, false
+	}
+	bounds := strings.SplitN(parts[0], "-", 2)
+	first, err := strconv.ParseInt(bounds[0], 10, 64)
 	if err != nil {
-		return event.PhysicalResourceID, nil, err
+		return "", 0, 0, nil, false
+	}
+	last := first
+	if len(bounds) == 2 {
+		if last, err = strconv.ParseInt(bounds[1], 10, 64); err != nil || last < first {
+			return "", 0, 0, nil, false
+		}
+	}
+	values, ok := parseValues(parts[1], last-first+1)
+	if !ok {
+		return "", 0, 0, nil, false
 	}
-	valueText := strconv.FormatInt(value, 10);
-	data := make(map[string]interface{}, 1)
-	data["ValueText"] = valueText
-	data["Value"] = value
-	return event.PhysicalResourceID, data, nil
+	return id[:i], first, last, values, true
 }
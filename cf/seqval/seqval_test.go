@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awstest"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/resource"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/sequences"
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsssm "github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/pkg/errors"
+)
+
+func TestSequenceValue(t *testing.T) {
+	const sequence = "/hyperdrive/sequence/a"
+	for i, test := range []struct {
+		event    cfn.Event
+		draws    int
+		failures awstest.Failures
+		fails    bool
+		value    int64
+	}{
+		// test 0: the first value is drawn with x = 1
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: map[string]interface{}{"Sequence": sequence}},
+			value: 10},
+		// test 1: the values follow the expression
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: map[string]interface{}{"Sequence": sequence}},
+			draws: 2, value: 30},
+		// test 2: an update draws a new value
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: "Value",
+			ResourceProperties:    map[string]interface{}{"Sequence": sequence},
+			OldResourceProperties: map[string]interface{}{"Sequence": sequence}},
+			draws: 1, value: 20},
+		// test 3: the sequence is required
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: map[string]interface{}{}},
+			fails: true},
+		// test 4: the sequence does not exist
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: map[string]interface{}{"Sequence": "/unknown"}},
+			fails: true},
+		// test 5: failure to increment the sequence
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: map[string]interface{}{"Sequence": sequence}},
+			failures: awstest.Failures{"PutParameter": errors.New("boom")}, fails: true},
+		// test 6: delete is a NOP
+		{event: cfn.Event{RequestType: cfn.RequestDelete, PhysicalResourceID: "Value", ResourceProperties: map[string]interface{}{"Sequence": sequence}}},
+	} {
+		ssm := awstest.NewSSM()
+		ssm.PutString(sequence, "10*x")
+		value := &sequenceValue{ssm: ssm}
+		handler := resource.Handler(resource.Properties(SequenceValueProperties{}), value)
+		for d := 0; d < test.draws; d++ {
+			if _, _, err := handler(context.Background(), cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: map[string]interface{}{"Sequence": sequence}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ssm.Failures = test.failures
+		_, data, err := handler(context.Background(), test.event)
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if test.value != 0 && (data == nil || data["Value"] != test.value) {
+			t.Errorf("test %d: expecting value %d got %v", i, test.value, data)
+		}
+		if test.event.RequestType == cfn.RequestDelete && ssm.Called("PutParameter") != test.draws {
+			t.Errorf("test %d: delete must not draw a value", i)
+		}
+	}
+}
+
+func TestSequenceValueRecycling(t *testing.T) {
+	const sequence = "/hyperdrive/sequence/ports"
+	properties := func(extra map[string]interface{}) map[string]interface{} {
+		properties := map[string]interface{}{"Sequence": sequence}
+		for k, v := range extra {
+			properties[k] = v
+		}
+		return properties
+	}
+	for i, test := range []struct {
+		event    cfn.Event
+		ssm      bool
+		released []int64
+		id       string
+		fails    bool
+		values   []int64
+		free     []string
+	}{
+		// test 0: reserve a block of values
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties(map[string]interface{}{"Reserve": "3"})},
+			id: sequence + ":3-5=8003..8005", values: []int64{8003, 8004, 8005}},
+		// test 1: the smallest released value is recycled first
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties(map[string]interface{}{"Recycle": "true"})},
+			released: []int64{2, 1}, id: sequence + ":1=8001", values: []int64{8001}, free: []string{"2"}},
+		// test 2: without recycling, the released values stay free
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties(nil)},
+			released: []int64{1}, id: sequence + ":3=8003", values: []int64{8003}, free: []string{"1"}},
+		// test 3: blocks are not recycled
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties(map[string]interface{}{"Recycle": "true", "Reserve": "2"})},
+			released: []int64{1}, id: sequence + ":3-4=8003,8004", values: []int64{8003, 8004}, free: []string{"1"}},
+		// test 4: the values below the minimum are skipped
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties(map[string]interface{}{"Min": "8005"})},
+			id: sequence + ":5=8005", values: []int64{8005}},
+		// test 5: the sequence is exhausted
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Value", ResourceProperties: properties(map[string]interface{}{"Max": "8003", "Reserve": "2"})},
+			id: "failure-Value", fails: true},
+		// test 6: the recycled values above the maximum are dropped
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: properties(map[string]interface{}{"Recycle": "true", "Max": "8003"})},
+			released: []int64{9}, id: sequence + ":3=8003", values: []int64{8003}},
+		// test 7: delete releases the recycled values
+		{event: cfn.Event{RequestType: cfn.RequestDelete, PhysicalResourceID: sequence + ":1-2=8001,8002", ResourceProperties: properties(map[string]interface{}{"Recycle": "true"})},
+			id: sequence + ":1-2=8001,8002", free: []string{"1", "2"}},
+		// test 8: delete does not release the values that are not recycled
+		{event: cfn.Event{RequestType: cfn.RequestDelete, PhysicalResourceID: sequence + ":1-2=8001,8002", ResourceProperties: properties(nil)},
+			id: sequence + ":1-2=8001,8002"},
+		// test 9: delete of a value drawn before the values were recorded
+		{event: cfn.Event{RequestType: cfn.RequestDelete, PhysicalResourceID: "2019/01/01/[$LATEST]0123", ResourceProperties: properties(map[string]interface{}{"Recycle": "true"})},
+			id: "2019/01/01/[$LATEST]0123"},
+		// test 10: recycling requires the dynamodb backend
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Value", ResourceProperties: properties(map[string]interface{}{"Recycle": "true"})},
+			ssm: true, id: "failure-Value", fails: true},
+		// test 11: invalid bounds
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Value", ResourceProperties: properties(map[string]interface{}{"Min": "10", "Max": "1"})},
+			id: "failure-Value", fails: true},
+	} {
+		ssm := awstest.NewSSM()
+		dynamodb := awstest.NewDynamoDB()
+		dynamodb.CreateTable("sequences", "Name")
+		store := sequences.Store{SSM: ssm, DynamoDB: dynamodb, Table: "sequences"}
+		backend := sequences.BackendDynamoDB
+		if test.ssm {
+			backend = sequences.BackendSSM
+		}
+		if err := store.Create(sequence, "8000+x", backend); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := store.Reserve(sequence, 2); err != nil && !test.ssm {
+			t.Fatal(err)
+		}
+		if err := store.Release(sequence, test.released); err != nil {
+			t.Fatal(err)
+		}
+		handler := resource.Handler(resource.Properties(SequenceValueProperties{}), &sequenceValue{ssm: ssm, dynamodb: dynamodb, table: "sequences"})
+		id, data, err := handler(context.Background(), test.event)
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if id != test.id {
+			t.Errorf("test %d: expecting id %s got %s", i, test.id, id)
+		}
+		if test.values != nil && (data == nil || !reflect.DeepEqual(data["Values"], test.values) || data["Value"] != test.values[0]) {
+			t.Errorf("test %d: expecting values %v got %v", i, test.values, data)
+		}
+		if free := dynamodb.Item("sequences", sequence)["Free"].NS; !reflect.DeepEqual(free, test.free) {
+			t.Errorf("test %d: expecting the free values %v got %v", i, test.free, free)
+		}
+	}
+}
+
+func TestSequenceValueStability(t *testing.T) {
+	const sequence = "/hyperdrive/sequence/a"
+	const id = sequence + ":2=20"
+	properties := func(extra map[string]interface{}) map[string]interface{} {
+		properties := map[string]interface{}{"Sequence": sequence}
+		for k, v := range extra {
+			properties[k] = v
+		}
+		return properties
+	}
+	for i, test := range []struct {
+		properties, oldProperties map[string]interface{}
+		physicalId                string
+		id                        string
+		value                     int64
+	}{
+		// test 0: the value is kept
+		{properties: properties(map[string]interface{}{"Recycle": "false"}), oldProperties: properties(nil),
+			physicalId: id, id: id, value: 20},
+		// test 1: the value is drawn again on request
+		{properties: properties(map[string]interface{}{"Redraw": "2"}), oldProperties: properties(map[string]interface{}{"Redraw": "1"}),
+			physicalId: id, id: sequence + ":3=30", value: 30},
+		// test 2: the value is drawn again for a block
+		{properties: properties(map[string]interface{}{"Reserve": "2"}), oldProperties: properties(nil),
+			physicalId: id, id: sequence + ":3-4=30,40", value: 30},
+		// test 3: the value is drawn again when out of the new bounds
+		{properties: properties(map[string]interface{}{"Min": "25"}), oldProperties: properties(nil),
+			physicalId: id, id: sequence + ":3=30", value: 30},
+		// test 4: the value is kept within the new bounds
+		{properties: properties(map[string]interface{}{"Max": "25"}), oldProperties: properties(nil),
+			physicalId: id, id: id, value: 20},
+		// test 5: the value drawn before the values were recorded is drawn again
+		{properties: properties(nil), oldProperties: properties(nil),
+			physicalId: "2019/01/01/[$LATEST]0123", id: sequence + ":3=30", value: 30},
+	} {
+		ssm := awstest.NewSSM()
+		ssm.PutString(sequence, "10*x")
+		// the values 10 and 20 have been drawn.
+		for d := 0; d < 2; d++ {
+			ssm.PutParameter(&awsssm.PutParameterInput{Name: aws.String(sequence), Value: aws.String("10*x"), Overwrite: aws.Bool(true)})
+		}
+		dynamodb := awstest.NewDynamoDB()
+		dynamodb.CreateTable("sequences", "Name")
+		store := sequences.Store{SSM: ssm, DynamoDB: dynamodb, Table: "sequences"}
+		if err := store.Update(sequence, "10*x", "10*x", sequences.BackendSSM, sequences.BackendDynamoDB); err != nil {
+			t.Fatal(err)
+		}
+		handler := resource.Handler(resource.Properties(SequenceValueProperties{}), &sequenceValue{ssm: ssm, dynamodb: dynamodb, table: "sequences"})
+		id, data, err := handler(context.Background(), cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: test.physicalId,
+			ResourceProperties: test.properties, OldResourceProperties: test.oldProperties})
+		if err != nil {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if id != test.id {
+			t.Errorf("test %d: expecting id %s got %s", i, test.id, id)
+		}
+		if data == nil || data["Value"] != test.value {
+			t.Errorf("test %d: expecting value %d got %v", i, test.value, data)
+		}
+	}
+}
+
+func TestSequenceValueFormat(t *testing.T) {
+	const sequence = "/hyperdrive/sequence/a"
+	for i, test := range []struct {
+		event     cfn.Event
+		format    string
+		fails     bool
+		formatted []string
+	}{
+		// test 0: no format
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: map[string]interface{}{"Sequence": sequence}},
+			formatted: []string{"1"}},
+		// test 1: fmt-style format
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: map[string]interface{}{"Sequence": sequence}},
+			format: "app-%04d", formatted: []string{"app-0001"}},
+		// test 2: template
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: map[string]interface{}{"Sequence": sequence}},
+			format: "10.0.{x}.0/24", formatted: []string{"10.0.1.0/24"}},
+		// test 3: the kept values are formatted with the current format
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: sequence + ":1=7",
+			ResourceProperties:    map[string]interface{}{"Sequence": sequence},
+			OldResourceProperties: map[string]interface{}{"Sequence": sequence}},
+			format: "{x < 10 ? \"high\" : \"low\"}", formatted: []string{"high"}},
+		// test 4: invalid stored format
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: map[string]interface{}{"Sequence": sequence}},
+			format: "{y}", fails: true},
+	} {
+		ssm := awstest.NewSSM()
+		ssm.PutString(sequence, "x")
+		if test.format != "" {
+			ssm.PutString("/hyperdrive/sequence-format/a", test.format)
+		}
+		_, data, err := resource.Handler(resource.Properties(SequenceValueProperties{}), &sequenceValue{ssm: ssm})(context.Background(), test.event)
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if test.formatted != nil && (data == nil || !reflect.DeepEqual(data["FormattedValues"], test.formatted) || data["FormattedValue"] != test.formatted[0]) {
+			t.Errorf("test %d: expecting %v got %v", i, test.formatted, data)
+		}
+	}
+}
+
+func TestSequenceValueConsumers(t *testing.T) {
+	const sequence = "/hyperdrive/sequence/a"
+	ssm := awstest.NewSSM()
+	ssm.PutString(sequence, "x")
+	value := &sequenceValue{ssm: ssm}
+	store := value.store()
+	handler := resource.Handler(resource.Properties(SequenceValueProperties{}), value)
+	properties := map[string]interface{}{"Sequence": sequence}
+	id, _, err := handler(context.Background(), cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Value", StackID: "stack", ResourceProperties: properties})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if consumers, err := store.Consumers(sequence); err != nil || !reflect.DeepEqual(consumers, []string{"Value of the stack stack"}) {
+		t.Errorf("unexpected consumers %v, %v", consumers, err)
+	}
+	// a redraw registers the new values before the old ones are deleted.
+	newId, _, err := handler(context.Background(), cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: id, LogicalResourceID: "Value", StackID: "stack",
+		ResourceProperties:    map[string]interface{}{"Sequence": sequence, "Redraw": "1"},
+		OldResourceProperties: properties})
+	if err != nil || newId == id {
+		t.Fatalf("expecting new values got %s, %v", newId, err)
+	}
+	for _, deleted := range []string{id, newId} {
+		if consumers, _ := store.Consumers(sequence); len(consumers) == 0 {
+			t.Errorf("the sequence must have consumers before the deletion of %s", deleted)
+		}
+		if _, _, err := handler(context.Background(), cfn.Event{RequestType: cfn.RequestDelete, PhysicalResourceID: deleted, ResourceProperties: properties}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if consumers, err := store.Consumers(sequence); err != nil || len(consumers) != 0 {
+		t.Errorf("expecting no consumer got %v, %v", consumers, err)
+	}
+}
+
+func TestValuesId(t *testing.T) {
+	const sequence = "/hyperdrive/sequence/ports"
+	for i, test := range []struct {
+		first  int64
+		values []int64
+		id     string
+	}{
+		// test 0: a single value
+		{first: 1, values: []int64{8001}, id: sequence + ":1=8001"},
+		// test 1: consecutive values
+		{first: 1, values: []int64{8001, 8002, 8003, 8004}, id: sequence + ":1-4=8001..8004"},
+		// test 2: values with a step
+		{first: 1, values: []int64{10, 20, 30}, id: sequence + ":1-3=10..30/10"},
+		// test 3: decreasing values
+		{first: 1, values: []int64{-1, -2, -3}, id: sequence + ":1-3=-1..-3/-1"},
+		// test 4: runs and single values
+		{first: 1, values: []int64{1, 4, 9, 10, 11, 12, 2, 2}, id: sequence + ":1-8=1,4,9..12,2,2"},
+	} {
+		id := valuesId(sequence, test.first, test.values)
+		if id != test.id {
+			t.Errorf("test %d: expecting id %s got %s", i, test.id, id)
+		}
+		name, first, last, values, ok := parseValuesId(id)
+		if !ok || name != sequence || first != test.first || last != test.first+int64(len(test.values))-1 || !reflect.DeepEqual(values, test.values) {
+			t.Errorf("test %d: could not parse %s: %s %d %d %v", i, id, name, first, last, values)
+		}
+	}
+	for i, id := range []string{
+		// test 0: the number of values does not match
+		sequence + ":1-3=1..4",
+		// test 1: the step does not reach the end of the range
+		sequence + ":1-3=1..6/2",
+		// test 2: the step goes away from the end of the range
+		sequence + ":1-3=3..1",
+		// test 3: zero step
+		sequence + ":1-3=1..1/0",
+	} {
+		if _, _, _, _, ok := parseValuesId(id); ok {
+			t.Errorf("invalid test %d: %s must not be parsed", i, id)
+		}
+	}
+}
+
+func TestSequenceValueTooLong(t *testing.T) {
+	const sequence = "/hyperdrive/sequence/large"
+	ssm := awstest.NewSSM()
+	dynamodb := awstest.NewDynamoDB()
+	dynamodb.CreateTable("sequences", "Name")
+	store := sequences.Store{SSM: ssm, DynamoDB: dynamodb, Table: "sequences"}
+	if err := store.Create(sequence, "x*x*x*1000000000", sequences.BackendDynamoDB); err != nil {
+		t.Fatal(err)
+	}
+	handler := resource.Handler(resource.Properties(SequenceValueProperties{}), &sequenceValue{ssm: ssm, dynamodb: dynamodb, table: "sequences"})
+	_, _, err := handler(context.Background(), cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Value",
+		ResourceProperties: map[string]interface{}{"Sequence": sequence, "Reserve": "100"}})
+	if err == nil {
+		t.Fatal("the values are too long for the physical id")
+	}
+	if free := dynamodb.Item("sequences", sequence)["Free"].NS; len(free) != 100 {
+		t.Errorf("expecting the 100 values to be released got %v", free)
+	}
+}
@@ -0,0 +1,90 @@
+package awsapi
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+)
+
+// ACM is the subset of the ACM api used by the dnscert resource.
+type ACM interface {
+	AddTagsToCertificate(input *acm.AddTagsToCertificateInput) (*acm.AddTagsToCertificateOutput, error)
+	DeleteCertificate(input *acm.DeleteCertificateInput) (*acm.DeleteCertificateOutput, error)
+	DescribeCertificate(input *acm.DescribeCertificateInput) (*acm.DescribeCertificateOutput, error)
+	ImportCertificate(input *acm.ImportCertificateInput) (*acm.ImportCertificateOutput, error)
+	ListCertificates(input *acm.ListCertificatesInput) (*acm.ListCertificatesOutput, error)
+	ListTagsForCertificate(input *acm.ListTagsForCertificateInput) (*acm.ListTagsForCertificateOutput, error)
+	RemoveTagsFromCertificate(input *acm.RemoveTagsFromCertificateInput) (*acm.RemoveTagsFromCertificateOutput, error)
+	RequestCertificate(input *RequestCertificateInput) (*acm.RequestCertificateOutput, error)
+	UpdateCertificateOptions(input *acm.UpdateCertificateOptionsInput) (*acm.UpdateCertificateOptionsOutput, error)
+}
+
+// The RequestCertificateInput is the input of the `RequestCertificate`
+// operation with the `KeyAlgorithm` of the certificate. The version of the
+// SDK does not model the algorithm: the type mirrors the one of the api and
+// is serialized by the JSON protocol of the client like the generated
+// types.
+type RequestCertificateInput struct {
+	_ struct{} `type:"structure"`
+
+	CertificateAuthorityArn *string                      `min:"20" type:"string"`
+	DomainName              *string                      `min:"1" type:"string" required:"true"`
+	DomainValidationOptions []acm.DomainValidationOption `min:"1" type:"list"`
+	IdempotencyToken        *string                      `min:"1" type:"string"`
+	KeyAlgorithm            *string                      `type:"string"`
+	Options                 *acm.CertificateOptions      `type:"structure"`
+	SubjectAlternativeNames []string                     `min:"1" type:"list"`
+	ValidationMethod        *string                      `type:"string"`
+}
+
+func NewACM(client *acm.ACM) ACM {
+	return acmClient{client}
+}
+
+type acmClient struct {
+	client *acm.ACM
+}
+
+func (c acmClient) AddTagsToCertificate(input *acm.AddTagsToCertificateInput) (*acm.AddTagsToCertificateOutput, error) {
+	return c.client.AddTagsToCertificateRequest(input).Send()
+}
+
+func (c acmClient) DeleteCertificate(input *acm.DeleteCertificateInput) (*acm.DeleteCertificateOutput, error) {
+	return c.client.DeleteCertificateRequest(input).Send()
+}
+
+func (c acmClient) DescribeCertificate(input *acm.DescribeCertificateInput) (*acm.DescribeCertificateOutput, error) {
+	return c.client.DescribeCertificateRequest(input).Send()
+}
+
+func (c acmClient) ImportCertificate(input *acm.ImportCertificateInput) (*acm.ImportCertificateOutput, error) {
+	return c.client.ImportCertificateRequest(input).Send()
+}
+
+func (c acmClient) ListCertificates(input *acm.ListCertificatesInput) (*acm.ListCertificatesOutput, error) {
+	return c.client.ListCertificatesRequest(input).Send()
+}
+
+func (c acmClient) ListTagsForCertificate(input *acm.ListTagsForCertificateInput) (*acm.ListTagsForCertificateOutput, error) {
+	return c.client.ListTagsForCertificateRequest(input).Send()
+}
+
+func (c acmClient) RemoveTagsFromCertificate(input *acm.RemoveTagsFromCertificateInput) (*acm.RemoveTagsFromCertificateOutput, error) {
+	return c.client.RemoveTagsFromCertificateRequest(input).Send()
+}
+
+func (c acmClient) RequestCertificate(input *RequestCertificateInput) (*acm.RequestCertificateOutput, error) {
+	output := &acm.RequestCertificateOutput{}
+	request := c.client.NewRequest(&aws.Operation{
+		Name:       "RequestCertificate",
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}, input, output)
+	if err := request.Send(); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (c acmClient) UpdateCertificateOptions(input *acm.UpdateCertificateOptionsInput) (*acm.UpdateCertificateOptionsOutput, error) {
+	return c.client.UpdateCertificateOptionsRequest(input).Send()
+}
@@ -0,0 +1,27 @@
+package awsapi
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/apigateway"
+)
+
+// APIGateway is the subset of the API Gateway api used by the cfapikey resource.
+type APIGateway interface {
+	CreateApiKey(input *apigateway.CreateApiKeyInput) (*apigateway.CreateApiKeyOutput, error)
+	DeleteApiKey(input *apigateway.DeleteApiKeyInput) (*apigateway.DeleteApiKeyOutput, error)
+}
+
+func NewAPIGateway(client *apigateway.APIGateway) APIGateway {
+	return apiGatewayClient{client}
+}
+
+type apiGatewayClient struct {
+	client *apigateway.APIGateway
+}
+
+func (c apiGatewayClient) CreateApiKey(input *apigateway.CreateApiKeyInput) (*apigateway.CreateApiKeyOutput, error) {
+	return c.client.CreateApiKeyRequest(input).Send()
+}
+
+func (c apiGatewayClient) DeleteApiKey(input *apigateway.DeleteApiKeyInput) (*apigateway.DeleteApiKeyOutput, error) {
+	return c.client.DeleteApiKeyRequest(input).Send()
+}
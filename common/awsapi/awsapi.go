@@ -0,0 +1,12 @@
+// # AWS API
+//
+// The custom resources do not use the clients of the AWS sdk directly but
+// narrow interfaces with the subset of the calls that they actually use.
+// The interfaces take the input structs of the sdk and return the output
+// structs, hiding the request/send pattern of the sdk. This allows to
+// replace the clients by the in-memory fakes of the `awstest` package in
+// unit tests.
+//
+// Each interface comes with a constructor wrapping the corresponding sdk
+// client.
+package awsapi
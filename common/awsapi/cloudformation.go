@@ -0,0 +1,27 @@
+package awsapi
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+)
+
+// CloudFormation is the subset of the cloudformation api used to inspect the stacks of the resources.
+type CloudFormation interface {
+	DescribeStacks(input *cloudformation.DescribeStacksInput) (*cloudformation.DescribeStacksOutput, error)
+	DescribeStackResource(input *cloudformation.DescribeStackResourceInput) (*cloudformation.DescribeStackResourceOutput, error)
+}
+
+func NewCloudFormation(client *cloudformation.CloudFormation) CloudFormation {
+	return cloudFormationClient{client}
+}
+
+type cloudFormationClient struct {
+	client *cloudformation.CloudFormation
+}
+
+func (c cloudFormationClient) DescribeStacks(input *cloudformation.DescribeStacksInput) (*cloudformation.DescribeStacksOutput, error) {
+	return c.client.DescribeStacksRequest(input).Send()
+}
+
+func (c cloudFormationClient) DescribeStackResource(input *cloudformation.DescribeStackResourceInput) (*cloudformation.DescribeStackResourceOutput, error) {
+	return c.client.DescribeStackResourceRequest(input).Send()
+}
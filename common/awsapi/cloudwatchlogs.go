@@ -0,0 +1,87 @@
+package awsapi
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+)
+
+// CloudWatchLogs is the subset of the cloudwatch logs api used by the loggrp resource.
+type CloudWatchLogs interface {
+	AssociateKmsKey(input *cloudwatchlogs.AssociateKmsKeyInput) (*cloudwatchlogs.AssociateKmsKeyOutput, error)
+	CreateLogGroup(input *cloudwatchlogs.CreateLogGroupInput) (*cloudwatchlogs.CreateLogGroupOutput, error)
+	DeleteLogGroup(input *cloudwatchlogs.DeleteLogGroupInput) (*cloudwatchlogs.DeleteLogGroupOutput, error)
+	DeleteMetricFilter(input *cloudwatchlogs.DeleteMetricFilterInput) (*cloudwatchlogs.DeleteMetricFilterOutput, error)
+	DeleteRetentionPolicy(input *cloudwatchlogs.DeleteRetentionPolicyInput) (*cloudwatchlogs.DeleteRetentionPolicyOutput, error)
+	DeleteSubscriptionFilter(input *cloudwatchlogs.DeleteSubscriptionFilterInput) (*cloudwatchlogs.DeleteSubscriptionFilterOutput, error)
+	DescribeLogGroups(input *cloudwatchlogs.DescribeLogGroupsInput) (*cloudwatchlogs.DescribeLogGroupsOutput, error)
+	DisassociateKmsKey(input *cloudwatchlogs.DisassociateKmsKeyInput) (*cloudwatchlogs.DisassociateKmsKeyOutput, error)
+	ListTagsLogGroup(input *cloudwatchlogs.ListTagsLogGroupInput) (*cloudwatchlogs.ListTagsLogGroupOutput, error)
+	PutMetricFilter(input *cloudwatchlogs.PutMetricFilterInput) (*cloudwatchlogs.PutMetricFilterOutput, error)
+	PutRetentionPolicy(input *cloudwatchlogs.PutRetentionPolicyInput) (*cloudwatchlogs.PutRetentionPolicyOutput, error)
+	PutSubscriptionFilter(input *cloudwatchlogs.PutSubscriptionFilterInput) (*cloudwatchlogs.PutSubscriptionFilterOutput, error)
+	TagLogGroup(input *cloudwatchlogs.TagLogGroupInput) (*cloudwatchlogs.TagLogGroupOutput, error)
+	UntagLogGroup(input *cloudwatchlogs.UntagLogGroupInput) (*cloudwatchlogs.UntagLogGroupOutput, error)
+}
+
+func NewCloudWatchLogs(client *cloudwatchlogs.CloudWatchLogs) CloudWatchLogs {
+	return cloudWatchLogsClient{client}
+}
+
+type cloudWatchLogsClient struct {
+	client *cloudwatchlogs.CloudWatchLogs
+}
+
+func (c cloudWatchLogsClient) AssociateKmsKey(input *cloudwatchlogs.AssociateKmsKeyInput) (*cloudwatchlogs.AssociateKmsKeyOutput, error) {
+	return c.client.AssociateKmsKeyRequest(input).Send()
+}
+
+func (c cloudWatchLogsClient) CreateLogGroup(input *cloudwatchlogs.CreateLogGroupInput) (*cloudwatchlogs.CreateLogGroupOutput, error) {
+	return c.client.CreateLogGroupRequest(input).Send()
+}
+
+func (c cloudWatchLogsClient) DeleteLogGroup(input *cloudwatchlogs.DeleteLogGroupInput) (*cloudwatchlogs.DeleteLogGroupOutput, error) {
+	return c.client.DeleteLogGroupRequest(input).Send()
+}
+
+func (c cloudWatchLogsClient) DeleteMetricFilter(input *cloudwatchlogs.DeleteMetricFilterInput) (*cloudwatchlogs.DeleteMetricFilterOutput, error) {
+	return c.client.DeleteMetricFilterRequest(input).Send()
+}
+
+func (c cloudWatchLogsClient) DeleteRetentionPolicy(input *cloudwatchlogs.DeleteRetentionPolicyInput) (*cloudwatchlogs.DeleteRetentionPolicyOutput, error) {
+	return c.client.DeleteRetentionPolicyRequest(input).Send()
+}
+
+func (c cloudWatchLogsClient) DeleteSubscriptionFilter(input *cloudwatchlogs.DeleteSubscriptionFilterInput) (*cloudwatchlogs.DeleteSubscriptionFilterOutput, error) {
+	return c.client.DeleteSubscriptionFilterRequest(input).Send()
+}
+
+func (c cloudWatchLogsClient) DescribeLogGroups(input *cloudwatchlogs.DescribeLogGroupsInput) (*cloudwatchlogs.DescribeLogGroupsOutput, error) {
+	return c.client.DescribeLogGroupsRequest(input).Send()
+}
+
+func (c cloudWatchLogsClient) DisassociateKmsKey(input *cloudwatchlogs.DisassociateKmsKeyInput) (*cloudwatchlogs.DisassociateKmsKeyOutput, error) {
+	return c.client.DisassociateKmsKeyRequest(input).Send()
+}
+
+func (c cloudWatchLogsClient) ListTagsLogGroup(input *cloudwatchlogs.ListTagsLogGroupInput) (*cloudwatchlogs.ListTagsLogGroupOutput, error) {
+	return c.client.ListTagsLogGroupRequest(input).Send()
+}
+
+func (c cloudWatchLogsClient) PutMetricFilter(input *cloudwatchlogs.PutMetricFilterInput) (*cloudwatchlogs.PutMetricFilterOutput, error) {
+	return c.client.PutMetricFilterRequest(input).Send()
+}
+
+func (c cloudWatchLogsClient) PutRetentionPolicy(input *cloudwatchlogs.PutRetentionPolicyInput) (*cloudwatchlogs.PutRetentionPolicyOutput, error) {
+	return c.client.PutRetentionPolicyRequest(input).Send()
+}
+
+func (c cloudWatchLogsClient) PutSubscriptionFilter(input *cloudwatchlogs.PutSubscriptionFilterInput) (*cloudwatchlogs.PutSubscriptionFilterOutput, error) {
+	return c.client.PutSubscriptionFilterRequest(input).Send()
+}
+
+func (c cloudWatchLogsClient) TagLogGroup(input *cloudwatchlogs.TagLogGroupInput) (*cloudwatchlogs.TagLogGroupOutput, error) {
+	return c.client.TagLogGroupRequest(input).Send()
+}
+
+func (c cloudWatchLogsClient) UntagLogGroup(input *cloudwatchlogs.UntagLogGroupInput) (*cloudwatchlogs.UntagLogGroupOutput, error) {
+	return c.client.UntagLogGroupRequest(input).Send()
+}
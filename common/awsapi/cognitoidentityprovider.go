@@ -0,0 +1,52 @@
+package awsapi
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
+)
+
+// CognitoIdentityProvider is the subset of the cognito api used by the cognito resources and triggers.
+type CognitoIdentityProvider interface {
+	AdminListGroupsForUser(input *cognitoidentityprovider.AdminListGroupsForUserInput) (*cognitoidentityprovider.AdminListGroupsForUserOutput, error)
+	CreateIdentityProvider(input *cognitoidentityprovider.CreateIdentityProviderInput) (*cognitoidentityprovider.CreateIdentityProviderOutput, error)
+	CreateUserPoolDomain(input *cognitoidentityprovider.CreateUserPoolDomainInput) (*cognitoidentityprovider.CreateUserPoolDomainOutput, error)
+	DeleteIdentityProvider(input *cognitoidentityprovider.DeleteIdentityProviderInput) (*cognitoidentityprovider.DeleteIdentityProviderOutput, error)
+	DeleteUserPoolDomain(input *cognitoidentityprovider.DeleteUserPoolDomainInput) (*cognitoidentityprovider.DeleteUserPoolDomainOutput, error)
+	UpdateIdentityProvider(input *cognitoidentityprovider.UpdateIdentityProviderInput) (*cognitoidentityprovider.UpdateIdentityProviderOutput, error)
+	UpdateUserPoolClient(input *cognitoidentityprovider.UpdateUserPoolClientInput) (*cognitoidentityprovider.UpdateUserPoolClientOutput, error)
+}
+
+func NewCognitoIdentityProvider(client *cognitoidentityprovider.CognitoIdentityProvider) CognitoIdentityProvider {
+	return cognitoIdentityProviderClient{client}
+}
+
+type cognitoIdentityProviderClient struct {
+	client *cognitoidentityprovider.CognitoIdentityProvider
+}
+
+func (c cognitoIdentityProviderClient) AdminListGroupsForUser(input *cognitoidentityprovider.AdminListGroupsForUserInput) (*cognitoidentityprovider.AdminListGroupsForUserOutput, error) {
+	return c.client.AdminListGroupsForUserRequest(input).Send()
+}
+
+func (c cognitoIdentityProviderClient) CreateIdentityProvider(input *cognitoidentityprovider.CreateIdentityProviderInput) (*cognitoidentityprovider.CreateIdentityProviderOutput, error) {
+	return c.client.CreateIdentityProviderRequest(input).Send()
+}
+
+func (c cognitoIdentityProviderClient) CreateUserPoolDomain(input *cognitoidentityprovider.CreateUserPoolDomainInput) (*cognitoidentityprovider.CreateUserPoolDomainOutput, error) {
+	return c.client.CreateUserPoolDomainRequest(input).Send()
+}
+
+func (c cognitoIdentityProviderClient) DeleteIdentityProvider(input *cognitoidentityprovider.DeleteIdentityProviderInput) (*cognitoidentityprovider.DeleteIdentityProviderOutput, error) {
+	return c.client.DeleteIdentityProviderRequest(input).Send()
+}
+
+func (c cognitoIdentityProviderClient) DeleteUserPoolDomain(input *cognitoidentityprovider.DeleteUserPoolDomainInput) (*cognitoidentityprovider.DeleteUserPoolDomainOutput, error) {
+	return c.client.DeleteUserPoolDomainRequest(input).Send()
+}
+
+func (c cognitoIdentityProviderClient) UpdateIdentityProvider(input *cognitoidentityprovider.UpdateIdentityProviderInput) (*cognitoidentityprovider.UpdateIdentityProviderOutput, error) {
+	return c.client.UpdateIdentityProviderRequest(input).Send()
+}
+
+func (c cognitoIdentityProviderClient) UpdateUserPoolClient(input *cognitoidentityprovider.UpdateUserPoolClientInput) (*cognitoidentityprovider.UpdateUserPoolClientOutput, error) {
+	return c.client.UpdateUserPoolClientRequest(input).Send()
+}
@@ -0,0 +1,42 @@
+package awsapi
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// DynamoDB is the subset of the DynamoDB api used by the resources storing their state in tables.
+type DynamoDB interface {
+	DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error)
+	GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error)
+	PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error)
+	Scan(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error)
+	UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error)
+}
+
+func NewDynamoDB(client *dynamodb.DynamoDB) DynamoDB {
+	return dynamoDBClient{client}
+}
+
+type dynamoDBClient struct {
+	client *dynamodb.DynamoDB
+}
+
+func (c dynamoDBClient) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	return c.client.DeleteItemRequest(input).Send()
+}
+
+func (c dynamoDBClient) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return c.client.GetItemRequest(input).Send()
+}
+
+func (c dynamoDBClient) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	return c.client.PutItemRequest(input).Send()
+}
+
+func (c dynamoDBClient) Scan(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	return c.client.ScanRequest(input).Send()
+}
+
+func (c dynamoDBClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	return c.client.UpdateItemRequest(input).Send()
+}
@@ -0,0 +1,22 @@
+package awsapi
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// EC2 is the subset of the EC2 api used to list the regions of the account.
+type EC2 interface {
+	DescribeRegions(input *ec2.DescribeRegionsInput) (*ec2.DescribeRegionsOutput, error)
+}
+
+func NewEC2(client *ec2.EC2) EC2 {
+	return ec2Client{client}
+}
+
+type ec2Client struct {
+	client *ec2.EC2
+}
+
+func (c ec2Client) DescribeRegions(input *ec2.DescribeRegionsInput) (*ec2.DescribeRegionsOutput, error) {
+	return c.client.DescribeRegionsRequest(input).Send()
+}
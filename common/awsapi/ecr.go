@@ -0,0 +1,37 @@
+package awsapi
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+)
+
+// ECR is the subset of the ECR api used by the ecrcleanup resource.
+type ECR interface {
+	BatchDeleteImage(input *ecr.BatchDeleteImageInput) (*ecr.BatchDeleteImageOutput, error)
+	DeleteRepository(input *ecr.DeleteRepositoryInput) (*ecr.DeleteRepositoryOutput, error)
+	DescribeImages(input *ecr.DescribeImagesInput) (*ecr.DescribeImagesOutput, error)
+	ListImages(input *ecr.ListImagesInput) (*ecr.ListImagesOutput, error)
+}
+
+func NewECR(client *ecr.ECR) ECR {
+	return ecrClient{client}
+}
+
+type ecrClient struct {
+	client *ecr.ECR
+}
+
+func (c ecrClient) BatchDeleteImage(input *ecr.BatchDeleteImageInput) (*ecr.BatchDeleteImageOutput, error) {
+	return c.client.BatchDeleteImageRequest(input).Send()
+}
+
+func (c ecrClient) DeleteRepository(input *ecr.DeleteRepositoryInput) (*ecr.DeleteRepositoryOutput, error) {
+	return c.client.DeleteRepositoryRequest(input).Send()
+}
+
+func (c ecrClient) DescribeImages(input *ecr.DescribeImagesInput) (*ecr.DescribeImagesOutput, error) {
+	return c.client.DescribeImagesRequest(input).Send()
+}
+
+func (c ecrClient) ListImages(input *ecr.ListImagesInput) (*ecr.ListImagesOutput, error) {
+	return c.client.ListImagesRequest(input).Send()
+}
@@ -0,0 +1,79 @@
+package awsapi
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/elbv2"
+)
+
+// ELBV2 is the subset of the ELBv2 api used by the listenerRuleSwapper resource.
+type ELBV2 interface {
+	DescribeRules(input *elbv2.DescribeRulesInput) (*elbv2.DescribeRulesOutput, error)
+	ModifyRuleForward(input *ModifyRuleForwardInput) (*elbv2.ModifyRuleOutput, error)
+	SetRulePriorities(input *elbv2.SetRulePrioritiesInput) (*elbv2.SetRulePrioritiesOutput, error)
+}
+
+// The ModifyRuleForwardInput is the input of the `ModifyRule` operation
+// with weighted forward actions. The version of the SDK does not model the
+// `ForwardConfig` of the actions: the types mirror the ones of the api and
+// are serialized by the query protocol of the client like the generated
+// types.
+type ModifyRuleForwardInput struct {
+	_ struct{} `type:"structure"`
+
+	Actions []ForwardAction `type:"list" required:"true"`
+	RuleArn *string         `type:"string" required:"true"`
+}
+
+// A ForwardAction is an action of type `forward` to target groups.
+type ForwardAction struct {
+	_ struct{} `type:"structure"`
+
+	ForwardConfig *ForwardActionConfig `type:"structure"`
+	Order         *int64               `min:"1" type:"integer"`
+	Type          *string              `type:"string" required:"true"`
+}
+
+// A ForwardActionConfig gives the target groups of a forward action.
+type ForwardActionConfig struct {
+	_ struct{} `type:"structure"`
+
+	TargetGroups []TargetGroupTuple `type:"list"`
+}
+
+// A TargetGroupTuple is a target group of a forward action with its
+// weight.
+type TargetGroupTuple struct {
+	_ struct{} `type:"structure"`
+
+	TargetGroupArn *string `type:"string"`
+	Weight         *int64  `type:"integer"`
+}
+
+func NewELBV2(client *elbv2.ELBV2) ELBV2 {
+	return elbv2Client{client}
+}
+
+type elbv2Client struct {
+	client *elbv2.ELBV2
+}
+
+func (c elbv2Client) DescribeRules(input *elbv2.DescribeRulesInput) (*elbv2.DescribeRulesOutput, error) {
+	return c.client.DescribeRulesRequest(input).Send()
+}
+
+func (c elbv2Client) ModifyRuleForward(input *ModifyRuleForwardInput) (*elbv2.ModifyRuleOutput, error) {
+	output := &elbv2.ModifyRuleOutput{}
+	request := c.client.NewRequest(&aws.Operation{
+		Name:       "ModifyRule",
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}, input, output)
+	if err := request.Send(); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (c elbv2Client) SetRulePriorities(input *elbv2.SetRulePrioritiesInput) (*elbv2.SetRulePrioritiesOutput, error) {
+	return c.client.SetRulePrioritiesRequest(input).Send()
+}
@@ -0,0 +1,22 @@
+package awsapi
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+)
+
+// Lambda is the subset of the lambda api used by the lambdas to re-invoke themselves.
+type Lambda interface {
+	Invoke(input *lambda.InvokeInput) (*lambda.InvokeOutput, error)
+}
+
+func NewLambda(client *lambda.Lambda) Lambda {
+	return lambdaClient{client}
+}
+
+type lambdaClient struct {
+	client *lambda.Lambda
+}
+
+func (c lambdaClient) Invoke(input *lambda.InvokeInput) (*lambda.InvokeOutput, error) {
+	return c.client.InvokeRequest(input).Send()
+}
@@ -0,0 +1,28 @@
+package awsapi
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+)
+
+// Route53 is the subset of the route53 api used by the dnscert resource to
+// manage the validation records.
+type Route53 interface {
+	ChangeResourceRecordSets(input *route53.ChangeResourceRecordSetsInput) (*route53.ChangeResourceRecordSetsOutput, error)
+	ListResourceRecordSets(input *route53.ListResourceRecordSetsInput) (*route53.ListResourceRecordSetsOutput, error)
+}
+
+func NewRoute53(client *route53.Route53) Route53 {
+	return route53Client{client}
+}
+
+type route53Client struct {
+	client *route53.Route53
+}
+
+func (c route53Client) ChangeResourceRecordSets(input *route53.ChangeResourceRecordSetsInput) (*route53.ChangeResourceRecordSetsOutput, error) {
+	return c.client.ChangeResourceRecordSetsRequest(input).Send()
+}
+
+func (c route53Client) ListResourceRecordSets(input *route53.ListResourceRecordSetsInput) (*route53.ListResourceRecordSetsOutput, error) {
+	return c.client.ListResourceRecordSetsRequest(input).Send()
+}
@@ -0,0 +1,52 @@
+package awsapi
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// S3 is the subset of the S3 api used by the s3cleanup resource.
+type S3 interface {
+	AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error)
+	DeleteBucket(input *s3.DeleteBucketInput) (*s3.DeleteBucketOutput, error)
+	DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error)
+	GetObjectTagging(input *s3.GetObjectTaggingInput) (*s3.GetObjectTaggingOutput, error)
+	ListMultipartUploads(input *s3.ListMultipartUploadsInput) (*s3.ListMultipartUploadsOutput, error)
+	ListObjectVersions(input *s3.ListObjectVersionsInput) (*s3.ListObjectVersionsOutput, error)
+	PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error)
+}
+
+func NewS3(client *s3.S3) S3 {
+	return s3Client{client}
+}
+
+type s3Client struct {
+	client *s3.S3
+}
+
+func (c s3Client) AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	return c.client.AbortMultipartUploadRequest(input).Send()
+}
+
+func (c s3Client) DeleteBucket(input *s3.DeleteBucketInput) (*s3.DeleteBucketOutput, error) {
+	return c.client.DeleteBucketRequest(input).Send()
+}
+
+func (c s3Client) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	return c.client.DeleteObjectsRequest(input).Send()
+}
+
+func (c s3Client) GetObjectTagging(input *s3.GetObjectTaggingInput) (*s3.GetObjectTaggingOutput, error) {
+	return c.client.GetObjectTaggingRequest(input).Send()
+}
+
+func (c s3Client) ListMultipartUploads(input *s3.ListMultipartUploadsInput) (*s3.ListMultipartUploadsOutput, error) {
+	return c.client.ListMultipartUploadsRequest(input).Send()
+}
+
+func (c s3Client) ListObjectVersions(input *s3.ListObjectVersionsInput) (*s3.ListObjectVersionsOutput, error) {
+	return c.client.ListObjectVersionsRequest(input).Send()
+}
+
+func (c s3Client) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	return c.client.PutObjectRequest(input).Send()
+}
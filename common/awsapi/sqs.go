@@ -0,0 +1,22 @@
+package awsapi
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// SQS is the subset of the sqs api used by the lambdas to delay their continuations.
+type SQS interface {
+	SendMessage(input *sqs.SendMessageInput) (*sqs.SendMessageOutput, error)
+}
+
+func NewSQS(client *sqs.SQS) SQS {
+	return sqsClient{client}
+}
+
+type sqsClient struct {
+	client *sqs.SQS
+}
+
+func (c sqsClient) SendMessage(input *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	return c.client.SendMessageRequest(input).Send()
+}
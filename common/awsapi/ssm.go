@@ -0,0 +1,37 @@
+package awsapi
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// SSM is the subset of the SSM api used by the resources storing their state in parameters.
+type SSM interface {
+	DeleteParameter(input *ssm.DeleteParameterInput) (*ssm.DeleteParameterOutput, error)
+	GetParameter(input *ssm.GetParameterInput) (*ssm.GetParameterOutput, error)
+	GetParametersByPath(input *ssm.GetParametersByPathInput) (*ssm.GetParametersByPathOutput, error)
+	PutParameter(input *ssm.PutParameterInput) (*ssm.PutParameterOutput, error)
+}
+
+func NewSSM(client *ssm.SSM) SSM {
+	return ssmClient{client}
+}
+
+type ssmClient struct {
+	client *ssm.SSM
+}
+
+func (c ssmClient) DeleteParameter(input *ssm.DeleteParameterInput) (*ssm.DeleteParameterOutput, error) {
+	return c.client.DeleteParameterRequest(input).Send()
+}
+
+func (c ssmClient) GetParameter(input *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+	return c.client.GetParameterRequest(input).Send()
+}
+
+func (c ssmClient) GetParametersByPath(input *ssm.GetParametersByPathInput) (*ssm.GetParametersByPathOutput, error) {
+	return c.client.GetParametersByPathRequest(input).Send()
+}
+
+func (c ssmClient) PutParameter(input *ssm.PutParameterInput) (*ssm.PutParameterOutput, error) {
+	return c.client.PutParameterRequest(input).Send()
+}
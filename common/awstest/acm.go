@@ -0,0 +1,227 @@
+package awstest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awsapi"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+)
+
+// ACM is a fake of the certificate manager for a given region. Requested
+// certificates get their DNS validation records immediately; like in ACM,
+// a wildcard domain has the same record as its base domain. The PEM of the
+// imported certificates is kept in `Imported`.
+type ACM struct {
+	Calls
+	Failures     Failures
+	Region       string
+	Certificates map[string]*acm.CertificateDetail
+	Tags         map[string][]acm.Tag
+	Imported     map[string]string
+	mutex        sync.Mutex
+	counter      int
+}
+
+func NewACM(region string) *ACM {
+	return &ACM{
+		Region:       region,
+		Certificates: make(map[string]*acm.CertificateDetail),
+		Tags:         make(map[string][]acm.Tag),
+		Imported:     make(map[string]string),
+	}
+}
+
+func (f *ACM) RequestCertificate(input *awsapi.RequestCertificateInput) (*acm.RequestCertificateOutput, error) {
+	f.record("RequestCertificate")
+	if err := f.Failures.fail("RequestCertificate"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.counter++
+	arn := fmt.Sprintf("arn:aws:acm:%s:123456789012:certificate/%d", f.Region, f.counter)
+	domains := append([]string{*input.DomainName}, input.SubjectAlternativeNames...)
+	options := make([]acm.DomainValidation, len(domains))
+	for i, domain := range domains {
+		domainName := domain
+		base := strings.TrimPrefix(domain, "*.")
+		name := "_validation." + base + "."
+		value := "_" + base + ".acm-validations.aws."
+		options[i] = acm.DomainValidation{
+			DomainName: &domainName,
+			ResourceRecord: &acm.ResourceRecord{
+				Name:  &name,
+				Type:  acm.RecordTypeCname,
+				Value: &value,
+			},
+		}
+	}
+	keyAlgorithm := acm.KeyAlgorithmRsa2048
+	if input.KeyAlgorithm != nil {
+		keyAlgorithm = acm.KeyAlgorithm(*input.KeyAlgorithm)
+	}
+	f.Certificates[arn] = &acm.CertificateDetail{
+		CertificateArn:          &arn,
+		DomainName:              input.DomainName,
+		DomainValidationOptions: options,
+		KeyAlgorithm:            keyAlgorithm,
+		Options:                 input.Options,
+		Status:                  acm.CertificateStatusPendingValidation,
+		SubjectAlternativeNames: domains,
+		Type:                    acm.CertificateTypeAmazonIssued,
+	}
+	return &acm.RequestCertificateOutput{CertificateArn: &arn}, nil
+}
+
+func (f *ACM) DescribeCertificate(input *acm.DescribeCertificateInput) (*acm.DescribeCertificateOutput, error) {
+	f.record("DescribeCertificate")
+	if err := f.Failures.fail("DescribeCertificate"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	certificate, ok := f.Certificates[*input.CertificateArn]
+	if !ok {
+		return nil, NotFound("ResourceNotFoundException", *input.CertificateArn)
+	}
+	detail := *certificate
+	return &acm.DescribeCertificateOutput{Certificate: &detail}, nil
+}
+
+func (f *ACM) DeleteCertificate(input *acm.DeleteCertificateInput) (*acm.DeleteCertificateOutput, error) {
+	f.record("DeleteCertificate")
+	if err := f.Failures.fail("DeleteCertificate"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, ok := f.Certificates[*input.CertificateArn]; !ok {
+		return nil, NotFound("ResourceNotFoundException", *input.CertificateArn)
+	}
+	delete(f.Certificates, *input.CertificateArn)
+	delete(f.Tags, *input.CertificateArn)
+	return &acm.DeleteCertificateOutput{}, nil
+}
+
+func (f *ACM) AddTagsToCertificate(input *acm.AddTagsToCertificateInput) (*acm.AddTagsToCertificateOutput, error) {
+	f.record("AddTagsToCertificate")
+	if err := f.Failures.fail("AddTagsToCertificate"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	tags := f.Tags[*input.CertificateArn]
+OUTER:
+	for _, tag := range input.Tags {
+		for i, existing := range tags {
+			if *existing.Key == *tag.Key {
+				tags[i] = tag
+				continue OUTER
+			}
+		}
+		tags = append(tags, tag)
+	}
+	f.Tags[*input.CertificateArn] = tags
+	return &acm.AddTagsToCertificateOutput{}, nil
+}
+
+func (f *ACM) RemoveTagsFromCertificate(input *acm.RemoveTagsFromCertificateInput) (*acm.RemoveTagsFromCertificateOutput, error) {
+	f.record("RemoveTagsFromCertificate")
+	if err := f.Failures.fail("RemoveTagsFromCertificate"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var tags []acm.Tag
+OUTER:
+	for _, existing := range f.Tags[*input.CertificateArn] {
+		for _, tag := range input.Tags {
+			if *existing.Key == *tag.Key {
+				continue OUTER
+			}
+		}
+		tags = append(tags, existing)
+	}
+	f.Tags[*input.CertificateArn] = tags
+	return &acm.RemoveTagsFromCertificateOutput{}, nil
+}
+
+func (f *ACM) ListTagsForCertificate(input *acm.ListTagsForCertificateInput) (*acm.ListTagsForCertificateOutput, error) {
+	f.record("ListTagsForCertificate")
+	if err := f.Failures.fail("ListTagsForCertificate"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	tags := append([]acm.Tag(nil), f.Tags[*input.CertificateArn]...)
+	return &acm.ListTagsForCertificateOutput{Tags: tags}, nil
+}
+
+func (f *ACM) ListCertificates(input *acm.ListCertificatesInput) (*acm.ListCertificatesOutput, error) {
+	f.record("ListCertificates")
+	if err := f.Failures.fail("ListCertificates"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	arns := make([]string, 0, len(f.Certificates))
+	for arn := range f.Certificates {
+		arns = append(arns, arn)
+	}
+	sort.Strings(arns)
+	output := &acm.ListCertificatesOutput{}
+	for _, arn := range arns {
+		certificate := f.Certificates[arn]
+		output.CertificateSummaryList = append(output.CertificateSummaryList, acm.CertificateSummary{
+			CertificateArn: certificate.CertificateArn,
+			DomainName:     certificate.DomainName,
+		})
+	}
+	return output, nil
+}
+
+// ImportCertificate stores the imported certificate as is: the fake does
+// not parse it.
+func (f *ACM) ImportCertificate(input *acm.ImportCertificateInput) (*acm.ImportCertificateOutput, error) {
+	f.record("ImportCertificate")
+	if err := f.Failures.fail("ImportCertificate"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var arn string
+	if input.CertificateArn != nil {
+		arn = *input.CertificateArn
+		if _, ok := f.Certificates[arn]; !ok {
+			return nil, NotFound("ResourceNotFoundException", arn)
+		}
+	} else {
+		f.counter++
+		arn = fmt.Sprintf("arn:aws:acm:%s:123456789012:certificate/%d", f.Region, f.counter)
+	}
+	f.Certificates[arn] = &acm.CertificateDetail{
+		CertificateArn: &arn,
+		Status:         acm.CertificateStatusIssued,
+		Type:           acm.CertificateTypeImported,
+	}
+	f.Imported[arn] = string(input.Certificate)
+	return &acm.ImportCertificateOutput{CertificateArn: &arn}, nil
+}
+
+func (f *ACM) UpdateCertificateOptions(input *acm.UpdateCertificateOptionsInput) (*acm.UpdateCertificateOptionsOutput, error) {
+	f.record("UpdateCertificateOptions")
+	if err := f.Failures.fail("UpdateCertificateOptions"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	certificate, ok := f.Certificates[*input.CertificateArn]
+	if !ok {
+		return nil, NotFound("ResourceNotFoundException", *input.CertificateArn)
+	}
+	certificate.Options = input.Options
+	return &acm.UpdateCertificateOptionsOutput{}, nil
+}
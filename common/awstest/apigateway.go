@@ -0,0 +1,50 @@
+package awstest
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/apigateway"
+)
+
+// APIGateway is a fake of the api keys of API Gateway.
+type APIGateway struct {
+	Calls
+	Failures Failures
+	ApiKeys  map[string]apigateway.CreateApiKeyOutput
+	mutex    sync.Mutex
+	counter  int
+}
+
+func NewAPIGateway() *APIGateway {
+	return &APIGateway{ApiKeys: make(map[string]apigateway.CreateApiKeyOutput)}
+}
+
+func (f *APIGateway) CreateApiKey(input *apigateway.CreateApiKeyInput) (*apigateway.CreateApiKeyOutput, error) {
+	f.record("CreateApiKey")
+	if err := f.Failures.fail("CreateApiKey"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.counter++
+	id := "key" + strconv.Itoa(f.counter)
+	value := "secret" + strconv.Itoa(f.counter)
+	key := apigateway.CreateApiKeyOutput{Id: &id, Name: input.Name, Enabled: input.Enabled, Value: &value}
+	f.ApiKeys[id] = key
+	return &key, nil
+}
+
+func (f *APIGateway) DeleteApiKey(input *apigateway.DeleteApiKeyInput) (*apigateway.DeleteApiKeyOutput, error) {
+	f.record("DeleteApiKey")
+	if err := f.Failures.fail("DeleteApiKey"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, ok := f.ApiKeys[*input.ApiKey]; !ok {
+		return nil, NotFound("NotFoundException", *input.ApiKey)
+	}
+	delete(f.ApiKeys, *input.ApiKey)
+	return &apigateway.DeleteApiKeyOutput{}, nil
+}
@@ -0,0 +1,74 @@
+// # AWS Test
+//
+// In-memory fakes of the `awsapi` interfaces to unit test the custom
+// resources without AWS. The fakes keep just enough state to behave like
+// the real services for the calls made by the resources. Every call can be
+// made to fail by registering an error for the name of the operation in
+// the `Failures` of the fake.
+package awstest
+
+import (
+	"sync"
+
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awsapi"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+)
+
+// Failures maps the name of an operation, e.g. "PutParameter", to the
+// error that the fake must return when the operation is called.
+type Failures map[string]error
+
+func (f Failures) fail(operation string) error {
+	if f == nil {
+		return nil
+	}
+	return f[operation]
+}
+
+// Calls records the names of the operations called on a fake, in order.
+type Calls struct {
+	mutex sync.Mutex
+	calls []string
+}
+
+func (c *Calls) record(operation string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.calls = append(c.calls, operation)
+}
+
+// Called returns the number of times the given operation has been called.
+func (c *Calls) Called(operation string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	n := 0
+	for _, call := range c.calls {
+		if call == operation {
+			n++
+		}
+	}
+	return n
+}
+
+// NotFound creates an error in the format of the sdk with the given error
+// code.
+func NotFound(code, message string) error {
+	return awserr.New(code, message, nil)
+}
+
+var (
+	_ awsapi.ACM                     = &ACM{}
+	_ awsapi.APIGateway              = &APIGateway{}
+	_ awsapi.CloudFormation          = &CloudFormation{}
+	_ awsapi.CloudWatchLogs          = &CloudWatchLogs{}
+	_ awsapi.CognitoIdentityProvider = &CognitoIdentityProvider{}
+	_ awsapi.DynamoDB                = &DynamoDB{}
+	_ awsapi.EC2                     = &EC2{}
+	_ awsapi.ECR                     = &ECR{}
+	_ awsapi.ELBV2                   = &ELBV2{}
+	_ awsapi.Lambda                  = &Lambda{}
+	_ awsapi.Route53                 = &Route53{}
+	_ awsapi.S3                      = &S3{}
+	_ awsapi.SQS                     = &SQS{}
+	_ awsapi.SSM                     = &SSM{}
+)
@@ -0,0 +1,89 @@
+package awstest
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+)
+
+// CloudFormation is a fake of cloudformation with stacks identified by
+// their ids. The physical ids of the resources are kept in `Resources` by
+// stack id and logical id.
+type CloudFormation struct {
+	Calls
+	Failures  Failures
+	Stacks    map[string]cloudformation.Stack
+	Resources map[string]map[string]string
+	mutex     sync.Mutex
+}
+
+func NewCloudFormation() *CloudFormation {
+	return &CloudFormation{
+		Stacks:    make(map[string]cloudformation.Stack),
+		Resources: make(map[string]map[string]string),
+	}
+}
+
+// PutStack adds a stack with the given id, name and status.
+func (f *CloudFormation) PutStack(id, name string, status cloudformation.StackStatus) {
+	f.PutNestedStack(id, name, "", status)
+}
+
+// PutNestedStack adds a stack with the given id, name and status nested
+// in the stack with the given parent id; the root of the stack is the
+// root of its parent.
+func (f *CloudFormation) PutNestedStack(id, name, parentId string, status cloudformation.StackStatus) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	stackId, stackName := id, name
+	stack := cloudformation.Stack{StackId: &stackId, StackName: &stackName, StackStatus: status}
+	if parentId != "" {
+		parent, root := parentId, parentId
+		if f.Stacks[parentId].RootId != nil {
+			root = *f.Stacks[parentId].RootId
+		}
+		stack.ParentId, stack.RootId = &parent, &root
+	}
+	f.Stacks[id] = stack
+}
+
+// PutStackResource sets the physical id of a resource of a stack.
+func (f *CloudFormation) PutStackResource(stackId, logicalId, physicalId string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.Resources[stackId] == nil {
+		f.Resources[stackId] = make(map[string]string)
+	}
+	f.Resources[stackId][logicalId] = physicalId
+}
+
+func (f *CloudFormation) DescribeStacks(input *cloudformation.DescribeStacksInput) (*cloudformation.DescribeStacksOutput, error) {
+	f.record("DescribeStacks")
+	if err := f.Failures.fail("DescribeStacks"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	stack, ok := f.Stacks[*input.StackName]
+	if !ok {
+		return nil, NotFound("ValidationError", "Stack with id "+*input.StackName+" does not exist")
+	}
+	return &cloudformation.DescribeStacksOutput{Stacks: []cloudformation.Stack{stack}}, nil
+}
+
+func (f *CloudFormation) DescribeStackResource(input *cloudformation.DescribeStackResourceInput) (*cloudformation.DescribeStackResourceOutput, error) {
+	f.record("DescribeStackResource")
+	if err := f.Failures.fail("DescribeStackResource"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	physicalId, ok := f.Resources[*input.StackName][*input.LogicalResourceId]
+	if !ok {
+		return nil, NotFound("ValidationError", "Resource "+*input.LogicalResourceId+" does not exist for stack "+*input.StackName)
+	}
+	logicalId := *input.LogicalResourceId
+	return &cloudformation.DescribeStackResourceOutput{
+		StackResourceDetail: &cloudformation.StackResourceDetail{LogicalResourceId: &logicalId, PhysicalResourceId: &physicalId},
+	}, nil
+}
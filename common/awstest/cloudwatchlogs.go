@@ -0,0 +1,312 @@
+package awstest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+)
+
+// LogGroup is the state of a log group in the CloudWatchLogs fake.
+type LogGroup struct {
+	Arn                 string
+	KmsKeyId            string
+	RetentionInDays     *int64
+	Tags                map[string]string
+	SubscriptionFilters map[string]cloudwatchlogs.SubscriptionFilter
+	MetricFilters       map[string]cloudwatchlogs.MetricFilter
+}
+
+// MaxSubscriptionFilters is the maximal number of subscription filters of
+// a log group.
+const MaxSubscriptionFilters = 2
+
+// CloudWatchLogs is a fake of cloudwatch logs for a given region.
+type CloudWatchLogs struct {
+	Calls
+	Failures  Failures
+	Region    string
+	LogGroups map[string]*LogGroup
+	mutex     sync.Mutex
+}
+
+func NewCloudWatchLogs(region string) *CloudWatchLogs {
+	return &CloudWatchLogs{Region: region, LogGroups: make(map[string]*LogGroup)}
+}
+
+func (f *CloudWatchLogs) group(name string) (*LogGroup, error) {
+	group, ok := f.LogGroups[name]
+	if !ok {
+		return nil, NotFound(cloudwatchlogs.ErrCodeResourceNotFoundException, name)
+	}
+	return group, nil
+}
+
+func (f *CloudWatchLogs) CreateLogGroup(input *cloudwatchlogs.CreateLogGroupInput) (*cloudwatchlogs.CreateLogGroupOutput, error) {
+	f.record("CreateLogGroup")
+	if err := f.Failures.fail("CreateLogGroup"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, ok := f.LogGroups[*input.LogGroupName]; ok {
+		return nil, NotFound(cloudwatchlogs.ErrCodeResourceAlreadyExistsException, *input.LogGroupName)
+	}
+	tags := make(map[string]string, len(input.Tags))
+	for k, v := range input.Tags {
+		tags[k] = v
+	}
+	f.LogGroups[*input.LogGroupName] = &LogGroup{
+		Arn:                 fmt.Sprintf("arn:aws:logs:%s:123456789012:log-group:%s:*", f.Region, *input.LogGroupName),
+		Tags:                tags,
+		SubscriptionFilters: make(map[string]cloudwatchlogs.SubscriptionFilter),
+		MetricFilters:       make(map[string]cloudwatchlogs.MetricFilter),
+	}
+	if input.KmsKeyId != nil {
+		f.LogGroups[*input.LogGroupName].KmsKeyId = *input.KmsKeyId
+	}
+	return &cloudwatchlogs.CreateLogGroupOutput{}, nil
+}
+
+func (f *CloudWatchLogs) DeleteLogGroup(input *cloudwatchlogs.DeleteLogGroupInput) (*cloudwatchlogs.DeleteLogGroupOutput, error) {
+	f.record("DeleteLogGroup")
+	if err := f.Failures.fail("DeleteLogGroup"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, err := f.group(*input.LogGroupName); err != nil {
+		return nil, err
+	}
+	delete(f.LogGroups, *input.LogGroupName)
+	return &cloudwatchlogs.DeleteLogGroupOutput{}, nil
+}
+
+func (f *CloudWatchLogs) DescribeLogGroups(input *cloudwatchlogs.DescribeLogGroupsInput) (*cloudwatchlogs.DescribeLogGroupsOutput, error) {
+	f.record("DescribeLogGroups")
+	if err := f.Failures.fail("DescribeLogGroups"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	names := make([]string, 0, len(f.LogGroups))
+	for name := range f.LogGroups {
+		if input.LogGroupNamePrefix == nil || strings.HasPrefix(name, *input.LogGroupNamePrefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	groups := make([]cloudwatchlogs.LogGroup, len(names))
+	for i, name := range names {
+		logGroupName := name
+		arn := f.LogGroups[name].Arn
+		groups[i] = cloudwatchlogs.LogGroup{
+			Arn:             &arn,
+			LogGroupName:    &logGroupName,
+			RetentionInDays: f.LogGroups[name].RetentionInDays,
+		}
+		if kmsKeyId := f.LogGroups[name].KmsKeyId; kmsKeyId != "" {
+			groups[i].KmsKeyId = &kmsKeyId
+		}
+	}
+	return &cloudwatchlogs.DescribeLogGroupsOutput{LogGroups: groups}, nil
+}
+
+func (f *CloudWatchLogs) PutRetentionPolicy(input *cloudwatchlogs.PutRetentionPolicyInput) (*cloudwatchlogs.PutRetentionPolicyOutput, error) {
+	f.record("PutRetentionPolicy")
+	if err := f.Failures.fail("PutRetentionPolicy"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	group, err := f.group(*input.LogGroupName)
+	if err != nil {
+		return nil, err
+	}
+	retention := *input.RetentionInDays
+	group.RetentionInDays = &retention
+	return &cloudwatchlogs.PutRetentionPolicyOutput{}, nil
+}
+
+func (f *CloudWatchLogs) DeleteRetentionPolicy(input *cloudwatchlogs.DeleteRetentionPolicyInput) (*cloudwatchlogs.DeleteRetentionPolicyOutput, error) {
+	f.record("DeleteRetentionPolicy")
+	if err := f.Failures.fail("DeleteRetentionPolicy"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	group, err := f.group(*input.LogGroupName)
+	if err != nil {
+		return nil, err
+	}
+	group.RetentionInDays = nil
+	return &cloudwatchlogs.DeleteRetentionPolicyOutput{}, nil
+}
+
+func (f *CloudWatchLogs) ListTagsLogGroup(input *cloudwatchlogs.ListTagsLogGroupInput) (*cloudwatchlogs.ListTagsLogGroupOutput, error) {
+	f.record("ListTagsLogGroup")
+	if err := f.Failures.fail("ListTagsLogGroup"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	group, err := f.group(*input.LogGroupName)
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string, len(group.Tags))
+	for k, v := range group.Tags {
+		tags[k] = v
+	}
+	return &cloudwatchlogs.ListTagsLogGroupOutput{Tags: tags}, nil
+}
+
+func (f *CloudWatchLogs) TagLogGroup(input *cloudwatchlogs.TagLogGroupInput) (*cloudwatchlogs.TagLogGroupOutput, error) {
+	f.record("TagLogGroup")
+	if err := f.Failures.fail("TagLogGroup"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	group, err := f.group(*input.LogGroupName)
+	if err != nil {
+		return nil, err
+	}
+	if group.Tags == nil {
+		group.Tags = make(map[string]string)
+	}
+	for k, v := range input.Tags {
+		group.Tags[k] = v
+	}
+	return &cloudwatchlogs.TagLogGroupOutput{}, nil
+}
+
+func (f *CloudWatchLogs) UntagLogGroup(input *cloudwatchlogs.UntagLogGroupInput) (*cloudwatchlogs.UntagLogGroupOutput, error) {
+	f.record("UntagLogGroup")
+	if err := f.Failures.fail("UntagLogGroup"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	group, err := f.group(*input.LogGroupName)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range input.Tags {
+		delete(group.Tags, k)
+	}
+	return &cloudwatchlogs.UntagLogGroupOutput{}, nil
+}
+
+func (f *CloudWatchLogs) AssociateKmsKey(input *cloudwatchlogs.AssociateKmsKeyInput) (*cloudwatchlogs.AssociateKmsKeyOutput, error) {
+	f.record("AssociateKmsKey")
+	if err := f.Failures.fail("AssociateKmsKey"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	group, err := f.group(*input.LogGroupName)
+	if err != nil {
+		return nil, err
+	}
+	group.KmsKeyId = *input.KmsKeyId
+	return &cloudwatchlogs.AssociateKmsKeyOutput{}, nil
+}
+
+func (f *CloudWatchLogs) DisassociateKmsKey(input *cloudwatchlogs.DisassociateKmsKeyInput) (*cloudwatchlogs.DisassociateKmsKeyOutput, error) {
+	f.record("DisassociateKmsKey")
+	if err := f.Failures.fail("DisassociateKmsKey"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	group, err := f.group(*input.LogGroupName)
+	if err != nil {
+		return nil, err
+	}
+	group.KmsKeyId = ""
+	return &cloudwatchlogs.DisassociateKmsKeyOutput{}, nil
+}
+
+func (f *CloudWatchLogs) PutSubscriptionFilter(input *cloudwatchlogs.PutSubscriptionFilterInput) (*cloudwatchlogs.PutSubscriptionFilterOutput, error) {
+	f.record("PutSubscriptionFilter")
+	if err := f.Failures.fail("PutSubscriptionFilter"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	group, err := f.group(*input.LogGroupName)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := group.SubscriptionFilters[*input.FilterName]; !ok && len(group.SubscriptionFilters) >= MaxSubscriptionFilters {
+		return nil, NotFound(cloudwatchlogs.ErrCodeLimitExceededException, *input.FilterName)
+	}
+	group.SubscriptionFilters[*input.FilterName] = cloudwatchlogs.SubscriptionFilter{
+		DestinationArn: input.DestinationArn,
+		Distribution:   input.Distribution,
+		FilterName:     input.FilterName,
+		FilterPattern:  input.FilterPattern,
+		LogGroupName:   input.LogGroupName,
+		RoleArn:        input.RoleArn,
+	}
+	return &cloudwatchlogs.PutSubscriptionFilterOutput{}, nil
+}
+
+func (f *CloudWatchLogs) DeleteSubscriptionFilter(input *cloudwatchlogs.DeleteSubscriptionFilterInput) (*cloudwatchlogs.DeleteSubscriptionFilterOutput, error) {
+	f.record("DeleteSubscriptionFilter")
+	if err := f.Failures.fail("DeleteSubscriptionFilter"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	group, err := f.group(*input.LogGroupName)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := group.SubscriptionFilters[*input.FilterName]; !ok {
+		return nil, NotFound(cloudwatchlogs.ErrCodeResourceNotFoundException, *input.FilterName)
+	}
+	delete(group.SubscriptionFilters, *input.FilterName)
+	return &cloudwatchlogs.DeleteSubscriptionFilterOutput{}, nil
+}
+
+func (f *CloudWatchLogs) PutMetricFilter(input *cloudwatchlogs.PutMetricFilterInput) (*cloudwatchlogs.PutMetricFilterOutput, error) {
+	f.record("PutMetricFilter")
+	if err := f.Failures.fail("PutMetricFilter"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	group, err := f.group(*input.LogGroupName)
+	if err != nil {
+		return nil, err
+	}
+	group.MetricFilters[*input.FilterName] = cloudwatchlogs.MetricFilter{
+		FilterName:            input.FilterName,
+		FilterPattern:         input.FilterPattern,
+		LogGroupName:          input.LogGroupName,
+		MetricTransformations: input.MetricTransformations,
+	}
+	return &cloudwatchlogs.PutMetricFilterOutput{}, nil
+}
+
+func (f *CloudWatchLogs) DeleteMetricFilter(input *cloudwatchlogs.DeleteMetricFilterInput) (*cloudwatchlogs.DeleteMetricFilterOutput, error) {
+	f.record("DeleteMetricFilter")
+	if err := f.Failures.fail("DeleteMetricFilter"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	group, err := f.group(*input.LogGroupName)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := group.MetricFilters[*input.FilterName]; !ok {
+		return nil, NotFound(cloudwatchlogs.ErrCodeResourceNotFoundException, *input.FilterName)
+	}
+	delete(group.MetricFilters, *input.FilterName)
+	return &cloudwatchlogs.DeleteMetricFilterOutput{}, nil
+}
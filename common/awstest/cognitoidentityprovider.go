@@ -0,0 +1,160 @@
+package awstest
+
+import (
+	"strconv"
+	"sync"
+
+	cip "github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
+)
+
+// CognitoIdentityProvider is a fake of the cognito user pools keeping the
+// domains, the identity providers and the client settings that have been
+// configured, and the groups of the users by user pool and user name.
+type CognitoIdentityProvider struct {
+	Calls
+	Failures          Failures
+	Domains           map[string]cip.CreateUserPoolDomainInput
+	IdentityProviders map[string]cip.CreateIdentityProviderInput
+	Clients           map[string]cip.UpdateUserPoolClientInput
+	Groups            map[string]map[string][]string
+	mutex             sync.Mutex
+}
+
+func NewCognitoIdentityProvider() *CognitoIdentityProvider {
+	return &CognitoIdentityProvider{
+		Domains:           make(map[string]cip.CreateUserPoolDomainInput),
+		IdentityProviders: make(map[string]cip.CreateIdentityProviderInput),
+		Clients:           make(map[string]cip.UpdateUserPoolClientInput),
+		Groups:            make(map[string]map[string][]string),
+	}
+}
+
+// AddUserToGroup adds the user of the user pool to the group.
+func (f *CognitoIdentityProvider) AddUserToGroup(userPoolId, username, group string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.Groups[userPoolId] == nil {
+		f.Groups[userPoolId] = make(map[string][]string)
+	}
+	f.Groups[userPoolId][username] = append(f.Groups[userPoolId][username], group)
+}
+
+// AdminListGroupsForUser returns the groups of the user, one per page.
+func (f *CognitoIdentityProvider) AdminListGroupsForUser(input *cip.AdminListGroupsForUserInput) (*cip.AdminListGroupsForUserOutput, error) {
+	f.record("AdminListGroupsForUser")
+	if err := f.Failures.fail("AdminListGroupsForUser"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	groups, ok := f.Groups[*input.UserPoolId][*input.Username]
+	if !ok {
+		return nil, NotFound("UserNotFoundException", *input.Username)
+	}
+	output := &cip.AdminListGroupsForUserOutput{}
+	next := 0
+	if input.NextToken != nil {
+		next, _ = strconv.Atoi(*input.NextToken)
+	}
+	if next < len(groups) {
+		group := groups[next]
+		output.Groups = []cip.GroupType{{GroupName: &group, UserPoolId: input.UserPoolId}}
+	}
+	if next+1 < len(groups) {
+		token := strconv.Itoa(next + 1)
+		output.NextToken = &token
+	}
+	return output, nil
+}
+
+func (f *CognitoIdentityProvider) CreateUserPoolDomain(input *cip.CreateUserPoolDomainInput) (*cip.CreateUserPoolDomainOutput, error) {
+	f.record("CreateUserPoolDomain")
+	if err := f.Failures.fail("CreateUserPoolDomain"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, ok := f.Domains[*input.Domain]; ok {
+		return nil, NotFound("InvalidParameterException", "domain already exists")
+	}
+	f.Domains[*input.Domain] = *input
+	output := &cip.CreateUserPoolDomainOutput{}
+	if input.CustomDomainConfig != nil {
+		cloudFrontDomain := "d111111abcdef8.cloudfront.net"
+		output.CloudFrontDomain = &cloudFrontDomain
+	}
+	return output, nil
+}
+
+func (f *CognitoIdentityProvider) DeleteUserPoolDomain(input *cip.DeleteUserPoolDomainInput) (*cip.DeleteUserPoolDomainOutput, error) {
+	f.record("DeleteUserPoolDomain")
+	if err := f.Failures.fail("DeleteUserPoolDomain"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, ok := f.Domains[*input.Domain]; !ok {
+		return nil, NotFound("ResourceNotFoundException", *input.Domain)
+	}
+	delete(f.Domains, *input.Domain)
+	return &cip.DeleteUserPoolDomainOutput{}, nil
+}
+
+func (f *CognitoIdentityProvider) CreateIdentityProvider(input *cip.CreateIdentityProviderInput) (*cip.CreateIdentityProviderOutput, error) {
+	f.record("CreateIdentityProvider")
+	if err := f.Failures.fail("CreateIdentityProvider"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	id := *input.UserPoolId + "/" + *input.ProviderName
+	if _, ok := f.IdentityProviders[id]; ok {
+		return nil, NotFound("DuplicateProviderException", id)
+	}
+	f.IdentityProviders[id] = *input
+	return &cip.CreateIdentityProviderOutput{}, nil
+}
+
+func (f *CognitoIdentityProvider) UpdateIdentityProvider(input *cip.UpdateIdentityProviderInput) (*cip.UpdateIdentityProviderOutput, error) {
+	f.record("UpdateIdentityProvider")
+	if err := f.Failures.fail("UpdateIdentityProvider"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	id := *input.UserPoolId + "/" + *input.ProviderName
+	provider, ok := f.IdentityProviders[id]
+	if !ok {
+		return nil, NotFound("ResourceNotFoundException", id)
+	}
+	provider.AttributeMapping = input.AttributeMapping
+	provider.ProviderDetails = input.ProviderDetails
+	f.IdentityProviders[id] = provider
+	return &cip.UpdateIdentityProviderOutput{}, nil
+}
+
+func (f *CognitoIdentityProvider) DeleteIdentityProvider(input *cip.DeleteIdentityProviderInput) (*cip.DeleteIdentityProviderOutput, error) {
+	f.record("DeleteIdentityProvider")
+	if err := f.Failures.fail("DeleteIdentityProvider"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	id := *input.UserPoolId + "/" + *input.ProviderName
+	if _, ok := f.IdentityProviders[id]; !ok {
+		return nil, NotFound("ResourceNotFoundException", id)
+	}
+	delete(f.IdentityProviders, id)
+	return &cip.DeleteIdentityProviderOutput{}, nil
+}
+
+func (f *CognitoIdentityProvider) UpdateUserPoolClient(input *cip.UpdateUserPoolClientInput) (*cip.UpdateUserPoolClientOutput, error) {
+	f.record("UpdateUserPoolClient")
+	if err := f.Failures.fail("UpdateUserPoolClient"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.Clients[*input.UserPoolId+"/"+*input.ClientId] = *input
+	return &cip.UpdateUserPoolClientOutput{}, nil
+}
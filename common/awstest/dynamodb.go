@@ -0,0 +1,425 @@
+package awstest
+
+import (
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// DynamoDB is a fake of DynamoDB tables with a hash key only. The tables
+// must be created with `CreateTable` before use. The fake understands the
+// subset of the expressions used by the resources:
+//
+// - conditions joined with `AND`: `attribute_exists(a)`,
+//   `attribute_not_exists(a)`, `contains(a, :v)` for sets and the
+//   comparisons `a = :v`, `a <> :v`, `a < :v`, `a <= :v`, `a > :v` and
+//   `a >= :v`;
+// - updates with the clauses `SET a = :v, b = b + :v, c = c - :v`,
+//   `ADD a :v` for numbers and sets, `DELETE a :v` for sets and
+//   `REMOVE a, b`.
+//
+// The attribute names may be placeholders (`#a`) of the expression
+// attribute names.
+type DynamoDB struct {
+	Calls
+	Failures Failures
+	Tables   map[string]map[string]map[string]dynamodb.AttributeValue
+	keys     map[string]string
+	mutex    sync.Mutex
+}
+
+func NewDynamoDB() *DynamoDB {
+	return &DynamoDB{
+		Tables: make(map[string]map[string]map[string]dynamodb.AttributeValue),
+		keys:   make(map[string]string),
+	}
+}
+
+// CreateTable creates an empty table with the given hash key.
+func (f *DynamoDB) CreateTable(table, hashKey string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.Tables[table] = make(map[string]map[string]dynamodb.AttributeValue)
+	f.keys[table] = hashKey
+}
+
+// Item returns the item of the table with the given string hash key.
+func (f *DynamoDB) Item(table, key string) map[string]dynamodb.AttributeValue {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.Tables[table][key]
+}
+
+func (f *DynamoDB) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	f.record("GetItem")
+	if err := f.Failures.fail("GetItem"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	items, key, err := f.lookup(input.TableName, input.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.GetItemOutput{Item: copyItem(items[key])}, nil
+}
+
+func (f *DynamoDB) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	f.record("PutItem")
+	if err := f.Failures.fail("PutItem"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	items, key, err := f.lookup(input.TableName, input.Item)
+	if err != nil {
+		return nil, err
+	}
+	if err := condition(input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, items[key]); err != nil {
+		return nil, err
+	}
+	old := items[key]
+	items[key] = copyItem(input.Item)
+	output := &dynamodb.PutItemOutput{}
+	if input.ReturnValues == dynamodb.ReturnValueAllOld {
+		output.Attributes = old
+	}
+	return output, nil
+}
+
+func (f *DynamoDB) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	f.record("UpdateItem")
+	if err := f.Failures.fail("UpdateItem"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	items, key, err := f.lookup(input.TableName, input.Key)
+	if err != nil {
+		return nil, err
+	}
+	if err := condition(input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, items[key]); err != nil {
+		return nil, err
+	}
+	old := items[key]
+	item := copyItem(old)
+	if item == nil {
+		item = copyItem(input.Key)
+	}
+	if input.UpdateExpression != nil {
+		if err := update(*input.UpdateExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, item); err != nil {
+			return nil, err
+		}
+	}
+	items[key] = item
+	output := &dynamodb.UpdateItemOutput{}
+	switch input.ReturnValues {
+	case dynamodb.ReturnValueAllOld, dynamodb.ReturnValueUpdatedOld:
+		output.Attributes = copyItem(old)
+	case dynamodb.ReturnValueAllNew, dynamodb.ReturnValueUpdatedNew:
+		output.Attributes = copyItem(item)
+	}
+	return output, nil
+}
+
+func (f *DynamoDB) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	f.record("DeleteItem")
+	if err := f.Failures.fail("DeleteItem"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	items, key, err := f.lookup(input.TableName, input.Key)
+	if err != nil {
+		return nil, err
+	}
+	if err := condition(input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, items[key]); err != nil {
+		return nil, err
+	}
+	old := items[key]
+	delete(items, key)
+	output := &dynamodb.DeleteItemOutput{}
+	if input.ReturnValues == dynamodb.ReturnValueAllOld {
+		output.Attributes = old
+	}
+	return output, nil
+}
+
+// Scan returns the items ordered by key, in pages of `Limit` items.
+func (f *DynamoDB) Scan(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	f.record("Scan")
+	if err := f.Failures.fail("Scan"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	items, ok := f.Tables[*input.TableName]
+	if !ok {
+		return nil, NotFound(dynamodb.ErrCodeResourceNotFoundException, *input.TableName)
+	}
+	hashKey := f.keys[*input.TableName]
+	var keys []string
+	for key := range items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	output := &dynamodb.ScanOutput{}
+	for _, key := range keys {
+		if start, ok := input.ExclusiveStartKey[hashKey]; ok && key <= attributeString(start) {
+			continue
+		}
+		if input.Limit != nil && int64(len(output.Items)) == *input.Limit {
+			last := output.Items[len(output.Items)-1]
+			output.LastEvaluatedKey = map[string]dynamodb.AttributeValue{hashKey: last[hashKey]}
+			break
+		}
+		output.Items = append(output.Items, copyItem(items[key]))
+	}
+	count := int64(len(output.Items))
+	output.Count = &count
+	return output, nil
+}
+
+func (f *DynamoDB) lookup(table *string, item map[string]dynamodb.AttributeValue) (map[string]map[string]dynamodb.AttributeValue, string, error) {
+	items, ok := f.Tables[*table]
+	if !ok {
+		return nil, "", NotFound(dynamodb.ErrCodeResourceNotFoundException, *table)
+	}
+	key, ok := item[f.keys[*table]]
+	if !ok {
+		return nil, "", NotFound("ValidationException", "missing the key "+f.keys[*table])
+	}
+	return items, attributeString(key), nil
+}
+
+func attributeString(value dynamodb.AttributeValue) string {
+	switch {
+	case value.S != nil:
+		return *value.S
+	case value.N != nil:
+		return *value.N
+	}
+	return ""
+}
+
+func copyItem(item map[string]dynamodb.AttributeValue) map[string]dynamodb.AttributeValue {
+	if item == nil {
+		return nil
+	}
+	c := make(map[string]dynamodb.AttributeValue, len(item))
+	for k, v := range item {
+		v.SS = append([]string(nil), v.SS...)
+		v.NS = append([]string(nil), v.NS...)
+		v.L = append([]dynamodb.AttributeValue(nil), v.L...)
+		c[k] = v
+	}
+	return c
+}
+
+var comparison = regexp.MustCompile(`^(#?\w+)\s*(=|<>|<=|>=|<|>)\s*(:\w+)$`)
+var function = regexp.MustCompile(`^(attribute_exists|attribute_not_exists)\(\s*(#?\w+)\s*\)$`)
+var contains = regexp.MustCompile(`^contains\(\s*(#?\w+)\s*,\s*(:\w+)\s*\)$`)
+
+func attributeName(name string, names map[string]string) string {
+	if strings.HasPrefix(name, "#") {
+		return names[name]
+	}
+	return name
+}
+
+func condition(expression *string, names map[string]string, values map[string]dynamodb.AttributeValue, item map[string]dynamodb.AttributeValue) error {
+	if expression == nil {
+		return nil
+	}
+	failed := NotFound(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed")
+	for _, clause := range strings.Split(*expression, " AND ") {
+		clause = strings.TrimSpace(clause)
+		if m := function.FindStringSubmatch(clause); m != nil {
+			_, exists := item[attributeName(m[2], names)]
+			if exists != (m[1] == "attribute_exists") {
+				return failed
+			}
+			continue
+		}
+		if m := contains.FindStringSubmatch(clause); m != nil {
+			set := item[attributeName(m[1], names)]
+			if !member(append(set.SS, set.NS...), attributeString(values[m[2]])) {
+				return failed
+			}
+			continue
+		}
+		m := comparison.FindStringSubmatch(clause)
+		if m == nil {
+			return NotFound("ValidationException", "unsupported condition "+clause)
+		}
+		actual, ok := item[attributeName(m[1], names)]
+		if !ok {
+			return failed
+		}
+		c := compare(actual, values[m[3]])
+		var holds bool
+		switch m[2] {
+		case "=":
+			holds = c == 0
+		case "<>":
+			holds = c != 0
+		case "<":
+			holds = c < 0
+		case "<=":
+			holds = c <= 0
+		case ">":
+			holds = c > 0
+		case ">=":
+			holds = c >= 0
+		}
+		if !holds {
+			return failed
+		}
+	}
+	return nil
+}
+
+func compare(a, b dynamodb.AttributeValue) int {
+	if a.N != nil && b.N != nil {
+		x, _ := new(big.Int).SetString(*a.N, 10)
+		y, _ := new(big.Int).SetString(*b.N, 10)
+		if x != nil && y != nil {
+			return x.Cmp(y)
+		}
+	}
+	return strings.Compare(attributeString(a), attributeString(b))
+}
+
+var clauses = regexp.MustCompile(`\b(SET|ADD|DELETE|REMOVE)\b`)
+var arithmetic = regexp.MustCompile(`^(#?\w+)\s*(\+|-)\s*(:\w+)$`)
+
+func update(expression string, names map[string]string, values map[string]dynamodb.AttributeValue, item map[string]dynamodb.AttributeValue) error {
+	bounds := clauses.FindAllStringSubmatchIndex(expression, -1)
+	for i, bound := range bounds {
+		end := len(expression)
+		if i+1 < len(bounds) {
+			end = bounds[i+1][0]
+		}
+		action := expression[bound[2]:bound[3]]
+		for _, part := range strings.Split(expression[bound[1]:end], ",") {
+			part = strings.TrimSpace(part)
+			if err := updateAttribute(action, part, names, values, item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func updateAttribute(action, part string, names map[string]string, values map[string]dynamodb.AttributeValue, item map[string]dynamodb.AttributeValue) error {
+	invalid := NotFound("ValidationException", "unsupported update "+action+" "+part)
+	switch action {
+	case "SET":
+		assignment := strings.SplitN(part, "=", 2)
+		if len(assignment) != 2 {
+			return invalid
+		}
+		name := attributeName(strings.TrimSpace(assignment[0]), names)
+		operand := strings.TrimSpace(assignment[1])
+		if m := arithmetic.FindStringSubmatch(operand); m != nil {
+			sum, err := addNumbers(item[attributeName(m[1], names)], values[m[3]], m[2] == "-")
+			if err != nil {
+				return err
+			}
+			item[name] = sum
+			return nil
+		}
+		value, ok := values[operand]
+		if !ok {
+			return invalid
+		}
+		item[name] = value
+	case "ADD", "DELETE":
+		fields := strings.Fields(part)
+		if len(fields) != 2 {
+			return invalid
+		}
+		name := attributeName(fields[0], names)
+		value := values[fields[1]]
+		current, exists := item[name]
+		switch {
+		case value.N != nil && action == "ADD":
+			if !exists {
+				zero := "0"
+				current = dynamodb.AttributeValue{N: &zero}
+			}
+			sum, err := addNumbers(current, value, false)
+			if err != nil {
+				return err
+			}
+			item[name] = sum
+		case value.SS != nil:
+			current.SS = updateSet(current.SS, value.SS, action == "DELETE")
+			if len(current.SS) == 0 {
+				delete(item, name)
+			} else {
+				item[name] = current
+			}
+		case value.NS != nil:
+			current.NS = updateSet(current.NS, value.NS, action == "DELETE")
+			if len(current.NS) == 0 {
+				delete(item, name)
+			} else {
+				item[name] = current
+			}
+		default:
+			return invalid
+		}
+	case "REMOVE":
+		delete(item, attributeName(part, names))
+	}
+	return nil
+}
+
+func addNumbers(a, b dynamodb.AttributeValue, subtract bool) (dynamodb.AttributeValue, error) {
+	if a.N == nil || b.N == nil {
+		return dynamodb.AttributeValue{}, NotFound("ValidationException", "an operand is not a number")
+	}
+	x, _ := new(big.Int).SetString(*a.N, 10)
+	y, _ := new(big.Int).SetString(*b.N, 10)
+	if x == nil || y == nil {
+		return dynamodb.AttributeValue{}, NotFound("ValidationException", fmt.Sprintf("invalid numbers %s, %s", *a.N, *b.N))
+	}
+	if subtract {
+		y.Neg(y)
+	}
+	sum := x.Add(x, y).String()
+	return dynamodb.AttributeValue{N: &sum}, nil
+}
+
+func member(set []string, element string) bool {
+	for _, e := range set {
+		if e == element {
+			return true
+		}
+	}
+	return false
+}
+
+func updateSet(set, elements []string, remove bool) []string {
+	members := make(map[string]bool, len(set))
+	for _, element := range set {
+		members[element] = true
+	}
+	for _, element := range elements {
+		members[element] = !remove
+	}
+	var result []string
+	for element, member := range members {
+		if member {
+			result = append(result, element)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,29 @@
+package awstest
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// EC2 is a fake of ec2 listing the enabled regions of the account.
+type EC2 struct {
+	Calls
+	Failures Failures
+	Regions  []string
+}
+
+func NewEC2(regions ...string) *EC2 {
+	return &EC2{Regions: regions}
+}
+
+func (f *EC2) DescribeRegions(input *ec2.DescribeRegionsInput) (*ec2.DescribeRegionsOutput, error) {
+	f.record("DescribeRegions")
+	if err := f.Failures.fail("DescribeRegions"); err != nil {
+		return nil, err
+	}
+	regions := make([]ec2.Region, len(f.Regions))
+	for i := range f.Regions {
+		endpoint := "ec2." + f.Regions[i] + ".amazonaws.com"
+		regions[i] = ec2.Region{RegionName: &f.Regions[i], Endpoint: &endpoint}
+	}
+	return &ec2.DescribeRegionsOutput{Regions: regions}, nil
+}
@@ -0,0 +1,197 @@
+package awstest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+)
+
+// ECR is a fake of the ECR repositories. The images are listed in pages
+// of `PageSize` entries (default 100) as the real service does. The
+// deletion of the images whose digest is in `Denied` is reported as a
+// failure in the response of `BatchDeleteImage`. The repositories belong
+// to the registry `RegistryId`; the calls for other registries fail.
+type ECR struct {
+	Calls
+	Failures     Failures
+	RegistryId   string
+	PageSize     int
+	Repositories map[string][]ecr.ImageIdentifier
+	Denied       map[string]bool
+	pushed       map[string]time.Time
+	mutex        sync.Mutex
+}
+
+func NewECR() *ECR {
+	return &ECR{
+		RegistryId:   "123456789012",
+		PageSize:     100,
+		Repositories: make(map[string][]ecr.ImageIdentifier),
+		Denied:       make(map[string]bool),
+		pushed:       make(map[string]time.Time),
+	}
+}
+
+// PutImage adds an image with the given digest and tag to the repository.
+func (f *ECR) PutImage(repository, digest, tag string) {
+	f.PutImageAt(repository, digest, tag, time.Now())
+}
+
+// PutImageAt adds an image with the given digest and tag pushed at the
+// given time to the repository. An image is tagged several times by
+// putting it with each tag.
+func (f *ECR) PutImageAt(repository, digest, tag string, pushed time.Time) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	d, t := digest, tag
+	image := ecr.ImageIdentifier{ImageDigest: &d}
+	if tag != "" {
+		image.ImageTag = &t
+	}
+	f.Repositories[repository] = append(f.Repositories[repository], image)
+	f.pushed[digest] = pushed
+}
+
+func (f *ECR) repository(registryId *string, name string) ([]ecr.ImageIdentifier, error) {
+	images, ok := f.Repositories[name]
+	if !ok || (registryId != nil && *registryId != f.RegistryId) {
+		return nil, NotFound(ecr.ErrCodeRepositoryNotFoundException, name)
+	}
+	return images, nil
+}
+
+func (f *ECR) ListImages(input *ecr.ListImagesInput) (*ecr.ListImagesOutput, error) {
+	f.record("ListImages")
+	if err := f.Failures.fail("ListImages"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	images, err := f.repository(input.RegistryId, *input.RepositoryName)
+	if err != nil {
+		return nil, err
+	}
+	start := 0
+	if input.NextToken != nil {
+		for i, image := range images {
+			if *image.ImageDigest == *input.NextToken {
+				start = i
+				break
+			}
+		}
+	}
+	output := &ecr.ListImagesOutput{}
+	end := start + f.PageSize
+	if end < len(images) {
+		output.NextToken = images[end].ImageDigest
+	} else {
+		end = len(images)
+	}
+	output.ImageIds = append([]ecr.ImageIdentifier(nil), images[start:end]...)
+	return output, nil
+}
+
+// DescribeImages gives the details of the images, one per digest with all
+// its tags, ordered by digest.
+func (f *ECR) DescribeImages(input *ecr.DescribeImagesInput) (*ecr.DescribeImagesOutput, error) {
+	f.record("DescribeImages")
+	if err := f.Failures.fail("DescribeImages"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	images, err := f.repository(input.RegistryId, *input.RepositoryName)
+	if err != nil {
+		return nil, err
+	}
+	details := make(map[string]*ecr.ImageDetail)
+	var digests []string
+	for _, image := range images {
+		detail, ok := details[*image.ImageDigest]
+		if !ok {
+			digest, pushed := *image.ImageDigest, f.pushed[*image.ImageDigest]
+			detail = &ecr.ImageDetail{ImageDigest: &digest, ImagePushedAt: &pushed, RepositoryName: input.RepositoryName}
+			details[digest] = detail
+			digests = append(digests, digest)
+		}
+		if image.ImageTag != nil {
+			detail.ImageTags = append(detail.ImageTags, *image.ImageTag)
+		}
+	}
+	sort.Strings(digests)
+	start := 0
+	if input.NextToken != nil {
+		start = sort.SearchStrings(digests, *input.NextToken)
+	}
+	output := &ecr.DescribeImagesOutput{}
+	end := start + f.PageSize
+	if end < len(digests) {
+		next := digests[end]
+		output.NextToken = &next
+	} else {
+		end = len(digests)
+	}
+	for _, digest := range digests[start:end] {
+		output.ImageDetails = append(output.ImageDetails, *details[digest])
+	}
+	return output, nil
+}
+
+// BatchDeleteImage deletes the images by digest with all their tags.
+func (f *ECR) BatchDeleteImage(input *ecr.BatchDeleteImageInput) (*ecr.BatchDeleteImageOutput, error) {
+	f.record("BatchDeleteImage")
+	if err := f.Failures.fail("BatchDeleteImage"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	images, err := f.repository(input.RegistryId, *input.RepositoryName)
+	if err != nil {
+		return nil, err
+	}
+	output := &ecr.BatchDeleteImageOutput{}
+	for _, id := range input.ImageIds {
+		id := id
+		if f.Denied[*id.ImageDigest] {
+			reason := "the image is denied"
+			output.Failures = append(output.Failures, ecr.ImageFailure{FailureCode: ecr.ImageFailureCodeImageReferencedByManifestList, FailureReason: &reason, ImageId: &id})
+			continue
+		}
+		var kept []ecr.ImageIdentifier
+		for _, image := range images {
+			if *image.ImageDigest != *id.ImageDigest {
+				kept = append(kept, image)
+			}
+		}
+		if len(kept) == len(images) {
+			reason := "the image does not exist"
+			output.Failures = append(output.Failures, ecr.ImageFailure{FailureCode: ecr.ImageFailureCodeImageNotFound, FailureReason: &reason, ImageId: &id})
+			continue
+		}
+		images = kept
+		output.ImageIds = append(output.ImageIds, id)
+	}
+	f.Repositories[*input.RepositoryName] = images
+	return output, nil
+}
+
+// DeleteRepository deletes a repository with images only if forced.
+func (f *ECR) DeleteRepository(input *ecr.DeleteRepositoryInput) (*ecr.DeleteRepositoryOutput, error) {
+	f.record("DeleteRepository")
+	if err := f.Failures.fail("DeleteRepository"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	images, err := f.repository(input.RegistryId, *input.RepositoryName)
+	if err != nil {
+		return nil, err
+	}
+	if len(images) > 0 && (input.Force == nil || !*input.Force) {
+		return nil, NotFound(ecr.ErrCodeRepositoryNotEmptyException, *input.RepositoryName)
+	}
+	delete(f.Repositories, *input.RepositoryName)
+	return &ecr.DeleteRepositoryOutput{}, nil
+}
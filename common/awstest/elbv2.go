@@ -0,0 +1,115 @@
+package awstest
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awsapi"
+	"github.com/aws/aws-sdk-go-v2/service/elbv2"
+)
+
+// ELBV2 is a fake of the rules of the listeners of application load
+// balancers.
+// The weighted forward actions, that the version of the SDK does not
+// model in the rules, are kept in `Forwards`.
+type ELBV2 struct {
+	Calls
+	Failures Failures
+	Rules    map[string]elbv2.Rule
+	Forwards map[string][]awsapi.TargetGroupTuple
+	mutex    sync.Mutex
+}
+
+func NewELBV2() *ELBV2 {
+	return &ELBV2{Rules: make(map[string]elbv2.Rule), Forwards: make(map[string][]awsapi.TargetGroupTuple)}
+}
+
+// PutForwardRule adds a rule with the given arn and a forward action to
+// the target group.
+func (f *ELBV2) PutForwardRule(arn, targetGroupArn string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	ruleArn, priority := arn, "1"
+	f.Rules[arn] = elbv2.Rule{RuleArn: &ruleArn, Priority: &priority, Actions: []elbv2.Action{
+		{Type: elbv2.ActionTypeEnumForward, TargetGroupArn: &targetGroupArn},
+	}}
+}
+
+// PutRule adds a rule with the given arn and priority.
+func (f *ELBV2) PutRule(arn string, priority int64) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	ruleArn, p := arn, strconv.FormatInt(priority, 10)
+	f.Rules[arn] = elbv2.Rule{RuleArn: &ruleArn, Priority: &p}
+}
+
+// Priority returns the priority of the rule with the given arn.
+func (f *ELBV2) Priority(arn string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return *f.Rules[arn].Priority
+}
+
+func (f *ELBV2) DescribeRules(input *elbv2.DescribeRulesInput) (*elbv2.DescribeRulesOutput, error) {
+	f.record("DescribeRules")
+	if err := f.Failures.fail("DescribeRules"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	output := &elbv2.DescribeRulesOutput{}
+	for _, arn := range input.RuleArns {
+		rule, ok := f.Rules[arn]
+		if !ok {
+			return nil, NotFound("RuleNotFound", arn)
+		}
+		output.Rules = append(output.Rules, rule)
+	}
+	return output, nil
+}
+
+func (f *ELBV2) ModifyRuleForward(input *awsapi.ModifyRuleForwardInput) (*elbv2.ModifyRuleOutput, error) {
+	f.record("ModifyRule")
+	if err := f.Failures.fail("ModifyRule"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	rule, ok := f.Rules[*input.RuleArn]
+	if !ok {
+		return nil, NotFound("RuleNotFound", *input.RuleArn)
+	}
+	if len(input.Actions) != 1 || input.Actions[0].ForwardConfig == nil {
+		return nil, NotFound("ValidationError", "a single weighted forward action is supported")
+	}
+	rule.Actions = []elbv2.Action{{Type: elbv2.ActionTypeEnumForward}}
+	f.Rules[*input.RuleArn] = rule
+	f.Forwards[*input.RuleArn] = input.Actions[0].ForwardConfig.TargetGroups
+	return &elbv2.ModifyRuleOutput{Rules: []elbv2.Rule{rule}}, nil
+}
+
+func (f *ELBV2) SetRulePriorities(input *elbv2.SetRulePrioritiesInput) (*elbv2.SetRulePrioritiesOutput, error) {
+	f.record("SetRulePriorities")
+	if err := f.Failures.fail("SetRulePriorities"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, pair := range input.RulePriorities {
+		if pair.Priority == nil {
+			return nil, NotFound("ValidationError", "priority must be defined")
+		}
+		if _, ok := f.Rules[*pair.RuleArn]; !ok {
+			return nil, NotFound("RuleNotFound", *pair.RuleArn)
+		}
+	}
+	output := &elbv2.SetRulePrioritiesOutput{}
+	for _, pair := range input.RulePriorities {
+		rule := f.Rules[*pair.RuleArn]
+		priority := strconv.FormatInt(*pair.Priority, 10)
+		rule.Priority = &priority
+		f.Rules[*pair.RuleArn] = rule
+		output.Rules = append(output.Rules, rule)
+	}
+	return output, nil
+}
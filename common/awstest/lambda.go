@@ -0,0 +1,31 @@
+package awstest
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+)
+
+// Lambda is a fake of the lambda service recording the invocations.
+type Lambda struct {
+	Calls
+	Failures    Failures
+	Invocations []lambda.InvokeInput
+	mutex       sync.Mutex
+}
+
+func NewLambda() *Lambda {
+	return &Lambda{}
+}
+
+func (f *Lambda) Invoke(input *lambda.InvokeInput) (*lambda.InvokeOutput, error) {
+	f.record("Invoke")
+	if err := f.Failures.fail("Invoke"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.Invocations = append(f.Invocations, *input)
+	status := int64(202)
+	return &lambda.InvokeOutput{StatusCode: &status}, nil
+}
@@ -0,0 +1,127 @@
+package awstest
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+)
+
+// Route53 is a fake of the hosted zones. The record sets of a zone are
+// keyed by their name and type; the changes of a batch are applied
+// atomically and fail like the real service on conflicting records.
+type Route53 struct {
+	Calls
+	Failures Failures
+	Zones    map[string]map[string]route53.ResourceRecordSet
+	mutex    sync.Mutex
+}
+
+func NewRoute53() *Route53 {
+	return &Route53{Zones: make(map[string]map[string]route53.ResourceRecordSet)}
+}
+
+// PutZone creates an empty hosted zone with the given id.
+func (f *Route53) PutZone(id string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.Zones[id] = make(map[string]route53.ResourceRecordSet)
+}
+
+// RecordKey is the key of a record set in its zone.
+func RecordKey(name string, recordType route53.RRType) string {
+	return strings.ToLower(strings.TrimSuffix(name, ".")) + ". " + string(recordType)
+}
+
+func (f *Route53) zone(id string) (map[string]route53.ResourceRecordSet, error) {
+	zone, ok := f.Zones[id]
+	if !ok {
+		return nil, NotFound("NoSuchHostedZone", id)
+	}
+	return zone, nil
+}
+
+func (f *Route53) ChangeResourceRecordSets(input *route53.ChangeResourceRecordSetsInput) (*route53.ChangeResourceRecordSetsOutput, error) {
+	f.record("ChangeResourceRecordSets")
+	if err := f.Failures.fail("ChangeResourceRecordSets"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	zone, err := f.zone(*input.HostedZoneId)
+	if err != nil {
+		return nil, err
+	}
+	changed := make(map[string]bool, len(input.ChangeBatch.Changes))
+	for _, change := range input.ChangeBatch.Changes {
+		key := RecordKey(*change.ResourceRecordSet.Name, change.ResourceRecordSet.Type)
+		if changed[key] {
+			return nil, NotFound("InvalidChangeBatch", "duplicate record set "+key)
+		}
+		changed[key] = true
+		_, exists := zone[key]
+		switch change.Action {
+		case route53.ChangeActionCreate:
+			if exists {
+				return nil, NotFound("InvalidChangeBatch", "record set already exists "+key)
+			}
+		case route53.ChangeActionDelete:
+			if !exists {
+				return nil, NotFound("InvalidChangeBatch", "record set not found "+key)
+			}
+		}
+	}
+	for _, change := range input.ChangeBatch.Changes {
+		key := RecordKey(*change.ResourceRecordSet.Name, change.ResourceRecordSet.Type)
+		if change.Action == route53.ChangeActionDelete {
+			delete(zone, key)
+		} else {
+			zone[key] = *change.ResourceRecordSet
+		}
+	}
+	id := "change"
+	return &route53.ChangeResourceRecordSetsOutput{ChangeInfo: &route53.ChangeInfo{Id: &id, Status: route53.ChangeStatusPending}}, nil
+}
+
+func (f *Route53) ListResourceRecordSets(input *route53.ListResourceRecordSetsInput) (*route53.ListResourceRecordSetsOutput, error) {
+	f.record("ListResourceRecordSets")
+	if err := f.Failures.fail("ListResourceRecordSets"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	zone, err := f.zone(*input.HostedZoneId)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(zone))
+	for key := range zone {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	start := ""
+	if input.StartRecordName != nil {
+		start = RecordKey(*input.StartRecordName, input.StartRecordType)
+	}
+	max := 100
+	if input.MaxItems != nil {
+		if n, err := strconv.Atoi(*input.MaxItems); err == nil {
+			max = n
+		}
+	}
+	truncated := false
+	output := &route53.ListResourceRecordSetsOutput{IsTruncated: &truncated}
+	for _, key := range keys {
+		if key < start {
+			continue
+		}
+		if len(output.ResourceRecordSets) == max {
+			truncated = true
+			break
+		}
+		output.ResourceRecordSets = append(output.ResourceRecordSets, zone[key])
+	}
+	return output, nil
+}
@@ -0,0 +1,289 @@
+package awstest
+
+import (
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// S3 is a fake of versioned S3 buckets. The versions and delete markers
+// are listed together in pages of `PageSize` entries (default 1000) as the
+// real service does. The deletion of the objects whose key is in `Denied`
+// is reported as an error in the response of `DeleteObjects`. A bucket
+// exists as long as it has an entry in `Buckets`; it can only be deleted
+// when it has no versions, delete markers and multipart uploads. The
+// content of the objects put is kept in `Objects` by bucket and key,
+// separately from the listed versions.
+type S3 struct {
+	Calls
+	Failures      Failures
+	PageSize      int
+	Buckets       map[string][]s3.ObjectVersion
+	DeleteMarkers map[string][]s3.DeleteMarkerEntry
+	Uploads       map[string][]s3.MultipartUpload
+	Tags          map[string]map[string]string
+	Denied        map[string]bool
+	Objects       map[string]map[string][]byte
+	mutex         sync.Mutex
+}
+
+func NewS3() *S3 {
+	return &S3{
+		PageSize:      1000,
+		Buckets:       make(map[string][]s3.ObjectVersion),
+		DeleteMarkers: make(map[string][]s3.DeleteMarkerEntry),
+		Uploads:       make(map[string][]s3.MultipartUpload),
+		Tags:          make(map[string]map[string]string),
+		Denied:        make(map[string]bool),
+		Objects:       make(map[string]map[string][]byte),
+	}
+}
+
+// PutVersion adds a version of an object to the given bucket.
+func (f *S3) PutVersion(bucket, key, versionId string) {
+	f.PutVersionAt(bucket, key, versionId, 0, time.Now())
+}
+
+// PutVersionAt adds a version of an object of the given size last modified
+// at the given time to the given bucket.
+func (f *S3) PutVersionAt(bucket, key, versionId string, size int64, modified time.Time) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	k, v, m := key, versionId, modified
+	f.Buckets[bucket] = append(f.Buckets[bucket], s3.ObjectVersion{Key: &k, VersionId: &v, Size: &size, LastModified: &m})
+	sort.SliceStable(f.Buckets[bucket], func(i, j int) bool {
+		return versionMarker(f.Buckets[bucket][i].Key, f.Buckets[bucket][i].VersionId) < versionMarker(f.Buckets[bucket][j].Key, f.Buckets[bucket][j].VersionId)
+	})
+}
+
+// PutDeleteMarker adds a delete marker of an object to the given bucket.
+func (f *S3) PutDeleteMarker(bucket, key, versionId string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	k, v, m := key, versionId, time.Now()
+	f.DeleteMarkers[bucket] = append(f.DeleteMarkers[bucket], s3.DeleteMarkerEntry{Key: &k, VersionId: &v, LastModified: &m})
+	sort.SliceStable(f.DeleteMarkers[bucket], func(i, j int) bool {
+		return versionMarker(f.DeleteMarkers[bucket][i].Key, f.DeleteMarkers[bucket][i].VersionId) < versionMarker(f.DeleteMarkers[bucket][j].Key, f.DeleteMarkers[bucket][j].VersionId)
+	})
+}
+
+// PutUpload adds an incomplete multipart upload of an object to the given
+// bucket.
+func (f *S3) PutUpload(bucket, key, uploadId string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	k, u, i := key, uploadId, time.Now()
+	f.Uploads[bucket] = append(f.Uploads[bucket], s3.MultipartUpload{Key: &k, UploadId: &u, Initiated: &i})
+	sort.SliceStable(f.Uploads[bucket], func(i, j int) bool {
+		return versionMarker(f.Uploads[bucket][i].Key, f.Uploads[bucket][i].UploadId) < versionMarker(f.Uploads[bucket][j].Key, f.Uploads[bucket][j].UploadId)
+	})
+}
+
+// TagVersion sets the tags of a version of an object.
+func (f *S3) TagVersion(key, versionId string, tags map[string]string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.Tags[versionMarker(&key, &versionId)] = tags
+}
+
+func (f *S3) ListObjectVersions(input *s3.ListObjectVersionsInput) (*s3.ListObjectVersionsOutput, error) {
+	f.record("ListObjectVersions")
+	if err := f.Failures.fail("ListObjectVersions"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	marker := versionMarker(input.KeyMarker, input.VersionIdMarker)
+	selected := func(key, versionId *string) bool {
+		if input.Prefix != nil && !strings.HasPrefix(*key, *input.Prefix) {
+			return false
+		}
+		return input.KeyMarker == nil || versionMarker(key, versionId) > marker
+	}
+	var entries []string
+	versions := make(map[string]s3.ObjectVersion)
+	markers := make(map[string]s3.DeleteMarkerEntry)
+	for _, version := range f.Buckets[*input.Bucket] {
+		if selected(version.Key, version.VersionId) {
+			entry := versionMarker(version.Key, version.VersionId)
+			entries = append(entries, entry)
+			versions[entry] = version
+		}
+	}
+	for _, deleteMarker := range f.DeleteMarkers[*input.Bucket] {
+		if selected(deleteMarker.Key, deleteMarker.VersionId) {
+			entry := versionMarker(deleteMarker.Key, deleteMarker.VersionId)
+			entries = append(entries, entry)
+			markers[entry] = deleteMarker
+		}
+	}
+	sort.Strings(entries)
+	truncated := len(entries) > f.PageSize
+	output := &s3.ListObjectVersionsOutput{IsTruncated: &truncated}
+	if truncated {
+		entries = entries[:f.PageSize]
+	}
+	for _, entry := range entries {
+		if version, ok := versions[entry]; ok {
+			output.Versions = append(output.Versions, version)
+			output.NextKeyMarker, output.NextVersionIdMarker = version.Key, version.VersionId
+		} else {
+			deleteMarker := markers[entry]
+			output.DeleteMarkers = append(output.DeleteMarkers, deleteMarker)
+			output.NextKeyMarker, output.NextVersionIdMarker = deleteMarker.Key, deleteMarker.VersionId
+		}
+	}
+	if !truncated {
+		output.NextKeyMarker, output.NextVersionIdMarker = nil, nil
+	}
+	return output, nil
+}
+
+func (f *S3) GetObjectTagging(input *s3.GetObjectTaggingInput) (*s3.GetObjectTaggingOutput, error) {
+	f.record("GetObjectTagging")
+	if err := f.Failures.fail("GetObjectTagging"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	output := &s3.GetObjectTaggingOutput{VersionId: input.VersionId}
+	for k, v := range f.Tags[versionMarker(input.Key, input.VersionId)] {
+		key, value := k, v
+		output.TagSet = append(output.TagSet, s3.Tag{Key: &key, Value: &value})
+	}
+	return output, nil
+}
+
+func (f *S3) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	f.record("DeleteObjects")
+	if err := f.Failures.fail("DeleteObjects"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	output := &s3.DeleteObjectsOutput{}
+	for _, object := range input.Delete.Objects {
+		if f.Denied[*object.Key] {
+			code, message := "AccessDenied", "Access Denied"
+			output.Errors = append(output.Errors, s3.Error{Key: object.Key, VersionId: object.VersionId, Code: &code, Message: &message})
+			continue
+		}
+		versions := f.Buckets[*input.Bucket]
+		for i, version := range versions {
+			if *version.Key == *object.Key && *version.VersionId == *object.VersionId {
+				f.Buckets[*input.Bucket] = append(versions[:i], versions[i+1:]...)
+				break
+			}
+		}
+		markers := f.DeleteMarkers[*input.Bucket]
+		for i, deleteMarker := range markers {
+			if *deleteMarker.Key == *object.Key && *deleteMarker.VersionId == *object.VersionId {
+				f.DeleteMarkers[*input.Bucket] = append(markers[:i], markers[i+1:]...)
+				break
+			}
+		}
+		if input.Delete.Quiet == nil || !*input.Delete.Quiet {
+			output.Deleted = append(output.Deleted, s3.DeletedObject{Key: object.Key, VersionId: object.VersionId})
+		}
+	}
+	return output, nil
+}
+
+func (f *S3) ListMultipartUploads(input *s3.ListMultipartUploadsInput) (*s3.ListMultipartUploadsOutput, error) {
+	f.record("ListMultipartUploads")
+	if err := f.Failures.fail("ListMultipartUploads"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	marker := versionMarker(input.KeyMarker, input.UploadIdMarker)
+	var uploads []s3.MultipartUpload
+	for _, upload := range f.Uploads[*input.Bucket] {
+		if input.Prefix != nil && !strings.HasPrefix(*upload.Key, *input.Prefix) {
+			continue
+		}
+		if input.KeyMarker != nil && versionMarker(upload.Key, upload.UploadId) <= marker {
+			continue
+		}
+		uploads = append(uploads, upload)
+	}
+	truncated := len(uploads) > f.PageSize
+	output := &s3.ListMultipartUploadsOutput{Bucket: input.Bucket, IsTruncated: &truncated}
+	if truncated {
+		uploads = uploads[:f.PageSize]
+		last := uploads[len(uploads)-1]
+		output.NextKeyMarker = last.Key
+		output.NextUploadIdMarker = last.UploadId
+	}
+	output.Uploads = uploads
+	return output, nil
+}
+
+func (f *S3) AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	f.record("AbortMultipartUpload")
+	if err := f.Failures.fail("AbortMultipartUpload"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	uploads := f.Uploads[*input.Bucket]
+	for i, upload := range uploads {
+		if *upload.Key == *input.Key && *upload.UploadId == *input.UploadId {
+			f.Uploads[*input.Bucket] = append(uploads[:i], uploads[i+1:]...)
+			return &s3.AbortMultipartUploadOutput{}, nil
+		}
+	}
+	return nil, NotFound("NoSuchUpload", *input.UploadId)
+}
+
+func (f *S3) DeleteBucket(input *s3.DeleteBucketInput) (*s3.DeleteBucketOutput, error) {
+	f.record("DeleteBucket")
+	if err := f.Failures.fail("DeleteBucket"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	bucket := *input.Bucket
+	if _, ok := f.Buckets[bucket]; !ok {
+		return nil, NotFound(s3.ErrCodeNoSuchBucket, bucket)
+	}
+	if len(f.Buckets[bucket]) > 0 || len(f.DeleteMarkers[bucket]) > 0 || len(f.Uploads[bucket]) > 0 {
+		return nil, NotFound("BucketNotEmpty", bucket)
+	}
+	delete(f.Buckets, bucket)
+	delete(f.DeleteMarkers, bucket)
+	delete(f.Uploads, bucket)
+	return &s3.DeleteBucketOutput{}, nil
+}
+
+func (f *S3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	f.record("PutObject")
+	if err := f.Failures.fail("PutObject"); err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.Objects[*input.Bucket] == nil {
+		f.Objects[*input.Bucket] = make(map[string][]byte)
+	}
+	f.Objects[*input.Bucket][*input.Key] = content
+	return &s3.PutObjectOutput{}, nil
+}
+
+func versionMarker(key, versionId *string) string {
+	if key == nil {
+		return ""
+	}
+	if versionId == nil {
+		return *key
+	}
+	return *key + "\x00" + *versionId
+}
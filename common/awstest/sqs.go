@@ -0,0 +1,32 @@
+package awstest
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// SQS is a fake of the sqs service recording the messages sent.
+type SQS struct {
+	Calls
+	Failures Failures
+	Messages []sqs.SendMessageInput
+	mutex    sync.Mutex
+}
+
+func NewSQS() *SQS {
+	return &SQS{}
+}
+
+func (f *SQS) SendMessage(input *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	f.record("SendMessage")
+	if err := f.Failures.fail("SendMessage"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.Messages = append(f.Messages, *input)
+	id := strconv.Itoa(len(f.Messages))
+	return &sqs.SendMessageOutput{MessageId: &id}, nil
+}
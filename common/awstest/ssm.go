@@ -0,0 +1,126 @@
+package awstest
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// SSM is a fake of the SSM parameter store. Every put of a parameter
+// increments its version as the real service does.
+type SSM struct {
+	Calls
+	Failures   Failures
+	Parameters map[string]ssm.Parameter
+	mutex      sync.Mutex
+}
+
+func NewSSM() *SSM {
+	return &SSM{Parameters: make(map[string]ssm.Parameter)}
+}
+
+// PutString puts the string parameter directly, as the first version.
+func (f *SSM) PutString(name, value string) {
+	var version int64 = 1
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.Parameters[name] = ssm.Parameter{
+		Name:    &name,
+		Type:    ssm.ParameterTypeString,
+		Value:   &value,
+		Version: &version,
+	}
+}
+
+func (f *SSM) GetParameter(input *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+	f.record("GetParameter")
+	if err := f.Failures.fail("GetParameter"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	parameter, ok := f.Parameters[*input.Name]
+	if !ok {
+		return nil, NotFound(ssm.ErrCodeParameterNotFound, *input.Name)
+	}
+	return &ssm.GetParameterOutput{Parameter: &parameter}, nil
+}
+
+func (f *SSM) PutParameter(input *ssm.PutParameterInput) (*ssm.PutParameterOutput, error) {
+	f.record("PutParameter")
+	if err := f.Failures.fail("PutParameter"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	parameter, ok := f.Parameters[*input.Name]
+	if ok && (input.Overwrite == nil || !*input.Overwrite) {
+		return nil, NotFound(ssm.ErrCodeParameterAlreadyExists, *input.Name)
+	}
+	var version int64 = 1
+	if ok {
+		version = *parameter.Version + 1
+	}
+	name := *input.Name
+	value := *input.Value
+	f.Parameters[name] = ssm.Parameter{
+		Name:    &name,
+		Type:    input.Type,
+		Value:   &value,
+		Version: &version,
+	}
+	return &ssm.PutParameterOutput{Version: &version}, nil
+}
+
+func (f *SSM) DeleteParameter(input *ssm.DeleteParameterInput) (*ssm.DeleteParameterOutput, error) {
+	f.record("DeleteParameter")
+	if err := f.Failures.fail("DeleteParameter"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, ok := f.Parameters[*input.Name]; !ok {
+		return nil, NotFound(ssm.ErrCodeParameterNotFound, *input.Name)
+	}
+	delete(f.Parameters, *input.Name)
+	return &ssm.DeleteParameterOutput{}, nil
+}
+
+// GetParametersByPath returns the parameters under the path ordered by
+// name, in pages of `MaxResults` parameters (10 by default).
+func (f *SSM) GetParametersByPath(input *ssm.GetParametersByPathInput) (*ssm.GetParametersByPathOutput, error) {
+	f.record("GetParametersByPath")
+	if err := f.Failures.fail("GetParametersByPath"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	prefix := strings.TrimSuffix(*input.Path, "/") + "/"
+	recursive := input.Recursive != nil && *input.Recursive
+	var names []string
+	for name := range f.Parameters {
+		if strings.HasPrefix(name, prefix) && (recursive || !strings.Contains(name[len(prefix):], "/")) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	max := 10
+	if input.MaxResults != nil {
+		max = int(*input.MaxResults)
+	}
+	output := &ssm.GetParametersByPathOutput{}
+	for _, name := range names {
+		if input.NextToken != nil && name <= *input.NextToken {
+			continue
+		}
+		if len(output.Parameters) == max {
+			next := *output.Parameters[len(output.Parameters)-1].Name
+			output.NextToken = &next
+			break
+		}
+		output.Parameters = append(output.Parameters, f.Parameters[name])
+	}
+	return output, nil
+}
@@ -1,20 +1,49 @@
 // Inspired from https://github.com/alecthomas/participle/blob/master/_examples/expr/main.go
+//
+// The expressions of the sequences are evaluated for the integer variable
+// `x` with the usual precedence, from the lowest:
+//
+// 1. the conditional `c ? a : b`, with `c` true if not 0;
+// 2. the comparisons `==`, `!=`, `<`, `<=`, `>` and `>=`, giving 1 or 0;
+// 3. the addition `+` and the subtraction `-`;
+// 4. the multiplication `*`, the division `/` and the modulo `%`;
+// 5. the unary minus `-`;
+// 6. the integers, `x`, the strings in double quotes, the function calls
+//    and the parenthesized expressions.
+//
+// The functions are `min(a, b, ...)`, `max(a, b, ...)`, `abs(a)` and the
+// formatting helpers that give a text instead of a number: `pad(a, width)`
+// pads the number with zeros, `hex(a)` gives the number in hexadecimal and
+// `format("svc-%04d", a, ...)` formats the arguments as `fmt.Sprintf`.
+// A text cannot be used in arithmetic.
 package common
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+
 	"github.com/alecthomas/participle"
+	"github.com/alecthomas/participle/lexer"
 	"github.com/pkg/errors"
-	"strings"
 )
 
 type Factor struct {
-	Number        *int64        `  @Int`
+	Negated       *Factor     `  "-" @@`
+	Number        *int64      `| @Int`
+	Text          *string     `| @String`
 	Variable      *string     `| @"x"`
+	Call          *Call       `| @@`
 	Subexpression *Expression `| "(" @@ ")"`
 }
 
+type Call struct {
+	Function  string        `@Ident "("`
+	Arguments []*Expression `( @@ ( "," @@ )* )? ")"`
+}
+
 type OpValue struct {
-	Op     string  `@("*" | "/")`
+	Op     string  `@("*" | "/" | "%")`
 	Factor *Factor `@@`
 }
 
@@ -28,59 +57,391 @@ type OpTerm struct {
 	Term *Term  `@@`
 }
 
-type Expression struct {
+type Sum struct {
 	Term    *Term     `@@`
 	OpTerms []*OpTerm `(@@)*`
 }
 
-var parser *participle.Parser = participle.MustBuild(&Expression{})
+type Comparison struct {
+	Sum   *Sum   `@@`
+	Op    string `( @("==" | "!=" | "<=" | ">=" | "<" | ">")`
+	Other *Sum   `  @@ )?`
+}
+
+type Expression struct {
+	Condition *Comparison `@@`
+	Then      *Expression `( "?" @@`
+	Else      *Expression `  ":" @@ )?`
+}
+
+var calcLexer = lexer.Must(lexer.Regexp(`(\s+)` +
+	`|(?P<Ident>[a-zA-Z_][a-zA-Z0-9_]*)` +
+	`|(?P<Int>\d+)` +
+	`|(?P<String>"(?:\\.|[^"\\])*")` +
+	`|(?P<Operator>==|!=|<=|>=|[-+*/%<>?:(),])`))
+
+var parser *participle.Parser = participle.MustBuild(&Expression{},
+	participle.Lexer(calcLexer),
+	participle.Unquote("String"),
+	participle.UseLookahead(2),
+)
+
+// A value is either a number or, for the formatting helpers, a text.
+type value struct {
+	number int64
+	text   *string
+}
+
+func number(n int64) value {
+	return value{number: n}
+}
+
+func text(s string) value {
+	return value{text: &s}
+}
+
+func (v value) String() string {
+	if v.text != nil {
+		return *v.text
+	}
+	return strconv.FormatInt(v.number, 10)
+}
+
+func (v value) asNumber() (int64, error) {
+	if v.text != nil {
+		return 0, errors.Errorf("the text %q is not a number", *v.text)
+	}
+	return v.number, nil
+}
+
+func (e *Expression) eval(x int64) (value, error) {
+	condition, err := e.Condition.eval(x)
+	if err != nil || e.Then == nil {
+		return condition, err
+	}
+	c, err := condition.asNumber()
+	if err != nil {
+		return value{}, err
+	}
+	if c != 0 {
+		return e.Then.eval(x)
+	}
+	return e.Else.eval(x)
+}
+
+func (c *Comparison) eval(x int64) (value, error) {
+	v, err := c.Sum.eval(x)
+	if err != nil || c.Other == nil {
+		return v, err
+	}
+	other, err := c.Other.eval(x)
+	if err != nil {
+		return value{}, err
+	}
+	v1, err := v.asNumber()
+	if err != nil {
+		return value{}, err
+	}
+	v2, err := other.asNumber()
+	if err != nil {
+		return value{}, err
+	}
+	var holds bool
+	switch c.Op {
+	case "==":
+		holds = v1 == v2
+	case "!=":
+		holds = v1 != v2
+	case "<":
+		holds = v1 < v2
+	case "<=":
+		holds = v1 <= v2
+	case ">":
+		holds = v1 > v2
+	case ">=":
+		holds = v1 >= v2
+	default:
+		return value{}, errors.Errorf("unsupported operator: %s", c.Op)
+	}
+	if holds {
+		return number(1), nil
+	}
+	return number(0), nil
+}
 
-func EvalExpression(e Expression, x int64) int64 {
-	value := EvalTerm(*e.Term, x)
-	for _, t := range e.OpTerms {
-		tmp := EvalTerm(*t.Term, x)
-		value = EvalOp(value, t.Op, tmp)
+func (s *Sum) eval(x int64) (value, error) {
+	v, err := s.Term.eval(x)
+	if err != nil || len(s.OpTerms) == 0 {
+		return v, err
 	}
-	return value
+	for _, t := range s.OpTerms {
+		tmp, err := t.Term.eval(x)
+		if err != nil {
+			return value{}, err
+		}
+		if v, err = evalOp(v, t.Op, tmp); err != nil {
+			return value{}, err
+		}
+	}
+	return v, nil
 }
 
-func EvalTerm(t Term, x int64) int64 {
-	value := EvalFactor(*t.Factor, x)
+func (t *Term) eval(x int64) (value, error) {
+	v, err := t.Factor.eval(x)
+	if err != nil || len(t.OpFactor) == 0 {
+		return v, err
+	}
 	for _, f := range t.OpFactor {
-		tmp := EvalFactor(*f.Factor, x)
-		value = EvalOp(value, f.Op, tmp)
+		tmp, err := f.Factor.eval(x)
+		if err != nil {
+			return value{}, err
+		}
+		if v, err = evalOp(v, f.Op, tmp); err != nil {
+			return value{}, err
+		}
+	}
+	return v, nil
+}
+
+func (f *Factor) eval(x int64) (value, error) {
+	switch {
+	case f.Negated != nil:
+		v, err := f.Negated.eval(x)
+		if err != nil {
+			return value{}, err
+		}
+		n, err := v.asNumber()
+		if err != nil {
+			return value{}, err
+		}
+		return number(-n), nil
+	case f.Number != nil:
+		return number(*f.Number), nil
+	case f.Text != nil:
+		return text(*f.Text), nil
+	case f.Variable != nil:
+		return number(x), nil
+	case f.Call != nil:
+		return f.Call.eval(x)
+	default:
+		return f.Subexpression.eval(x)
+	}
+}
+
+func (c *Call) eval(x int64) (value, error) {
+	args := make([]value, len(c.Arguments))
+	for i, argument := range c.Arguments {
+		v, err := argument.eval(x)
+		if err != nil {
+			return value{}, err
+		}
+		args[i] = v
+	}
+	function, ok := functions[c.Function]
+	if !ok {
+		return value{}, errors.Errorf("unknown function %s", c.Function)
+	}
+	if len(args) < function.minArgs || (function.maxArgs >= 0 && len(args) > function.maxArgs) {
+		return value{}, errors.Errorf("wrong number of arguments for %s: %d", c.Function, len(args))
+	}
+	v, err := function.apply(args)
+	if err != nil {
+		return value{}, errors.Wrapf(err, "could not evaluate %s", c.Function)
+	}
+	return v, nil
+}
+
+type function struct {
+	minArgs, maxArgs int
+	apply            func(args []value) (value, error)
+}
+
+var functions = map[string]function{
+	"min": {1, -1, func(args []value) (value, error) {
+		return fold(args, func(a, b int64) bool { return b < a })
+	}},
+	"max": {1, -1, func(args []value) (value, error) {
+		return fold(args, func(a, b int64) bool { return b > a })
+	}},
+	"abs": {1, 1, func(args []value) (value, error) {
+		n, err := args[0].asNumber()
+		if n < 0 {
+			n = -n
+		}
+		return number(n), err
+	}},
+	"pad": {2, 2, func(args []value) (value, error) {
+		n, err := args[0].asNumber()
+		if err != nil {
+			return value{}, err
+		}
+		width, err := args[1].asNumber()
+		if err != nil {
+			return value{}, err
+		}
+		if width < 0 || width > 64 {
+			return value{}, errors.Errorf("invalid width %d", width)
+		}
+		return text(fmt.Sprintf("%0*d", width, n)), nil
+	}},
+	"hex": {1, 1, func(args []value) (value, error) {
+		n, err := args[0].asNumber()
+		return text(strconv.FormatInt(n, 16)), err
+	}},
+	"format": {1, -1, func(args []value) (value, error) {
+		if args[0].text == nil {
+			return value{}, errors.New("the format must be a text")
+		}
+		operands := make([]interface{}, len(args)-1)
+		for i, arg := range args[1:] {
+			if arg.text != nil {
+				operands[i] = *arg.text
+			} else {
+				operands[i] = arg.number
+			}
+		}
+		formatted := fmt.Sprintf(*args[0].text, operands...)
+		if strings.Contains(formatted, "%!") {
+			return value{}, errors.Errorf("invalid format %q for the arguments", *args[0].text)
+		}
+		return text(formatted), nil
+	}},
+}
+
+// fold keeps the argument that replaces the current one.
+func fold(args []value, replaces func(current, candidate int64) bool) (value, error) {
+	result, err := args[0].asNumber()
+	if err != nil {
+		return value{}, err
+	}
+	for _, arg := range args[1:] {
+		n, err := arg.asNumber()
+		if err != nil {
+			return value{}, err
+		}
+		if replaces(result, n) {
+			result = n
+		}
 	}
-	return value
+	return number(result), nil
 }
 
-func EvalFactor(t Factor, x int64) int64 {
-	if t.Number != nil {
-		return *t.Number
-	} else if t.Variable != nil {
-		return x
-	} else {
-		return EvalExpression(*t.Subexpression, x)
+func evalOp(v1 value, op string, v2 value) (value, error) {
+	n1, err := v1.asNumber()
+	if err != nil {
+		return value{}, err
 	}
+	n2, err := v2.asNumber()
+	if err != nil {
+		return value{}, err
+	}
+	n, err := EvalOp(n1, op, n2)
+	return number(n), err
 }
 
-func EvalOp(v1 int64, op string, v2 int64) int64 {
+func EvalOp(v1 int64, op string, v2 int64) (int64, error) {
 	switch op {
 	case "+":
-		return v1 + v2
+		return v1 + v2, nil
 	case "-":
-		return v1 - v2
+		return v1 - v2, nil
 	case "*":
-		return v1 * v2
+		return v1 * v2, nil
 	case "/":
-		return v1 / v2
+		if v2 == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return v1 / v2, nil
+	case "%":
+		if v2 == 0 {
+			return 0, errors.New("modulo by zero")
+		}
+		return v1 % v2, nil
 	}
-	panic("unsupported operator : " + op)
+	return 0, errors.Errorf("unsupported operator: %s", op)
 }
 
-func Eval(expr string, x int64) (int64, error) {
+func parse(expr string) (*Expression, error) {
 	ast := &Expression{}
 	if err := parser.Parse(strings.NewReader(expr), ast); err != nil {
-		return 0, errors.Wrapf(err, "could not parse the expression `%s`", expr)
+		return nil, errors.Wrapf(err, "could not parse the expression `%s`", expr)
+	}
+	return ast, nil
+}
+
+// EvalExpression evaluates a parsed expression that must give a number.
+func EvalExpression(e Expression, x int64) (int64, error) {
+	v, err := e.eval(x)
+	if err != nil {
+		return 0, err
+	}
+	return v.asNumber()
+}
+
+// Eval evaluates an expression that must give a number.
+func Eval(expr string, x int64) (int64, error) {
+	ast, err := parse(expr)
+	if err != nil {
+		return 0, err
+	}
+	n, err := EvalExpression(*ast, x)
+	if err != nil {
+		return 0, errors.Wrapf(err, "could not evaluate the expression `%s`", expr)
+	}
+	return n, nil
+}
+
+// EvalText evaluates an expression giving a number or, with the formatting
+// helpers, a text.
+func EvalText(expr string, x int64) (string, error) {
+	ast, err := parse(expr)
+	if err != nil {
+		return "", err
+	}
+	v, err := ast.eval(x)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not evaluate the expression `%s`", expr)
+	}
+	return v.String(), nil
+}
+
+// Format formats the value of a sequence. An empty format gives the value
+// in decimal; a format with braces is a template where each `{expression}`
+// is replaced by the expression evaluated for the value, like
+// `10.0.{x}.0/24`; any other format is a `fmt.Sprintf` format for the
+// value, like `app-%04d`.
+func Format(format string, x int64) (string, error) {
+	if format == "" {
+		return strconv.FormatInt(x, 10), nil
+	}
+	if !strings.ContainsAny(format, "{}") {
+		formatted := fmt.Sprintf(format, x)
+		if strings.Contains(formatted, "%!") {
+			return "", errors.Errorf("invalid format %q for the value", format)
+		}
+		return formatted, nil
+	}
+	var b strings.Builder
+	for rest := format; rest != ""; {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			b.WriteString(rest)
+			break
+		}
+		if rest[open] == '}' {
+			return "", errors.Errorf("unmatched } in the format %q", format)
+		}
+		b.WriteString(rest[:open])
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return "", errors.Errorf("unmatched { in the format %q", format)
+		}
+		text, err := EvalText(rest[open+1:open+end], x)
+		if err != nil {
+			return "", errors.Wrapf(err, "could not format with %q", format)
+		}
+		b.WriteString(text)
+		rest = rest[open+end+1:]
 	}
-	return EvalExpression(*ast, x), nil
+	return b.String(), nil
 }
@@ -20,3 +20,130 @@ func TestCalc(t *testing.T) {
 	}
 
 }
+
+func TestCalcGrammar(t *testing.T) {
+	for i, test := range []struct {
+		expr  string
+		x     int64
+		value int64
+	}{
+		// test 0: modulo for a round robin over 3 subnets
+		{expr: "(x - 1) % 3", x: 5, value: 1},
+		// test 1: unary minus
+		{expr: "-x + 10", x: 3, value: 7},
+		// test 2: double unary minus
+		{expr: "x - -1", x: 3, value: 4},
+		// test 3: precedence of the multiplication
+		{expr: "1 + 2 * x % 4", x: 3, value: 3},
+		// test 4: functions
+		{expr: "min(x, 10) + max(1, 2, x) + abs(-x)", x: 12, value: 34},
+		// test 5: comparisons
+		{expr: "(x == 2) + (x != 2) * 10 + (x < 3) * 100 + (x >= 3) * 1000", x: 2, value: 101},
+		// test 6: conditional
+		{expr: "x > 10 ? x - 10 : x + 10", x: 12, value: 2},
+		// test 7: nested conditional
+		{expr: "x < 5 ? 0 : x < 10 ? 1 : 2", x: 7, value: 1},
+		// test 8: conditional with a parenthesized condition
+		{expr: "(x % 2 == 0) ? x / 2 : 3 * x + 1", x: 3, value: 10},
+	} {
+		value, err := Eval(test.expr, test.x)
+		if err != nil {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if value != test.value {
+			t.Errorf("test %d: expecting %d got %d", i, test.value, value)
+		}
+	}
+}
+
+func TestCalcText(t *testing.T) {
+	for i, test := range []struct {
+		expr string
+		x    int64
+		text string
+	}{
+		// test 0: a number
+		{expr: "8000 + x", x: 1, text: "8001"},
+		// test 1: zero-padded
+		{expr: "pad(x, 4)", x: 42, text: "0042"},
+		// test 2: hexadecimal
+		{expr: "hex(x + 255)", x: 1, text: "100"},
+		// test 3: format
+		{expr: `format("svc-%04d", x)`, x: 7, text: "svc-0007"},
+		// test 4: format with several arguments
+		{expr: `format("%s-%d", x % 2 == 0 ? "even" : "odd", x)`, x: 3, text: "odd-3"},
+	} {
+		text, err := EvalText(test.expr, test.x)
+		if err != nil {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if text != test.text {
+			t.Errorf("test %d: expecting %s got %s", i, test.text, text)
+		}
+	}
+}
+
+func TestCalcErrors(t *testing.T) {
+	for i, expr := range []string{
+		// test 0: syntax error
+		"x +",
+		// test 1: division by zero
+		"x / (x - 1)",
+		// test 2: modulo by zero
+		"x % 0",
+		// test 3: unknown function
+		"sqrt(x)",
+		// test 4: wrong number of arguments
+		"abs(x, 1)",
+		// test 5: text in arithmetic
+		"pad(x, 2) + 1",
+		// test 6: text result
+		"hex(x)",
+		// test 7: invalid format
+		`format("%d %d", x)`,
+		// test 8: unknown variable
+		"y",
+	} {
+		if _, err := Eval(expr, 1); err == nil {
+			t.Errorf("test %d: expecting an error for %s", i, expr)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	for i, test := range []struct {
+		format string
+		x      int64
+		text   string
+		fails  bool
+	}{
+		// test 0: no format
+		{format: "", x: 42, text: "42"},
+		// test 1: fmt-style
+		{format: "app-%04d", x: 42, text: "app-0042"},
+		// test 2: template
+		{format: "10.0.{x}.0/24", x: 3, text: "10.0.3.0/24"},
+		// test 3: template with several expressions
+		{format: "{x < 10 ? \"high\" : \"low\"}-{pad(x, 3)}", x: 5, text: "high-005"},
+		// test 4: invalid fmt-style format
+		{format: "app-%s-%d", x: 1, fails: true},
+		// test 5: unmatched brace
+		{format: "10.0.{x.0/24", x: 1, fails: true},
+		// test 6: invalid expression
+		{format: "{y}", x: 1, fails: true},
+	} {
+		text, err := Format(test.format, test.x)
+		if test.fails {
+			if err == nil {
+				t.Errorf("test %d: expecting an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if text != test.text {
+			t.Errorf("test %d: expecting %s got %s", i, test.text, text)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// # Pre Authentication Rules
+//
+// The settings of the `cog_cond_pre_auth` cognito trigger decide which
+// users may authenticate with a client of a user pool. They are written by
+// the `cog_cond_pre_auth_settings` custom resource as JSON in an SSM
+// parameter and evaluated by the trigger on every authentication:
+//
+// 1. the deny rules are evaluated first: a user matching any of them is
+//    refused;
+// 2. with `All`, every other user is authorized;
+// 3. otherwise, a user must match one of the allow rules.
+//
+// A rule matches the email of the user, exactly or by pattern, the domain
+// of the email, exactly or by wildcard, the groups of the user in the user
+// pool or the identity provider of the user.
+//
+// * The domains are compared without case. The wildcard domain
+//   `*.example.com` matches all the subdomains of `example.com`, but not
+//   `example.com` itself.
+// * The emails are compared without case.
+// * The email patterns are regular expressions (Go syntax) matching the
+//   whole email, without case.
+// * The groups are the names of the cognito groups of the user.
+// * The identity providers are the provider names of the federated users,
+//   e.g. `Google` or the name of a SAML provider, and `Cognito` for the
+//   users of the user pool itself.
+package preauth
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ParameterPrefix is the prefix of the SSM parameters of the settings,
+// followed by the user pool id and the client id.
+const ParameterPrefix = "/hyperdrive/cog_cond_pre_auth/"
+
+// DefaultClient stands for the client id in the name of the parameter of
+// the default settings of a user pool, used by the clients without their
+// own settings.
+const DefaultClient = "default"
+
+// CognitoProvider is the identity provider of the users of the user pool
+// itself.
+const CognitoProvider = "Cognito"
+
+// Settings are the rules of a client. The names of the JSON fields are the
+// names of the properties of `Custom::CogCondPreAuthSettings`.
+type Settings struct {
+	All                   bool     `json:"All"`
+	Domains               []string `json:"Domains"`
+	Emails                []string `json:"Emails"`
+	EmailPatterns         []string `json:"EmailPatterns,omitempty"`
+	Groups                []string `json:"Groups,omitempty"`
+	IdentityProviders     []string `json:"IdentityProviders,omitempty"`
+	DenyDomains           []string `json:"DenyDomains,omitempty"`
+	DenyEmails            []string `json:"DenyEmails,omitempty"`
+	DenyEmailPatterns     []string `json:"DenyEmailPatterns,omitempty"`
+	DenyGroups            []string `json:"DenyGroups,omitempty"`
+	DenyIdentityProviders []string `json:"DenyIdentityProviders,omitempty"`
+}
+
+// ParameterName gives the name of the SSM parameter of the settings of a
+// client.
+func ParameterName(userPoolId, clientId string) string {
+	return ParameterPrefix + userPoolId + "/" + clientId
+}
+
+// DefaultParameterName gives the name of the SSM parameter of the default
+// settings of the clients of a user pool.
+func DefaultParameterName(userPoolId string) string {
+	return ParameterPrefix + userPoolId + "/" + DefaultClient
+}
+
+// UsesGroups tells if the rules need the groups of the user, that are not
+// part of the pre authentication event.
+func (s Settings) UsesGroups() bool {
+	return len(s.Groups) > 0 || len(s.DenyGroups) > 0
+}
+
+// A User is the user authenticating.
+type User struct {
+	Email            string
+	Groups           []string
+	IdentityProvider string
+}
+
+// Domain gives the domain of the email of the user.
+func (u User) Domain() (string, error) {
+	parts := strings.Split(u.Email, "@")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", errors.Errorf("invalid email: %s", u.Email)
+	}
+	return parts[1], nil
+}
+
+// A rule is one of the allow or deny lists of the settings, ready to be
+// evaluated.
+type rule struct {
+	domains, emails, groups, identityProviders []string
+	emailPatterns                              []*regexp.Regexp
+}
+
+// Rules are the compiled settings.
+type Rules struct {
+	all         bool
+	allow, deny rule
+}
+
+// Compile validates the settings and compiles their patterns.
+func Compile(settings Settings) (*Rules, error) {
+	allow, err := compileRule(settings.Domains, settings.Emails, settings.EmailPatterns, settings.Groups, settings.IdentityProviders)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := compileRule(settings.DenyDomains, settings.DenyEmails, settings.DenyEmailPatterns, settings.DenyGroups, settings.DenyIdentityProviders)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid deny rule")
+	}
+	return &Rules{all: settings.All, allow: allow, deny: deny}, nil
+}
+
+func compileRule(domains, emails, emailPatterns, groups, identityProviders []string) (rule, error) {
+	for _, domain := range domains {
+		if err := validateDomain(domain); err != nil {
+			return rule{}, err
+		}
+	}
+	r := rule{domains: domains, emails: emails, groups: groups, identityProviders: identityProviders}
+	for _, pattern := range emailPatterns {
+		compiled, err := regexp.Compile("(?i)^(?:" + pattern + ")$")
+		if err != nil {
+			return rule{}, errors.Wrapf(err, "invalid email pattern %s", pattern)
+		}
+		r.emailPatterns = append(r.emailPatterns, compiled)
+	}
+	return r, nil
+}
+
+// The wildcard is only allowed as the first label of a domain.
+func validateDomain(domain string) error {
+	name := strings.TrimPrefix(domain, "*.")
+	if name == "" || strings.Contains(name, "*") || strings.Contains(name, "@") {
+		return errors.Errorf("invalid domain %s", domain)
+	}
+	return nil
+}
+
+// Authorize tells if the user may authenticate; the error gives the
+// reason of the refusal.
+func (r *Rules) Authorize(user User) error {
+	domain, err := user.Domain()
+	if err != nil {
+		return err
+	}
+	if reason, ok := r.deny.match(user, domain); ok {
+		return errors.Errorf("not authorized: denied by %s", reason)
+	}
+	if r.all {
+		return nil
+	}
+	if _, ok := r.allow.match(user, domain); ok {
+		return nil
+	}
+	return errors.New("not authorized.")
+}
+
+// match gives the description of the first part of the rule matching the
+// user.
+func (r rule) match(user User, domain string) (string, bool) {
+	for _, d := range r.domains {
+		if matchDomain(d, domain) {
+			return "the domain " + d, true
+		}
+	}
+	for _, email := range r.emails {
+		if strings.EqualFold(email, user.Email) {
+			return "the email " + email, true
+		}
+	}
+	for _, pattern := range r.emailPatterns {
+		if pattern.MatchString(user.Email) {
+			return "the email pattern " + pattern.String(), true
+		}
+	}
+	for _, group := range r.groups {
+		for _, g := range user.Groups {
+			if g == group {
+				return "the group " + group, true
+			}
+		}
+	}
+	for _, provider := range r.identityProviders {
+		if strings.EqualFold(provider, user.IdentityProvider) {
+			return "the identity provider " + provider, true
+		}
+	}
+	return "", false
+}
+
+func matchDomain(rule, domain string) bool {
+	rule, domain = strings.ToLower(rule), strings.ToLower(domain)
+	if strings.HasPrefix(rule, "*.") {
+		return strings.HasSuffix(domain, rule[1:]) && len(domain) > len(rule)-1
+	}
+	return rule == domain
+}
@@ -0,0 +1,88 @@
+package preauth
+
+import (
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	google := User{Email: "ann@gmail.com", IdentityProvider: "Google"}
+	for i, test := range []struct {
+		settings   Settings
+		user       User
+		authorized bool
+	}{
+		// test 0: nothing is authorized by default
+		{settings: Settings{}, user: User{Email: "ann@test.com"}},
+		// test 1: all
+		{settings: Settings{All: true}, user: User{Email: "ann@test.com"}, authorized: true},
+		// test 2: exact domain, without case
+		{settings: Settings{Domains: []string{"test.com"}}, user: User{Email: "ann@Test.COM"}, authorized: true},
+		// test 3: the exact domain does not match the subdomains
+		{settings: Settings{Domains: []string{"test.com"}}, user: User{Email: "ann@eu.test.com"}},
+		// test 4: wildcard domain
+		{settings: Settings{Domains: []string{"*.test.com"}}, user: User{Email: "ann@a.eu.test.com"}, authorized: true},
+		// test 5: the wildcard domain does not match the domain itself
+		{settings: Settings{Domains: []string{"*.test.com"}}, user: User{Email: "ann@test.com"}},
+		// test 6: the wildcard domain does not match a suffix of a label
+		{settings: Settings{Domains: []string{"*.test.com"}}, user: User{Email: "ann@attest.com"}},
+		// test 7: exact email, without case
+		{settings: Settings{Emails: []string{"Ann@test.com"}}, user: User{Email: "ann@test.com"}, authorized: true},
+		// test 8: email pattern matching the whole email
+		{settings: Settings{EmailPatterns: []string{`[a-z]+\.ops@test\.com`}}, user: User{Email: "ann.ops@test.com"}, authorized: true},
+		// test 9: email pattern not matching the whole email
+		{settings: Settings{EmailPatterns: []string{`ops@test\.com`}}, user: User{Email: "ann.ops@test.com.evil.com"}},
+		// test 10: group
+		{settings: Settings{Groups: []string{"admins"}}, user: User{Email: "ann@test.com", Groups: []string{"users", "admins"}}, authorized: true},
+		// test 11: identity provider
+		{settings: Settings{IdentityProviders: []string{"Google"}}, user: google, authorized: true},
+		// test 12: the users of the pool are not federated
+		{settings: Settings{IdentityProviders: []string{"Google"}}, user: User{Email: "ann@gmail.com", IdentityProvider: CognitoProvider}},
+		// test 13: the deny rules are evaluated before all
+		{settings: Settings{All: true, DenyEmails: []string{"ann@test.com"}}, user: User{Email: "ann@test.com"}},
+		// test 14: the deny rules are evaluated before the allow rules
+		{settings: Settings{Domains: []string{"test.com"}, DenyEmailPatterns: []string{`.*\+.*@test\.com`}}, user: User{Email: "ann+1@test.com"}},
+		// test 15: the deny rules only refuse the users matching them
+		{settings: Settings{Domains: []string{"test.com"}, DenyEmailPatterns: []string{`.*\+.*@test\.com`}}, user: User{Email: "ann@test.com"}, authorized: true},
+		// test 16: denied wildcard domain
+		{settings: Settings{Domains: []string{"*.test.com"}, DenyDomains: []string{"*.ext.test.com"}}, user: User{Email: "ann@a.ext.test.com"}},
+		// test 17: denied group
+		{settings: Settings{All: true, DenyGroups: []string{"suspended"}}, user: User{Email: "ann@test.com", Groups: []string{"suspended"}}},
+		// test 18: denied identity provider
+		{settings: Settings{All: true, DenyIdentityProviders: []string{"google"}}, user: google},
+		// test 19: invalid email
+		{settings: Settings{All: true}, user: User{Email: "ann"}},
+	} {
+		rules, err := Compile(test.settings)
+		if err != nil {
+			t.Errorf("test %d: unexpected error %v", i, err)
+			continue
+		}
+		if err := rules.Authorize(test.user); (err == nil) != test.authorized {
+			t.Errorf("test %d: expecting the authorization %t got %v", i, test.authorized, err)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	for i, test := range []struct {
+		settings Settings
+		fails    bool
+	}{
+		// test 0: valid settings
+		{settings: Settings{Domains: []string{"test.com", "*.test.com"}, EmailPatterns: []string{`.*@test\.com`}, DenyDomains: []string{"*.ext.test.com"}}},
+		// test 1: invalid pattern
+		{settings: Settings{EmailPatterns: []string{`(`}}, fails: true},
+		// test 2: invalid deny pattern
+		{settings: Settings{DenyEmailPatterns: []string{`[`}}, fails: true},
+		// test 3: wildcard inside a domain
+		{settings: Settings{Domains: []string{"a.*.com"}}, fails: true},
+		// test 4: wildcard alone
+		{settings: Settings{Domains: []string{"*"}}, fails: true},
+		// test 5: email as domain
+		{settings: Settings{DenyDomains: []string{"ann@test.com"}}, fails: true},
+	} {
+		if _, err := Compile(test.settings); (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+	}
+}
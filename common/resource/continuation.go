@@ -0,0 +1,270 @@
+package resource
+
+// ## Long-running operations
+//
+// Some operations take longer than a lambda may run, e.g. waiting for a
+// certificate to be issued or deleting millions of objects from a bucket.
+// Instead of sleeping, a resource returns the error `InProgress` with a
+// state. The lambda then re-invokes itself asynchronously with the
+// original event and the state, and the resource continues where it
+// stopped. Only when the operation is done, the response is sent to
+// cloudformation.
+//
+// A continuation with a delay, e.g. to poll a certificate every 30
+// seconds, is not waited for in the lambda: it is sent to the SQS queue
+// given by the environment variable `HYPERDRIVE_CONTINUATION_QUEUE` with
+// the delay of the message, and the queue triggers the lambda.
+//
+// To use continuations, the lambda must be started with `LambdaWrap`
+// instead of `cfn.LambdaWrap` and its role must be allowed to invoke the
+// lambda function itself (`lambda:InvokeFunction`) and, for the delays, to
+// send messages to the queue (`sqs:SendMessage`).
+//
+// ```go
+// lambda.Start(resource.LambdaWrap(resource.Handler(resource.Properties(MyProperties{}), &myResource{}), awsapi.NewLambda(awslambda.New(cfg)), awsapi.NewSQS(sqs.New(cfg))))
+// ```
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awsapi"
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/pkg/errors"
+)
+
+// MaxDuration is the maximal duration of an operation over all the
+// invocations. Cloudformation waits for at most one hour for the response
+// of a custom resource.
+const MaxDuration = 55 * time.Minute
+
+// ReturnContinuationEnv is the environment variable that, if set to
+// `true`, makes the lambda return the next invocation as its result
+// instead of invoking itself. It is used to run the lambdas locally.
+const ReturnContinuationEnv = "HYPERDRIVE_RETURN_CONTINUATION"
+
+// ContinuationQueueEnv is the environment variable with the URL of the SQS
+// queue of the delayed continuations.
+const ContinuationQueueEnv = "HYPERDRIVE_CONTINUATION_QUEUE"
+
+// MaxDelay is the maximal delay of a continuation, the maximal delay of the
+// messages of SQS.
+const MaxDelay = 15 * time.Minute
+
+// An InProgressError signals that an operation is not done yet. The
+// state is marshalled as JSON and given back to the resource in the
+// `State` of the request of the next invocation, after the delay.
+type InProgressError struct {
+	State interface{}
+	Delay time.Duration
+}
+
+func (e *InProgressError) Error() string {
+	return "operation in progress"
+}
+
+// InProgress creates the error to return by a resource to signal that the
+// operation must continue in a new invocation after the given delay.
+func InProgress(state interface{}, delay time.Duration) error {
+	return &InProgressError{State: state, Delay: delay}
+}
+
+// An Invocation is the payload of the lambda: the event from cloudformation
+// and, for the re-invocations, the continuation of the operation. The
+// delayed continuations come from the queue as the body of the `Records`.
+type Invocation struct {
+	cfn.Event
+	Continuation *Continuation       `json:",omitempty"`
+	Records      []events.SQSMessage `json:",omitempty"`
+}
+
+// A Continuation is the state of an operation in progress. The delay is
+// the time to wait before the invocation.
+type Continuation struct {
+	PhysicalResourceId string
+	State              json.RawMessage
+	Attempt            int
+	Started            time.Time
+	Delay              time.Duration `json:",omitempty"`
+}
+
+type continuationKey struct{}
+
+// WithContinuation adds the continuation to the context; the handler
+// gives its state and attempt to the resource in the request.
+func WithContinuation(ctx context.Context, continuation *Continuation) context.Context {
+	return context.WithValue(ctx, continuationKey{}, continuation)
+}
+
+func continuationFrom(ctx context.Context) *Continuation {
+	continuation, _ := ctx.Value(continuationKey{}).(*Continuation)
+	return continuation
+}
+
+// TimeLeft returns the time left before the deadline of the invocation.
+// Resources processing data in batches stop and return `InProgress` when
+// the time left gets short.
+func TimeLeft(ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return MaxDuration
+	}
+	return time.Until(deadline)
+}
+
+// LambdaWrap creates the lambda function for the handler. Like
+// `cfn.LambdaWrap`, it sends the response to cloudformation unless the
+// handler returns `InProgress`; in that case, the lambda invokes itself
+// asynchronously with the continuation, or sends it to the queue of the
+// delayed continuations. If the environment variable
+// `HYPERDRIVE_RETURN_CONTINUATION` is `true`, the next invocation is
+// returned instead.
+func LambdaWrap(handler cfn.CustomResourceFunction, lambdas awsapi.Lambda, queues awsapi.SQS) func(ctx context.Context, invocation Invocation) (*Invocation, error) {
+	return func(ctx context.Context, invocation Invocation) (*Invocation, error) {
+		if len(invocation.Records) == 0 {
+			return continueOperation(ctx, handler, lambdas, queues, invocation)
+		}
+		for _, record := range invocation.Records {
+			var delayed Invocation
+			if err := json.Unmarshal([]byte(record.Body), &delayed); err != nil {
+				log.Printf("dropping the invalid continuation %s: %v", record.MessageId, err)
+				continue
+			}
+			if _, err := continueOperation(ctx, handler, lambdas, queues, delayed); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+}
+
+func continueOperation(ctx context.Context, handler cfn.CustomResourceFunction, lambdas awsapi.Lambda, queues awsapi.SQS, invocation Invocation) (*Invocation, error) {
+	continuation := invocation.Continuation
+	if continuation != nil {
+		if time.Since(continuation.Started) > MaxDuration {
+			return nil, respond(invocation.Event, continuation.PhysicalResourceId, nil, errors.Errorf("operation timed out after %d attempts", continuation.Attempt))
+		}
+		ctx = WithContinuation(ctx, continuation)
+	}
+	id, data, err := handler(ctx, invocation.Event)
+	progress, ok := errors.Cause(err).(*InProgressError)
+	if !ok {
+		return nil, respond(invocation.Event, id, data, err)
+	}
+	next, err := nextInvocation(invocation, id, progress)
+	if err != nil {
+		return nil, respond(invocation.Event, id, nil, err)
+	}
+	if os.Getenv(ReturnContinuationEnv) == "true" {
+		return next, nil
+	}
+	if next.Continuation.Delay > 0 {
+		err = sendDelayed(queues, next)
+	} else {
+		err = invokeSelf(ctx, lambdas, next)
+	}
+	if err != nil {
+		return nil, respond(invocation.Event, id, nil, err)
+	}
+	return nil, nil
+}
+
+func nextInvocation(invocation Invocation, id string, progress *InProgressError) (*Invocation, error) {
+	state, err := json.Marshal(progress.State)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not marshal the state of the operation")
+	}
+	next := &Invocation{
+		Event: invocation.Event,
+		Continuation: &Continuation{
+			PhysicalResourceId: id,
+			State:              state,
+			Attempt:            1,
+			Started:            time.Now(),
+			Delay:              progress.Delay,
+		},
+	}
+	if next.Continuation.Delay > MaxDelay {
+		next.Continuation.Delay = MaxDelay
+	}
+	if invocation.Continuation != nil {
+		next.Continuation.Attempt = invocation.Continuation.Attempt + 1
+		next.Continuation.Started = invocation.Continuation.Started
+	}
+	return next, nil
+}
+
+// The lambda invokes the same version of itself as the one invoked by
+// cloudformation.
+func invokeSelf(ctx context.Context, lambdas awsapi.Lambda, next *Invocation) error {
+	function := lambdacontext.FunctionName
+	if lc, ok := lambdacontext.FromContext(ctx); ok && lc.InvokedFunctionArn != "" {
+		function = lc.InvokedFunctionArn
+	}
+	payload, err := json.Marshal(next)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal the continuation")
+	}
+	log.Printf("continuing the operation with attempt %d", next.Continuation.Attempt)
+	_, err = lambdas.Invoke(&lambda.InvokeInput{
+		FunctionName:   &function,
+		InvocationType: lambda.InvocationTypeEvent,
+		Payload:        payload,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "could not invoke the lambda %s to continue the operation", function)
+	}
+	return nil
+}
+
+// The queue delays the message by whole seconds.
+func sendDelayed(queues awsapi.SQS, next *Invocation) error {
+	queue := os.Getenv(ContinuationQueueEnv)
+	if queue == "" {
+		return errors.Errorf("the environment variable %s is required to delay the continuation", ContinuationQueueEnv)
+	}
+	body, err := json.Marshal(next)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal the continuation")
+	}
+	bodyText := string(body)
+	delay := int64((next.Continuation.Delay + time.Second - 1) / time.Second)
+	log.Printf("continuing the operation with attempt %d in %d seconds", next.Continuation.Attempt, delay)
+	_, err = queues.SendMessage(&sqs.SendMessageInput{
+		QueueUrl:     &queue,
+		MessageBody:  &bodyText,
+		DelaySeconds: &delay,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "could not send the continuation to the queue %s", queue)
+	}
+	return nil
+}
+
+// The response is sent as `cfn.LambdaWrap` does.
+func respond(event cfn.Event, id string, data map[string]interface{}, err error) error {
+	response := cfn.NewResponse(&event)
+	response.PhysicalResourceID = id
+	response.Data = data
+	if response.PhysicalResourceID == "" {
+		response.PhysicalResourceID = lambdacontext.LogStreamName
+	}
+	if err != nil {
+		response.Status = cfn.StatusFailed
+		response.Reason = err.Error()
+		log.Printf("sending status failed: %s", response.Reason)
+	} else {
+		response.Status = cfn.StatusSuccess
+	}
+	if err := response.Send(); err != nil {
+		return errors.Wrapf(err, "could not send the response for the resource %s", event.LogicalResourceID)
+	}
+	return nil
+}
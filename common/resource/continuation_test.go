@@ -0,0 +1,202 @@
+package resource
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awstest"
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/pkg/errors"
+)
+
+type countState struct {
+	Count int
+}
+
+// The counter resource needs 3 invocations to be created.
+type counterResource struct {
+	attempts []int
+	delay    time.Duration
+}
+
+func (r *counterResource) Create(ctx context.Context, request Request) (string, map[string]interface{}, error) {
+	r.attempts = append(r.attempts, request.Attempt)
+	var state countState
+	if request.Continued() {
+		if err := request.DecodeState(&state); err != nil {
+			return "", nil, err
+		}
+	}
+	if state.Count < 2 {
+		return "counter", nil, InProgress(countState{state.Count + 1}, r.delay)
+	}
+	return "counter", map[string]interface{}{"Count": state.Count}, nil
+}
+
+func (r *counterResource) Update(ctx context.Context, request Request) (string, map[string]interface{}, error) {
+	return r.Create(ctx, request)
+}
+
+func (r *counterResource) Delete(ctx context.Context, request Request) error {
+	return nil
+}
+
+func TestLambdaWrap(t *testing.T) {
+	var responses []cfn.Response
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var response cfn.Response
+		if err := json.NewDecoder(req.Body).Decode(&response); err != nil {
+			t.Error(err)
+		}
+		responses = append(responses, response)
+	}))
+	defer server.Close()
+	event := cfn.Event{
+		RequestType:        cfn.RequestCreate,
+		ResponseURL:        server.URL,
+		LogicalResourceID:  "Counter",
+		ResourceProperties: map[string]interface{}{"Name": "counter"},
+	}
+
+	for i, test := range []struct {
+		failures awstest.Failures
+		started  time.Time
+		status   cfn.StatusType
+		invokes  int
+		attempts []int
+	}{
+		// test 0: the operation continues until done
+		{status: cfn.StatusSuccess, invokes: 2, attempts: []int{0, 1, 2}},
+		// test 1: failure to continue the operation
+		{failures: awstest.Failures{"Invoke": errors.New("boom")}, status: cfn.StatusFailed, attempts: []int{0}},
+		// test 2: the operation times out
+		{started: time.Now().Add(-time.Hour), status: cfn.StatusFailed, invokes: 1, attempts: []int{0}},
+	} {
+		responses = nil
+		lambdas := awstest.NewLambda()
+		lambdas.Failures = test.failures
+		resource := &counterResource{}
+		handler := LambdaWrap(Handler(Properties(testProperties{}), resource), lambdas, awstest.NewSQS())
+		if _, err := handler(context.Background(), Invocation{Event: event}); err != nil {
+			t.Fatalf("test %d: %v", i, err)
+		}
+		for n := 0; n < len(lambdas.Invocations); n++ {
+			invocation := lambdas.Invocations[n]
+			if invocation.InvocationType != lambda.InvocationTypeEvent {
+				t.Errorf("test %d: unexpected invocation type %s", i, invocation.InvocationType)
+			}
+			var next Invocation
+			if err := json.Unmarshal(invocation.Payload, &next); err != nil {
+				t.Fatalf("test %d: %v", i, err)
+			}
+			if next.LogicalResourceID != "Counter" || next.Continuation.PhysicalResourceId != "counter" {
+				t.Errorf("test %d: unexpected continuation %+v", i, next)
+			}
+			if !test.started.IsZero() {
+				next.Continuation.Started = test.started
+			}
+			if _, err := handler(context.Background(), next); err != nil {
+				t.Fatalf("test %d: %v", i, err)
+			}
+		}
+		if len(lambdas.Invocations) != test.invokes {
+			t.Errorf("test %d: expecting %d invocations got %d", i, test.invokes, len(lambdas.Invocations))
+		}
+		if len(responses) != 1 || responses[0].Status != test.status {
+			t.Errorf("test %d: expecting one response %s got %+v", i, test.status, responses)
+			continue
+		}
+		if responses[0].PhysicalResourceID != "counter" {
+			t.Errorf("test %d: unexpected physical id %s", i, responses[0].PhysicalResourceID)
+		}
+		if len(resource.attempts) != len(test.attempts) {
+			t.Errorf("test %d: expecting attempts %v got %v", i, test.attempts, resource.attempts)
+		}
+	}
+}
+
+func TestLambdaWrapReturnContinuation(t *testing.T) {
+	os.Setenv(ReturnContinuationEnv, "true")
+	defer os.Unsetenv(ReturnContinuationEnv)
+	lambdas := awstest.NewLambda()
+	handler := LambdaWrap(Handler(Properties(testProperties{}), &counterResource{delay: 30 * time.Second}), lambdas, awstest.NewSQS())
+	next, err := handler(context.Background(), Invocation{Event: cfn.Event{
+		RequestType:        cfn.RequestCreate,
+		ResourceProperties: map[string]interface{}{"Name": "counter"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == nil || next.Continuation.Attempt != 1 || string(next.Continuation.State) != `{"Count":1}` || next.Continuation.Delay != 30*time.Second {
+		t.Errorf("unexpected continuation %+v", next)
+	}
+	if lambdas.Called("Invoke") != 0 {
+		t.Error("the lambda must not invoke itself")
+	}
+}
+
+func TestLambdaWrapDelay(t *testing.T) {
+	var responses []cfn.Response
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var response cfn.Response
+		if err := json.NewDecoder(req.Body).Decode(&response); err != nil {
+			t.Error(err)
+		}
+		responses = append(responses, response)
+	}))
+	defer server.Close()
+	event := cfn.Event{
+		RequestType:        cfn.RequestCreate,
+		ResponseURL:        server.URL,
+		LogicalResourceID:  "Counter",
+		ResourceProperties: map[string]interface{}{"Name": "counter"},
+	}
+	defer os.Unsetenv(ContinuationQueueEnv)
+
+	for i, test := range []struct {
+		queue    string
+		delay    time.Duration
+		status   cfn.StatusType
+		messages int
+		seconds  int64
+	}{
+		// test 0: the delayed continuations go through the queue
+		{queue: "https://queue", delay: 1500 * time.Millisecond, status: cfn.StatusSuccess, messages: 2, seconds: 2},
+		// test 1: the delay is at most the one of SQS
+		{queue: "https://queue", delay: time.Hour, status: cfn.StatusSuccess, messages: 2, seconds: 900},
+		// test 2: the queue is required for a delay
+		{delay: time.Second, status: cfn.StatusFailed},
+	} {
+		responses = nil
+		os.Setenv(ContinuationQueueEnv, test.queue)
+		lambdas := awstest.NewLambda()
+		queues := awstest.NewSQS()
+		handler := LambdaWrap(Handler(Properties(testProperties{}), &counterResource{delay: test.delay}), lambdas, queues)
+		if _, err := handler(context.Background(), Invocation{Event: event}); err != nil {
+			t.Fatalf("test %d: %v", i, err)
+		}
+		for n := 0; n < len(queues.Messages); n++ {
+			message := queues.Messages[n]
+			if *message.QueueUrl != test.queue || *message.DelaySeconds != test.seconds {
+				t.Errorf("test %d: unexpected message %+v", i, message)
+			}
+			records := []events.SQSMessage{{MessageId: "invalid", Body: "{"}, {MessageId: "message", Body: *message.MessageBody}}
+			if _, err := handler(context.Background(), Invocation{Records: records}); err != nil {
+				t.Fatalf("test %d: %v", i, err)
+			}
+		}
+		if len(queues.Messages) != test.messages || lambdas.Called("Invoke") != 0 {
+			t.Errorf("test %d: expecting %d messages got %d and %d invocations", i, test.messages, len(queues.Messages), lambdas.Called("Invoke"))
+		}
+		if len(responses) != 1 || responses[0].Status != test.status {
+			t.Errorf("test %d: expecting one response %s got %+v", i, test.status, responses)
+		}
+	}
+}
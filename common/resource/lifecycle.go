@@ -0,0 +1,149 @@
+package resource
+
+// ## Stack lifecycle
+//
+// Cleanup resources, like `S3Cleanup` or `EcrCleanup`, only act when
+// their deletion is part of a given lifecycle of the stack, typically the
+// deletion of the stack. The status of the stack of the resource alone is
+// not enough: a nested stack is deleted as well when its root stack is
+// deleted or when the creation of its root stack is rolled back, and a
+// resource deleted during the cleanup of an update may have been removed
+// from the template or replaced.
+//
+// `StackLifecycle` walks from the stack of the resource to its root stack
+// and classifies the lifecycle in which the resource is deleted:
+//
+// 1. `Delete`: the stack or one of its parents is being deleted;
+// 2. `CreateRollback`: the creation of the stack or of one of its parents
+//    is rolled back;
+// 3. `Replacement`: the resource has been replaced by a new one during an
+//    update and the old one is cleaned up;
+// 4. `UpdateCleanup`: the resource has been removed from the template
+//    during an update;
+// 5. `UpdateRollback`: the update of the stack is rolled back and the
+//    resources it created are cleaned up;
+// 6. `Other`: any other status of the stack.
+//
+// The status of the root stack wins over the status of the nested stacks:
+// the nested stacks are deleted when the creation of their root is rolled
+// back.
+
+import (
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awsapi"
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/pkg/errors"
+)
+
+// A Lifecycle is the phase of the stack in which a resource is deleted.
+type Lifecycle string
+
+const (
+	LifecycleDelete         Lifecycle = "Delete"
+	LifecycleCreateRollback Lifecycle = "CreateRollback"
+	LifecycleReplacement    Lifecycle = "Replacement"
+	LifecycleUpdateCleanup  Lifecycle = "UpdateCleanup"
+	LifecycleUpdateRollback Lifecycle = "UpdateRollback"
+	LifecycleOther          Lifecycle = "Other"
+)
+
+// DefaultCleanupLifecycles are the lifecycles in which cleanup resources
+// act by default: the resources of the stack are gone for good.
+var DefaultCleanupLifecycles = []string{string(LifecycleDelete), string(LifecycleCreateRollback)}
+
+var lifecycles = map[Lifecycle]bool{
+	LifecycleDelete:         true,
+	LifecycleCreateRollback: true,
+	LifecycleReplacement:    true,
+	LifecycleUpdateCleanup:  true,
+	LifecycleUpdateRollback: true,
+	LifecycleOther:          true,
+}
+
+// ValidateLifecycles checks the names of lifecycles given as a property.
+func ValidateLifecycles(names []string) error {
+	for _, name := range names {
+		if !lifecycles[Lifecycle(name)] {
+			return errors.Errorf("invalid lifecycle %s", name)
+		}
+	}
+	return nil
+}
+
+// StackLifecycle classifies the lifecycle in which the resource of the
+// event is deleted.
+func StackLifecycle(cf awsapi.CloudFormation, event cfn.Event) (Lifecycle, error) {
+	// 1. the stacks from the stack of the resource to its root.
+	var stacks []cloudformation.Stack
+	for stackId := &event.StackID; stackId != nil; {
+		output, err := cf.DescribeStacks(&cloudformation.DescribeStacksInput{StackName: stackId})
+		if err != nil {
+			return "", errors.Wrapf(err, "could not fetch the stack %s for the resource %s", *stackId, event.PhysicalResourceID)
+		}
+		if len(output.Stacks) == 0 {
+			return "", errors.Errorf("the stack %s of the resource %s does not exist", *stackId, event.PhysicalResourceID)
+		}
+		stacks = append(stacks, output.Stacks[0])
+		stackId = output.Stacks[0].ParentId
+	}
+	// 2. the deletion or the rollback of the creation of a stack, from the root down.
+	for i := len(stacks) - 1; i >= 0; i-- {
+		switch stacks[i].StackStatus {
+		case cloudformation.StackStatusDeleteInProgress:
+			return LifecycleDelete, nil
+		case cloudformation.StackStatusRollbackInProgress:
+			return LifecycleCreateRollback, nil
+		}
+	}
+	// 3. the cleanup of an update of the stack of the resource.
+	switch stacks[0].StackStatus {
+	case cloudformation.StackStatusUpdateCompleteCleanupInProgress:
+		replaced, err := isReplaced(cf, event)
+		if err != nil {
+			return "", err
+		}
+		if replaced {
+			return LifecycleReplacement, nil
+		}
+		return LifecycleUpdateCleanup, nil
+	case cloudformation.StackStatusUpdateRollbackInProgress, cloudformation.StackStatusUpdateRollbackCompleteCleanupInProgress:
+		return LifecycleUpdateRollback, nil
+	}
+	return LifecycleOther, nil
+}
+
+// A resource is replaced if the stack still has a resource with the same
+// logical id but another physical id.
+func isReplaced(cf awsapi.CloudFormation, event cfn.Event) (bool, error) {
+	output, err := cf.DescribeStackResource(&cloudformation.DescribeStackResourceInput{
+		StackName:         &event.StackID,
+		LogicalResourceId: &event.LogicalResourceID,
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ValidationError" {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "could not fetch the resource %s of the stack %s", event.LogicalResourceID, event.StackID)
+	}
+	detail := output.StackResourceDetail
+	return detail != nil && detail.PhysicalResourceId != nil && *detail.PhysicalResourceId != event.PhysicalResourceID, nil
+}
+
+// ShouldCleanup tells if the resource of the event is deleted in one of
+// the given lifecycles, by default `DefaultCleanupLifecycles`.
+func ShouldCleanup(cf awsapi.CloudFormation, event cfn.Event, names []string) (bool, error) {
+	if len(names) == 0 {
+		names = DefaultCleanupLifecycles
+	}
+	lifecycle, err := StackLifecycle(cf, event)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range names {
+		if Lifecycle(name) == lifecycle {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,104 @@
+package resource
+
+import (
+	"testing"
+
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awstest"
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	"github.com/pkg/errors"
+)
+
+func TestStackLifecycle(t *testing.T) {
+	const (
+		root   = "arn:aws:cloudformation:eu-west-1:123456789012:stack/root/1"
+		parent = "arn:aws:cloudformation:eu-west-1:123456789012:stack/root-parent/2"
+		nested = "arn:aws:cloudformation:eu-west-1:123456789012:stack/root-parent-nested/3"
+	)
+	for i, test := range []struct {
+		statuses  []cloudformation.StackStatus
+		physical  string
+		failures  awstest.Failures
+		lifecycle Lifecycle
+		fails     bool
+	}{
+		// test 0: the stack is deleted
+		{statuses: []cloudformation.StackStatus{cloudformation.StackStatusDeleteInProgress}, lifecycle: LifecycleDelete},
+		// test 1: the root of the nested stack is deleted
+		{statuses: []cloudformation.StackStatus{cloudformation.StackStatusDeleteInProgress, cloudformation.StackStatusDeleteInProgress, cloudformation.StackStatusDeleteInProgress},
+			lifecycle: LifecycleDelete},
+		// test 2: the nested stack is deleted while the creation of the root is rolled back
+		{statuses: []cloudformation.StackStatus{cloudformation.StackStatusRollbackInProgress, cloudformation.StackStatusDeleteInProgress, cloudformation.StackStatusDeleteInProgress},
+			lifecycle: LifecycleCreateRollback},
+		// test 3: the nested stack is removed from its parent during an update
+		{statuses: []cloudformation.StackStatus{cloudformation.StackStatusUpdateInProgress, cloudformation.StackStatusUpdateCompleteCleanupInProgress, cloudformation.StackStatusDeleteInProgress},
+			lifecycle: LifecycleDelete},
+		// test 4: the resource is replaced
+		{statuses: []cloudformation.StackStatus{cloudformation.StackStatusUpdateCompleteCleanupInProgress}, physical: "Cleanup-2", lifecycle: LifecycleReplacement},
+		// test 5: the resource is removed from the template
+		{statuses: []cloudformation.StackStatus{cloudformation.StackStatusUpdateCompleteCleanupInProgress}, lifecycle: LifecycleUpdateCleanup},
+		// test 6: the update is rolled back
+		{statuses: []cloudformation.StackStatus{cloudformation.StackStatusUpdateRollbackCompleteCleanupInProgress}, lifecycle: LifecycleUpdateRollback},
+		// test 7: the resource is deleted on its own
+		{statuses: []cloudformation.StackStatus{cloudformation.StackStatusUpdateInProgress}, lifecycle: LifecycleOther},
+		// test 8: failure to fetch the stacks
+		{statuses: []cloudformation.StackStatus{cloudformation.StackStatusDeleteInProgress}, failures: awstest.Failures{"DescribeStacks": errors.New("boom")}, fails: true},
+		// test 9: failure to fetch the resource
+		{statuses: []cloudformation.StackStatus{cloudformation.StackStatusUpdateCompleteCleanupInProgress}, failures: awstest.Failures{"DescribeStackResource": errors.New("boom")}, fails: true},
+	} {
+		cf := awstest.NewCloudFormation()
+		cf.Failures = test.failures
+		ids := []string{root, parent, nested}[:len(test.statuses)]
+		for n, id := range ids {
+			parentId := ""
+			if n > 0 {
+				parentId = ids[n-1]
+			}
+			cf.PutNestedStack(id, id, parentId, test.statuses[n])
+		}
+		stackId := ids[len(ids)-1]
+		if test.physical != "" {
+			cf.PutStackResource(stackId, "Cleanup", test.physical)
+		}
+		lifecycle, err := StackLifecycle(cf, cfn.Event{StackID: stackId, LogicalResourceID: "Cleanup", PhysicalResourceID: "Cleanup-1"})
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if lifecycle != test.lifecycle {
+			t.Errorf("test %d: expecting lifecycle %s got %s", i, test.lifecycle, lifecycle)
+		}
+	}
+}
+
+func TestShouldCleanup(t *testing.T) {
+	const stackId = "arn:aws:cloudformation:eu-west-1:123456789012:stack/test/1"
+	for i, test := range []struct {
+		status     cloudformation.StackStatus
+		lifecycles []string
+		cleanup    bool
+	}{
+		// test 0: by default on deletion
+		{status: cloudformation.StackStatusDeleteInProgress, cleanup: true},
+		// test 1: by default on the rollback of the creation
+		{status: cloudformation.StackStatusRollbackInProgress, cleanup: true},
+		// test 2: not by default on the cleanup of an update
+		{status: cloudformation.StackStatusUpdateCompleteCleanupInProgress},
+		// test 3: only on deletion
+		{status: cloudformation.StackStatusRollbackInProgress, lifecycles: []string{"Delete"}},
+		// test 4: on the cleanup of an update
+		{status: cloudformation.StackStatusUpdateCompleteCleanupInProgress, lifecycles: []string{"UpdateCleanup"}, cleanup: true},
+	} {
+		cf := awstest.NewCloudFormation()
+		cf.PutStack(stackId, "test", test.status)
+		cleanup, err := ShouldCleanup(cf, cfn.Event{StackID: stackId, LogicalResourceID: "Cleanup", PhysicalResourceID: "Cleanup"}, test.lifecycles)
+		if err != nil {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if cleanup != test.cleanup {
+			t.Errorf("test %d: expecting cleanup %t got %t", i, test.cleanup, cleanup)
+		}
+	}
+	if err := ValidateLifecycles([]string{"Delete", "Deleted"}); err == nil {
+		t.Errorf("expecting an invalid lifecycle")
+	}
+}
@@ -0,0 +1,198 @@
+// # Custom Resource Framework
+//
+// All the custom resource lambdas of hyperdrive follow the same pattern:
+// decode the properties of the cloudformation event, dispatch on the
+// request type, gracefully ignore the deletion of resources whose creation
+// has failed and, on update, decide if the change requires a replacement.
+//
+// The `resource` package implements this pattern once. A custom resource
+// is a struct implementing the `Resource` interface, i.e. the 3 methods
+// `Create`, `Update` and `Delete`, and a properties struct that is decoded
+// with [mapstructure](https://github.com/mitchellh/mapstructure).
+//
+// ```go
+// func main() {
+// 	lambda.Start(cfn.LambdaWrap(resource.Handler(resource.Properties(MyProperties{}), &myResource{})))
+// }
+// ```
+package resource
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common"
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+)
+
+// A Request is the cloudformation event together with its decoded
+// properties. The old properties are only defined for update requests.
+// The state and the attempt are only defined when the request continues
+// a long-running operation (see `InProgress`).
+type Request struct {
+	cfn.Event
+	Properties    interface{}
+	OldProperties interface{}
+	State         json.RawMessage
+	Attempt       int
+}
+
+// Continued tells if the request continues an operation in progress.
+func (r Request) Continued() bool {
+	return r.State != nil
+}
+
+// DecodeState decodes the state of the operation in progress into the
+// given pointer.
+func (r Request) DecodeState(state interface{}) error {
+	if err := json.Unmarshal(r.State, state); err != nil {
+		return errors.Wrap(err, "could not decode the state of the operation")
+	}
+	return nil
+}
+
+// Changed tells if any of the given fields of the properties struct has
+// changed between the old and the new properties. It is meant to detect
+// replacements in `RequiresReplacement`.
+func (r Request) Changed(fields ...string) bool {
+	if r.OldProperties == nil {
+		return false
+	}
+	old := reflect.ValueOf(r.OldProperties)
+	new := reflect.ValueOf(r.Properties)
+	for _, field := range fields {
+		if !reflect.DeepEqual(old.FieldByName(field).Interface(), new.FieldByName(field).Interface()) {
+			return true
+		}
+	}
+	return false
+}
+
+// The Resource interface is implemented by every custom resource. Create
+// and Update return the physical resource id and the attributes of the
+// resource.
+type Resource interface {
+	Create(ctx context.Context, request Request) (string, map[string]interface{}, error)
+	Update(ctx context.Context, request Request) (string, map[string]interface{}, error)
+	Delete(ctx context.Context, request Request) error
+}
+
+// A Resource can optionally implement the Replacer interface to signal
+// that an update requires a replacement. In that case, the framework calls
+// `Create` instead of `Update`; cloudformation deletes the old resource
+// afterwards as the physical resource id changes.
+type Replacer interface {
+	RequiresReplacement(request Request) bool
+}
+
+// A properties struct can optionally implement the Validator interface to
+// check its values and to set defaults after decoding. The method must
+// have a pointer receiver to be able to set defaults.
+type Validator interface {
+	Validate() error
+}
+
+// A Decoder decodes the generic map of a cloudformation event into the
+// properties struct of a resource.
+type Decoder func(input map[string]interface{}) (interface{}, error)
+
+// Decode decodes the input into the properties that must be a pointer to
+// a struct and validates them if they implement the Validator interface.
+func Decode(input map[string]interface{}, properties interface{}) error {
+	if err := mapstructure.Decode(input, properties); err != nil {
+		return err
+	}
+	if validator, ok := properties.(Validator); ok {
+		return validator.Validate()
+	}
+	return nil
+}
+
+// Properties creates a Decoder for the type of the given properties
+// struct. The decoded properties are given to the resource as value, not
+// as pointer.
+func Properties(prototype interface{}) Decoder {
+	t := reflect.TypeOf(prototype)
+	return func(input map[string]interface{}) (interface{}, error) {
+		properties := reflect.New(t)
+		if err := Decode(input, properties.Interface()); err != nil {
+			return nil, err
+		}
+		return properties.Elem().Interface(), nil
+	}
+}
+
+// Handler creates the function to wrap with `cfn.LambdaWrap`. The handler
+// processes the event as follows:
+//
+// 1. Delete: if the physical resource id is a failure id, this is a NOP,
+//    otherwise the properties are decoded and the resource is deleted.
+// 2. Create: the properties are decoded and the resource is created. If the
+//    creation fails before a physical resource id is known, a failure id
+//    is generated so that the following delete is a NOP.
+// 3. Update: the new and the old properties are decoded. If the resource
+//    requires a replacement, it is created anew, otherwise it is updated.
+// 4. Any other request type is an error.
+//
+// When the context carries a continuation (see `LambdaWrap`), its state
+// is given to the resource in the request.
+func Handler(decoder Decoder, resource Resource) cfn.CustomResourceFunction {
+	return func(ctx context.Context, event cfn.Event) (string, map[string]interface{}, error) {
+		request := Request{Event: event}
+		if continuation := continuationFrom(ctx); continuation != nil {
+			request.State = continuation.State
+			request.Attempt = continuation.Attempt
+		}
+		switch event.RequestType {
+		case cfn.RequestDelete:
+			if common.IsFailurePhysicalResourceId(event.PhysicalResourceID) {
+				return event.PhysicalResourceID, nil, nil
+			}
+			properties, err := decoder(event.ResourceProperties)
+			if err != nil {
+				return event.PhysicalResourceID, nil, errors.Wrapf(err, "invalid properties for the resource %s", event.PhysicalResourceID)
+			}
+			request.Properties = properties
+			return event.PhysicalResourceID, nil, resource.Delete(ctx, request)
+		case cfn.RequestCreate:
+			properties, err := decoder(event.ResourceProperties)
+			if err != nil {
+				return common.FailurePhysicalResourceId(event), nil, errors.Wrap(err, "invalid properties")
+			}
+			request.Properties = properties
+			return create(ctx, resource, request)
+		case cfn.RequestUpdate:
+			properties, err := decoder(event.ResourceProperties)
+			if err != nil {
+				return event.PhysicalResourceID, nil, errors.Wrap(err, "invalid properties")
+			}
+			oldProperties, err := decoder(event.OldResourceProperties)
+			if err != nil {
+				return event.PhysicalResourceID, nil, errors.Wrap(err, "invalid old properties")
+			}
+			request.Properties = properties
+			request.OldProperties = oldProperties
+			if replacer, ok := resource.(Replacer); ok && replacer.RequiresReplacement(request) {
+				return create(ctx, resource, request)
+			}
+			id, data, err := resource.Update(ctx, request)
+			if id == "" {
+				id = event.PhysicalResourceID
+			}
+			return id, data, err
+		default:
+			return event.PhysicalResourceID, nil, errors.Errorf("unknown request type %s", event.RequestType)
+		}
+	}
+}
+
+func create(ctx context.Context, resource Resource, request Request) (string, map[string]interface{}, error) {
+	id, data, err := resource.Create(ctx, request)
+	if _, inProgress := errors.Cause(err).(*InProgressError); err != nil && !inProgress && id == "" {
+		id = common.FailurePhysicalResourceId(request.Event)
+	}
+	return id, data, err
+}
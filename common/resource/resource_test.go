@@ -0,0 +1,112 @@
+package resource
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/pkg/errors"
+)
+
+type testProperties struct {
+	Name, Value string
+}
+
+func (p *testProperties) Validate() error {
+	if p.Name == "" {
+		return errors.New("Name is required")
+	}
+	if p.Value == "" {
+		p.Value = "default"
+	}
+	return nil
+}
+
+type testResource struct {
+	calls []string
+	err   error
+}
+
+func (r *testResource) Create(ctx context.Context, request Request) (string, map[string]interface{}, error) {
+	r.calls = append(r.calls, "create")
+	if r.err != nil {
+		return "", nil, r.err
+	}
+	properties := request.Properties.(testProperties)
+	return properties.Name, map[string]interface{}{"Value": properties.Value}, nil
+}
+
+func (r *testResource) Update(ctx context.Context, request Request) (string, map[string]interface{}, error) {
+	r.calls = append(r.calls, "update")
+	return request.PhysicalResourceID, nil, r.err
+}
+
+func (r *testResource) Delete(ctx context.Context, request Request) error {
+	r.calls = append(r.calls, "delete")
+	return r.err
+}
+
+func (r *testResource) RequiresReplacement(request Request) bool {
+	return request.Changed("Name")
+}
+
+func TestHandler(t *testing.T) {
+	for i, test := range []struct {
+		event cfn.Event
+		err   error
+		calls []string
+		id    string
+		fails bool
+	}{
+		// test 0: create with defaults
+		{event: cfn.Event{RequestType: cfn.RequestCreate, ResourceProperties: map[string]interface{}{"Name": "a"}},
+			calls: []string{"create"}, id: "a"},
+		// test 1: invalid properties on create give a failure id
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Res", ResourceProperties: map[string]interface{}{}},
+			id: "failure-Res", fails: true},
+		// test 2: failed create gives a failure id
+		{event: cfn.Event{RequestType: cfn.RequestCreate, LogicalResourceID: "Res", ResourceProperties: map[string]interface{}{"Name": "a"}},
+			err: errors.New("boom"), calls: []string{"create"}, id: "failure-Res", fails: true},
+		// test 3: update in place
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: "a",
+			ResourceProperties:    map[string]interface{}{"Name": "a", "Value": "2"},
+			OldResourceProperties: map[string]interface{}{"Name": "a", "Value": "1"}},
+			calls: []string{"update"}, id: "a"},
+		// test 4: update with replacement
+		{event: cfn.Event{RequestType: cfn.RequestUpdate, PhysicalResourceID: "a",
+			ResourceProperties:    map[string]interface{}{"Name": "b"},
+			OldResourceProperties: map[string]interface{}{"Name": "a"}},
+			calls: []string{"create"}, id: "b"},
+		// test 5: delete
+		{event: cfn.Event{RequestType: cfn.RequestDelete, PhysicalResourceID: "a", ResourceProperties: map[string]interface{}{"Name": "a"}},
+			calls: []string{"delete"}, id: "a"},
+		// test 6: delete of a failure id is a NOP
+		{event: cfn.Event{RequestType: cfn.RequestDelete, PhysicalResourceID: "failure-Res", ResourceProperties: map[string]interface{}{}},
+			id: "failure-Res"},
+		// test 7: unknown request type
+		{event: cfn.Event{RequestType: "Unknown", PhysicalResourceID: "a"},
+			id: "a", fails: true},
+	} {
+		resource := &testResource{err: test.err}
+		id, _, err := Handler(Properties(testProperties{}), resource)(context.Background(), test.event)
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if id != test.id {
+			t.Errorf("test %d: expecting id %s got %s", i, test.id, id)
+		}
+		if len(resource.calls) != len(test.calls) || (len(test.calls) > 0 && resource.calls[0] != test.calls[0]) {
+			t.Errorf("test %d: expecting calls %v got %v", i, test.calls, resource.calls)
+		}
+	}
+}
+
+func TestProperties(t *testing.T) {
+	p, err := Properties(testProperties{})(map[string]interface{}{"Name": "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.(testProperties).Value != "default" {
+		t.Errorf("default not applied: %+v", p)
+	}
+}
@@ -0,0 +1,883 @@
+// # Sequences
+//
+// The sequences of the `seq` and `seqval` custom resources are stored in
+// one of two backends:
+//
+// 1. `ssm`, the default: the sequence is an SSM parameter whose value is
+//    the expression of the sequence. Drawing a value puts the parameter
+//    again and derives the value from the new version of the parameter.
+// 2. `dynamodb`: the sequence is an item of the sequence table with an
+//    atomic counter, incremented with a conditional update. Concurrent
+//    draws never get the same value and no value is skipped.
+//
+// In both cases, the SSM parameter is created: its name identifies the
+// sequence and its value is the expression. When the sequence table is
+// configured, a draw first tries the counter of the table and falls back
+// to the SSM parameter if the sequence has no item.
+//
+// The `dynamodb` backend also supports drawing blocks of consecutive values
+// and recycling: released values are kept in the set `Free` of the item
+// and drawn again, smallest first, before the counter is incremented.
+//
+// The format of the values of a sequence, if any, is the SSM parameter with
+// the same name under the prefix `/hyperdrive/sequence-format`.
+//
+// A sequence is migrated from `ssm` to `dynamodb` by changing its backend:
+// the counter starts from the last value drawn from the parameter. The
+// migration must not run while values are drawn from the sequence. It
+// can be reverted, e.g. by the rollback of the update, as long as no value
+// has been drawn from the counter.
+//
+// A deleted sequence leaves a tombstone, the SSM parameter with the same
+// name under the prefix `/hyperdrive/sequence-tombstone` whose value is the
+// counter of the sequence: a sequence created again with the same name
+// resumes from the counter and never gives the values again. The consumers
+// of a sequence, e.g. the `seqval` resources, register themselves as SSM
+// parameters under `/hyperdrive/sequence-consumer` and the name of the
+// sequence, to prevent the deletion of a sequence still in use.
+//
+// The counter of a sequence is the last value of `x` drawn: the version of
+// the parameter minus 1 plus the base of the sequence, or the attribute
+// `Counter` of the item. It can be bumped, i.e. values are skipped, or reset
+// by the administration tools. As the version of a parameter only grows,
+// the counter of an `ssm` sequence is reset, or resumed from a tombstone, by
+// changing its base: the SSM parameter with the same name under the prefix
+// `/hyperdrive/sequence-base`, 0 if missing.
+package sequences
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awsapi"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	awsssm "github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ParameterPrefix is the prefix of the names of the SSM parameters of
+	// the sequences.
+	ParameterPrefix = "/hyperdrive/sequence"
+	// FormatPrefix is the prefix of the names of the SSM parameters of the
+	// formats of the sequences.
+	FormatPrefix = "/hyperdrive/sequence-format"
+	// BasePrefix is the prefix of the names of the SSM parameters with the
+	// bases of the counters of the `ssm` sequences.
+	BasePrefix = "/hyperdrive/sequence-base"
+	// TombstonePrefix is the prefix of the names of the SSM parameters
+	// with the counters of the deleted sequences.
+	TombstonePrefix = "/hyperdrive/sequence-tombstone"
+	// ConsumerPrefix is the prefix of the paths of the SSM parameters of
+	// the consumers of the sequences.
+	ConsumerPrefix = "/hyperdrive/sequence-consumer"
+	// TableEnv is the environment variable with the name of the DynamoDB
+	// table of the sequences. The table has the hash key `Name` (string).
+	TableEnv = "HYPERDRIVE_SEQUENCE_TABLE"
+
+	BackendSSM      = "ssm"
+	BackendDynamoDB = "dynamodb"
+)
+
+// The attributes of the items of the sequence table.
+const (
+	nameAttribute       = "Name"
+	counterAttribute    = "Counter"
+	expressionAttribute = "Expression"
+	migratedAttribute   = "Migrated"
+	freeAttribute       = "Free"
+)
+
+// maxRecycleAttempts bounds the attempts to take a released value that
+// is concurrently taken by another draw.
+const maxRecycleAttempts = 5
+
+// A Store gives access to the sequences in both backends. The table is
+// optional as long as no sequence uses the `dynamodb` backend.
+type Store struct {
+	SSM      awsapi.SSM
+	DynamoDB awsapi.DynamoDB
+	Table    string
+}
+
+// A Sequence is the state of a sequence, e.g. to inspect it or to move it
+// to another account. The name is the name of the parameter.
+type Sequence struct {
+	Name, Expression string
+	Format           string `json:",omitempty"`
+	Backend          string
+	Counter          int64
+	Free             []int64 `json:",omitempty"`
+}
+
+// ParameterName gives the name of the SSM parameter of a sequence.
+func ParameterName(sequenceName string) string {
+	return ParameterPrefix + sequenceName
+}
+
+// Create creates the parameter of the sequence and, for the `dynamodb`
+// backend, its counter. A sequence deleted before resumes from its
+// tombstone.
+func (s Store) Create(parameterName, expression, backend string) error {
+	if err := s.checkBackend(backend); err != nil {
+		return err
+	}
+	if err := s.putParameter(parameterName, expression); err != nil {
+		return err
+	}
+	if backend == BackendDynamoDB {
+		if err := s.putCounter(parameterName, expression, 0, false); err != nil {
+			return err
+		}
+	}
+	return s.resume(parameterName)
+}
+
+// Update changes the expression and, if the backend changes, migrates the
+// sequence. The parameter is only put again if the expression changes: a
+// put skips a value of an `ssm` sequence.
+func (s Store) Update(parameterName, oldExpression, expression, oldBackend, backend string) error {
+	if err := s.checkBackend(backend); err != nil {
+		return err
+	}
+	switch {
+	case oldBackend != BackendDynamoDB && backend == BackendDynamoDB:
+		if err := s.migrate(parameterName, expression); err != nil {
+			return err
+		}
+	case oldBackend == BackendDynamoDB && backend != BackendDynamoDB:
+		if err := s.revert(parameterName); err != nil {
+			return err
+		}
+	case backend == BackendDynamoDB && expression != oldExpression:
+		if err := s.updateExpression(parameterName, expression); err != nil {
+			return err
+		}
+	}
+	if expression == oldExpression {
+		return nil
+	}
+	return s.putParameter(parameterName, expression)
+}
+
+// PutFormat sets the format of the values of the sequence; an empty
+// format removes it.
+func (s Store) PutFormat(parameterName, format string) error {
+	formatName := formatParameterName(parameterName)
+	if format == "" {
+		_, err := s.SSM.DeleteParameter(&awsssm.DeleteParameterInput{
+			Name: &formatName,
+		})
+		if err != nil && !isParameterNotFound(err) {
+			return errors.Wrapf(err, "could not delete the parameter %s", formatName)
+		}
+		return nil
+	}
+	return s.putParameter(formatName, format)
+}
+
+// Format gives the format of the values of the sequence, empty if none.
+func (s Store) Format(parameterName string) (string, error) {
+	formatName := formatParameterName(parameterName)
+	param, err := s.SSM.GetParameter(&awsssm.GetParameterInput{
+		Name: &formatName,
+	})
+	if isParameterNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to get the parameter %s", formatName)
+	}
+	return *param.Parameter.Value, nil
+}
+
+// Delete deletes the counter, if any, and the parameters of the sequence
+// and leaves its tombstone. It does not check the consumers. Deleting a
+// deleted sequence is a NOP.
+//
+// The tombstone only grows: a retry after a partial deletion, e.g. of the
+// counter but not of the parameter, must not lower it.
+func (s Store) Delete(parameterName string) error {
+	sequence, err := s.Describe(parameterName)
+	if isParameterNotFound(errors.Cause(err)) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	counter, found, err := s.tombstone(parameterName)
+	if err != nil {
+		return err
+	}
+	if !found || sequence.Counter > counter {
+		tombstone := siblingName(TombstonePrefix, parameterName)
+		if err := s.putParameter(tombstone, strconv.FormatInt(sequence.Counter, 10)); err != nil {
+			return err
+		}
+	}
+	if err := s.PutFormat(parameterName, ""); err != nil {
+		return err
+	}
+	if err := s.putBase(parameterName, 0); err != nil {
+		return err
+	}
+	if s.Table != "" {
+		_, err := s.DynamoDB.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName: &s.Table,
+			Key:       key(parameterName),
+		})
+		if err != nil {
+			return errors.Wrapf(err, "could not delete the counter of the sequence %s", parameterName)
+		}
+	}
+	_, err = s.SSM.DeleteParameter(&awsssm.DeleteParameterInput{
+		Name: &parameterName,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "could not delete the parameter %s", parameterName)
+	}
+	return nil
+}
+
+// Register records a consumer of the sequence under its id, e.g. the
+// physical id of a `seqval` resource. The description tells where the
+// consumer is defined.
+func (s Store) Register(parameterName, id, description string) error {
+	return s.putParameter(consumerParameterName(parameterName, id), description)
+}
+
+// Unregister removes a consumer of the sequence, if registered.
+func (s Store) Unregister(parameterName, id string) error {
+	consumer := consumerParameterName(parameterName, id)
+	_, err := s.SSM.DeleteParameter(&awsssm.DeleteParameterInput{
+		Name: &consumer,
+	})
+	if err != nil && !isParameterNotFound(err) {
+		return errors.Wrapf(err, "could not delete the parameter %s", consumer)
+	}
+	return nil
+}
+
+// Consumers gives the descriptions of the registered consumers of the
+// sequence.
+func (s Store) Consumers(parameterName string) ([]string, error) {
+	var consumers []string
+	input := &awsssm.GetParametersByPathInput{
+		Path: aws.String(siblingName(ConsumerPrefix, parameterName)),
+	}
+	for {
+		output, err := s.SSM.GetParametersByPath(input)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not list the consumers of the sequence %s", parameterName)
+		}
+		for _, param := range output.Parameters {
+			consumers = append(consumers, *param.Value)
+		}
+		if output.NextToken == nil {
+			return consumers, nil
+		}
+		input.NextToken = output.NextToken
+	}
+}
+
+// List gives the names of the parameters of all the sequences.
+func (s Store) List() ([]string, error) {
+	var names []string
+	input := &awsssm.GetParametersByPathInput{
+		Path:      aws.String(ParameterPrefix),
+		Recursive: aws.Bool(true),
+	}
+	for {
+		output, err := s.SSM.GetParametersByPath(input)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not list the parameters under %s", ParameterPrefix)
+		}
+		for _, param := range output.Parameters {
+			names = append(names, *param.Name)
+		}
+		if output.NextToken == nil {
+			return names, nil
+		}
+		input.NextToken = output.NextToken
+	}
+}
+
+// Describe gives the current state of the sequence.
+func (s Store) Describe(parameterName string) (Sequence, error) {
+	param, err := s.SSM.GetParameter(&awsssm.GetParameterInput{
+		Name: &parameterName,
+	})
+	if err != nil {
+		return Sequence{}, errors.Wrapf(err, "unable to get the parameter %s", parameterName)
+	}
+	format, err := s.Format(parameterName)
+	if err != nil {
+		return Sequence{}, err
+	}
+	sequence := Sequence{
+		Name:       parameterName,
+		Expression: *param.Parameter.Value,
+		Format:     format,
+		Backend:    BackendSSM,
+		Counter:    *param.Parameter.Version - 1,
+	}
+	item, err := s.item(parameterName)
+	if err != nil {
+		return Sequence{}, err
+	}
+	if item == nil {
+		base, err := s.base(parameterName)
+		if err != nil {
+			return Sequence{}, err
+		}
+		sequence.Counter += base
+		return sequence, nil
+	}
+	sequence.Backend = BackendDynamoDB
+	sequence.Expression = stringValue(item[expressionAttribute])
+	if sequence.Counter, err = numberValue(item[counterAttribute]); err != nil {
+		return Sequence{}, errors.Wrapf(err, "invalid counter of the sequence %s", parameterName)
+	}
+	for _, n := range item[freeAttribute].NS {
+		x, err := strconv.ParseInt(n, 10, 64)
+		if err != nil {
+			return Sequence{}, errors.Wrapf(err, "invalid released values of the sequence %s", parameterName)
+		}
+		sequence.Free = append(sequence.Free, x)
+	}
+	sort.Slice(sequence.Free, func(i, j int) bool { return sequence.Free[i] < sequence.Free[j] })
+	return sequence, nil
+}
+
+// Bump skips count values of the sequence and gives the new counter. Like
+// a draw, it is safe while values are drawn concurrently.
+func (s Store) Bump(parameterName string, count int64) (int64, error) {
+	if count < 1 {
+		return 0, errors.Errorf("invalid number of values to skip %d", count)
+	}
+	if s.Table != "" {
+		counter, _, err := s.drawCounter(parameterName, count)
+		if err == nil || !isConditionalCheckFailed(err) {
+			return counter, err
+		}
+	}
+	var counter int64
+	for i := int64(0); i < count; i++ {
+		var err error
+		if counter, _, err = s.drawParameter(parameterName); err != nil {
+			return 0, err
+		}
+	}
+	return counter, nil
+}
+
+// SetCounter sets the counter of the sequence: the next value drawn is
+// `x = counter + 1`. The released values greater than the counter are
+// dropped as the counter gives them again. The counter of an `ssm`
+// sequence is set with its base, the parameter is not put. Values must not
+// be drawn while the counter is set.
+func (s Store) SetCounter(parameterName string, counter int64) error {
+	if counter < 0 {
+		return errors.Errorf("invalid counter %d", counter)
+	}
+	sequence, err := s.Describe(parameterName)
+	if err != nil {
+		return err
+	}
+	if sequence.Backend == BackendDynamoDB {
+		return s.setItemCounter(sequence, counter)
+	}
+	base, err := s.base(parameterName)
+	if err != nil {
+		return err
+	}
+	return s.putBase(parameterName, base+counter-sequence.Counter)
+}
+
+// Restore creates a sequence, e.g. exported from another account, with
+// its counter and released values. The sequence must not exist.
+func (s Store) Restore(sequence Sequence) error {
+	_, err := s.SSM.GetParameter(&awsssm.GetParameterInput{
+		Name: &sequence.Name,
+	})
+	if err == nil {
+		return errors.Errorf("the sequence %s already exists", sequence.Name)
+	}
+	if !isParameterNotFound(err) {
+		return errors.Wrapf(err, "unable to get the parameter %s", sequence.Name)
+	}
+	if err := s.Create(sequence.Name, sequence.Expression, sequence.Backend); err != nil {
+		return err
+	}
+	if err := s.PutFormat(sequence.Name, sequence.Format); err != nil {
+		return err
+	}
+	// the counter of a tombstone may be greater.
+	created, err := s.Describe(sequence.Name)
+	if err != nil {
+		return err
+	}
+	if sequence.Counter > created.Counter {
+		if err := s.SetCounter(sequence.Name, sequence.Counter); err != nil {
+			return err
+		}
+	}
+	return s.Release(sequence.Name, sequence.Free)
+}
+
+// resume moves the counter of a new sequence to the counter of its
+// tombstone, if any, and removes the tombstone.
+func (s Store) resume(parameterName string) error {
+	counter, found, err := s.tombstone(parameterName)
+	if err != nil || !found {
+		return err
+	}
+	sequence, err := s.Describe(parameterName)
+	if err != nil {
+		return err
+	}
+	if counter > sequence.Counter {
+		if err := s.SetCounter(parameterName, counter); err != nil {
+			return errors.Wrapf(err, "could not resume the sequence %s from its tombstone", parameterName)
+		}
+	}
+	tombstone := siblingName(TombstonePrefix, parameterName)
+	_, err = s.SSM.DeleteParameter(&awsssm.DeleteParameterInput{
+		Name: &tombstone,
+	})
+	if err != nil && !isParameterNotFound(err) {
+		return errors.Wrapf(err, "could not delete the parameter %s", tombstone)
+	}
+	return nil
+}
+
+// tombstone gives the counter of the tombstone of the sequence, if any.
+func (s Store) tombstone(parameterName string) (int64, bool, error) {
+	tombstone := siblingName(TombstonePrefix, parameterName)
+	param, err := s.SSM.GetParameter(&awsssm.GetParameterInput{
+		Name: &tombstone,
+	})
+	if isParameterNotFound(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "unable to get the parameter %s", tombstone)
+	}
+	counter, err := strconv.ParseInt(*param.Parameter.Value, 10, 64)
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "invalid tombstone of the sequence %s", parameterName)
+	}
+	return counter, true, nil
+}
+
+// Draw draws the next value of the sequence. It gives the value of the
+// variable `x`, starting with 1, and the expression of the sequence.
+func (s Store) Draw(parameterName string) (int64, string, error) {
+	if s.Table != "" {
+		x, expression, err := s.drawCounter(parameterName, 1)
+		if err == nil || !isConditionalCheckFailed(err) {
+			return x, expression, err
+		}
+	}
+	return s.drawParameter(parameterName)
+}
+
+// Reserve draws a block of count consecutive values of `x` from the
+// counter of a `dynamodb` sequence. It gives the first value of the block.
+func (s Store) Reserve(parameterName string, count int64) (int64, string, error) {
+	if count == 1 {
+		return s.Draw(parameterName)
+	}
+	if s.Table == "" {
+		return 0, "", errors.Errorf("the sequence %s must use the dynamodb backend to reserve values", parameterName)
+	}
+	last, expression, err := s.drawCounter(parameterName, count)
+	if isConditionalCheckFailed(err) {
+		return 0, "", errors.Errorf("the sequence %s must use the dynamodb backend to reserve values", parameterName)
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	return last - count + 1, expression, nil
+}
+
+// Recycled takes the smallest released value of `x` of a `dynamodb`
+// sequence, if any.
+func (s Store) Recycled(parameterName string) (int64, string, bool, error) {
+	for attempt := 0; attempt < maxRecycleAttempts; attempt++ {
+		item, err := s.item(parameterName)
+		if err != nil {
+			return 0, "", false, err
+		}
+		if item == nil {
+			return 0, "", false, errors.Errorf("the sequence %s must use the dynamodb backend to recycle values", parameterName)
+		}
+		free := item[freeAttribute].NS
+		if len(free) == 0 {
+			return 0, "", false, nil
+		}
+		x, err := smallest(free)
+		if err != nil {
+			return 0, "", false, errors.Wrapf(err, "invalid released values of the sequence %s", parameterName)
+		}
+		value := strconv.FormatInt(x, 10)
+		_, err = s.DynamoDB.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName:                &s.Table,
+			Key:                      key(parameterName),
+			UpdateExpression:         aws.String("DELETE #f :x"),
+			ConditionExpression:      aws.String("contains(#f, :v)"),
+			ExpressionAttributeNames: map[string]string{"#f": freeAttribute},
+			ExpressionAttributeValues: map[string]dynamodb.AttributeValue{
+				":x": {NS: []string{value}},
+				":v": {N: &value},
+			},
+		})
+		if isConditionalCheckFailed(err) {
+			// taken by a concurrent draw.
+			continue
+		}
+		if err != nil {
+			return 0, "", false, errors.Wrapf(err, "unable to take a released value of the sequence %s", parameterName)
+		}
+		return x, stringValue(item[expressionAttribute]), true, nil
+	}
+	return 0, "", false, nil
+}
+
+// Release gives the values of `x` back to a `dynamodb` sequence to be
+// drawn again. Releasing values of a deleted sequence is a NOP.
+func (s Store) Release(parameterName string, xs []int64) error {
+	if len(xs) == 0 {
+		return nil
+	}
+	if s.Table == "" {
+		return errors.Errorf("the sequence %s must use the dynamodb backend to release values", parameterName)
+	}
+	values := make([]string, len(xs))
+	for i, x := range xs {
+		values[i] = strconv.FormatInt(x, 10)
+	}
+	_, err := s.DynamoDB.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                &s.Table,
+		Key:                      key(parameterName),
+		UpdateExpression:         aws.String("ADD #f :xs"),
+		ConditionExpression:      aws.String("attribute_exists(#n)"),
+		ExpressionAttributeNames: map[string]string{"#n": nameAttribute, "#f": freeAttribute},
+		ExpressionAttributeValues: map[string]dynamodb.AttributeValue{
+			":xs": {NS: values},
+		},
+	})
+	if err != nil && !isConditionalCheckFailed(err) {
+		return errors.Wrapf(err, "could not release the values of the sequence %s", parameterName)
+	}
+	return nil
+}
+
+func (s Store) drawCounter(parameterName string, count int64) (int64, string, error) {
+	output, err := s.DynamoDB.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                &s.Table,
+		Key:                      key(parameterName),
+		UpdateExpression:         aws.String("ADD #c :count"),
+		ConditionExpression:      aws.String("attribute_exists(#n)"),
+		ExpressionAttributeNames: map[string]string{"#n": nameAttribute, "#c": counterAttribute},
+		ExpressionAttributeValues: map[string]dynamodb.AttributeValue{
+			":count": number(count),
+		},
+		ReturnValues: dynamodb.ReturnValueAllNew,
+	})
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return 0, "", err
+		}
+		return 0, "", errors.Wrapf(err, "unable to increment the counter of the sequence %s", parameterName)
+	}
+	x, err := numberValue(output.Attributes[counterAttribute])
+	if err != nil {
+		return 0, "", errors.Wrapf(err, "invalid counter of the sequence %s", parameterName)
+	}
+	return x, stringValue(output.Attributes[expressionAttribute]), nil
+}
+
+func (s Store) drawParameter(parameterName string) (int64, string, error) {
+	overwrite := true
+	param, err := s.SSM.GetParameter(&awsssm.GetParameterInput{
+		Name: &parameterName,
+	})
+	if err != nil {
+		return 0, "", errors.Wrapf(err, "unable to get the parameter %s", parameterName)
+	}
+	expression := *param.Parameter.Value
+	next, err := s.SSM.PutParameter(&awsssm.PutParameterInput{
+		Name:      &parameterName,
+		Value:     &expression,
+		Type:      awsssm.ParameterTypeString,
+		Overwrite: &overwrite,
+	})
+	if err != nil {
+		return 0, "", errors.Wrapf(err, "unable to put the parameter %s", parameterName)
+	}
+	// The initial version is 1 (when the sequence is created, it means that the first real value will be 2. As we
+	// want to start with 1, we decrement the value obtain from incrementing the parameter.
+	base, err := s.base(parameterName)
+	if err != nil {
+		return 0, "", err
+	}
+	return base + *next.Version - 1, expression, nil
+}
+
+// The counter starts from the last value drawn from the parameter. It is
+// recorded to allow the migration to be reverted.
+func (s Store) migrate(parameterName, expression string) error {
+	param, err := s.SSM.GetParameter(&awsssm.GetParameterInput{
+		Name: &parameterName,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "unable to get the parameter %s", parameterName)
+	}
+	base, err := s.base(parameterName)
+	if err != nil {
+		return err
+	}
+	err = s.putCounter(parameterName, expression, base+*param.Parameter.Version-1, true)
+	if isConditionalCheckFailed(errors.Cause(err)) {
+		// already migrated, e.g. by a previous attempt.
+		return s.updateExpression(parameterName, expression)
+	}
+	return err
+}
+
+// A migration can only be reverted if no value has been drawn from the
+// counter: the parameter would give the same values again.
+func (s Store) revert(parameterName string) error {
+	item, err := s.item(parameterName)
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		return nil
+	}
+	migrated, ok := item[migratedAttribute]
+	if !ok || stringValue(item[counterAttribute]) != aws.StringValue(migrated.N) {
+		return errors.Errorf("values have been drawn from the counter of the sequence %s, it cannot use the ssm backend anymore", parameterName)
+	}
+	_, err = s.DynamoDB.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:                 &s.Table,
+		Key:                       key(parameterName),
+		ConditionExpression:       aws.String("#c = :migrated"),
+		ExpressionAttributeNames:  map[string]string{"#c": counterAttribute},
+		ExpressionAttributeValues: map[string]dynamodb.AttributeValue{":migrated": migrated},
+	})
+	if isConditionalCheckFailed(err) {
+		return errors.Errorf("values have been drawn from the counter of the sequence %s, it cannot use the ssm backend anymore", parameterName)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "could not delete the counter of the sequence %s", parameterName)
+	}
+	return nil
+}
+
+// base gives the base of the counter of an `ssm` sequence.
+func (s Store) base(parameterName string) (int64, error) {
+	baseName := siblingName(BasePrefix, parameterName)
+	param, err := s.SSM.GetParameter(&awsssm.GetParameterInput{
+		Name: &baseName,
+	})
+	if isParameterNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to get the parameter %s", baseName)
+	}
+	base, err := strconv.ParseInt(*param.Parameter.Value, 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid base of the sequence %s", parameterName)
+	}
+	return base, nil
+}
+
+// putBase sets the base of the counter of an `ssm` sequence; the base 0
+// is the missing parameter.
+func (s Store) putBase(parameterName string, base int64) error {
+	baseName := siblingName(BasePrefix, parameterName)
+	if base != 0 {
+		return s.putParameter(baseName, strconv.FormatInt(base, 10))
+	}
+	_, err := s.SSM.DeleteParameter(&awsssm.DeleteParameterInput{
+		Name: &baseName,
+	})
+	if err != nil && !isParameterNotFound(err) {
+		return errors.Wrapf(err, "could not delete the parameter %s", baseName)
+	}
+	return nil
+}
+
+func (s Store) item(parameterName string) (map[string]dynamodb.AttributeValue, error) {
+	if s.Table == "" {
+		return nil, nil
+	}
+	consistent := true
+	output, err := s.DynamoDB.GetItem(&dynamodb.GetItemInput{
+		TableName:      &s.Table,
+		Key:            key(parameterName),
+		ConsistentRead: &consistent,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to get the counter of the sequence %s", parameterName)
+	}
+	return output.Item, nil
+}
+
+func (s Store) putCounter(parameterName, expression string, counter int64, migrated bool) error {
+	item := key(parameterName)
+	item[counterAttribute] = number(counter)
+	item[expressionAttribute] = dynamodb.AttributeValue{S: &expression}
+	if migrated {
+		item[migratedAttribute] = number(counter)
+	}
+	_, err := s.DynamoDB.PutItem(&dynamodb.PutItemInput{
+		TableName:                &s.Table,
+		Item:                     item,
+		ConditionExpression:      aws.String("attribute_not_exists(#n)"),
+		ExpressionAttributeNames: map[string]string{"#n": nameAttribute},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "could not create the counter of the sequence %s", parameterName)
+	}
+	return nil
+}
+
+func (s Store) updateExpression(parameterName, expression string) error {
+	_, err := s.DynamoDB.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                &s.Table,
+		Key:                      key(parameterName),
+		UpdateExpression:         aws.String("SET #e = :e"),
+		ConditionExpression:      aws.String("attribute_exists(#n)"),
+		ExpressionAttributeNames: map[string]string{"#n": nameAttribute, "#e": expressionAttribute},
+		ExpressionAttributeValues: map[string]dynamodb.AttributeValue{
+			":e": {S: &expression},
+		},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "could not update the counter of the sequence %s", parameterName)
+	}
+	return nil
+}
+
+func (s Store) setItemCounter(sequence Sequence, counter int64) error {
+	update := "SET #c = :c"
+	names := map[string]string{"#n": nameAttribute, "#c": counterAttribute}
+	values := map[string]dynamodb.AttributeValue{":c": number(counter)}
+	var stale []string
+	for _, x := range sequence.Free {
+		if x > counter {
+			stale = append(stale, strconv.FormatInt(x, 10))
+		}
+	}
+	if len(stale) > 0 {
+		update += " DELETE #f :stale"
+		names["#f"] = freeAttribute
+		values[":stale"] = dynamodb.AttributeValue{NS: stale}
+	}
+	_, err := s.DynamoDB.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 &s.Table,
+		Key:                       key(sequence.Name),
+		UpdateExpression:          &update,
+		ConditionExpression:       aws.String("attribute_exists(#n)"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "could not set the counter of the sequence %s", sequence.Name)
+	}
+	return nil
+}
+
+func (s Store) putParameter(parameterName, expression string) error {
+	overwrite := true
+	_, err := s.SSM.PutParameter(&awsssm.PutParameterInput{
+		Name:      &parameterName,
+		Type:      awsssm.ParameterTypeString,
+		Value:     &expression,
+		Overwrite: &overwrite,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "could not put the parameter %s", parameterName)
+	}
+	return nil
+}
+
+func (s Store) checkBackend(backend string) error {
+	if backend == BackendDynamoDB && s.Table == "" {
+		return errors.Errorf("the table of the sequences is not configured (%s)", TableEnv)
+	}
+	return nil
+}
+
+func formatParameterName(parameterName string) string {
+	return siblingName(FormatPrefix, parameterName)
+}
+
+// siblingName gives the name of a parameter with the same name as the
+// parameter of the sequence under another prefix.
+func siblingName(prefix, parameterName string) string {
+	return prefix + strings.TrimPrefix(parameterName, ParameterPrefix)
+}
+
+// The ids of the consumers are hashed to be valid parameter names.
+func consumerParameterName(parameterName, id string) string {
+	hash := sha1.Sum([]byte(id))
+	return siblingName(ConsumerPrefix, parameterName) + "/" + hex.EncodeToString(hash[:])
+}
+
+func key(parameterName string) map[string]dynamodb.AttributeValue {
+	name := parameterName
+	return map[string]dynamodb.AttributeValue{nameAttribute: {S: &name}}
+}
+
+func number(n int64) dynamodb.AttributeValue {
+	s := strconv.FormatInt(n, 10)
+	return dynamodb.AttributeValue{N: &s}
+}
+
+func numberValue(value dynamodb.AttributeValue) (int64, error) {
+	if value.N == nil {
+		return 0, errors.New("not a number")
+	}
+	return strconv.ParseInt(*value.N, 10, 64)
+}
+
+func smallest(numbers []string) (int64, error) {
+	var min int64
+	for i, n := range numbers {
+		x, err := strconv.ParseInt(n, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		if i == 0 || x < min {
+			min = x
+		}
+	}
+	return min, nil
+}
+
+func stringValue(value dynamodb.AttributeValue) string {
+	if value.S != nil {
+		return *value.S
+	}
+	return aws.StringValue(value.N)
+}
+
+func isParameterNotFound(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == awsssm.ErrCodeParameterNotFound
+}
+
+func isConditionalCheckFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
@@ -0,0 +1,402 @@
+package sequences
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awstest"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsdynamodb "github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/pkg/errors"
+)
+
+const (
+	table     = "sequences"
+	parameter = "/hyperdrive/sequence/a"
+)
+
+func newStore() (Store, *awstest.SSM, *awstest.DynamoDB) {
+	ssm := awstest.NewSSM()
+	dynamodb := awstest.NewDynamoDB()
+	dynamodb.CreateTable(table, "Name")
+	return Store{SSM: ssm, DynamoDB: dynamodb, Table: table}, ssm, dynamodb
+}
+
+func draw(t *testing.T, store Store, n int) []int64 {
+	var xs []int64
+	for i := 0; i < n; i++ {
+		x, _, err := store.Draw(parameter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		xs = append(xs, x)
+	}
+	return xs
+}
+
+func TestStoreDraw(t *testing.T) {
+	for i, test := range []struct {
+		backend  string
+		table    string
+		failures awstest.Failures
+		fails    bool
+		xs       []int64
+	}{
+		// test 0: the ssm backend
+		{backend: BackendSSM, table: table, xs: []int64{1, 2, 3}},
+		// test 1: the ssm backend without table
+		{backend: BackendSSM, xs: []int64{1, 2, 3}},
+		// test 2: the dynamodb backend
+		{backend: BackendDynamoDB, table: table, xs: []int64{1, 2, 3}},
+		// test 3: the dynamodb backend requires the table
+		{backend: BackendDynamoDB, fails: true},
+		// test 4: the failure of the counter is not hidden by the parameter
+		{backend: BackendDynamoDB, table: table, failures: awstest.Failures{"UpdateItem": errors.New("boom")}, fails: true},
+	} {
+		store, ssm, dynamodb := newStore()
+		store.Table = test.table
+		err := store.Create(parameter, "10*x", test.backend)
+		if err == nil {
+			ssm.Failures, dynamodb.Failures = test.failures, test.failures
+			var x int64
+			for _, expected := range test.xs {
+				var expression string
+				if x, expression, err = store.Draw(parameter); err != nil {
+					break
+				}
+				if x != expected || expression != "10*x" {
+					t.Errorf("test %d: expecting %d, 10*x got %d, %s", i, expected, x, expression)
+				}
+			}
+			if len(test.xs) == 0 {
+				_, _, err = store.Draw(parameter)
+			}
+		}
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+	}
+}
+
+func TestStoreConcurrentDraws(t *testing.T) {
+	store, _, _ := newStore()
+	if err := store.Create(parameter, "x", BackendDynamoDB); err != nil {
+		t.Fatal(err)
+	}
+	const workers, draws = 8, 25
+	var mutex sync.Mutex
+	var xs []int
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := 0; d < draws; d++ {
+				x, _, err := store.Draw(parameter)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mutex.Lock()
+				xs = append(xs, int(x))
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	sort.Ints(xs)
+	for i, x := range xs {
+		if x != i+1 {
+			t.Fatalf("expecting the values 1..%d without gap or collision got %v", workers*draws, xs)
+		}
+	}
+}
+
+func TestStoreMigration(t *testing.T) {
+	store, ssm, dynamodb := newStore()
+	if err := store.Create(parameter, "x", BackendSSM); err != nil {
+		t.Fatal(err)
+	}
+	draw(t, store, 3)
+	// 1. the counter continues from the last value drawn from the parameter.
+	if err := store.Update(parameter, "x", "x", BackendSSM, BackendDynamoDB); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Update(parameter, "x", "x", BackendSSM, BackendDynamoDB); err != nil {
+		t.Errorf("the migration must be idempotent: %v", err)
+	}
+	// 2. the migration can be reverted as long as no value is drawn.
+	if err := store.Update(parameter, "x", "x", BackendDynamoDB, BackendSSM); err != nil {
+		t.Fatal(err)
+	}
+	if item := dynamodb.Item(table, parameter); item != nil {
+		t.Errorf("the counter must be deleted by the revert, got %v", item)
+	}
+	if err := store.Update(parameter, "x", "2*x", BackendSSM, BackendDynamoDB); err != nil {
+		t.Fatal(err)
+	}
+	puts := ssm.Called("PutParameter")
+	if xs := draw(t, store, 2); xs[0] != 4 || xs[1] != 5 {
+		t.Errorf("expecting the values 4, 5 after the migration got %v", xs)
+	}
+	if ssm.Called("PutParameter") != puts {
+		t.Errorf("the parameter must not be put by the draws of a migrated sequence")
+	}
+	if _, expression, _ := store.Draw(parameter); expression != "2*x" {
+		t.Errorf("expecting the expression 2*x got %s", expression)
+	}
+	// 3. once values are drawn, the migration cannot be reverted anymore.
+	if err := store.Update(parameter, "2*x", "2*x", BackendDynamoDB, BackendSSM); err == nil {
+		t.Errorf("the migration must not be reverted once values are drawn")
+	}
+	// 4. deleting the sequence deletes the counter and the parameter.
+	if err := store.Delete(parameter); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ssm.Parameters[parameter]; ok || dynamodb.Item(table, parameter) != nil {
+		t.Errorf("the sequence must be deleted")
+	}
+}
+
+func TestStoreRecycling(t *testing.T) {
+	store, _, _ := newStore()
+	if err := store.Create(parameter, "x", BackendDynamoDB); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Reserve(parameter, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Release(parameter, []int64{7, 3, 5}); err != nil {
+		t.Fatal(err)
+	}
+	// concurrent draws take each released value once.
+	var mutex sync.Mutex
+	var xs []int
+	var wg sync.WaitGroup
+	for w := 0; w < 6; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			x, _, ok, err := store.Recycled(parameter)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ok {
+				mutex.Lock()
+				xs = append(xs, int(x))
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	sort.Ints(xs)
+	if !reflect.DeepEqual(xs, []int{3, 5, 7}) {
+		t.Errorf("expecting the released values 3, 5, 7 got %v", xs)
+	}
+	if first, _, err := store.Reserve(parameter, 2); err != nil || first != 11 {
+		t.Errorf("expecting the block 11-12 got %d, %v", first, err)
+	}
+	ssmStore, _, _ := newStore()
+	ssmStore.Create(parameter, "x", BackendSSM)
+	if _, _, _, err := ssmStore.Recycled(parameter); err == nil {
+		t.Errorf("recycling requires the dynamodb backend")
+	}
+	if _, _, err := ssmStore.Reserve(parameter, 2); err == nil {
+		t.Errorf("reserving several values requires the dynamodb backend")
+	}
+}
+
+func TestStoreAdministration(t *testing.T) {
+	for i, test := range []struct {
+		backend  string
+		free     []int64
+		bump     int64
+		counter  int64
+		expected Sequence
+	}{
+		// test 0: bump and reset of an ssm sequence
+		{backend: BackendSSM, bump: 5, counter: 2,
+			expected: Sequence{Name: parameter, Expression: "x", Format: "a-%d", Backend: BackendSSM, Counter: 2}},
+		// test 1: bump and reset of a dynamodb sequence
+		{backend: BackendDynamoDB, bump: 5, counter: 2,
+			expected: Sequence{Name: parameter, Expression: "x", Format: "a-%d", Backend: BackendDynamoDB, Counter: 2}},
+		// test 2: the released values above the counter are dropped
+		{backend: BackendDynamoDB, free: []int64{3, 1}, bump: 3, counter: 2,
+			expected: Sequence{Name: parameter, Expression: "x", Format: "a-%d", Backend: BackendDynamoDB, Counter: 2, Free: []int64{1}}},
+		// test 3: the counter can be moved forward
+		{backend: BackendSSM, bump: 1, counter: 4,
+			expected: Sequence{Name: parameter, Expression: "x", Format: "a-%d", Backend: BackendSSM, Counter: 4}},
+		// test 4: a large counter of an ssm sequence
+		{backend: BackendSSM, bump: 1, counter: 1000000000,
+			expected: Sequence{Name: parameter, Expression: "x", Format: "a-%d", Backend: BackendSSM, Counter: 1000000000}},
+	} {
+		store, ssm, _ := newStore()
+		if err := store.Create(parameter, "x", test.backend); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.PutFormat(parameter, "a-%d"); err != nil {
+			t.Fatal(err)
+		}
+		if counter, err := store.Bump(parameter, test.bump); err != nil || counter != test.bump {
+			t.Errorf("test %d: expecting the counter %d got %d, %v", i, test.bump, counter, err)
+		}
+		if err := store.Release(parameter, test.free); err != nil {
+			t.Fatal(err)
+		}
+		puts := ssm.Called("PutParameter")
+		if err := store.SetCounter(parameter, test.counter); err != nil {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if ssm.Called("PutParameter")-puts > 1 {
+			t.Errorf("test %d: the counter must be set without putting the parameter for each value", i)
+		}
+		sequence, err := store.Describe(parameter)
+		if err != nil || !reflect.DeepEqual(sequence, test.expected) {
+			t.Errorf("test %d: expecting %+v got %+v, %v", i, test.expected, sequence, err)
+		}
+		if x, _, err := store.Draw(parameter); err != nil || x != test.counter+1 {
+			t.Errorf("test %d: expecting the next value %d got %d, %v", i, test.counter+1, x, err)
+		}
+	}
+}
+
+func TestStoreListAndRestore(t *testing.T) {
+	store, _, _ := newStore()
+	sequences := []Sequence{
+		{Name: "/hyperdrive/sequence/a", Expression: "x", Backend: BackendSSM, Counter: 3},
+		{Name: "/hyperdrive/sequence/b/c", Expression: "10*x", Format: "b-%d", Backend: BackendDynamoDB, Counter: 7, Free: []int64{2, 5}},
+	}
+	for _, sequence := range sequences {
+		if err := store.Restore(sequence); err != nil {
+			t.Fatal(err)
+		}
+	}
+	names, err := store.List()
+	if err != nil || !reflect.DeepEqual(names, []string{"/hyperdrive/sequence/a", "/hyperdrive/sequence/b/c"}) {
+		t.Errorf("unexpected sequences %v, %v", names, err)
+	}
+	for i, name := range names {
+		sequence, err := store.Describe(name)
+		if err != nil || !reflect.DeepEqual(sequence, sequences[i]) {
+			t.Errorf("expecting %+v got %+v, %v", sequences[i], sequence, err)
+		}
+	}
+	for _, sequence := range sequences {
+		if err := store.Restore(sequence); err == nil {
+			t.Errorf("the existing sequence %s must not be restored", sequence.Name)
+		}
+	}
+}
+
+func TestStoreTombstone(t *testing.T) {
+	for i, backend := range []string{BackendSSM, BackendDynamoDB} {
+		store, ssm, _ := newStore()
+		if err := store.Create(parameter, "x", backend); err != nil {
+			t.Fatal(err)
+		}
+		draw(t, store, 3)
+		if err := store.Delete(parameter); err != nil {
+			t.Fatal(err)
+		}
+		if tombstone, ok := ssm.Parameters["/hyperdrive/sequence-tombstone/a"]; !ok || *tombstone.Value != "3" {
+			t.Errorf("test %d: expecting the tombstone 3", i)
+		}
+		// the sequence created again resumes from the tombstone.
+		if err := store.Create(parameter, "x", backend); err != nil {
+			t.Fatal(err)
+		}
+		if xs := draw(t, store, 2); !reflect.DeepEqual(xs, []int64{4, 5}) {
+			t.Errorf("test %d: expecting the values 4, 5 got %v", i, xs)
+		}
+		if _, ok := ssm.Parameters["/hyperdrive/sequence-tombstone/a"]; ok {
+			t.Errorf("test %d: the tombstone must be removed", i)
+		}
+	}
+}
+
+func TestStoreBase(t *testing.T) {
+	store, ssm, _ := newStore()
+	ssm.PutString("/hyperdrive/sequence-tombstone/a", "1000000000")
+	if err := store.Create(parameter, "x", BackendSSM); err != nil {
+		t.Fatal(err)
+	}
+	// the sequence resumes from a large tombstone with its base.
+	if puts := ssm.Called("PutParameter"); puts > 2 {
+		t.Errorf("expecting the parameter and the base to be put once got %d puts", puts)
+	}
+	if base, ok := ssm.Parameters["/hyperdrive/sequence-base/a"]; !ok || *base.Value != "1000000000" {
+		t.Errorf("expecting the base 1000000000")
+	}
+	if xs := draw(t, store, 2); !reflect.DeepEqual(xs, []int64{1000000001, 1000000002}) {
+		t.Errorf("expecting the values 1000000001, 1000000002 got %v", xs)
+	}
+	// the migration starts from the counter with its base.
+	if err := store.Update(parameter, "x", "x", BackendSSM, BackendDynamoDB); err != nil {
+		t.Fatal(err)
+	}
+	if xs := draw(t, store, 1); xs[0] != 1000000003 {
+		t.Errorf("expecting the value 1000000003 after the migration got %v", xs)
+	}
+	if err := store.Delete(parameter); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ssm.Parameters["/hyperdrive/sequence-base/a"]; ok {
+		t.Errorf("the base must be deleted with the sequence")
+	}
+}
+
+func TestStoreDeleteRetry(t *testing.T) {
+	store, ssm, dynamodb := newStore()
+	if err := store.Create(parameter, "x", BackendDynamoDB); err != nil {
+		t.Fatal(err)
+	}
+	draw(t, store, 3)
+	ssm.Failures = awstest.Failures{"DeleteParameter": errors.New("failure")}
+	if err := store.Delete(parameter); err == nil {
+		t.Fatal("expecting the failure of the deletion")
+	}
+	// the counter is deleted but not the parameter, which gives a smaller
+	// counter: the tombstone must not be lowered by the retry.
+	ssm.Failures = nil
+	dynamodb.DeleteItem(&awsdynamodb.DeleteItemInput{TableName: aws.String(table), Key: key(parameter)})
+	if err := store.Delete(parameter); err != nil {
+		t.Fatal(err)
+	}
+	if tombstone, ok := ssm.Parameters["/hyperdrive/sequence-tombstone/a"]; !ok || *tombstone.Value != "3" {
+		t.Errorf("expecting the tombstone 3")
+	}
+	if err := store.Delete(parameter); err != nil {
+		t.Errorf("deleting a deleted sequence must be a NOP, got %v", err)
+	}
+}
+
+func TestStoreConsumers(t *testing.T) {
+	store, _, _ := newStore()
+	if err := store.Create(parameter, "x", BackendSSM); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"/hyperdrive/sequence/a:1=1", "/hyperdrive/sequence/a:2=2", "/hyperdrive/sequence/a:1=1"} {
+		if err := store.Register(parameter, id, "consumer "+id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Register("/hyperdrive/sequence/a/b", "/hyperdrive/sequence/a/b:1=1", "nested"); err != nil {
+		t.Fatal(err)
+	}
+	consumers, err := store.Consumers(parameter)
+	sort.Strings(consumers)
+	if err != nil || !reflect.DeepEqual(consumers, []string{"consumer /hyperdrive/sequence/a:1=1", "consumer /hyperdrive/sequence/a:2=2"}) {
+		t.Errorf("unexpected consumers %v, %v", consumers, err)
+	}
+	for _, id := range []string{"/hyperdrive/sequence/a:1=1", "/hyperdrive/sequence/a:2=2", "/hyperdrive/sequence/a:3=3"} {
+		if err := store.Unregister(parameter, id); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	if consumers, err := store.Consumers(parameter); err != nil || len(consumers) != 0 {
+		t.Errorf("expecting no consumer got %v, %v", consumers, err)
+	}
+}
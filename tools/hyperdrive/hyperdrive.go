@@ -0,0 +1,59 @@
+// # Hyperdrive
+//
+// `hyperdrive` is the command line companion of the hyperdrive lambdas.
+// It groups several commands under a single binary:
+//
+// ```
+// hyperdrive <command> [flags] [arguments]
+// ```
+//
+// ## Commands
+//
+// * `simulate`: runs a custom resource lambda locally against the
+//   sequence of cloudformation events of a stack lifecycle.
+// * `sequence`: inspects and administers the sequences of the `seq` and
+//   `seqval` custom resources.
+//
+// Every command prints its own usage with the `-h` flag.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+type command struct {
+	name, description string
+	run               func(args []string) error
+}
+
+var commands = []command{
+	{"simulate", "run a custom resource lambda against simulated cloudformation events", simulate},
+	{"sequence", "inspect and administer the sequences", sequenceCommand},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	for _, c := range commands {
+		if c.name == os.Args[1] {
+			if err := c.run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "hyperdrive %s: %v\n", c.name, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: hyperdrive <command> [flags] [arguments]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.description)
+	}
+}
@@ -0,0 +1,373 @@
+// ## Sequence
+//
+// The `sequence` command inspects and administers the sequences of the
+// `seq` and `seqval` custom resources. It uses the default AWS credentials
+// and region of the environment.
+//
+// ```
+// hyperdrive sequence [-table <table>] <subcommand> [flags] [arguments]
+// ```
+//
+// The sequences are named either by the `SequenceName` of the `seq`
+// resource, e.g. `/ports`, or by their SSM parameter, e.g.
+// `/hyperdrive/sequence/ports`. The flag `-table` gives the DynamoDB table
+// of the sequences with the `dynamodb` backend, by default the variable
+// `HYPERDRIVE_SEQUENCE_TABLE`; without table, all the sequences are read
+// as `ssm` sequences. The counter of a sequence is the last value of `x`
+// drawn.
+//
+// * `list`: lists the sequences with their backend, counter and next
+//   value;
+// * `show <name>`: shows the expression, the format, the counter, the next
+//   value, the released values and the consumers of a sequence;
+// * `peek [-n 10] <name>`: shows the last values drawn from a sequence;
+// * `bump [-yes] <name> <count>`: skips values of a sequence. A bump is
+//   safe while values are drawn;
+// * `reset [-yes] <name> <counter>`: sets the counter of a sequence. A
+//   smaller counter gives the same values again; values must not be drawn
+//   during the reset;
+// * `export [-o <file>] [<name> ...]`: exports the sequences, by default
+//   all of them, as JSON;
+// * `import [-yes] <file>`: creates the exported sequences, e.g. in another
+//   account. The sequences must not exist.
+//
+// The commands changing the sequences ask for a confirmation unless the
+// flag `-yes` is given. The bump of an `ssm` sequence puts its parameter
+// once per skipped value and takes time for large counts; the reset and the
+// import only set the base of the counter.
+//
+// The AWS principal of the command needs the access to the SSM parameters
+// under `/hyperdrive/sequence/*`, `/hyperdrive/sequence-format/*`,
+// `/hyperdrive/sequence-base/*`, `/hyperdrive/sequence-tombstone/*` and
+// `/hyperdrive/sequence-consumer/*`, and to the items of the table.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awsapi"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/sequences"
+	"github.com/aws/aws-sdk-go-v2/aws/external"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/pkg/errors"
+)
+
+func sequenceCommand(args []string) error {
+	flags := flag.NewFlagSet("sequence", flag.ContinueOnError)
+	table := flags.String("table", os.Getenv(sequences.TableEnv), "DynamoDB table of the sequences (default $"+sequences.TableEnv+")")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: hyperdrive sequence [-table <table>] <list|show|peek|bump|reset|export|import> [flags] [arguments]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("a subcommand is required")
+	}
+	cfg, err := external.LoadDefaultAWSConfig()
+	if err != nil {
+		return errors.Wrap(err, "could not load the AWS configuration")
+	}
+	admin := &sequenceAdmin{
+		store: sequences.Store{
+			SSM:      awsapi.NewSSM(ssm.New(cfg)),
+			DynamoDB: awsapi.NewDynamoDB(dynamodb.New(cfg)),
+			Table:    *table,
+		},
+		in:  bufio.NewReader(os.Stdin),
+		out: os.Stdout,
+	}
+	return admin.run(flags.Args())
+}
+
+// ### Subcommands
+//
+// The sequence admin runs the subcommands against a store; the answers to
+// the confirmations are read from `in`.
+type sequenceAdmin struct {
+	store sequences.Store
+	in    *bufio.Reader
+	out   io.Writer
+}
+
+func (a *sequenceAdmin) run(args []string) error {
+	flags := flag.NewFlagSet("sequence "+args[0], flag.ContinueOnError)
+	count := flags.Int64("n", 10, "number of values to show")
+	yes := flags.Bool("yes", false, "do not ask for a confirmation")
+	output := flags.String("o", "", "output file (default stdout)")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	arguments := flags.Args()
+	switch args[0] {
+	case "list":
+		return a.list()
+	case "show":
+		if len(arguments) != 1 {
+			return errors.New("usage: hyperdrive sequence show <name>")
+		}
+		return a.show(arguments[0])
+	case "peek":
+		if len(arguments) != 1 || *count < 1 {
+			return errors.New("usage: hyperdrive sequence peek [-n <count>] <name>")
+		}
+		return a.peek(arguments[0], *count)
+	case "bump":
+		n, err := numberArgument(arguments)
+		if err != nil || n < 1 {
+			return errors.New("usage: hyperdrive sequence bump [-yes] <name> <count>")
+		}
+		return a.bump(arguments[0], n, *yes)
+	case "reset":
+		counter, err := numberArgument(arguments)
+		if err != nil || counter < 0 {
+			return errors.New("usage: hyperdrive sequence reset [-yes] <name> <counter>")
+		}
+		return a.reset(arguments[0], counter, *yes)
+	case "export":
+		return a.export(arguments, *output)
+	case "import":
+		if len(arguments) != 1 {
+			return errors.New("usage: hyperdrive sequence import [-yes] <file>")
+		}
+		return a.restore(arguments[0], *yes)
+	}
+	return errors.Errorf("unknown subcommand %s", args[0])
+}
+
+func numberArgument(arguments []string) (int64, error) {
+	if len(arguments) != 2 {
+		return 0, errors.New("expecting a name and a number")
+	}
+	return strconv.ParseInt(arguments[1], 10, 64)
+}
+
+func (a *sequenceAdmin) list() error {
+	names, err := a.store.List()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(a.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tBACKEND\tCOUNTER\tNEXT")
+	for _, name := range names {
+		sequence, err := a.store.Describe(name)
+		if err != nil {
+			return err
+		}
+		_, next, err := sequenceValue(sequence, sequence.Counter+1)
+		if err != nil {
+			next = "error: " + err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", strings.TrimPrefix(name, sequences.ParameterPrefix), sequence.Backend, sequence.Counter, next)
+	}
+	return w.Flush()
+}
+
+func (a *sequenceAdmin) show(name string) error {
+	sequence, err := a.describe(name)
+	if err != nil {
+		return err
+	}
+	value, formatted, err := sequenceValue(sequence, sequence.Counter+1)
+	if err != nil {
+		return err
+	}
+	consumers, err := a.store.Consumers(sequence.Name)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(a.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s\n", sequence.Name)
+	fmt.Fprintf(w, "Backend:\t%s\n", sequence.Backend)
+	fmt.Fprintf(w, "Expression:\t%s\n", sequence.Expression)
+	fmt.Fprintf(w, "Format:\t%s\n", sequence.Format)
+	fmt.Fprintf(w, "Counter:\t%d\n", sequence.Counter)
+	fmt.Fprintf(w, "Next:\tx = %d, %d (%s)\n", sequence.Counter+1, value, formatted)
+	if len(sequence.Free) > 0 {
+		fmt.Fprintf(w, "Released:\t%s\n", joinNumbers(sequence.Free))
+	}
+	for _, consumer := range consumers {
+		fmt.Fprintf(w, "Consumer:\t%s\n", consumer)
+	}
+	return w.Flush()
+}
+
+// The values drawn last are derived from the counter: the released values
+// are not taken into account.
+func (a *sequenceAdmin) peek(name string, count int64) error {
+	sequence, err := a.describe(name)
+	if err != nil {
+		return err
+	}
+	first := sequence.Counter - count + 1
+	if first < 1 {
+		first = 1
+	}
+	w := tabwriter.NewWriter(a.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "X\tVALUE\tFORMATTED")
+	for x := first; x <= sequence.Counter; x++ {
+		value, formatted, err := sequenceValue(sequence, x)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%d\t%d\t%s\n", x, value, formatted)
+	}
+	return w.Flush()
+}
+
+func (a *sequenceAdmin) bump(name string, count int64, yes bool) error {
+	sequence, err := a.describe(name)
+	if err != nil {
+		return err
+	}
+	question := fmt.Sprintf("skip %d values of the sequence %s, from the counter %d to %d?", count, sequence.Name, sequence.Counter, sequence.Counter+count)
+	if err := a.confirm(question, yes); err != nil {
+		return err
+	}
+	counter, err := a.store.Bump(sequence.Name, count)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.out, "the counter of the sequence %s is %d\n", sequence.Name, counter)
+	return nil
+}
+
+func (a *sequenceAdmin) reset(name string, counter int64, yes bool) error {
+	sequence, err := a.describe(name)
+	if err != nil {
+		return err
+	}
+	question := fmt.Sprintf("set the counter of the sequence %s from %d to %d?", sequence.Name, sequence.Counter, counter)
+	if counter < sequence.Counter {
+		question = fmt.Sprintf("the values from x = %d to %d will be drawn again. %s", counter+1, sequence.Counter, question)
+	}
+	if err := a.confirm(question, yes); err != nil {
+		return err
+	}
+	if err := a.store.SetCounter(sequence.Name, counter); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.out, "the counter of the sequence %s is %d\n", sequence.Name, counter)
+	return nil
+}
+
+func (a *sequenceAdmin) export(names []string, output string) error {
+	if len(names) == 0 {
+		var err error
+		if names, err = a.store.List(); err != nil {
+			return err
+		}
+	}
+	exported := make([]sequences.Sequence, 0, len(names))
+	for _, name := range names {
+		sequence, err := a.describe(name)
+		if err != nil {
+			return err
+		}
+		exported = append(exported, sequence)
+	}
+	text, err := json.MarshalIndent(exported, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "could not marshal the sequences")
+	}
+	text = append(text, '\n')
+	if output == "" {
+		_, err = a.out.Write(text)
+		return err
+	}
+	if err := ioutil.WriteFile(output, text, 0644); err != nil {
+		return errors.Wrapf(err, "could not write the file %s", output)
+	}
+	return nil
+}
+
+func (a *sequenceAdmin) restore(file string, yes bool) error {
+	text, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Wrapf(err, "could not read the file %s", file)
+	}
+	var imported []sequences.Sequence
+	if err := json.Unmarshal(text, &imported); err != nil {
+		return errors.Wrapf(err, "could not parse the file %s", file)
+	}
+	names := make([]string, len(imported))
+	for i, sequence := range imported {
+		if !strings.HasPrefix(sequence.Name, sequences.ParameterPrefix+"/") {
+			return errors.Errorf("invalid sequence name %s", sequence.Name)
+		}
+		if _, _, err := sequenceValue(sequence, sequence.Counter+1); err != nil {
+			return err
+		}
+		names[i] = sequence.Name
+	}
+	if err := a.confirm(fmt.Sprintf("create the sequences %s?", strings.Join(names, ", ")), yes); err != nil {
+		return err
+	}
+	for _, sequence := range imported {
+		if err := a.store.Restore(sequence); err != nil {
+			return err
+		}
+		fmt.Fprintf(a.out, "created the sequence %s with the counter %d\n", sequence.Name, sequence.Counter)
+	}
+	return nil
+}
+
+func (a *sequenceAdmin) describe(name string) (sequences.Sequence, error) {
+	if !strings.HasPrefix(name, "/") {
+		return sequences.Sequence{}, errors.Errorf("name %s must start with an /", name)
+	}
+	if !strings.HasPrefix(name, sequences.ParameterPrefix+"/") {
+		name = sequences.ParameterName(name)
+	}
+	return a.store.Describe(name)
+}
+
+func (a *sequenceAdmin) confirm(question string, yes bool) error {
+	if yes {
+		return nil
+	}
+	fmt.Fprintf(a.out, "%s [y/N] ", question)
+	answer, err := a.in.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return errors.Wrap(err, "could not read the answer")
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return errors.New("aborted")
+}
+
+// sequenceValue evaluates the value of the sequence for x and formats it.
+func sequenceValue(sequence sequences.Sequence, x int64) (int64, string, error) {
+	value, err := common.Eval(sequence.Expression, x)
+	if err != nil {
+		return 0, "", err
+	}
+	formatted, err := common.Format(sequence.Format, value)
+	if err != nil {
+		return 0, "", err
+	}
+	return value, formatted, nil
+}
+
+func joinNumbers(numbers []int64) string {
+	texts := make([]string, len(numbers))
+	for i, n := range numbers {
+		texts[i] = strconv.FormatInt(n, 10)
+	}
+	return strings.Join(texts, ", ")
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/awstest"
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/sequences"
+)
+
+func newSequenceAdmin(t *testing.T, input string) (*sequenceAdmin, *bytes.Buffer) {
+	ssm := awstest.NewSSM()
+	dynamodb := awstest.NewDynamoDB()
+	dynamodb.CreateTable("sequences", "Name")
+	store := sequences.Store{SSM: ssm, DynamoDB: dynamodb, Table: "sequences"}
+	for _, sequence := range []sequences.Sequence{
+		{Name: "/hyperdrive/sequence/ports", Expression: "8000 + x", Backend: sequences.BackendSSM, Counter: 3},
+		{Name: "/hyperdrive/sequence/apps", Expression: "x", Format: "app-%04d", Backend: sequences.BackendDynamoDB, Counter: 41, Free: []int64{7}},
+	} {
+		if err := store.Restore(sequence); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Register("/hyperdrive/sequence/apps", "/hyperdrive/sequence/apps:41=41", "App of the stack apps"); err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	return &sequenceAdmin{store: store, in: bufio.NewReader(strings.NewReader(input)), out: out}, out
+}
+
+func TestSequenceAdmin(t *testing.T) {
+	for i, test := range []struct {
+		args    []string
+		input   string
+		fails   bool
+		output  []string
+		counter int64
+	}{
+		// test 0: list
+		{args: []string{"list"}, output: []string{"/apps   dynamodb  41       app-0042", "/ports  ssm       3        8004"}},
+		// test 1: show
+		{args: []string{"show", "/apps"}, output: []string{"Format:      app-%04d", "Next:        x = 42, 42 (app-0042)", "Released:    7", "Consumer:    App of the stack apps"}},
+		// test 2: show by parameter name
+		{args: []string{"show", "/hyperdrive/sequence/ports"}, output: []string{"Counter:     3", "Next:        x = 4, 8004 (8004)"}},
+		// test 3: unknown sequence
+		{args: []string{"show", "/unknown"}, fails: true},
+		// test 4: peek
+		{args: []string{"peek", "-n", "2", "/ports"}, output: []string{"2  8002", "3  8003"}},
+		// test 5: bump with confirmation
+		{args: []string{"bump", "/apps", "8"}, input: "y\n", output: []string{"from the counter 41 to 49? [y/N]", "is 49"}, counter: 49},
+		// test 6: bump aborted
+		{args: []string{"bump", "/apps", "8"}, input: "n\n", fails: true, counter: 41},
+		// test 7: reset to a smaller counter warns about the values drawn again
+		{args: []string{"reset", "/apps", "40"}, input: "yes\n", output: []string{"the values from x = 41 to 41 will be drawn again"}, counter: 40},
+		// test 8: reset without confirmation
+		{args: []string{"reset", "-yes", "/apps", "100"}, output: []string{"is 100"}, counter: 100},
+		// test 9: invalid counter
+		{args: []string{"reset", "/apps", "-1"}, fails: true, counter: 41},
+		// test 10: unknown subcommand
+		{args: []string{"drop"}, fails: true},
+	} {
+		admin, out := newSequenceAdmin(t, test.input)
+		err := admin.run(test.args)
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		for _, line := range test.output {
+			if !strings.Contains(out.String(), line) {
+				t.Errorf("test %d: expecting %q in the output\n%s", i, line, out.String())
+			}
+		}
+		if test.counter != 0 {
+			if sequence, _ := admin.store.Describe("/hyperdrive/sequence/apps"); sequence.Counter != test.counter {
+				t.Errorf("test %d: expecting the counter %d got %d", i, test.counter, sequence.Counter)
+			}
+		}
+	}
+}
+
+func TestSequenceExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hyperdrive-sequence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "sequences.json")
+	source, _ := newSequenceAdmin(t, "")
+	if err := source.run([]string{"export", "-o", file}); err != nil {
+		t.Fatal(err)
+	}
+	target := &sequenceAdmin{
+		store: sequences.Store{SSM: awstest.NewSSM(), DynamoDB: awstest.NewDynamoDB(), Table: "sequences"},
+		in:    bufio.NewReader(strings.NewReader("y\n")),
+		out:   &bytes.Buffer{},
+	}
+	target.store.DynamoDB.(*awstest.DynamoDB).CreateTable("sequences", "Name")
+	if err := target.run([]string{"import", file}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/hyperdrive/sequence/apps", "/hyperdrive/sequence/ports"} {
+		expected, _ := source.store.Describe(name)
+		sequence, err := target.store.Describe(name)
+		if err != nil || !reflect.DeepEqual(sequence, expected) {
+			t.Errorf("expecting %+v got %+v, %v", expected, sequence, err)
+		}
+	}
+	if err := target.run([]string{"import", "-yes", file}); err == nil {
+		t.Errorf("the existing sequences must not be imported again")
+	}
+}
@@ -0,0 +1,553 @@
+// ## Simulate
+//
+// The `simulate` command exercises a custom resource lambda without
+// deploying the hyperdrive lambda stack. It synthesizes the cloudformation
+// events of a stack lifecycle, runs the lambda locally and prints the
+// physical resource id and the attributes that cloudformation would have
+// recorded.
+//
+// ```
+// hyperdrive simulate -type Custom::LogGroup [flags] <properties.yaml> [<updated.yaml> ...]
+// ```
+//
+// The first properties file gives the properties of the `Create` event.
+// Every following file gives the properties of an `Update` event whose
+// `OldResourceProperties` are the properties of the previous event.
+// Finally, a `Delete` event is sent for the last properties, unless the
+// flag `-keep` is given. As cloudformation does, the simulation sends:
+//
+// * a `Delete` event for the old physical resource id when an update
+//   returns a new id (replacement);
+// * a `Delete` event when the creation fails (rollback);
+// * an `Update` event back to the old properties when an update fails
+//   (rollback).
+//
+// A properties file is either a plain YAML map of the properties or a
+// cloudformation template with the same shape as the ones in
+// `tools/templates`. In the latter case, the resource is selected by its
+// type or by its logical id with the `-logical-id` flag. The file is first
+// rendered as go template with the variables given by the `-var` flags,
+// e.g. `-var DomainName=test.com`. Intrinsic functions are not resolved.
+// As cloudformation does, all the scalar values are sent as strings.
+//
+// ### Running the lambda
+//
+// The custom resource lambdas are `main` packages and cannot be linked
+// into the command. The command therefore builds the lambda of the
+// resource type with `go build` from the root of the repository (flag
+// `-root`), or uses the binary given with `-binary`, and starts it
+// locally. The events are sent to the lambda with the RPC protocol of the
+// `go1.x` runtime, exactly as AWS does. The lambda uses the default AWS
+// credentials and region of the environment; its logs are printed on
+// stderr.
+//
+// The `ResponseURL` of the events points to a local HTTP server that
+// collects the responses of the lambda. Lambdas with long-running
+// operations return their continuation instead of invoking themselves
+// (see `resource.LambdaWrap`); the command sends the continuations to the
+// lambda, after their delay, until it responds.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/resource"
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-lambda-go/lambda/messages"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// The resource types as used in the templates, with the directory of the
+// lambda implementing them. The directory name itself can also be used as
+// type.
+var resourceTypes = map[string]string{
+	"Custom::CfApiKey":                "cf/cfapikey",
+	"Custom::CogCondPreAuthSettings":  "cf/cog_cond_pre_auth_settings",
+	"Custom::CognitoClientSettings":   "cf/cogclientset",
+	"Custom::CognitoIdentityProvider": "cf/cogidp",
+	"Custom::CognitoPoolDomain":       "cf/cogdomain",
+	"Custom::DnsCertificate":          "cf/dnscert",
+	"Custom::Dummy":                   "cf/dummy",
+	"Custom::EcrCleanup":              "cf/ecrcleanup",
+	"Custom::ListenerRuleSwapper":     "cf/listenerRuleSwapper",
+	"Custom::LogGroup":                "cf/loggrp",
+	"Custom::S3Cleanup":               "cf/s3cleanup",
+	"Custom::Sequence":                "cf/seq",
+	"Custom::SequenceGenerator":       "cf/seq",
+	"Custom::SequenceValue":           "cf/seqval",
+}
+
+func simulate(args []string) error {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	resourceType := flags.String("type", "", "resource type, e.g. Custom::LogGroup, or directory of the lambda in cf/")
+	logicalId := flags.String("logical-id", "", "logical id of the resource in the template (default Resource)")
+	binary := flags.String("binary", "", "prebuilt lambda binary; by default, the lambda is built with go build")
+	root := flags.String("root", ".", "root directory of the hyperdrive repository")
+	stackId := flags.String("stack-id", "", "stack id of the events (default a fake stack id)")
+	keep := flags.Bool("keep", false, "do not send the final Delete event")
+	timeout := flags.Duration("timeout", 15*time.Minute, "timeout of every invocation of the lambda")
+	vars := variables{}
+	flags.Var(vars, "var", "template variable as key=value, can be repeated")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: hyperdrive simulate -type <type> [flags] <properties.yaml> [<updated.yaml> ...]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("at least one properties file is required")
+	}
+
+	s := &simulation{resourceType: *resourceType, logicalId: *logicalId, stackId: *stackId, keep: *keep}
+	for _, file := range flags.Args() {
+		if err := s.readProperties(file, vars); err != nil {
+			return err
+		}
+	}
+	if s.resourceType == "" {
+		return errors.New("the resource type is required")
+	}
+	if s.logicalId == "" {
+		s.logicalId = "Resource"
+	}
+	if s.stackId == "" {
+		s.stackId = fmt.Sprintf("arn:aws:cloudformation:%s:123456789012:stack/hyperdrive-simulate/%s", region(), uuid.New())
+	}
+
+	if *binary == "" {
+		dir, err := handlerDir(s.resourceType)
+		if err != nil {
+			return err
+		}
+		built, clean, err := buildHandler(*root, dir)
+		if err != nil {
+			return err
+		}
+		defer clean()
+		*binary = built
+	}
+	responses, err := newResponder()
+	if err != nil {
+		return err
+	}
+	defer responses.Close()
+	handler, err := startLambda(*binary, *timeout)
+	if err != nil {
+		return err
+	}
+	defer handler.Close()
+	return s.run(handler.invoke, responses, os.Stdout)
+}
+
+// ### Events
+//
+// A simulation holds the properties of the successive events and sends
+// them to the lambda with an invoker.
+type simulation struct {
+	resourceType, logicalId, stackId string
+	properties                       []map[string]interface{}
+	keep                             bool
+}
+
+// An invoker sends an invocation to the lambda and returns the result of
+// the lambda.
+type invoker func(invocation resource.Invocation) ([]byte, error)
+
+func (s *simulation) run(invoke invoker, responses *responder, out io.Writer) error {
+	current := s.properties[0]
+	response, err := s.send(invoke, responses, out, cfn.Event{
+		RequestType:        cfn.RequestCreate,
+		ResourceProperties: current,
+	})
+	if err != nil {
+		return err
+	}
+	physicalId := response.PhysicalResourceID
+	if response.Status == cfn.StatusFailed {
+		if _, err := s.send(invoke, responses, out, cfn.Event{
+			RequestType:        cfn.RequestDelete,
+			PhysicalResourceID: physicalId,
+			ResourceProperties: current,
+		}); err != nil {
+			return err
+		}
+		return errors.Errorf("the creation failed: %s", response.Reason)
+	}
+	for _, properties := range s.properties[1:] {
+		response, err = s.send(invoke, responses, out, cfn.Event{
+			RequestType:           cfn.RequestUpdate,
+			PhysicalResourceID:    physicalId,
+			ResourceProperties:    properties,
+			OldResourceProperties: current,
+		})
+		if err != nil {
+			return err
+		}
+		if response.Status == cfn.StatusFailed {
+			if _, err := s.send(invoke, responses, out, cfn.Event{
+				RequestType:           cfn.RequestUpdate,
+				PhysicalResourceID:    physicalId,
+				ResourceProperties:    current,
+				OldResourceProperties: properties,
+			}); err != nil {
+				return err
+			}
+			return errors.Errorf("the update failed: %s", response.Reason)
+		}
+		if response.PhysicalResourceID != physicalId {
+			if _, err := s.send(invoke, responses, out, cfn.Event{
+				RequestType:        cfn.RequestDelete,
+				PhysicalResourceID: physicalId,
+				ResourceProperties: current,
+			}); err != nil {
+				return err
+			}
+			physicalId = response.PhysicalResourceID
+		}
+		current = properties
+	}
+	if s.keep {
+		return nil
+	}
+	response, err = s.send(invoke, responses, out, cfn.Event{
+		RequestType:        cfn.RequestDelete,
+		PhysicalResourceID: physicalId,
+		ResourceProperties: current,
+	})
+	if err != nil {
+		return err
+	}
+	if response.Status == cfn.StatusFailed {
+		return errors.Errorf("the deletion failed: %s", response.Reason)
+	}
+	return nil
+}
+
+func (s *simulation) send(invoke invoker, responses *responder, out io.Writer, event cfn.Event) (cfn.Response, error) {
+	event.RequestID = uuid.New().String()
+	event.ResponseURL = responses.url(event.RequestID)
+	event.ResourceType = s.resourceType
+	event.LogicalResourceID = s.logicalId
+	event.StackID = s.stackId
+	invocation := resource.Invocation{Event: event}
+	for {
+		result, err := invoke(invocation)
+		if err != nil {
+			return cfn.Response{}, errors.Wrapf(err, "could not invoke the lambda for the %s event", event.RequestType)
+		}
+		if response, ok := responses.response(event.RequestID); ok {
+			printResponse(out, event, response)
+			return response, nil
+		}
+		var next resource.Invocation
+		if err := json.Unmarshal(result, &next); err != nil || next.Continuation == nil {
+			return cfn.Response{}, errors.Errorf("the lambda did not respond to the %s event", event.RequestType)
+		}
+		fmt.Fprintf(out, "%s %s: IN_PROGRESS (attempt %d)\n", event.RequestType, event.LogicalResourceID, next.Continuation.Attempt)
+		time.Sleep(next.Continuation.Delay)
+		invocation = next
+	}
+}
+
+func printResponse(out io.Writer, event cfn.Event, response cfn.Response) {
+	fmt.Fprintf(out, "%s %s: %s\n", event.RequestType, event.LogicalResourceID, response.Status)
+	fmt.Fprintf(out, "  PhysicalResourceId: %s\n", response.PhysicalResourceID)
+	if response.Reason != "" {
+		fmt.Fprintf(out, "  Reason: %s\n", response.Reason)
+	}
+	if len(response.Data) > 0 {
+		keys := make([]string, 0, len(response.Data))
+		for key := range response.Data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fmt.Fprintln(out, "  Data:")
+		for _, key := range keys {
+			fmt.Fprintf(out, "    %s: %v\n", key, response.Data[key])
+		}
+	}
+}
+
+// ### Properties
+//
+// The properties file is rendered as go template before being parsed.
+// The resource type and the logical id found in the first template are
+// used for the whole simulation.
+func (s *simulation) readProperties(file string, vars variables) error {
+	text, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Wrapf(err, "could not read the file %s", file)
+	}
+	tmpl, err := template.New(filepath.Base(file)).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return errors.Wrapf(err, "could not parse the template %s", file)
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, map[string]string(vars)); err != nil {
+		return errors.Wrapf(err, "could not render the template %s", file)
+	}
+	var document map[string]interface{}
+	if err := yaml.Unmarshal(rendered.Bytes(), &document); err != nil {
+		return errors.Wrapf(err, "could not parse the yaml file %s", file)
+	}
+	resources, ok := document["Resources"]
+	if !ok {
+		s.properties = append(s.properties, properties(document))
+		return nil
+	}
+	var found []string
+	var resource map[string]interface{}
+	for id, r := range normalize(resources).(map[string]interface{}) {
+		definition, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		resourceType, _ := definition["Type"].(string)
+		if (s.logicalId == "" || s.logicalId == id) && (s.resourceType == "" || s.resourceType == resourceType) {
+			found = append(found, id)
+			resource = definition
+		}
+	}
+	if len(found) != 1 {
+		return errors.Errorf("expecting one resource with type '%s' and logical id '%s' in %s, found %v", s.resourceType, s.logicalId, file, found)
+	}
+	s.logicalId = found[0]
+	s.resourceType, _ = resource["Type"].(string)
+	props, _ := resource["Properties"].(map[string]interface{})
+	s.properties = append(s.properties, properties(props))
+	return nil
+}
+
+func properties(document map[string]interface{}) map[string]interface{} {
+	if document == nil {
+		return map[string]interface{}{}
+	}
+	return normalize(document).(map[string]interface{})
+}
+
+// The yaml library decodes maps with generic keys and typed scalars;
+// cloudformation sends maps with string keys and only strings as scalars.
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, e := range v {
+			if e != nil {
+				m[fmt.Sprint(key)] = normalize(e)
+			}
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, e := range v {
+			if e != nil {
+				m[key] = normalize(e)
+			}
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = normalize(e)
+		}
+		return l
+	case string, nil:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+type variables map[string]string
+
+func (v variables) String() string {
+	return fmt.Sprint(map[string]string(v))
+}
+
+func (v variables) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return errors.Errorf("variable %s must have the form key=value", value)
+	}
+	v[parts[0]] = parts[1]
+	return nil
+}
+
+// ### Response server
+//
+// The responder is the local HTTP server receiving the responses sent by
+// the lambda to the `ResponseURL` of the events.
+type responder struct {
+	listener  net.Listener
+	mutex     sync.Mutex
+	responses map[string]cfn.Response
+}
+
+func newResponder() (*responder, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.Wrap(err, "could not start the response server")
+	}
+	r := &responder{listener: listener, responses: make(map[string]cfn.Response)}
+	go http.Serve(listener, r)
+	return r, nil
+}
+
+func (r *responder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPut {
+		http.Error(w, "only PUT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	var response cfn.Response
+	if err := json.NewDecoder(req.Body).Decode(&response); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.responses[strings.TrimPrefix(req.URL.Path, "/")] = response
+}
+
+func (r *responder) url(requestId string) string {
+	return "http://" + r.listener.Addr().String() + "/" + requestId
+}
+
+func (r *responder) response(requestId string) (cfn.Response, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	response, ok := r.responses[requestId]
+	return response, ok
+}
+
+func (r *responder) Close() error {
+	return r.listener.Close()
+}
+
+// ### Lambda process
+//
+// The lambda is built in a temporary directory and started with the
+// `_LAMBDA_SERVER_PORT` variable of the `go1.x` runtime. The events are
+// then sent with the `Function.Invoke` RPC call.
+func handlerDir(resourceType string) (string, error) {
+	if dir, ok := resourceTypes[resourceType]; ok {
+		return dir, nil
+	}
+	if !strings.Contains(resourceType, "::") {
+		return filepath.Join("cf", resourceType), nil
+	}
+	return "", errors.Errorf("unknown resource type %s", resourceType)
+}
+
+func buildHandler(root, dir string) (string, func(), error) {
+	tmp, err := ioutil.TempDir("", "hyperdrive-simulate")
+	if err != nil {
+		return "", nil, errors.Wrap(err, "could not create a temporary directory")
+	}
+	clean := func() { os.RemoveAll(tmp) }
+	binary := filepath.Join(tmp, filepath.Base(dir))
+	cmd := exec.Command("go", "build", "-o", binary, "./"+filepath.ToSlash(dir))
+	cmd.Dir = root
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		clean()
+		return "", nil, errors.Wrapf(err, "could not build the lambda %s", dir)
+	}
+	return binary, clean, nil
+}
+
+type lambdaProcess struct {
+	cmd     *exec.Cmd
+	client  *rpc.Client
+	timeout time.Duration
+}
+
+func startLambda(binary string, timeout time.Duration) (*lambdaProcess, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.Wrap(err, "could not find a free port")
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	_, port, _ := net.SplitHostPort(address)
+
+	cmd := exec.Command(binary)
+	cmd.Env = append(os.Environ(), "_LAMBDA_SERVER_PORT="+port, resource.ReturnContinuationEnv+"=true")
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "could not start the lambda %s", binary)
+	}
+	for i := 0; i < 100; i++ {
+		client, err := rpc.Dial("tcp", address)
+		if err == nil {
+			return &lambdaProcess{cmd: cmd, client: client, timeout: timeout}, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+	return nil, errors.Errorf("the lambda %s does not listen on %s", binary, address)
+}
+
+func (p *lambdaProcess) invoke(invocation resource.Invocation) ([]byte, error) {
+	payload, err := json.Marshal(invocation)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not marshal the event")
+	}
+	deadline := time.Now().Add(p.timeout)
+	request := messages.InvokeRequest{
+		Payload:            payload,
+		RequestId:          invocation.RequestID,
+		InvokedFunctionArn: fmt.Sprintf("arn:aws:lambda:%s:123456789012:function:hyperdrive-simulate", region()),
+		Deadline: messages.InvokeRequest_Timestamp{
+			Seconds: deadline.Unix(),
+			Nanos:   int64(deadline.Nanosecond()),
+		},
+	}
+	var response messages.InvokeResponse
+	if err := p.client.Call("Function.Invoke", &request, &response); err != nil {
+		return nil, err
+	}
+	if response.Error != nil {
+		return nil, errors.Errorf("%s: %s", response.Error.Type, response.Error.Message)
+	}
+	return response.Payload, nil
+}
+
+func (p *lambdaProcess) Close() error {
+	p.client.Close()
+	p.cmd.Process.Kill()
+	p.cmd.Wait()
+	return nil
+}
+
+func region() string {
+	if r := os.Getenv("AWS_REGION"); r != "" {
+		return r
+	}
+	if r := os.Getenv("AWS_DEFAULT_REGION"); r != "" {
+		return r
+	}
+	return "us-east-1"
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DEEP-IMPACT-AG/hyperdrive/common/resource"
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/pkg/errors"
+)
+
+func TestReadProperties(t *testing.T) {
+	s := &simulation{resourceType: "Custom::LogGroup"}
+	if err := s.readProperties("testdata/loggroup.yaml", variables{"Name": "edge"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.readProperties("testdata/properties.yaml", variables{}); err != nil {
+		t.Fatal(err)
+	}
+	if s.logicalId != "LambdaEdgeLogGroup" {
+		t.Errorf("unexpected logical id %s", s.logicalId)
+	}
+	expected := []map[string]interface{}{
+		{
+			"ServiceToken":    map[string]interface{}{"Fn::ImportValue": "${HyperdriveCore}-LogGroup"},
+			"LogGroupName":    "/aws/lambda/us-east-1.edge",
+			"Region":          "eu-west-1",
+			"RetentionInDays": "90",
+			"Tags":            map[string]interface{}{"test": "true"},
+		},
+		{
+			"LogGroupName":    "/aws/lambda/test",
+			"RetentionInDays": "30",
+		},
+	}
+	if !reflect.DeepEqual(s.properties, expected) {
+		t.Errorf("unexpected properties %+v", s.properties)
+	}
+}
+
+func TestReadPropertiesErrors(t *testing.T) {
+	for i, test := range []struct {
+		simulation simulation
+		vars       variables
+	}{
+		// test 0: missing variable
+		{simulation: simulation{resourceType: "Custom::LogGroup"}, vars: variables{}},
+		// test 1: two resources match
+		{simulation: simulation{}, vars: variables{"Name": "edge"}},
+		// test 2: no resource matches
+		{simulation: simulation{resourceType: "Custom::LogGroup", logicalId: "Sequence"}, vars: variables{"Name": "edge"}},
+	} {
+		if err := test.simulation.readProperties("testdata/loggroup.yaml", test.vars); err == nil {
+			t.Errorf("test %d: expecting an error", i)
+		}
+	}
+}
+
+func TestSimulation(t *testing.T) {
+	for i, test := range []struct {
+		properties []string
+		keep       bool
+		fails      bool
+		events     []string
+		output     []string
+	}{
+		// test 0: create and delete
+		{properties: []string{"a"},
+			events: []string{"Create", "Delete a"},
+			output: []string{"Create Res: SUCCESS", "PhysicalResourceId: a", "Name: a"}},
+		// test 1: update in place, replacement and keep
+		{properties: []string{"a", "a", "b"}, keep: true,
+			events: []string{"Create", "Update a a<-a", "Update a b<-a", "Delete a"}},
+		// test 2: failed creation is rolled back
+		{properties: []string{"fail"}, fails: true,
+			events: []string{"Create", "Delete failure-Res"},
+			output: []string{"Create Res: FAILED", "Reason: boom"}},
+		// test 3: failed update is rolled back
+		{properties: []string{"a", "fail", "b"}, fails: true,
+			events: []string{"Create", "Update a fail<-a", "Update a a<-fail"}},
+	} {
+		s := &simulation{resourceType: "Custom::Test", logicalId: "Res", stackId: "stack", keep: test.keep}
+		for _, name := range test.properties {
+			s.properties = append(s.properties, map[string]interface{}{"Name": name})
+		}
+		var events []string
+		handler := cfn.LambdaWrap(func(ctx context.Context, event cfn.Event) (string, map[string]interface{}, error) {
+			description := string(event.RequestType)
+			if event.PhysicalResourceID != "" {
+				description += " " + event.PhysicalResourceID
+			}
+			if event.RequestType == cfn.RequestUpdate {
+				description += " " + event.ResourceProperties["Name"].(string) + "<-" + event.OldResourceProperties["Name"].(string)
+			}
+			events = append(events, description)
+			name := event.ResourceProperties["Name"].(string)
+			if event.RequestType != cfn.RequestDelete && name == "fail" {
+				id := event.PhysicalResourceID
+				if id == "" {
+					id = "failure-" + event.LogicalResourceID
+				}
+				return id, nil, errors.New("boom")
+			}
+			return name, map[string]interface{}{"Name": name}, nil
+		})
+		responses, err := newResponder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		err = s.run(func(invocation resource.Invocation) ([]byte, error) {
+			_, err := handler(context.Background(), invocation.Event)
+			return nil, err
+		}, responses, &out)
+		responses.Close()
+		if (err != nil) != test.fails {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if !reflect.DeepEqual(events, test.events) {
+			t.Errorf("test %d: expecting events %v got %v", i, test.events, events)
+		}
+		for _, line := range test.output {
+			if !strings.Contains(out.String(), line) {
+				t.Errorf("test %d: missing %s in the output:\n%s", i, line, out.String())
+			}
+		}
+	}
+}